@@ -0,0 +1,1783 @@
+package gobox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// APIServer wraps MemFS and provides HTTP endpoints
+type APIServer struct {
+	fs            *MemFS
+	handleMap     map[uint64]*FileHandle
+	handleMutex   sync.Mutex
+	handleCounter atomic.Uint64
+	throttles     *clientThrottles // per-client limits on file I/O
+	mux           *http.ServeMux   // routes added by RegisterRoutes
+
+	authMu sync.RWMutex
+	auths  []Authenticator // none for an open API
+}
+
+// FileHandle tracks open file handles server-side
+type FileHandle struct {
+	path string
+	fh   uint64
+	dir  bool // from opendir
+}
+
+// Response is the standard JSON response structure
+type Response struct {
+	Error int         `json:"error"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// NewAPIServer creates a new API server wrapping the filesystem
+func NewAPIServer(fs *MemFS) *APIServer {
+	return &APIServer{
+		fs:        fs,
+		handleMap: make(map[uint64]*FileHandle),
+		throttles: newClientThrottles(),
+		mux:       http.NewServeMux(),
+	}
+}
+
+// ServeHTTP serves the routes added by RegisterRoutes. Each APIServer has
+// its own mux, so several can run in one process.
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ReleaseHandles releases every handle clients opened and never closed,
+// committing writes to the files, and returns the first error
+func (s *APIServer) ReleaseHandles() int {
+	s.handleMutex.Lock()
+	handles := s.handleMap
+	s.handleMap = make(map[uint64]*FileHandle)
+	s.handleMutex.Unlock()
+
+	errc := 0
+	for _, h := range handles {
+		if h.dir {
+			continue // nothing to commit
+		}
+		if e := s.fs.Release(h.path, h.fh); e != 0 && errc == 0 {
+			errc = e
+		}
+	}
+	return errc
+}
+
+// lookupHandle returns the API handle with the given ID if it was opened
+// for path, and nil otherwise
+func (s *APIServer) lookupHandle(id uint64, path string) *FileHandle {
+	s.handleMutex.Lock()
+	defer s.handleMutex.Unlock()
+	if h := s.handleMap[id]; h != nil && h.path == path {
+		return h
+	}
+	return nil
+}
+
+// getNextHandleID generates the next incrementing handle ID
+func (s *APIServer) getNextHandleID() uint64 {
+	return s.handleCounter.Add(1)
+}
+
+// RegisterRoutes registers all HTTP endpoints
+func (s *APIServer) RegisterRoutes() {
+	// Metadata endpoints
+	s.handle("/api/getattr", s.handleGetattr)
+	s.handle("/api/chmod", s.handleChmod)
+	s.handle("/api/chown", s.handleChown)
+	s.handle("/api/utimens", s.handleUtimens)
+
+	// Directory endpoints
+	s.handle("/api/mkdir", s.handleMkdir)
+	s.handle("/api/rmdir", s.handleRmdir)
+	s.reads("/api/opendir", s.handleOpendir)
+	s.handle("/api/readdir", s.handleReaddir)
+	s.handle("/api/readdir/paginated", s.handleReaddirPaginated)
+
+	// Linking endpoints
+	s.admin("/api/link/local", s.handleLinkLocal)
+	s.admin("/api/link/archive", s.handleLinkArchive)
+	s.admin("/api/link/overlay", s.handleLinkOverlay)
+	s.admin("/api/link/crypt", s.handleLinkCrypt)
+	s.admin("/api/link/compress", s.handleLinkCompress)
+	s.admin("/api/link/s3", s.handleLinkS3)
+	s.admin("/api/link/webdav", s.handleLinkWebDAV)
+	s.admin("/api/link/sftp", s.handleLinkSFTP)
+	s.admin("/api/link/http", s.handleLinkHTTP)
+	s.admin("/api/link/git", s.handleLinkGit)
+	s.admin("/api/link/mirror", s.handleLinkMirror)
+
+	// Cache endpoints
+	s.admin("/api/cache", s.handleCacheEnable)
+	s.admin("/api/cache/stats", s.handleCacheStats)
+
+	// Mirror endpoints
+	s.admin("/api/mirror/status", s.handleMirrorStatus)
+	s.admin("/api/mirror/resync", s.handleMirrorResync)
+
+	// Tiering endpoints
+	s.admin("/api/tier", s.handleTierEnable)
+	s.admin("/api/tier/status", s.handleTierStatus)
+	s.admin("/api/tier/pin", s.handleTierPin)
+
+	// Fault injection endpoints
+	s.admin("/api/fault", s.handleFault)
+
+	// Throttling endpoints
+	s.admin("/api/throttle", s.handleThrottleMount)
+	s.admin("/api/throttle/client", s.handleThrottleClient)
+	s.admin("/api/throttle/status", s.handleThrottleStatus)
+
+	// Change notification endpoints
+	s.handle("/api/events", s.handleEvents)
+	s.admin("/api/watch", s.handleWatch)
+	s.admin("/api/journal", s.handleJournal)
+	s.handle("/api/changes", s.handleChanges)
+
+	// Audit endpoints
+	s.admin("/api/audit", s.handleAudit)
+	s.admin("/api/audit/log", s.handleAuditLog)
+	s.admin("/api/audit/exclude", s.handleAuditExclude)
+
+	// File endpoints
+	s.handle("/api/create", s.handleCreate)
+	s.handle("/api/unlink", s.handleUnlink)
+	s.handle("/api/truncate", s.handleTruncate)
+	s.handle("/api/rename", s.handleRename)
+	s.handle("/api/release", s.handleRelease)
+
+	// Binary file I/O
+	s.handle("/api/files/read", s.handleFileRead)
+	s.uploads("/api/files/write", s.handleFileWrite)
+
+	// Filesystem stats
+	s.handle("/api/statfs", s.handleStatfs)
+	s.admin("/api/capacity", s.handleCapacity)
+
+	// Prometheus metrics
+	s.mux.Handle("/metrics", s.authorize(AccessRead, false, s.fs.Metrics().Handler()))
+}
+
+// handle registers an API endpoint, counting and timing its requests.
+// Callers need read access for GET and write access for anything else.
+func (s *APIServer) handle(pattern string, h http.HandlerFunc) {
+	s.route(pattern, AccessWrite, h)
+}
+
+// reads registers an endpoint that only reads, whatever its method
+func (s *APIServer) reads(pattern string, h http.HandlerFunc) {
+	s.route(pattern, AccessRead, h)
+}
+
+// admin registers an endpoint that changes how the filesystem is set up,
+// for admin callers only
+func (s *APIServer) admin(pattern string, h http.HandlerFunc) {
+	s.route(pattern, AccessAdmin, h)
+}
+
+// uploads registers an endpoint whose body is file content, not JSON, so
+// only its query is checked against callers' path scopes
+func (s *APIServer) uploads(pattern string, h http.HandlerFunc) {
+	s.mux.Handle(pattern, s.fs.Metrics().instrument(pattern, s.authorize(AccessWrite, false, h)))
+}
+
+func (s *APIServer) route(pattern string, need Access, h http.HandlerFunc) {
+	s.mux.Handle(pattern, s.fs.Metrics().instrument(pattern, s.authorize(need, true, h)))
+}
+
+// clientID identifies the REST client making a request by its address
+func clientID(r *http.Request) string {
+	if r.RemoteAddr == "" || r.RemoteAddr == "@" {
+		return "unix" // Unix socket peers have no address
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// audit records a mutating call made through the API, with the client's
+// address, if the audit log is enabled
+func (s *APIServer) audit(r *http.Request, rec AuditRecord) {
+	if l := s.fs.Audit(); l != nil {
+		rec.Source = AuditREST
+		rec.Client = clientID(r)
+		if p := principal(r); p != nil {
+			rec.User = p.Name
+		}
+		l.Record(rec)
+	}
+}
+
+// Helper to write JSON response
+func writeJSON(w http.ResponseWriter, statusCode int, resp Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Helper to map FUSE error codes to HTTP status codes
+func fuseErrorToHTTP(fuseErr int) int {
+	switch fuseErr {
+	case 0:
+		return http.StatusOK
+	case -2: // ENOENT (file not found)
+		return http.StatusNotFound
+	case -13: // EACCES (permission denied)
+		return http.StatusForbidden
+	case -17: // EEXIST (file exists)
+		return http.StatusConflict
+	case -21: // EISDIR (is a directory)
+		return http.StatusBadRequest
+	case -20: // ENOTDIR (not a directory)
+		return http.StatusBadRequest
+	case -22: // EINVAL (invalid argument)
+		return http.StatusBadRequest
+	case -30: // EROFS (read-only filesystem)
+		return http.StatusForbidden
+	case -fuse.ENOSPC: // over the capacity limits
+		return http.StatusInsufficientStorage
+	case -fuse.ENOTSUP: // not supported by this backend or platform
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ============ Metadata Endpoints ============
+
+func (s *APIServer) handleGetattr(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	stat := &fuse.Stat_t{}
+	err := s.fs.Getattr(path, stat, 0)
+	statusCode := fuseErrorToHTTP(err)
+	writeJSON(w, statusCode, Response{Error: err, Data: stat})
+}
+
+func (s *APIServer) handleChmod(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+		Mode uint32 `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	err := s.fs.Chmod(req.Path, req.Mode)
+	s.audit(r, AuditRecord{Op: "chmod", Path: req.Path, Result: err})
+	statusCode := fuseErrorToHTTP(err)
+	writeJSON(w, statusCode, Response{Error: err})
+}
+
+func (s *APIServer) handleChown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+		UID  uint32 `json:"uid"`
+		GID  uint32 `json:"gid"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	err := s.fs.Chown(req.Path, req.UID, req.GID)
+	s.audit(r, AuditRecord{Op: "chown", Path: req.Path, Result: err})
+	statusCode := fuseErrorToHTTP(err)
+	writeJSON(w, statusCode, Response{Error: err})
+}
+
+func (s *APIServer) handleUtimens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path string          `json:"path"`
+		Tmsp []fuse.Timespec `json:"times"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	err := s.fs.Utimens(req.Path, req.Tmsp)
+	s.audit(r, AuditRecord{Op: "utimens", Path: req.Path, Result: err})
+	statusCode := fuseErrorToHTTP(err)
+	writeJSON(w, statusCode, Response{Error: err})
+}
+
+// ============ Directory Endpoints ============
+
+func (s *APIServer) handleMkdir(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+		Mode uint32 `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	err := s.fs.Mkdir(req.Path, req.Mode)
+	s.audit(r, AuditRecord{Op: "mkdir", Path: req.Path, Result: err})
+	statusCode := fuseErrorToHTTP(err)
+	writeJSON(w, statusCode, Response{Error: err})
+}
+
+func (s *APIServer) handleRmdir(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	err := s.fs.Rmdir(path)
+	s.audit(r, AuditRecord{Op: "rmdir", Path: path, Result: err})
+	statusCode := fuseErrorToHTTP(err)
+	writeJSON(w, statusCode, Response{Error: err})
+}
+
+func (s *APIServer) handleOpendir(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	err, fh := s.fs.Opendir(req.Path)
+	statusCode := fuseErrorToHTTP(err)
+
+	if err == 0 {
+		// Store handle server-side
+		clientHandle := s.getNextHandleID()
+		s.handleMutex.Lock()
+		s.handleMap[clientHandle] = &FileHandle{path: req.Path, fh: fh, dir: true}
+		s.handleMutex.Unlock()
+
+		writeJSON(w, statusCode, Response{Error: err, Data: map[string]uint64{"handle": clientHandle}})
+	} else {
+		writeJSON(w, statusCode, Response{Error: err})
+	}
+}
+
+func (s *APIServer) handleReaddir(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Transfer-Encoding", "chunked")
+
+	// Collect entries with callback
+	var entries []map[string]interface{}
+	err := s.fs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		entry := map[string]interface{}{
+			"name": name,
+			"stat": stat,
+		}
+		entries = append(entries, entry)
+		return true
+	}, 0, 0)
+
+	if err != 0 {
+		w.WriteHeader(fuseErrorToHTTP(err))
+		json.NewEncoder(w).Encode(Response{Error: err})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	// Stream entries in chunks
+	for _, entry := range entries {
+		resp := Response{Error: 0, Data: entry}
+		json.NewEncoder(w).Encode(resp)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+func (s *APIServer) handleReaddirPaginated(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+
+	offset := 0
+	if o := r.URL.Query().Get("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
+			offset = parsed
+		}
+	}
+
+	// Collect all entries
+	var allEntries []map[string]interface{}
+	err := s.fs.Readdir(path, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		entry := map[string]interface{}{
+			"name": name,
+			"stat": stat,
+		}
+		allEntries = append(allEntries, entry)
+		return true
+	}, 0, 0)
+
+	if err != 0 {
+		statusCode := fuseErrorToHTTP(err)
+		writeJSON(w, statusCode, Response{Error: err})
+		return
+	}
+
+	// Paginate results
+	end := offset + limit
+	if end > len(allEntries) {
+		end = len(allEntries)
+	}
+
+	pageEntries := allEntries[offset:end]
+	data := map[string]interface{}{
+		"entries": pageEntries,
+		"offset":  offset,
+		"limit":   limit,
+		"total":   len(allEntries),
+	}
+
+	writeJSON(w, http.StatusOK, Response{Error: 0, Data: data})
+}
+
+// ============ File Endpoints ============
+
+func (s *APIServer) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path  string `json:"path"`
+		Flags int    `json:"flags"`
+		Mode  uint32 `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	err, fh := s.fs.Create(req.Path, req.Flags, req.Mode)
+	s.audit(r, AuditRecord{Op: "create", Path: req.Path, Result: err})
+	statusCode := fuseErrorToHTTP(err)
+
+	if err == 0 {
+		// Store handle server-side
+		clientHandle := s.getNextHandleID()
+		s.handleMutex.Lock()
+		s.handleMap[clientHandle] = &FileHandle{path: req.Path, fh: fh}
+		s.handleMutex.Unlock()
+
+		writeJSON(w, statusCode, Response{Error: err, Data: map[string]uint64{"handle": clientHandle}})
+	} else {
+		writeJSON(w, statusCode, Response{Error: err})
+	}
+}
+
+// handleRelease closes a handle from /api/create or /api/opendir. Closing
+// a file commits what was written through the handle.
+func (s *APIServer) handleRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path   string `json:"path"`
+		Handle uint64 `json:"handle"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	s.handleMutex.Lock()
+	handle := s.handleMap[req.Handle]
+	if handle == nil || handle.path != req.Path {
+		s.handleMutex.Unlock()
+		writeJSON(w, http.StatusBadRequest, Response{Error: -fuse.EBADF})
+		return
+	}
+	delete(s.handleMap, req.Handle)
+	s.handleMutex.Unlock()
+
+	err := 0
+	if !handle.dir {
+		err = s.fs.Release(handle.path, handle.fh)
+	}
+	writeJSON(w, fuseErrorToHTTP(err), Response{Error: err})
+}
+
+func (s *APIServer) handleUnlink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	err := s.fs.Unlink(path)
+	s.audit(r, AuditRecord{Op: "unlink", Path: path, Result: err})
+	statusCode := fuseErrorToHTTP(err)
+	writeJSON(w, statusCode, Response{Error: err})
+}
+
+func (s *APIServer) handleTruncate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"`
+		Size int64  `json:"size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	err := s.fs.Truncate(req.Path, req.Size, 0)
+	s.audit(r, AuditRecord{Op: "truncate", Path: req.Path, Size: req.Size, Result: err})
+	statusCode := fuseErrorToHTTP(err)
+	writeJSON(w, statusCode, Response{Error: err})
+}
+
+func (s *APIServer) handleRename(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		OldPath string `json:"oldPath"`
+		NewPath string `json:"newPath"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	err := s.fs.Rename(req.OldPath, req.NewPath)
+	s.audit(r, AuditRecord{Op: "rename", Path: req.OldPath, NewPath: req.NewPath, Result: err})
+	statusCode := fuseErrorToHTTP(err)
+	writeJSON(w, statusCode, Response{Error: err})
+}
+
+// ============ Binary File I/O ============
+
+// handleFileRead sends a file, or the part of it chosen by offset and
+// length or by a Range header, streaming it a chunk at a time
+func (s *APIServer) handleFileRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	q := r.URL.Query()
+	path := q.Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+	offset, length := int64(0), int64(-1)
+	for _, p := range []struct {
+		name string
+		v    *int64
+	}{{"offset", &offset}, {"length", &length}} {
+		if v := q.Get(p.name); v != "" {
+			n, ok := parseDigits(v)
+			if !ok {
+				writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+				return
+			}
+			*p.v = n
+		}
+	}
+	window := q.Has("offset") || q.Has("length")
+	if window && r.Header.Get("Range") != "" {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22}) // one way of choosing a part or the other
+		return
+	}
+
+	throttle := s.throttles.get(clientID(r))
+	if throttle.op(r.Context()) != nil {
+		return // client went away while waiting
+	}
+
+	stat := &fuse.Stat_t{}
+	if errc := s.fs.Getattr(path, stat, 0); errc != 0 {
+		w.WriteHeader(fuseErrorToHTTP(errc))
+		return
+	}
+	if stat.Mode&fuse.S_IFMT == fuse.S_IFDIR {
+		w.WriteHeader(fuseErrorToHTTP(-fuse.EISDIR))
+		return
+	}
+	size := stat.Size
+	modified := stat.Mtim.Time().UTC().Truncate(time.Second)
+
+	// Work out which parts to send
+	status := http.StatusOK
+	ranges := []byteRange{{start: 0, length: size}}
+	if window {
+		start := min(offset, size)
+		n := size - start
+		if length >= 0 {
+			n = min(n, length)
+		}
+		ranges[0] = byteRange{start: start, length: n}
+	} else if h := r.Header.Get("Range"); h != "" && ifRangeHolds(r, modified) {
+		parsed, err := parseRange(h, size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		total := int64(0)
+		for _, rg := range parsed {
+			total += rg.length
+		}
+		// Many or overlapping ranges could make the response far bigger
+		// than the file; they get the file instead
+		if len(parsed) > 0 && len(parsed) <= maxRanges && total <= size {
+			ranges, status = parsed, http.StatusPartialContent
+		}
+	}
+
+	errc, fh := s.fs.Open(path, 0)
+	if errc != 0 {
+		w.WriteHeader(fuseErrorToHTTP(errc))
+		return
+	}
+	// Opened read-only, so releasing commits nothing
+	defer s.fs.Release(path, fh)
+
+	// Read the first chunk before answering, so a file that can't be read
+	// gets an error status rather than a cut-off body
+	bufLen := int64(0)
+	for _, rg := range ranges {
+		bufLen = max(bufLen, min(rg.length, readChunk))
+	}
+	buf := make([]byte, bufLen)
+	have := 0
+	if r.Method == http.MethodGet && ranges[0].length > 0 {
+		if have = s.fs.Read(path, buf[:min(int64(len(buf)), ranges[0].length)], ranges[0].start, fh); have < 0 {
+			w.WriteHeader(fuseErrorToHTTP(have))
+			return
+		}
+	}
+
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Last-Modified", modified.Format(http.TimeFormat))
+	var mw *multipart.Writer
+	if len(ranges) == 1 {
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+		if status == http.StatusPartialContent {
+			h.Set("Content-Range", ranges[0].contentRange(size))
+		}
+	} else {
+		mw = multipart.NewWriter(w)
+		h.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		h.Set("Content-Length", strconv.FormatInt(multipartSize(mw.Boundary(), ranges, size), 10))
+	}
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	for _, rg := range ranges {
+		var part io.Writer = w
+		if mw != nil {
+			part, _ = mw.CreatePart(rangePartHeader(rg, size))
+		}
+		if err := s.sendRange(r.Context(), part, throttle, path, fh, buf, have, rg); err != nil {
+			slog.Debug("API read stopped", "path", path, "client", clientID(r), "err", err)
+			return
+		}
+		have = 0
+	}
+	if mw != nil {
+		mw.Close()
+	}
+}
+
+// ifRangeHolds reports whether a Range header applies given the file's
+// modification time: always without If-Range, and only if the file hasn't
+// changed since the date in it otherwise. Entity tags aren't supported, so
+// an If-Range with one gets the whole file.
+func ifRangeHolds(r *http.Request, modified time.Time) bool {
+	v := r.Header.Get("If-Range")
+	if v == "" {
+		return true
+	}
+	t, err := http.ParseTime(v)
+	return err == nil && t.Equal(modified)
+}
+
+func (s *APIServer) handleFileWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	offset := int64(0)
+	if o := r.URL.Query().Get("offset"); o != "" {
+		if parsed, err := strconv.ParseInt(o, 10, 64); err == nil && parsed >= 0 {
+			offset = parsed
+		}
+	}
+
+	throttle := s.throttles.get(clientID(r))
+	if throttle.op(r.Context()) != nil {
+		return // client went away while waiting
+	}
+
+	// Read binary data from request body
+	data, err := io.ReadAll(&throttledReader{ctx: r.Context(), t: throttle, r: r.Body})
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	var bytesWritten int
+	if h := r.URL.Query().Get("handle"); h != "" {
+		// A handle from /api/create keeps the file open across requests, so
+		// a file sent in chunks is committed once, by /api/release
+		id, err := strconv.ParseUint(h, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+		handle := s.lookupHandle(id, path)
+		if handle == nil || handle.dir {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -fuse.EBADF})
+			return
+		}
+		bytesWritten = s.fs.Write(path, data, offset, handle.fh)
+	} else {
+		// Open file (create if doesn't exist)
+		errOpen, fh := s.fs.Open(path, fuse.O_WRONLY)
+		if errOpen != 0 {
+			// Try creating
+			var errCreate int
+			errCreate, fh = s.fs.Create(path, 2, 0644)
+			s.audit(r, AuditRecord{Op: "create", Path: path, Result: errCreate})
+			if errCreate != 0 {
+				statusCode := fuseErrorToHTTP(errCreate)
+				writeJSON(w, statusCode, Response{Error: errCreate})
+				return
+			}
+		}
+
+		// Write data; releasing commits it, as a FUSE close would
+		bytesWritten = s.fs.Write(path, data, offset, fh)
+		if errRelease := s.fs.Release(path, fh); bytesWritten >= 0 && errRelease != 0 {
+			bytesWritten = errRelease
+		}
+	}
+
+	s.audit(r, AuditRecord{Op: "write", Path: path, Size: int64(max(bytesWritten, 0)), Result: min(bytesWritten, 0)})
+	if bytesWritten < 0 {
+		statusCode := fuseErrorToHTTP(bytesWritten)
+		writeJSON(w, statusCode, Response{Error: bytesWritten})
+	} else {
+		writeJSON(w, http.StatusOK, Response{Error: 0, Data: map[string]int{"bytesWritten": bytesWritten}})
+	}
+}
+
+// ============ Filesystem Endpoints ============
+
+func (s *APIServer) handleStatfs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+
+	stat := &fuse.Statfs_t{}
+	err := s.fs.Statfs(path, stat)
+	statusCode := fuseErrorToHTTP(err)
+	writeJSON(w, statusCode, Response{Error: err, Data: stat})
+}
+
+// handleCapacity shows (GET) or changes (POST) the capacity limits
+func (s *APIServer) handleCapacity(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, Response{Error: 0, Data: s.fs.Capacity()})
+
+	case http.MethodPost:
+		var req CapacityOptions
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+
+		res := s.fs.SetCapacity(req)
+		statusCode := fuseErrorToHTTP(res)
+		writeJSON(w, statusCode, Response{Error: res})
+
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+	}
+}
+
+// ============ Linking Endpoints ============
+
+func (s *APIServer) handleLinkLocal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path   string `json:"path"`   // where it appears in the mount
+		Target string `json:"target"` // real filesystem path
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	res := s.fs.LinkLocal(req.Path, req.Target)
+	s.audit(r, AuditRecord{Op: "link", Path: req.Path, Result: res})
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleLinkArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path   string `json:"path"`   // where it appears in the mount
+		Target string `json:"target"` // zip, tar or tar.gz file
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	res := s.fs.LinkArchive(req.Path, req.Target)
+	s.audit(r, AuditRecord{Op: "link", Path: req.Path, Result: res})
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleLinkOverlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path   string   `json:"path"`   // where it appears in the mount
+		Lowers []string `json:"lowers"` // read-only folders or archives, topmost first
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	res := s.fs.LinkOverlay(req.Path, req.Lowers)
+	s.audit(r, AuditRecord{Op: "link", Path: req.Path, Result: res})
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleLinkCrypt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path       string `json:"path"`       // where it appears in the mount
+		Target     string `json:"target"`     // real folder holding the ciphertext
+		Passphrase string `json:"passphrase"` // either a passphrase...
+		KeyFile    string `json:"keyFile"`    // ...or a key file on the server
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	opts := CryptOptions{Passphrase: req.Passphrase, KeyFile: req.KeyFile}
+	res := s.fs.LinkCrypt(req.Path, req.Target, opts)
+	s.audit(r, AuditRecord{Op: "link", Path: req.Path, Result: res})
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleLinkCompress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path      string `json:"path"`      // where it appears in the mount
+		Target    string `json:"target"`    // real folder holding the compressed files
+		Algorithm string `json:"algorithm"` // zstd, deflate or none
+		Level     int    `json:"level"`     // 0 for the algorithm default
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	opts := CompressOptions{Algorithm: req.Algorithm, Level: req.Level}
+	res := s.fs.LinkCompress(req.Path, req.Target, opts)
+	s.audit(r, AuditRecord{Op: "link", Path: req.Path, Result: res})
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleLinkS3(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path      string `json:"path"`     // where it appears in the mount
+		Endpoint  string `json:"endpoint"` // e.g. https://s3.amazonaws.com
+		Region    string `json:"region"`
+		Bucket    string `json:"bucket"`
+		Prefix    string `json:"prefix"`
+		AccessKey string `json:"accessKey"` // empty to use AWS_* environment variables
+		SecretKey string `json:"secretKey"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	opts := S3Options{
+		Endpoint:  req.Endpoint,
+		Region:    req.Region,
+		Bucket:    req.Bucket,
+		Prefix:    req.Prefix,
+		AccessKey: req.AccessKey,
+		SecretKey: req.SecretKey,
+	}
+	res := s.fs.LinkS3(req.Path, opts)
+	s.audit(r, AuditRecord{Op: "link", Path: req.Path, Result: res})
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleLinkWebDAV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path     string `json:"path"` // where it appears in the mount
+		URL      string `json:"url"`  // the WebDAV collection to link
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	opts := WebDAVOptions{URL: req.URL, Username: req.Username, Password: req.Password}
+	res := s.fs.LinkWebDAV(req.Path, opts)
+	s.audit(r, AuditRecord{Op: "link", Path: req.Path, Result: res})
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleLinkSFTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path       string `json:"path"` // where it appears in the mount
+		Addr       string `json:"addr"` // host or host:port
+		User       string `json:"user"`
+		KeyFile    string `json:"keyFile"` // private key on the API server's host
+		Passphrase string `json:"passphrase"`
+		HostKey    string `json:"hostKey"`    // authorized_keys line; empty to use knownHosts
+		KnownHosts string `json:"knownHosts"` // default ~/.ssh/known_hosts
+		Root       string `json:"root"`       // remote directory; default the login directory
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	opts := SFTPOptions{
+		Addr:           req.Addr,
+		User:           req.User,
+		KeyFile:        req.KeyFile,
+		Passphrase:     req.Passphrase,
+		HostKey:        req.HostKey,
+		KnownHostsFile: req.KnownHosts,
+		Root:           req.Root,
+	}
+	res := s.fs.LinkSFTP(req.Path, opts)
+	s.audit(r, AuditRecord{Op: "link", Path: req.Path, Result: res})
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleLinkHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path     string            `json:"path"`     // where it appears in the mount
+		URL      string            `json:"url"`      // root of the published tree
+		Manifest string            `json:"manifest"` // optional, relative to url
+		Headers  map[string]string `json:"headers"`  // e.g. {"Authorization": "Bearer ..."}
+		TTLMs    int64             `json:"ttlMs"`    // 0 for the default
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	opts := HTTPOptions{
+		URL:      req.URL,
+		Manifest: req.Manifest,
+		Header:   req.Headers,
+		TTL:      time.Duration(req.TTLMs) * time.Millisecond,
+	}
+	res := s.fs.LinkHTTP(req.Path, opts)
+	s.audit(r, AuditRecord{Op: "link", Path: req.Path, Result: res})
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleLinkGit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path   string `json:"path"`   // where it appears in the mount
+		Target string `json:"target"` // repository work tree or bare repository
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	res := s.fs.LinkGit(req.Path, req.Target)
+	s.audit(r, AuditRecord{Op: "link", Path: req.Path, Result: res})
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleLinkMirror(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path    string   `json:"path"`    // where it appears in the mount
+		Targets []string `json:"targets"` // real folders, preferred for reads first
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	res := s.fs.LinkMirror(req.Path, req.Targets)
+	s.audit(r, AuditRecord{Op: "link", Path: req.Path, Result: res})
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+// ============ Cache Endpoints ============
+
+func (s *APIServer) handleCacheEnable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path      string `json:"path"`      // an existing mount point
+		BlockSize int    `json:"blockSize"` // 0 for the default
+		MaxBytes  int64  `json:"maxBytes"`  // 0 for the default
+		TTLMillis int64  `json:"ttlMs"`     // Stat/Readdir lifetime, 0 for the default
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	opts := CacheOptions{
+		BlockSize: req.BlockSize,
+		MaxBytes:  req.MaxBytes,
+		MetaTTL:   time.Duration(req.TTLMillis) * time.Millisecond,
+	}
+	res := s.fs.CacheMount(req.Path, opts)
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	stats, res := s.fs.CacheStats(path)
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res, Data: stats})
+}
+
+// ============ Mirror Endpoints ============
+
+func (s *APIServer) handleMirrorStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	status, res := s.fs.MirrorStatus(path)
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res, Data: status})
+}
+
+func (s *APIServer) handleMirrorResync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"` // mount point of the mirror
+		Full bool   `json:"full"` // compare the whole tree, not just known divergences
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	res := s.fs.MirrorResync(req.Path, req.Full)
+	status, _ := s.fs.MirrorStatus(req.Path)
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res, Data: status})
+}
+
+// ============ Tiering Endpoints ============
+
+func (s *APIServer) handleTierEnable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		SpillDir     string `json:"spillDir"`     // where spilled contents are written
+		MaxFileBytes int64  `json:"maxFileBytes"` // larger files live on disk, 0 for no limit
+		IdleMillis   int64  `json:"idleMs"`       // spill files untouched this long, 0 to never
+		MemoryBudget int64  `json:"memoryBudget"` // total in-memory contents, 0 for no limit
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	opts := TierOptions{
+		SpillDir:     req.SpillDir,
+		MaxFileBytes: req.MaxFileBytes,
+		IdleAfter:    time.Duration(req.IdleMillis) * time.Millisecond,
+		MemoryBudget: req.MemoryBudget,
+	}
+	res := s.fs.EnableTiering(opts)
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleTierStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+
+	status, res := s.fs.TierStatus(path)
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res, Data: status})
+}
+
+func (s *APIServer) handleTierPin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path   string `json:"path"`
+		Pinned *bool  `json:"pinned"` // defaults to true
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	pinned := req.Pinned == nil || *req.Pinned
+	res := s.fs.TierPin(req.Path, pinned)
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+// ============ Fault Injection Endpoints ============
+
+// handleFault lists (GET), adds (POST) or removes (DELETE) the fault rules
+// of a mount point
+func (s *APIServer) handleFault(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+		rules, res := s.fs.FaultRules(path)
+		statusCode := fuseErrorToHTTP(res)
+		writeJSON(w, statusCode, Response{Error: res, Data: rules})
+
+	case http.MethodPost:
+		var req struct {
+			Path string    `json:"path"` // an existing mount point
+			Rule FaultRule `json:"rule"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+		added, res := s.fs.FaultInject(req.Path, req.Rule)
+		statusCode := fuseErrorToHTTP(res)
+		writeJSON(w, statusCode, Response{Error: res, Data: added})
+
+	case http.MethodDelete:
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+		id := 0
+		if v := r.URL.Query().Get("id"); v != "" {
+			var err error
+			if id, err = strconv.Atoi(v); err != nil || id <= 0 {
+				writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+				return
+			}
+		}
+		res := s.fs.FaultClear(path, id)
+		statusCode := fuseErrorToHTTP(res)
+		writeJSON(w, statusCode, Response{Error: res})
+
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+	}
+}
+
+// ============ Throttling Endpoints ============
+
+func (s *APIServer) handleThrottleMount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Path string `json:"path"` // an existing mount point
+		ThrottleOptions
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	res := s.fs.ThrottleMount(req.Path, req.ThrottleOptions)
+	statusCode := fuseErrorToHTTP(res)
+	writeJSON(w, statusCode, Response{Error: res})
+}
+
+func (s *APIServer) handleThrottleClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Client string `json:"client"` // client address, "" for the default
+		ThrottleOptions
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+	if req.BytesPerSec < 0 || req.OpsPerSec < 0 {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	s.throttles.set(req.Client, req.ThrottleOptions)
+	writeJSON(w, http.StatusOK, Response{Error: 0})
+}
+
+func (s *APIServer) handleThrottleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	def, clients := s.throttles.status()
+	writeJSON(w, http.StatusOK, Response{Error: 0, Data: map[string]interface{}{
+		"mounts":        s.fs.ThrottleStatus(),
+		"clients":       clients,
+		"clientDefault": def,
+	}})
+}
+
+// ============ Change Notification Endpoints ============
+
+// eventKeepalive is how often an idle event stream sends a comment so
+// proxies don't close it
+var eventKeepalive = 15 * time.Second
+
+// handleEvents streams filesystem changes as Server-Sent Events. A client
+// resumes after a reconnect with the Last-Event-ID header, which browsers
+// send automatically, or the since query parameter. If events were lost in
+// between it first gets a "gap" event; if it falls too far behind while
+// connected it gets a "lagged" event and the stream ends. Paths outside the
+// caller's scope, such as where a rename came from, are left empty.
+func (s *APIServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, Response{Error: -5})
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.URL.Query().Get("since")
+	}
+
+	scope := scopeOf(r)
+	bus := s.fs.Events()
+	var sub *Subscription
+	var missed []Event
+	var since uint64
+	complete := true
+	if resume != "" {
+		var err error
+		since, err = strconv.ParseUint(resume, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+		sub, missed, complete = bus.SubscribeFrom(prefix, since)
+	} else {
+		sub = bus.Subscribe(prefix)
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		// Some changes after since are gone; the client has to rescan
+		fmt.Fprintf(w, "event: gap\ndata: {\"since\":%d}\n\n", since)
+	}
+	for _, ev := range missed {
+		writeEvent(w, scope.redact(ev))
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-sub.C:
+			if !ok {
+				if sub.Lagged() {
+					io.WriteString(w, "event: lagged\ndata: {}\n\n")
+					flusher.Flush()
+				}
+				return
+			}
+			writeEvent(w, scope.redact(ev))
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes ev in Server-Sent Events format
+func writeEvent(w io.Writer, ev Event) {
+	data, _ := json.Marshal(ev)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, data)
+}
+
+// handleWatch starts (POST) or stops (DELETE) watching a linked folder for
+// changes made by other programs
+func (s *APIServer) handleWatch(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Path string `json:"path"` // mount point of the linked folder
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+
+		res := s.fs.WatchMount(req.Path)
+		statusCode := fuseErrorToHTTP(res)
+		writeJSON(w, statusCode, Response{Error: res})
+
+	case http.MethodDelete:
+		res := s.fs.UnwatchMount(r.URL.Query().Get("path"))
+		statusCode := fuseErrorToHTTP(res)
+		writeJSON(w, statusCode, Response{Error: res})
+
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+	}
+}
+
+// maxChangesWait bounds how long a changes query may wait for a change
+const maxChangesWait = 5 * time.Minute
+
+// handleJournal shows (GET), enables (POST) or disables (DELETE) the change
+// journal
+func (s *APIServer) handleJournal(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		j := s.fs.Journal()
+		if j == nil {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{Error: 0, Data: j.Status()})
+
+	case http.MethodPost:
+		var req JournalOptions
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+
+		res := s.fs.EnableJournal(req)
+		statusCode := fuseErrorToHTTP(res)
+		writeJSON(w, statusCode, Response{Error: res})
+
+	case http.MethodDelete:
+		res := s.fs.DisableJournal()
+		statusCode := fuseErrorToHTTP(res)
+		writeJSON(w, statusCode, Response{Error: res})
+
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+	}
+}
+
+// handleChanges returns the changes under prefix after the since cursor.
+// With waitMs it holds the request open until there is at least one. Paths
+// outside the caller's scope are left empty, as for events.
+func (s *APIServer) handleChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	j := s.fs.Journal()
+	if j == nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	q := r.URL.Query()
+	var since uint64
+	var limit int
+	var wait time.Duration
+	if v := q.Get("since"); v != "" {
+		parsed, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+		since = parsed
+	}
+	if v := q.Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+		limit = parsed
+	}
+	if v := q.Get("waitMs"); v != "" {
+		parsed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || parsed < 0 {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+		wait = min(time.Duration(parsed)*time.Millisecond, maxChangesWait)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	cs := j.Wait(ctx, since, q.Get("prefix"), limit)
+	scope := scopeOf(r)
+	for i, ev := range cs.Changes {
+		cs.Changes[i] = scope.redact(ev)
+	}
+	writeJSON(w, http.StatusOK, Response{Error: 0, Data: cs})
+}
+
+// ============ Audit Endpoints ============
+
+// handleAudit shows (GET), enables (POST) or disables (DELETE) the audit
+// log
+func (s *APIServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		l := s.fs.Audit()
+		if l == nil {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+		writeJSON(w, http.StatusOK, Response{Error: 0, Data: l.Status()})
+
+	case http.MethodPost:
+		var req AuditOptions
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+			return
+		}
+
+		res := s.fs.EnableAudit(req)
+		statusCode := fuseErrorToHTTP(res)
+		writeJSON(w, statusCode, Response{Error: res})
+
+	case http.MethodDelete:
+		res := s.fs.DisableAudit()
+		statusCode := fuseErrorToHTTP(res)
+		writeJSON(w, statusCode, Response{Error: res})
+
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+	}
+}
+
+// handleAuditLog returns the most recent audit records matching the query
+// filters
+func (s *APIServer) handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	l := s.fs.Audit()
+	if l == nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	v := r.URL.Query()
+	q := AuditQuery{
+		Prefix: v.Get("prefix"),
+		Op:     v.Get("op"),
+		Source: v.Get("source"),
+		Client: v.Get("client"),
+		User:   v.Get("user"),
+		Failed: v.Get("failed") == "true",
+	}
+	var err error
+	if p := v.Get("uid"); p != "" {
+		var uid uint64
+		if uid, err = strconv.ParseUint(p, 10, 32); err == nil {
+			q.UID = new(uint32)
+			*q.UID = uint32(uid)
+		}
+	}
+	if p := v.Get("since"); p != "" && err == nil {
+		q.Since, err = time.Parse(time.RFC3339, p)
+	}
+	if p := v.Get("until"); p != "" && err == nil {
+		q.Until, err = time.Parse(time.RFC3339, p)
+	}
+	if p := v.Get("limit"); p != "" && err == nil {
+		q.Limit, err = strconv.Atoi(p)
+	}
+	if err != nil || q.Limit < 0 {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	records, err := l.Query(q)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, Response{Error: -5})
+		return
+	}
+	writeJSON(w, http.StatusOK, Response{Error: 0, Data: records})
+}
+
+// handleAuditExclude replaces the patterns of paths left out of the audit
+// log
+func (s *APIServer) handleAuditExclude(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, Response{Error: -1})
+		return
+	}
+
+	var req struct {
+		Exclude []string `json:"exclude"` // path.Match patterns on a path or an ancestor
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+
+	l := s.fs.Audit()
+	if l == nil || l.SetExclude(req.Exclude) != nil {
+		writeJSON(w, http.StatusBadRequest, Response{Error: -22})
+		return
+	}
+	writeJSON(w, http.StatusOK, Response{Error: 0})
+}
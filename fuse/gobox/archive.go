@@ -0,0 +1,542 @@
+package gobox
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// errUnsupportedArchive is returned when an archive is not zip, tar or tar.gz
+var errUnsupportedArchive = errors.New("unsupported archive format")
+
+// defaultArchiveCacheBytes bounds the on-disk cache of decompressed entries
+const defaultArchiveCacheBytes = 256 << 20
+
+type archiveFormat int
+
+const (
+	formatZip archiveFormat = iota
+	formatTar
+	formatTarGz
+)
+
+// archiveEntry is a file or directory inside an archive
+type archiveEntry struct {
+	stat     fuse.Stat_t
+	children []string // sorted child names, directories only
+
+	// Random access: data lives at [offset, offset+size) of the archive file
+	direct bool
+	offset int64
+
+	zf *zip.File // zip entries that need decompression
+}
+
+// spooledEntry is a decompressed entry cached in a temporary file
+type spooledEntry struct {
+	path string
+	f    *os.File
+	size int64
+}
+
+// ArchiveBackend implements a read-only Backend over a zip, tar or tar.gz file
+type ArchiveBackend struct {
+	archivePath string
+	format      archiveFormat
+	f           *os.File
+	entries     map[string]*archiveEntry
+
+	// CacheBytes bounds the total size of decompressed entries kept on disk
+	CacheBytes int64
+
+	mu        sync.Mutex
+	spoolDir  string
+	spool     map[string]*list.Element // path -> element holding *spooledEntry
+	lru       *list.List               // front is most recently used
+	spoolSize int64
+}
+
+// NewArchiveBackend opens an archive and indexes its contents
+func NewArchiveBackend(archivePath string) (*ArchiveBackend, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := sniffArchive(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	b := &ArchiveBackend{
+		archivePath: archivePath,
+		format:      format,
+		f:           f,
+		entries:     make(map[string]*archiveEntry),
+		CacheBytes:  defaultArchiveCacheBytes,
+		spool:       make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	b.addDir("/", info.ModTime())
+
+	switch format {
+	case formatZip:
+		err = b.indexZip(info.Size())
+	case formatTar:
+		err = b.indexTar(f, true)
+	case formatTarGz:
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(bufio.NewReader(f))
+		if err == nil {
+			err = b.indexTar(gz, false)
+			gz.Close()
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	for _, e := range b.entries {
+		sort.Strings(e.children)
+	}
+	return b, nil
+}
+
+// sniffArchive detects the archive format from its leading bytes
+func sniffArchive(f *os.File) (archiveFormat, error) {
+	head := make([]byte, 512)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return formatZip, nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return formatTarGz, nil
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return formatTar, nil
+	}
+	return 0, errUnsupportedArchive
+}
+
+// cleanArchivePath turns an archive member name into a mount-relative path
+func cleanArchivePath(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	return path.Clean("/" + name)
+}
+
+// addDir registers a directory and any missing parents
+func (b *ArchiveBackend) addDir(p string, mtime time.Time) *archiveEntry {
+	e, ok := b.entries[p]
+	if ok && e.stat.Mode&fuse.S_IFDIR != 0 {
+		return e
+	}
+	ts := fuse.NewTimespec(mtime)
+	st := fuse.Stat_t{
+		Mode:  fuse.S_IFDIR | 0555,
+		Nlink: 2,
+		Atim:  ts,
+		Mtim:  ts,
+		Ctim:  ts,
+	}
+
+	// A directory replaces an earlier file of the same name, which is
+	// already in its parent
+	if ok {
+		*e = archiveEntry{stat: st}
+		return e
+	}
+
+	e = &archiveEntry{stat: st}
+	b.entries[p] = e
+	if p != "/" {
+		b.link(p, mtime)
+	}
+	return e
+}
+
+// link adds p to its parent's children, creating the parent if needed
+func (b *ArchiveBackend) link(p string, mtime time.Time) {
+	parent, name := split(p)
+	if parent == "" {
+		parent = "/"
+	}
+	pe := b.addDir(parent, mtime)
+	pe.children = append(pe.children, name)
+}
+
+// addFile registers a regular file
+func (b *ArchiveBackend) addFile(p string, size int64, perm os.FileMode, mtime time.Time) *archiveEntry {
+	ts := fuse.NewTimespec(mtime)
+	st := fuse.Stat_t{
+		Mode:  fuse.S_IFREG | uint32(perm&0555),
+		Nlink: 1,
+		Size:  size,
+		Atim:  ts,
+		Mtim:  ts,
+		Ctim:  ts,
+	}
+
+	// Later members replace earlier ones, as they would on extraction; a
+	// directory goes with everything in it
+	if e, ok := b.entries[p]; ok {
+		if e.stat.Mode&fuse.S_IFDIR != 0 {
+			b.drop(p)
+		}
+		*e = archiveEntry{stat: st}
+		return e
+	}
+
+	e := &archiveEntry{stat: st}
+	b.entries[p] = e
+	b.link(p, mtime)
+	return e
+}
+
+// drop forgets everything below directory p
+func (b *ArchiveBackend) drop(p string) {
+	for _, name := range b.entries[p].children {
+		child := joinPath(p, name)
+		if b.entries[child].stat.Mode&fuse.S_IFDIR != 0 {
+			b.drop(child)
+		}
+		delete(b.entries, child)
+	}
+}
+
+// indexZip builds the entry table from the zip central directory
+func (b *ArchiveBackend) indexZip(size int64) error {
+	zr, err := zip.NewReader(b.f, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		p := cleanArchivePath(zf.Name)
+		if p == "/" {
+			continue
+		}
+		info := zf.FileInfo()
+		if info.IsDir() {
+			b.addDir(p, zf.Modified)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		e := b.addFile(p, int64(zf.UncompressedSize64), info.Mode().Perm(), zf.Modified)
+		if zf.Method == zip.Store {
+			offset, err := zf.DataOffset()
+			if err != nil {
+				return err
+			}
+			e.direct = true
+			e.offset = offset
+		} else {
+			e.zf = zf
+		}
+	}
+	return nil
+}
+
+// indexTar builds the entry table by scanning tar headers.
+// When seekable is set, data offsets are recorded for random access.
+func (b *ArchiveBackend) indexTar(r io.Reader, seekable bool) error {
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		p := cleanArchivePath(hdr.Name)
+		if p == "/" {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			b.addDir(p, hdr.ModTime)
+		case tar.TypeReg, tar.TypeGNUSparse:
+			e := b.addFile(p, hdr.Size, os.FileMode(hdr.Mode).Perm(), hdr.ModTime)
+			// Sparse files are expanded by tar.Reader, so their data is not contiguous
+			if seekable && !isSparseTar(hdr) {
+				e.direct = true
+				e.offset = cr.n
+			}
+		}
+	}
+}
+
+// isSparseTar reports whether a header describes a sparse file
+func isSparseTar(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// countingReader tracks how many bytes have been consumed
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Close releases the archive and removes cached decompressed data
+func (b *ArchiveBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for e := b.lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*spooledEntry).f.Close()
+	}
+	b.spool = make(map[string]*list.Element)
+	b.lru.Init()
+	b.spoolSize = 0
+	if b.spoolDir != "" {
+		os.RemoveAll(b.spoolDir)
+		b.spoolDir = ""
+	}
+	return b.f.Close()
+}
+
+// Stat returns file attributes
+func (b *ArchiveBackend) Stat(path string) (*fuse.Stat_t, int) {
+	e, ok := b.entries[path]
+	if !ok {
+		return nil, -fuse.ENOENT
+	}
+	st := e.stat
+	return &st, 0
+}
+
+// Readdir lists directory entries
+func (b *ArchiveBackend) Readdir(path string) ([]DirEnt, int) {
+	e, ok := b.entries[path]
+	if !ok {
+		return nil, -fuse.ENOENT
+	}
+	if e.stat.Mode&fuse.S_IFDIR == 0 {
+		return nil, -fuse.ENOTDIR
+	}
+
+	prefix := path
+	if prefix != "/" {
+		prefix += "/"
+	}
+	out := make([]DirEnt, 0, len(e.children))
+	for _, name := range e.children {
+		out = append(out, DirEnt{Name: name, Stat: b.entries[prefix+name].stat})
+	}
+	return out, 0
+}
+
+// Read reads file content, directly where the format allows and from the
+// decompression cache otherwise
+func (b *ArchiveBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	e, ok := b.entries[path]
+	if !ok {
+		return 0, -fuse.ENOENT
+	}
+	if e.stat.Mode&fuse.S_IFDIR != 0 {
+		return 0, -fuse.EISDIR
+	}
+	if ofst >= e.stat.Size {
+		return 0, 0
+	}
+	if rem := e.stat.Size - ofst; int64(len(buff)) > rem {
+		buff = buff[:rem]
+	}
+
+	if e.direct {
+		n, err := b.f.ReadAt(buff, e.offset+ofst)
+		if err != nil && err != io.EOF {
+			return 0, -fuse.EIO
+		}
+		return n, 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	se, err := b.spooled(path, e)
+	if err != nil {
+		return 0, -fuse.EIO
+	}
+	n, err := se.f.ReadAt(buff, ofst)
+	if err != nil && err != io.EOF {
+		return 0, -fuse.EIO
+	}
+	return n, 0
+}
+
+// spooled returns the decompressed copy of an entry, extracting it if needed.
+// Caller must hold b.mu.
+func (b *ArchiveBackend) spooled(path string, e *archiveEntry) (*spooledEntry, error) {
+	if el, ok := b.spool[path]; ok {
+		b.lru.MoveToFront(el)
+		return el.Value.(*spooledEntry), nil
+	}
+
+	if b.spoolDir == "" {
+		dir, err := os.MkdirTemp("", "gobox-archive-")
+		if err != nil {
+			return nil, err
+		}
+		b.spoolDir = dir
+	}
+
+	f, err := os.CreateTemp(b.spoolDir, "entry-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name()) // keep the open handle only
+
+	if err := b.extract(path, e, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	se := &spooledEntry{path: path, f: f, size: e.stat.Size}
+	b.spool[path] = b.lru.PushFront(se)
+	b.spoolSize += se.size
+
+	// Evict least recently used entries, but always keep the one just added
+	for b.spoolSize > b.CacheBytes && b.lru.Len() > 1 {
+		old := b.lru.Remove(b.lru.Back()).(*spooledEntry)
+		old.f.Close()
+		delete(b.spool, old.path)
+		b.spoolSize -= old.size
+	}
+	return se, nil
+}
+
+// extract decompresses a single entry into f
+func (b *ArchiveBackend) extract(path string, e *archiveEntry, f *os.File) error {
+	if e.zf != nil {
+		rc, err := e.zf.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(f, rc)
+		return err
+	}
+
+	// Streams without random access must be scanned from the start
+	var r io.Reader = io.NewSectionReader(b.f, 0, 1<<62)
+	if b.format == formatTarGz {
+		gz, err := gzip.NewReader(bufio.NewReader(r))
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var found bool
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeGNUSparse) ||
+			cleanArchivePath(hdr.Name) != path {
+			continue
+		}
+		// Keep the last matching member, as addFile does
+		if found {
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// Write is not supported on archives
+func (b *ArchiveBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	return 0, -fuse.EROFS
+}
+
+// Truncate is not supported on archives
+func (b *ArchiveBackend) Truncate(path string, size int64) int {
+	return -fuse.EROFS
+}
+
+// Mkdir is not supported on archives
+func (b *ArchiveBackend) Mkdir(path string, mode uint32) int {
+	return -fuse.EROFS
+}
+
+// Create is not supported on archives
+func (b *ArchiveBackend) Create(path string, mode uint32) int {
+	return -fuse.EROFS
+}
+
+// Unlink is not supported on archives
+func (b *ArchiveBackend) Unlink(path string) int {
+	return -fuse.EROFS
+}
+
+// Rmdir is not supported on archives
+func (b *ArchiveBackend) Rmdir(path string) int {
+	return -fuse.EROFS
+}
+
+// Rename is not supported on archives
+func (b *ArchiveBackend) Rename(oldpath, newpath string) int {
+	return -fuse.EROFS
+}
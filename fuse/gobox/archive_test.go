@@ -0,0 +1,274 @@
+package gobox
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// archiveFiles is the content every test archive is built from
+var archiveFiles = map[string]string{
+	"readme.txt":          "hello archive",
+	"docs/guide.md":       "# Guide\n" + strings.Repeat("lorem ipsum ", 1000),
+	"docs/nested/deep.go": "package deep",
+}
+
+func writeTestZip(t *testing.T, dir string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range archiveFiles {
+		// Mix stored and deflated members to cover both read paths
+		method := zip.Deflate
+		if name == "readme.txt" {
+			method = zip.Store
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatalf("zip create %s: %v", name, err)
+		}
+		w.Write([]byte(content))
+	}
+	zw.Close()
+
+	p := filepath.Join(dir, "test.zip")
+	os.WriteFile(p, buf.Bytes(), 0644)
+	return p
+}
+
+func buildTestTar(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "docs/", Typeflag: tar.TypeDir, Mode: 0755})
+	for name, content := range archiveFiles {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("tar header %s: %v", name, err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func writeTestTar(t *testing.T, dir string) string {
+	t.Helper()
+	p := filepath.Join(dir, "test.tar")
+	os.WriteFile(p, buildTestTar(t), 0644)
+	return p
+}
+
+func writeTestTarGz(t *testing.T, dir string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(buildTestTar(t))
+	gz.Close()
+
+	p := filepath.Join(dir, "test.tar.gz")
+	os.WriteFile(p, buf.Bytes(), 0644)
+	return p
+}
+
+// TestArchiveBackendFormats checks every format exposes the same tree
+func TestArchiveBackendFormats(t *testing.T) {
+	builders := map[string]func(*testing.T, string) string{
+		"zip":    writeTestZip,
+		"tar":    writeTestTar,
+		"tar.gz": writeTestTarGz,
+	}
+
+	for format, build := range builders {
+		t.Run(format, func(t *testing.T) {
+			b, err := NewArchiveBackend(build(t, t.TempDir()))
+			if err != nil {
+				t.Fatalf("NewArchiveBackend failed: %v", err)
+			}
+			defer b.Close()
+
+			// Implicit directories are synthesized from member paths
+			st, errc := b.Stat("/docs/nested")
+			if errc != 0 {
+				t.Fatalf("Stat /docs/nested returned %d", errc)
+			}
+			if st.Mode&fuse.S_IFDIR == 0 {
+				t.Errorf("/docs/nested is not a directory")
+			}
+
+			ents, errc := b.Readdir("/docs")
+			if errc != 0 {
+				t.Fatalf("Readdir /docs returned %d", errc)
+			}
+			if len(ents) != 2 || ents[0].Name != "guide.md" || ents[1].Name != "nested" {
+				t.Errorf("Readdir /docs = %v, expected [guide.md nested]", ents)
+			}
+
+			for name, content := range archiveFiles {
+				st, errc := b.Stat("/" + name)
+				if errc != 0 {
+					t.Fatalf("Stat /%s returned %d", name, errc)
+				}
+				if st.Size != int64(len(content)) {
+					t.Errorf("Stat /%s size = %d, expected %d", name, st.Size, len(content))
+				}
+
+				// Read from the middle to exercise offset handling
+				ofst := int64(len(content) / 2)
+				buff := make([]byte, len(content))
+				n, errc := b.Read("/"+name, buff, ofst)
+				if errc != 0 {
+					t.Fatalf("Read /%s returned %d", name, errc)
+				}
+				if string(buff[:n]) != content[ofst:] {
+					t.Errorf("Read /%s at %d = %q, expected %q", name, ofst, buff[:n], content[ofst:])
+				}
+			}
+		})
+	}
+}
+
+// TestArchiveBackendReadOnly checks mutations are rejected
+func TestArchiveBackendReadOnly(t *testing.T) {
+	b, err := NewArchiveBackend(writeTestTar(t, t.TempDir()))
+	if err != nil {
+		t.Fatalf("NewArchiveBackend failed: %v", err)
+	}
+	defer b.Close()
+
+	if _, errc := b.Write("/readme.txt", []byte("x"), 0); errc != -fuse.EROFS {
+		t.Errorf("Write returned %d, expected %d", errc, -fuse.EROFS)
+	}
+	if errc := b.Create("/new.txt", 0644); errc != -fuse.EROFS {
+		t.Errorf("Create returned %d, expected %d", errc, -fuse.EROFS)
+	}
+	if errc := b.Unlink("/readme.txt"); errc != -fuse.EROFS {
+		t.Errorf("Unlink returned %d, expected %d", errc, -fuse.EROFS)
+	}
+	if _, errc := b.Stat("/missing"); errc != -fuse.ENOENT {
+		t.Errorf("Stat missing returned %d, expected %d", errc, -fuse.ENOENT)
+	}
+}
+
+// TestArchiveBackendCacheEviction checks the decompression cache stays bounded
+func TestArchiveBackendCacheEviction(t *testing.T) {
+	b, err := NewArchiveBackend(writeTestTarGz(t, t.TempDir()))
+	if err != nil {
+		t.Fatalf("NewArchiveBackend failed: %v", err)
+	}
+	defer b.Close()
+	b.CacheBytes = 1
+
+	buff := make([]byte, 16)
+	for _, name := range []string{"/readme.txt", "/docs/guide.md", "/docs/nested/deep.go"} {
+		if _, errc := b.Read(name, buff, 0); errc != 0 {
+			t.Fatalf("Read %s returned %d", name, errc)
+		}
+	}
+	if b.lru.Len() != 1 {
+		t.Errorf("cache holds %d entries, expected 1", b.lru.Len())
+	}
+}
+
+// TestArchiveBackendTypeConflicts tests later members replacing earlier
+// ones of the other type, in both orders
+func TestArchiveBackendTypeConflicts(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range []struct {
+		name    string
+		dir     bool
+		content string
+	}{
+		{name: "a", content: "file first"},
+		{name: "a/b", content: "child of a"},
+		{name: "c", content: "file first"},
+		{name: "c/", dir: true},
+		{name: "d/", dir: true},
+		{name: "d/x", content: "in d"},
+		{name: "d/sub/y", content: "deeper in d"},
+		{name: "d", content: "dir first"},
+	} {
+		hdr := &tar.Header{Name: m.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(m.content))}
+		if m.dir {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		tw.WriteHeader(hdr)
+		tw.Write([]byte(m.content))
+	}
+	tw.Close()
+	p := filepath.Join(t.TempDir(), "conflicts.tar")
+	os.WriteFile(p, buf.Bytes(), 0644)
+
+	b, err := NewArchiveBackend(p)
+	if err != nil {
+		t.Fatalf("NewArchiveBackend: %v", err)
+	}
+	defer b.Close()
+
+	ents, errc := b.Readdir("/")
+	assertSuccess(t, errc, "Readdir /")
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name)
+	}
+	if strings.Join(names, ",") != "a,c,d" {
+		t.Errorf("Readdir / = %v, expected each name once", names)
+	}
+
+	for _, dir := range []string{"/a", "/c"} {
+		if st, errc := b.Stat(dir); errc != 0 || st.Mode&fuse.S_IFDIR == 0 {
+			t.Errorf("Stat %s = (%+v, %d), expected a directory", dir, st, errc)
+		}
+	}
+	if ents, errc := b.Readdir("/a"); errc != 0 || len(ents) != 1 || ents[0].Name != "b" {
+		t.Errorf("Readdir /a = (%+v, %d)", ents, errc)
+	}
+
+	st, errc := b.Stat("/d")
+	if errc != 0 || st.Mode&fuse.S_IFREG == 0 || st.Size != int64(len("dir first")) {
+		t.Errorf("Stat /d = (%+v, %d), expected the file", st, errc)
+	}
+	for _, gone := range []string{"/d/x", "/d/sub", "/d/sub/y"} {
+		_, errc := b.Stat(gone)
+		assertError(t, errc, -fuse.ENOENT, "Stat "+gone)
+	}
+	buff := make([]byte, 32)
+	if n, errc := b.Read("/d", buff, 0); errc != 0 || string(buff[:n]) != "dir first" {
+		t.Errorf("Read /d = %q, %d", buff[:n], errc)
+	}
+}
+
+// TestLinkArchive tests linking an archive into the filesystem
+func TestLinkArchive(t *testing.T) {
+	fs := newTestFS()
+	tmpDir := t.TempDir()
+
+	errCode := fs.LinkArchive("/bundle", writeTestZip(t, tmpDir))
+	assertSuccess(t, errCode, "LinkArchive")
+
+	buff := make([]byte, 64)
+	n := fs.Read("/bundle/readme.txt", buff, 0, 0)
+	if string(buff[:n]) != "hello archive" {
+		t.Errorf("Read through MemFS = %q, expected %q", buff[:n], "hello archive")
+	}
+
+	errCode = fs.Mkdir("/bundle/newdir", 0755)
+	assertError(t, errCode, -fuse.EROFS, "Mkdir in archive")
+
+	// Non-archives are rejected
+	plain := filepath.Join(tmpDir, "plain.txt")
+	os.WriteFile(plain, []byte("not an archive"), 0644)
+	errCode = fs.LinkArchive("/plain", plain)
+	assertError(t, errCode, -fuse.EINVAL, "LinkArchive on plain file")
+
+	errCode = fs.LinkArchive("/missing", filepath.Join(tmpDir, "missing.zip"))
+	assertError(t, errCode, -fuse.ENOENT, "LinkArchive on missing file")
+}
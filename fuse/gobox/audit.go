@@ -0,0 +1,546 @@
+package gobox
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+const (
+	defaultAuditBytes  = 64 << 20
+	defaultAuditFiles  = 5
+	defaultAuditLimit  = 1000
+	maxAuditQueryLimit = 10000
+)
+
+// Audit record sources
+const (
+	AuditFUSE = "fuse"
+	AuditREST = "rest"
+)
+
+var errBadAuditOptions = errors.New("invalid audit options")
+
+// AuditOptions configures the audit log
+type AuditOptions struct {
+	Path     string   `json:"path"`     // file records are appended to
+	MaxBytes int64    `json:"maxBytes"` // size at which the file is rotated; 0 for 64 MiB
+	MaxFiles int      `json:"maxFiles"` // rotated files to keep as path.1 ... path.N; 0 for 5
+	Exclude  []string `json:"exclude"`  // path.Match patterns on a path or an ancestor that are not recorded
+}
+
+// AuditRecord is one mutating operation
+type AuditRecord struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"` // mkdir, rmdir, create, unlink, rename, write, truncate, chmod, chown, utimens or link
+	Path    string    `json:"path"`
+	NewPath string    `json:"newPath,omitempty"` // rename target
+	Size    int64     `json:"size,omitempty"`    // bytes written, or the size truncated to
+	Result  int       `json:"result"`            // 0 or a negative errno
+	Source  string    `json:"source"`            // fuse or rest
+	UID     uint32    `json:"uid,omitempty"`     // calling process, for fuse
+	GID     uint32    `json:"gid,omitempty"`
+	PID     int       `json:"pid,omitempty"`
+	Client  string    `json:"client,omitempty"` // client address, for rest
+	User    string    `json:"user,omitempty"`   // authenticated caller, for rest when auth is on
+}
+
+// AuditQuery selects audit records; zero fields match everything
+type AuditQuery struct {
+	Prefix string
+	Op     string
+	Source string
+	Client string
+	User   string
+	UID    *uint32
+	Since  time.Time
+	Until  time.Time
+	Failed bool // only records with a negative result
+	Limit  int  // most recent matches to return; 0 for 1000
+}
+
+// matches reports whether rec is selected by q
+func (q *AuditQuery) matches(rec *AuditRecord) bool {
+	switch {
+	case q.Prefix != "" && !pathUnder(rec.Path, q.Prefix) && (rec.NewPath == "" || !pathUnder(rec.NewPath, q.Prefix)):
+		return false
+	case q.Op != "" && rec.Op != q.Op,
+		q.Source != "" && rec.Source != q.Source,
+		q.Client != "" && rec.Client != q.Client,
+		q.User != "" && rec.User != q.User,
+		q.UID != nil && (rec.Source != AuditFUSE || rec.UID != *q.UID),
+		!q.Since.IsZero() && rec.Time.Before(q.Since),
+		!q.Until.IsZero() && rec.Time.After(q.Until),
+		q.Failed && rec.Result >= 0:
+		return false
+	}
+	return true
+}
+
+// AuditStatus describes the audit log
+type AuditStatus struct {
+	Path     string   `json:"path"`
+	Size     int64    `json:"size"` // bytes in the current file
+	MaxBytes int64    `json:"maxBytes"`
+	MaxFiles int      `json:"maxFiles"`
+	Exclude  []string `json:"exclude"`
+	Records  int64    `json:"records"` // recorded since the log was opened
+	Error    string   `json:"error,omitempty"`
+}
+
+// AuditLog appends a JSON line per operation to a file, rotating it to
+// path.1 ... path.N as it fills. Records are written before the call that
+// made them returns, so a crash loses at most the line being written.
+type AuditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	exclude  []string
+	file     *os.File
+	size     int64
+	records  int64
+	err      error
+}
+
+// validPatterns reports whether every pattern is a valid path.Match pattern
+func validPatterns(patterns []string) bool {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// OpenAuditLog opens the audit log, appending to opts.Path
+func OpenAuditLog(opts AuditOptions) (*AuditLog, error) {
+	if opts.Path == "" || opts.MaxBytes < 0 || opts.MaxFiles < 0 || !validPatterns(opts.Exclude) {
+		return nil, errBadAuditOptions
+	}
+	l := &AuditLog{
+		path:     opts.Path,
+		maxBytes: opts.MaxBytes,
+		maxFiles: opts.MaxFiles,
+		exclude:  append([]string(nil), opts.Exclude...),
+	}
+	if l.maxBytes == 0 {
+		l.maxBytes = defaultAuditBytes
+	}
+	if l.maxFiles == 0 {
+		l.maxFiles = defaultAuditFiles
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the current file for appending; the caller holds l.mu or owns
+// l exclusively
+func (l *AuditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, fi.Size()
+	return nil
+}
+
+// rotated returns the name of the nth rotated file
+func (l *AuditLog) rotated(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// rotate shifts path to path.1, path.1 to path.2 and so on, dropping the
+// oldest, and starts a new file; the caller holds l.mu
+func (l *AuditLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	os.Remove(l.rotated(l.maxFiles))
+	for n := l.maxFiles - 1; n >= 1; n-- {
+		os.Rename(l.rotated(n), l.rotated(n+1))
+	}
+	if err := os.Rename(l.path, l.rotated(1)); err != nil && !os.IsNotExist(err) {
+		// Keep appending to the file we have rather than lose records
+		if oerr := l.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	return l.open()
+}
+
+// Excluded reports whether p has been opted out of the audit log
+func (l *AuditLog) Excluded(p string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.excluded(p)
+}
+
+// excluded is Excluded for a caller holding l.mu
+func (l *AuditLog) excluded(p string) bool {
+	for _, pattern := range l.exclude {
+		if matchPath(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetExclude replaces the patterns of paths that are not recorded
+func (l *AuditLog) SetExclude(patterns []string) error {
+	if !validPatterns(patterns) {
+		return errBadAuditOptions
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.exclude = append([]string(nil), patterns...)
+	return nil
+}
+
+// Record appends rec to the log unless its paths are excluded. A rename is
+// recorded if either name is not excluded.
+func (l *AuditLog) Record(rec AuditRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil || l.excluded(rec.Path) && (rec.NewPath == "" || l.excluded(rec.NewPath)) {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	data, _ := json.Marshal(&rec)
+	data = append(data, '\n')
+
+	if l.size > 0 && l.size+int64(len(data)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			l.err = err
+			if l.file == nil {
+				return
+			}
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		l.err = err
+		return
+	}
+	l.records++
+}
+
+// Close closes the log file
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Status describes the audit log
+func (l *AuditLog) Status() AuditStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := AuditStatus{
+		Path:     l.path,
+		Size:     l.size,
+		MaxBytes: l.maxBytes,
+		MaxFiles: l.maxFiles,
+		Exclude:  append([]string{}, l.exclude...),
+		Records:  l.records,
+	}
+	if l.err != nil {
+		s.Error = l.err.Error()
+	}
+	return s
+}
+
+// Query returns the most recent records matching q, oldest first. The files
+// are opened under the lock so a rotation can't move them mid-query, then
+// read without it so recording carries on.
+func (l *AuditLog) Query(q AuditQuery) ([]AuditRecord, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultAuditLimit
+	}
+	q.Limit = min(q.Limit, maxAuditQueryLimit)
+
+	l.mu.Lock()
+	var files []io.Reader
+	for n := l.maxFiles; n >= 1; n-- {
+		f, err := os.Open(l.rotated(n))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		l.mu.Unlock()
+		return nil, err
+	}
+	defer f.Close()
+	// Stop at the records written so far, not one being appended
+	files = append(files, io.LimitReader(f, l.size))
+	l.mu.Unlock()
+
+	// Keep the last Limit matches in a ring
+	ring := make([]AuditRecord, 0, min(q.Limit, 256))
+	next := 0
+	sc := bufio.NewScanner(io.MultiReader(files...))
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		var rec AuditRecord
+		if json.Unmarshal(sc.Bytes(), &rec) != nil || !q.matches(&rec) {
+			continue
+		}
+		if len(ring) < q.Limit {
+			ring = append(ring, rec)
+			continue
+		}
+		ring[next] = rec
+		next = (next + 1) % q.Limit
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return append(ring[next:], ring[:next]...), nil
+}
+
+// ============ MemFS ============
+
+// EnableAudit starts recording mutating operations in an audit log
+func (fs *MemFS) EnableAudit(opts AuditOptions) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.audit != nil {
+		return -fuse.EEXIST
+	}
+	l, err := OpenAuditLog(opts)
+	if err == errBadAuditOptions {
+		return -fuse.EINVAL
+	}
+	if err != nil {
+		return -fuse.EIO
+	}
+	fs.audit = l
+	return 0
+}
+
+// DisableAudit stops recording and closes the audit log
+func (fs *MemFS) DisableAudit() int {
+	fs.lock.Lock()
+	l := fs.audit
+	fs.audit = nil
+	fs.lock.Unlock()
+
+	if l == nil {
+		return -fuse.EINVAL
+	}
+	if l.Close() != nil {
+		return -fuse.EIO
+	}
+	return 0
+}
+
+// Audit returns the audit log, or nil if it is not enabled
+func (fs *MemFS) Audit() *AuditLog {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.audit
+}
+
+// ============ FUSE ============
+
+// pendingWrite adds up the writes to a file until it is closed
+type pendingWrite struct {
+	bytes    int64
+	uid, gid uint32
+	pid      int
+}
+
+// auditFS is what the FUSE host mounts. It records the mutating calls the
+// kernel makes, with the calling process, then passes them to MemFS. The
+// REST API calls MemFS directly and records its own calls with the client
+// address. The many writes between an open and a close are recorded as one
+// when the file is flushed.
+type auditFS struct {
+	*MemFS
+	context func() (uid, gid uint32, pid int) // valid only on FUSE threads
+
+	mu      sync.Mutex
+	pending map[string]*pendingWrite
+}
+
+// newAuditFS wraps fs for mounting
+func newAuditFS(fs *MemFS) *auditFS {
+	return &auditFS{MemFS: fs, context: fuse.Getcontext, pending: make(map[string]*pendingWrite)}
+}
+
+// record logs a call made by the kernel if auditing is on
+func (a *auditFS) record(rec AuditRecord) {
+	l := a.Audit()
+	if l == nil {
+		return
+	}
+	rec.Source = AuditFUSE
+	rec.UID, rec.GID, rec.PID = a.context()
+	l.Record(rec)
+}
+
+// flushWrites records the writes to path since it was last flushed, with
+// the result of committing them
+func (a *auditFS) flushWrites(path string, result int) {
+	a.mu.Lock()
+	p := a.pending[path]
+	delete(a.pending, path)
+	a.mu.Unlock()
+
+	if p == nil {
+		return
+	}
+	if l := a.Audit(); l != nil {
+		l.Record(AuditRecord{Op: "write", Path: path, Size: p.bytes, Result: result, Source: AuditFUSE, UID: p.uid, GID: p.gid, PID: p.pid})
+	}
+}
+
+func (a *auditFS) Mkdir(path string, mode uint32) int {
+	errc := a.MemFS.Mkdir(path, mode)
+	a.record(AuditRecord{Op: "mkdir", Path: path, Result: errc})
+	return errc
+}
+
+func (a *auditFS) Rmdir(path string) int {
+	errc := a.MemFS.Rmdir(path)
+	a.record(AuditRecord{Op: "rmdir", Path: path, Result: errc})
+	return errc
+}
+
+func (a *auditFS) Mknod(path string, mode uint32, dev uint64) int {
+	errc := a.MemFS.Mknod(path, mode, dev)
+	a.record(AuditRecord{Op: "create", Path: path, Result: errc})
+	return errc
+}
+
+func (a *auditFS) Create(path string, flags int, mode uint32) (int, uint64) {
+	errc, fh := a.MemFS.Create(path, flags, mode)
+	a.record(AuditRecord{Op: "create", Path: path, Result: errc})
+	return errc, fh
+}
+
+func (a *auditFS) Unlink(path string) int {
+	a.flushWrites(path, 0)
+	errc := a.MemFS.Unlink(path)
+	a.record(AuditRecord{Op: "unlink", Path: path, Result: errc})
+	return errc
+}
+
+func (a *auditFS) Rename(oldpath string, newpath string) int {
+	errc := a.MemFS.Rename(oldpath, newpath)
+	if errc == 0 {
+		// An open file keeps its pending writes under its new name
+		a.mu.Lock()
+		if p := a.pending[oldpath]; p != nil {
+			delete(a.pending, oldpath)
+			a.pending[newpath] = p
+		}
+		a.mu.Unlock()
+	}
+	a.record(AuditRecord{Op: "rename", Path: oldpath, NewPath: newpath, Result: errc})
+	return errc
+}
+
+func (a *auditFS) Write(path string, buff []byte, ofst int64, fh uint64) int {
+	n := a.MemFS.Write(path, buff, ofst, fh)
+	if a.Audit() == nil {
+		return n
+	}
+	if n < 0 {
+		a.record(AuditRecord{Op: "write", Path: path, Result: n})
+		return n
+	}
+
+	a.mu.Lock()
+	p := a.pending[path]
+	if p == nil {
+		p = &pendingWrite{}
+		p.uid, p.gid, p.pid = a.context()
+		a.pending[path] = p
+	}
+	p.bytes += int64(n)
+	a.mu.Unlock()
+	return n
+}
+
+func (a *auditFS) Truncate(path string, size int64, fh uint64) int {
+	errc := a.MemFS.Truncate(path, size, fh)
+	a.record(AuditRecord{Op: "truncate", Path: path, Size: size, Result: errc})
+	return errc
+}
+
+func (a *auditFS) Chmod(path string, mode uint32) int {
+	errc := a.MemFS.Chmod(path, mode)
+	a.record(AuditRecord{Op: "chmod", Path: path, Result: errc})
+	return errc
+}
+
+func (a *auditFS) Chown(path string, uid uint32, gid uint32) int {
+	errc := a.MemFS.Chown(path, uid, gid)
+	a.record(AuditRecord{Op: "chown", Path: path, Result: errc})
+	return errc
+}
+
+func (a *auditFS) Utimens(path string, tmsp []fuse.Timespec) int {
+	errc := a.MemFS.Utimens(path, tmsp)
+	a.record(AuditRecord{Op: "utimens", Path: path, Result: errc})
+	return errc
+}
+
+func (a *auditFS) Flush(path string, fh uint64) int {
+	errc := a.MemFS.Flush(path, fh)
+	a.flushWrites(path, errc)
+	return errc
+}
+
+func (a *auditFS) Release(path string, fh uint64) int {
+	errc := a.MemFS.Release(path, fh)
+	a.flushWrites(path, errc)
+	return errc
+}
+
+// Destroy is called once the filesystem is unmounted. Files still open then
+// will never be released, so their writes are committed and recorded now.
+func (a *auditFS) Destroy() {
+	a.mu.Lock()
+	paths := make([]string, 0, len(a.pending))
+	for path := range a.pending {
+		paths = append(paths, path)
+	}
+	a.mu.Unlock()
+
+	for _, path := range paths {
+		a.flushWrites(path, a.MemFS.flush(path))
+	}
+}
@@ -0,0 +1,174 @@
+package gobox
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// TestAuditLog tests recording, rotation, filters and opt-outs
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if _, err := OpenAuditLog(AuditOptions{Path: path, Exclude: []string{"["}}); err != errBadAuditOptions {
+		t.Errorf("bad pattern = %v", err)
+	}
+
+	l, err := OpenAuditLog(AuditOptions{Path: path, MaxBytes: 1000, MaxFiles: 2, Exclude: []string{"/tmp", "/docs/*.swp"}})
+	if err != nil {
+		t.Fatalf("OpenAuditLog: %v", err)
+	}
+	defer l.Close()
+
+	l.Record(AuditRecord{Op: "mkdir", Path: "/docs", Source: AuditFUSE, UID: 1000, PID: 42})
+	l.Record(AuditRecord{Op: "create", Path: "/docs/a", Source: AuditREST, Client: "10.0.0.1"})
+	l.Record(AuditRecord{Op: "unlink", Path: "/docs/b", Result: -fuse.ENOENT, Source: AuditREST, Client: "10.0.0.2"})
+	l.Record(AuditRecord{Op: "write", Path: "/tmp/x", Source: AuditFUSE})                      // excluded
+	l.Record(AuditRecord{Op: "write", Path: "/docs/.a.swp", Source: AuditFUSE})                // excluded
+	l.Record(AuditRecord{Op: "rename", Path: "/tmp/y", NewPath: "/docs/y", Source: AuditFUSE}) // kept, /docs/y isn't excluded
+
+	query := func(q AuditQuery) []AuditRecord {
+		t.Helper()
+		recs, err := l.Query(q)
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		return recs
+	}
+	if recs := query(AuditQuery{}); len(recs) != 4 || recs[0].Op != "mkdir" || recs[3].Op != "rename" {
+		t.Fatalf("all records = %+v", recs)
+	}
+	uid := uint32(1000)
+	if recs := query(AuditQuery{UID: &uid}); len(recs) != 1 || recs[0].PID != 42 {
+		t.Errorf("by uid = %+v", recs)
+	}
+	if recs := query(AuditQuery{Failed: true}); len(recs) != 1 || recs[0].Path != "/docs/b" {
+		t.Errorf("failed = %+v", recs)
+	}
+	if recs := query(AuditQuery{Source: AuditREST, Client: "10.0.0.1"}); len(recs) != 1 || recs[0].Op != "create" {
+		t.Errorf("by client = %+v", recs)
+	}
+	if recs := query(AuditQuery{Prefix: "/docs", Limit: 2}); len(recs) != 2 || recs[1].Op != "rename" {
+		t.Errorf("latest two under /docs = %+v", recs)
+	}
+
+	// Opting a path out takes effect at once
+	l.SetExclude(nil)
+	l.Record(AuditRecord{Op: "write", Path: "/tmp/x", Source: AuditFUSE})
+	if recs := query(AuditQuery{Prefix: "/tmp"}); len(recs) != 2 {
+		t.Errorf("after clearing exclusions = %+v", recs)
+	}
+
+	// The file rotates once full, keeping MaxFiles old ones
+	for i := 0; i < 50; i++ {
+		l.Record(AuditRecord{Op: "chmod", Path: "/docs/a", Source: AuditFUSE})
+	}
+	if _, err := os.Stat(path + ".2"); err != nil {
+		t.Errorf("second rotated file: %v", err)
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("kept more than MaxFiles rotated files")
+	}
+	if st := l.Status(); st.Size > 1000 || st.Records != 55 || st.Error != "" {
+		t.Errorf("status = %+v", st)
+	}
+	recs := query(AuditQuery{})
+	if len(recs) == 0 || len(recs) >= 55 || recs[len(recs)-1].Op != "chmod" {
+		t.Errorf("records after rotation = %d", len(recs))
+	}
+}
+
+// TestAuditFUSE tests that kernel calls are recorded with the calling
+// process and that writes are recorded once per close
+func TestAuditFUSE(t *testing.T) {
+	fs := newTestFS()
+	a := newAuditFS(fs)
+	a.context = func() (uint32, uint32, int) { return 1000, 100, 4242 }
+
+	a.Mkdir("/off", 0755) // not recorded before auditing is on
+	assertSuccess(t, fs.EnableAudit(AuditOptions{Path: filepath.Join(t.TempDir(), "audit.log")}), "EnableAudit")
+	defer fs.DisableAudit()
+	assertError(t, fs.EnableAudit(AuditOptions{}), -fuse.EEXIST, "EnableAudit twice")
+
+	errc, fh := a.Create("/f", os.O_RDWR, 0644)
+	assertSuccess(t, errc, "Create")
+	a.Write("/f", []byte("hello "), 0, fh)
+	a.Write("/f", []byte("world"), 6, fh)
+	a.Rename("/f", "/g")
+	a.Flush("/g", fh)
+	a.Release("/g", fh)
+	a.Rmdir("/missing")
+
+	recs, _ := fs.Audit().Query(AuditQuery{})
+	ops := make([]string, len(recs))
+	for i, rec := range recs {
+		ops[i] = rec.Op
+	}
+	if got := strings.Join(ops, " "); got != "create rename write rmdir" {
+		t.Fatalf("ops = %s", got)
+	}
+	if w := recs[2]; w.Path != "/g" || w.Size != 11 || w.Source != AuditFUSE || w.UID != 1000 || w.GID != 100 || w.PID != 4242 {
+		t.Errorf("write = %+v", w)
+	}
+	if recs[3].Result != -fuse.ENOENT {
+		t.Errorf("failed rmdir = %+v", recs[3])
+	}
+
+	// Writes to files still open at unmount are recorded then
+	a.Write("/g", []byte("!"), 11, fh)
+	a.Destroy()
+	recs, _ = fs.Audit().Query(AuditQuery{Op: "write"})
+	if len(recs) != 2 || recs[1].Size != 1 {
+		t.Errorf("writes after Destroy = %+v", recs)
+	}
+}
+
+// TestAuditREST tests that API calls are recorded with the client address
+// and the query endpoint's filters
+func TestAuditREST(t *testing.T) {
+	fs := newTestFS()
+	s := NewAPIServer(fs)
+	assertSuccess(t, fs.EnableAudit(AuditOptions{Path: filepath.Join(t.TempDir(), "audit.log")}), "EnableAudit")
+	defer fs.DisableAudit()
+
+	call := func(h http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.7:5000"
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+	call(s.handleMkdir, http.MethodPost, "/api/mkdir", `{"path":"/docs","mode":493}`)
+	call(s.handleFileWrite, http.MethodPost, "/api/files/write?path=/docs/a", "abc")
+	call(s.handleAuditExclude, http.MethodPost, "/api/audit/exclude", `{"exclude":["/docs/private"]}`)
+	call(s.handleMkdir, http.MethodPost, "/api/mkdir", `{"path":"/docs/private","mode":493}`)
+	call(s.handleUnlink, http.MethodDelete, "/api/unlink?path=/nope", "")
+
+	var resp struct {
+		Data []AuditRecord `json:"data"`
+	}
+	w := call(s.handleAuditLog, http.MethodGet, "/api/audit/log?source=rest&prefix=/docs", "")
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Data) != 3 {
+		t.Fatalf("records under /docs = %+v", resp.Data)
+	}
+	if rec := resp.Data[2]; rec.Op != "write" || rec.Size != 3 || rec.Client != "192.0.2.7" {
+		t.Errorf("write = %+v", rec)
+	}
+
+	resp.Data = nil
+	w = call(s.handleAuditLog, http.MethodGet, "/api/audit/log?failed=true", "")
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Data) != 1 || resp.Data[0].Op != "unlink" || resp.Data[0].Result != -fuse.ENOENT {
+		t.Errorf("failed = %+v", resp.Data)
+	}
+
+	if w = call(s.handleAuditLog, http.MethodGet, "/api/audit/log?since=yesterday", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("bad since = %d", w.Code)
+	}
+}
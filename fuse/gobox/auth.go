@@ -0,0 +1,492 @@
+package gobox
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+const (
+	hmacScheme    = "GOBOX-HMAC-SHA256"
+	hmacMaxSkew   = 5 * time.Minute // how far a signed request's timestamp may be from now
+	minSecretLen  = 16              // bytes in a bearer token or HMAC key
+	maxScopedBody = 1 << 20         // bytes of a JSON body read to find the paths it names
+	maxSignedBody = 16 << 20        // bytes of body an HMAC-signed request may carry
+)
+
+var (
+	errBadToken     = errors.New("unknown bearer token")
+	errBadSignature = errors.New("bad request signature")
+	errBadCert      = errors.New("unknown client certificate")
+	errBodyTooLarge = errors.New("body too large to sign")
+)
+
+// Access is what a credential may do through the API. Each level includes
+// the ones before it.
+type Access string
+
+const (
+	AccessRead  Access = "read"  // GET endpoints and opendir
+	AccessWrite Access = "write" // also changing files and directories
+	AccessAdmin Access = "admin" // also linking, caches, mirrors, tiering, faults, throttles, watches, the journal, the audit log and capacity
+)
+
+func (a Access) level() int {
+	switch a {
+	case AccessRead:
+		return 1
+	case AccessWrite:
+		return 2
+	case AccessAdmin:
+		return 3
+	}
+	return 0
+}
+
+// allows reports whether a covers need
+func (a Access) allows(need Access) bool {
+	return a.level() >= need.level()
+}
+
+// Scope limits what a credential may do
+type Scope struct {
+	Access Access   `yaml:"access" json:"access"`
+	Paths  []string `yaml:"paths" json:"paths,omitempty"` // prefixes of the paths it may touch; none for the whole tree
+}
+
+// covers reports whether every path is within the scope's prefixes. A
+// scope limited to prefixes covers nothing when no path is named, so it
+// can't reach endpoints that act on the whole tree.
+func (s Scope) covers(paths []string) bool {
+	if len(s.Paths) == 0 {
+		return true
+	}
+	if len(paths) == 0 {
+		return false
+	}
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") || path.Clean(p) != p {
+			return false // "/docs/../etc" must not pass for "/docs"
+		}
+		ok := false
+		for _, prefix := range s.Paths {
+			if pathUnder(p, prefix) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// redact blanks the paths of ev outside the scope's prefixes, such as the
+// far side of a rename into or out of them, so events only name paths the
+// caller may touch
+func (s Scope) redact(ev Event) Event {
+	if !s.covers([]string{ev.Path}) {
+		ev.Path = ""
+	}
+	if ev.OldPath != "" && !s.covers([]string{ev.OldPath}) {
+		ev.OldPath = ""
+	}
+	return ev
+}
+
+// Credential is a caller the API accepts
+type Credential struct {
+	Name   string `yaml:"name"`   // who it is, in logs and the audit log; also the HMAC key ID, or the client certificate's common name
+	Secret string `yaml:"secret"` // bearer token or HMAC key; unused for client certificates
+	Scope  `yaml:",inline"`
+}
+
+// AuthConfig lists the credentials the API accepts. With none, anyone who
+// can reach the API may do anything.
+type AuthConfig struct {
+	Tokens      []Credential `yaml:"tokens"`      // sent as "Authorization: Bearer <secret>"
+	HMACKeys    []Credential `yaml:"hmacKeys"`    // sign each request with the secret
+	ClientCerts []Credential `yaml:"clientCerts"` // TLS client certificates the server has verified
+}
+
+// Enabled reports whether any credentials are configured
+func (c *AuthConfig) Enabled() bool {
+	return len(c.Tokens)+len(c.HMACKeys)+len(c.ClientCerts) > 0
+}
+
+// validate reports problems with the credentials through fail
+func (c *AuthConfig) validate(fail func(format string, args ...any)) {
+	for _, kind := range []struct {
+		key    string
+		creds  []Credential
+		secret bool
+	}{
+		{"auth.tokens", c.Tokens, true},
+		{"auth.hmacKeys", c.HMACKeys, true},
+		{"auth.clientCerts", c.ClientCerts, false},
+	} {
+		names := make(map[string]bool)
+		for i, cred := range kind.creds {
+			switch {
+			case cred.Name == "":
+				fail("%s[%d].name: required", kind.key, i)
+			case names[cred.Name]:
+				fail("%s[%d].name: %q is used twice", kind.key, i, cred.Name)
+			}
+			names[cred.Name] = true
+			if kind.secret && len(cred.Secret) < minSecretLen {
+				fail("%s[%d].secret: must be at least %d characters", kind.key, i, minSecretLen)
+			}
+			if cred.Access.level() == 0 {
+				fail("%s[%d].access: %q is not read, write or admin", kind.key, i, cred.Access)
+			}
+			for _, p := range cred.Paths {
+				if !strings.HasPrefix(p, "/") || path.Clean(p) != p {
+					fail("%s[%d].paths: %q must be an absolute, clean path", kind.key, i, p)
+				}
+			}
+		}
+	}
+}
+
+// Authenticators returns an Authenticator for each kind of credential
+// configured
+func (c *AuthConfig) Authenticators() []Authenticator {
+	var auths []Authenticator
+	if len(c.Tokens) > 0 {
+		auths = append(auths, NewTokenAuth(c.Tokens))
+	}
+	if len(c.HMACKeys) > 0 {
+		auths = append(auths, NewHMACAuth(c.HMACKeys))
+	}
+	if len(c.ClientCerts) > 0 {
+		auths = append(auths, NewCertAuth(c.ClientCerts))
+	}
+	return auths
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Name string
+	Scope
+}
+
+// Authenticator identifies the caller of an API request. It returns nil
+// and no error when the request carries no credentials of its kind, so the
+// next one can try, and an error when they are wrong.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// ============ Bearer tokens ============
+
+// TokenAuth accepts static bearer tokens
+type TokenAuth struct {
+	byHash map[[sha256.Size]byte]*Principal
+}
+
+// NewTokenAuth accepts the given tokens
+func NewTokenAuth(creds []Credential) *TokenAuth {
+	a := &TokenAuth{byHash: make(map[[sha256.Size]byte]*Principal)}
+	for _, c := range creds {
+		// Looking up a hash keeps the comparison's timing from telling
+		// how much of a guess was right
+		a.byHash[sha256.Sum256([]byte(c.Secret))] = &Principal{Name: c.Name, Scope: c.Scope}
+	}
+	return a
+}
+
+// Authenticate checks an "Authorization: Bearer" header
+func (a *TokenAuth) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+	if p := a.byHash[sha256.Sum256([]byte(token))]; p != nil {
+		return p, nil
+	}
+	return nil, errBadToken
+}
+
+// ============ HMAC-signed requests ============
+
+// HMACAuth accepts requests signed with a shared key. The client sends
+//
+//	Authorization: GOBOX-HMAC-SHA256 Credential=<name>, Timestamp=<unix seconds>, Signature=<hex>
+//
+// where the signature is the HMAC-SHA256, under the key's secret, of the
+// method, request URI, timestamp and hex SHA-256 of the body, each followed
+// by a newline except the last. Timestamps more than five minutes off are
+// refused, so a captured request can't be replayed later.
+type HMACAuth struct {
+	keys map[string]*hmacKey
+	now  func() time.Time
+}
+
+type hmacKey struct {
+	secret []byte
+	p      *Principal
+}
+
+// NewHMACAuth accepts requests signed with the given keys
+func NewHMACAuth(creds []Credential) *HMACAuth {
+	a := &HMACAuth{keys: make(map[string]*hmacKey), now: time.Now}
+	for _, c := range creds {
+		a.keys[c.Name] = &hmacKey{secret: []byte(c.Secret), p: &Principal{Name: c.Name, Scope: c.Scope}}
+	}
+	return a
+}
+
+// SignRequest signs r for HMACAuth with the named key, reading the body and
+// putting it back. Bodies over 16 MiB can't be signed; send large files in
+// chunks.
+func SignRequest(r *http.Request, name, secret string, now time.Time) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	sig := hmacSignature([]byte(secret), r.Method, r.URL.RequestURI(), ts, body)
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, Timestamp=%s, Signature=%s", hmacScheme, name, ts, sig))
+	return nil
+}
+
+func hmacSignature(secret []byte, method, uri, ts string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", method, uri, ts, hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticate checks a GOBOX-HMAC-SHA256 Authorization header. The body is
+// read to check it against the signature and put back for the handler.
+func (a *HMACAuth) Authenticate(r *http.Request) (*Principal, error) {
+	params, ok := strings.CutPrefix(r.Header.Get("Authorization"), hmacScheme+" ")
+	if !ok {
+		return nil, nil
+	}
+	fields := make(map[string]string)
+	for _, kv := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		fields[k] = v
+	}
+	key := a.keys[fields["Credential"]]
+	if key == nil {
+		return nil, errBadSignature
+	}
+	ts, err := strconv.ParseInt(fields["Timestamp"], 10, 64)
+	if err != nil {
+		return nil, errBadSignature
+	}
+	if skew := a.now().Sub(time.Unix(ts, 0)); skew > hmacMaxSkew || skew < -hmacMaxSkew {
+		return nil, errBadSignature
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	want := hmacSignature(key.secret, r.Method, r.URL.RequestURI(), fields["Timestamp"], body)
+	if !hmac.Equal([]byte(want), []byte(fields["Signature"])) {
+		return nil, errBadSignature
+	}
+	return key.p, nil
+}
+
+// readBody reads r's body and replaces it with a copy. It stops after
+// maxSignedBody bytes, since the signature has yet to be checked and
+// anyone can send a body.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	r.Body.Close()
+	if err == nil && len(body) > maxSignedBody {
+		return nil, errBodyTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// ============ TLS client certificates ============
+
+// CertAuth accepts TLS client certificates, by common name. It relies on
+// the TLS server to verify them against the trusted CAs.
+type CertAuth struct {
+	byName map[string]*Principal
+}
+
+// NewCertAuth accepts certificates with the given common names
+func NewCertAuth(creds []Credential) *CertAuth {
+	a := &CertAuth{byName: make(map[string]*Principal)}
+	for _, c := range creds {
+		a.byName[c.Name] = &Principal{Name: c.Name, Scope: c.Scope}
+	}
+	return a
+}
+
+// Authenticate checks the verified client certificate, if any
+func (a *CertAuth) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	if p := a.byName[r.TLS.VerifiedChains[0][0].Subject.CommonName]; p != nil {
+		return p, nil
+	}
+	return nil, errBadCert
+}
+
+// ============ Middleware ============
+
+type (
+	principalKey struct{}
+	peerKey      struct{}
+)
+
+// principal returns the caller authenticated for r, or nil if the API is
+// open
+func principal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+// scopeOf returns what the caller of r may touch; the whole tree if the API
+// is open
+func scopeOf(r *http.Request) Scope {
+	if p := principal(r); p != nil {
+		return p.Scope
+	}
+	return Scope{}
+}
+
+// withPeer serves h with p as the caller of requests that bring no
+// credentials, for listeners that control access some other way, such as
+// by socket file permissions
+func withPeer(h http.Handler, p *Principal) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerKey{}, p)))
+	})
+}
+
+// SetAuth makes the API require one of the given authenticators to accept
+// each request. With none, the API is open to anyone who can reach it.
+// It may be called while serving, such as to rotate tokens.
+func (s *APIServer) SetAuth(auths ...Authenticator) {
+	s.authMu.Lock()
+	s.auths = auths
+	s.authMu.Unlock()
+}
+
+// authorize lets requests through to h only from callers allowed need.
+// On endpoints needing write, GET and HEAD requests only need read.
+// jsonBody says whether the endpoint's body is JSON that may name paths,
+// rather than file content.
+func (s *APIServer) authorize(need Access, jsonBody bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.authMu.RLock()
+		auths := s.auths
+		s.authMu.RUnlock()
+		if len(auths) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var p *Principal
+		var err error
+		for _, a := range auths {
+			if p, err = a.Authenticate(r); err != nil {
+				slog.Debug("API authentication failed", "client", clientID(r), "err", err)
+				p = nil
+				break
+			}
+			if p != nil {
+				break
+			}
+		}
+		if p == nil && err == nil {
+			p, _ = r.Context().Value(peerKey{}).(*Principal)
+		}
+		if errors.Is(err, errBodyTooLarge) {
+			writeJSON(w, http.StatusRequestEntityTooLarge, Response{Error: -fuse.EFBIG})
+			return
+		}
+		if p == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gobox"`)
+			writeJSON(w, http.StatusUnauthorized, Response{Error: -fuse.EACCES})
+			return
+		}
+
+		want := need
+		if want == AccessWrite && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			want = AccessRead
+		}
+		allowed := p.Access.allows(want)
+		if allowed && len(p.Paths) > 0 {
+			paths, ok := requestPaths(r, jsonBody)
+			allowed = ok && p.covers(paths)
+		}
+		if !allowed {
+			slog.Debug("API request forbidden", "user", p.Name, "path", r.URL.Path)
+			writeJSON(w, http.StatusForbidden, Response{Error: -fuse.EACCES})
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// requestPaths returns the filesystem paths a request names: its path and
+// prefix query parameters and, on endpoints taking JSON, the path fields
+// of its body, decoded as the handlers decode them. It reports false when
+// the body can't be read or is too large to check, so such requests are
+// refused rather than let through unchecked.
+func requestPaths(r *http.Request, jsonBody bool) ([]string, bool) {
+	var paths []string
+	q := r.URL.Query()
+	for _, key := range []string{"path", "prefix"} {
+		if q.Has(key) {
+			paths = append(paths, q.Get(key))
+		}
+	}
+	if !jsonBody || r.Body == nil {
+		return paths, true
+	}
+
+	head, err := io.ReadAll(io.LimitReader(r.Body, maxScopedBody+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if err != nil || len(head) > maxScopedBody {
+		return nil, false
+	}
+	var body struct {
+		Path    *string `json:"path"`
+		OldPath *string `json:"oldPath"`
+		NewPath *string `json:"newPath"`
+		Prefix  *string `json:"prefix"`
+	}
+	// Bodies that aren't JSON set nothing here and fail in the handler too;
+	// fields of the wrong type elsewhere still leave these set
+	json.NewDecoder(bytes.NewReader(head)).Decode(&body)
+	for _, p := range []*string{body.Path, body.OldPath, body.NewPath, body.Prefix} {
+		if p != nil {
+			paths = append(paths, *p)
+		}
+	}
+	return paths, true
+}
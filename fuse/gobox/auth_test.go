@@ -0,0 +1,265 @@
+package gobox
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// TestAuthScopes tests bearer tokens and the access levels and path
+// prefixes they are limited to
+func TestAuthScopes(t *testing.T) {
+	fs := newTestFS()
+	s := NewAPIServer(fs)
+	s.RegisterRoutes()
+	s.SetAuth(NewTokenAuth([]Credential{
+		{Name: "reader", Secret: "reader-0123456789", Scope: Scope{Access: AccessRead}},
+		{Name: "writer", Secret: "writer-0123456789", Scope: Scope{Access: AccessWrite, Paths: []string{"/scratch"}}},
+		{Name: "root", Secret: "root-0123456789ab", Scope: Scope{Access: AccessAdmin}},
+	}))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	assertSuccess(t, fs.EnableAudit(AuditOptions{Path: filepath.Join(t.TempDir(), "audit.log")}), "EnableAudit")
+	defer fs.DisableAudit()
+
+	call := func(token, method, target, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := call("", "GET", "/api/getattr?path=/", ""); resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("no token = %d", resp.StatusCode)
+	}
+	for _, c := range []struct {
+		token, method, target, body string
+		code                        int
+	}{
+		{"wrong-0123456789", "GET", "/api/getattr?path=/", "", http.StatusUnauthorized},
+		{"reader-0123456789", "GET", "/api/getattr?path=/", "", http.StatusOK},
+		{"reader-0123456789", "GET", "/metrics", "", http.StatusOK},
+		{"reader-0123456789", "POST", "/api/mkdir", `{"path":"/r","mode":493}`, http.StatusForbidden},
+		{"reader-0123456789", "GET", "/api/cache/stats?path=/", "", http.StatusForbidden},
+		{"writer-0123456789", "POST", "/api/mkdir", `{"path":"/scratch","mode":493}`, http.StatusOK},
+		{"writer-0123456789", "POST", "/api/files/write?path=/scratch/a", "data", http.StatusOK},
+		{"writer-0123456789", "POST", "/api/mkdir", `{"path":"/other","mode":493}`, http.StatusForbidden},
+		{"writer-0123456789", "POST", "/api/mkdir", `{"path":"/scratch/../other","mode":493}`, http.StatusForbidden},
+		{"writer-0123456789", "POST", "/api/rename", `{"oldPath":"/scratch/a","newPath":"/a"}`, http.StatusForbidden},
+		{"writer-0123456789", "GET", "/api/statfs", "", http.StatusForbidden},
+		{"writer-0123456789", "GET", "/api/events?prefix=/", "", http.StatusForbidden},
+		{"writer-0123456789", "POST", "/api/link/local", `{"path":"/scratch/l","target":"/"}`, http.StatusForbidden},
+		{"root-0123456789ab", "POST", "/api/link/local", `{"path":"/l","target":"` + t.TempDir() + `"}`, http.StatusOK},
+		{"root-0123456789ab", "POST", "/api/mkdir", `{"path":"/secret","mode":493}`, http.StatusOK},
+		// Paths in the body count even when the query names one in scope
+		{"writer-0123456789", "POST", "/api/rename?path=/scratch", `{"oldPath":"/secret","newPath":"/scratch/stolen"}`, http.StatusForbidden},
+		{"writer-0123456789", "POST", "/api/mkdir?prefix=/scratch", `{"path":"/secret/x","mode":493} trailing`, http.StatusForbidden},
+		{"writer-0123456789", "POST", "/api/mkdir", `{"path":"/scratch/big","pad":"` + strings.Repeat("x", maxScopedBody) + `"}`, http.StatusForbidden},
+		// File contents are not read for paths
+		{"writer-0123456789", "POST", "/api/files/write?path=/scratch/b", `{"path":"/secret"}`, http.StatusOK},
+		// A GET on a write endpoint doesn't lower what later requests need
+		{"reader-0123456789", "GET", "/api/rename", "", http.StatusMethodNotAllowed},
+		{"reader-0123456789", "POST", "/api/rename", `{"oldPath":"/secret","newPath":"/moved"}`, http.StatusForbidden},
+	} {
+		if resp := call(c.token, c.method, c.target, c.body); resp.StatusCode != c.code {
+			t.Errorf("%s %s %s as %s = %d, expected %d", c.method, c.target, c.body, c.token, resp.StatusCode, c.code)
+		}
+	}
+
+	assertSuccess(t, fs.Getattr("/secret", &fuse.Stat_t{}, 0), "Getattr /secret")
+
+	recs, _ := fs.Audit().Query(AuditQuery{User: "writer"})
+	if len(recs) != 5 || recs[0].Op != "mkdir" || recs[0].Path != "/scratch" {
+		t.Errorf("audit records for writer = %+v", recs)
+	}
+}
+
+// TestAuthScopedEvents tests events and changes naming no path outside the
+// caller's scope, even when a rename crosses it
+func TestAuthScopedEvents(t *testing.T) {
+	fs := newTestFS()
+	assertSuccess(t, fs.EnableJournal(JournalOptions{}), "EnableJournal")
+	defer fs.DisableJournal()
+	s := NewAPIServer(fs)
+	s.RegisterRoutes()
+	s.SetAuth(NewTokenAuth([]Credential{{Name: "docs", Secret: "docs-0123456789ab", Scope: Scope{Access: AccessRead, Paths: []string{"/docs"}}}}))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	fs.Mkdir("/docs", 0755)
+	fs.Mkdir("/secret", 0755)
+	fs.Create("/secret/plan", os.O_RDWR, 0644)
+	fs.Rename("/secret/plan", "/docs/plan")
+	fs.Rename("/docs/plan", "/secret/moved")
+	settle(t, fs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	get := func(target string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+target, nil)
+		req.Header.Set("Authorization", "Bearer docs-0123456789ab")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s = %v, %v", target, resp, err)
+		}
+		return resp
+	}
+
+	want := []Event{{Type: EventMkdir, Path: "/docs"}, {Type: EventRename, Path: "/docs/plan"}, {Type: EventRename, OldPath: "/docs/plan"}}
+	check := func(what string, got []Event) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("%s = %+v", what, got)
+		}
+		for i, ev := range got {
+			if ev.Type != want[i].Type || ev.Path != want[i].Path || ev.OldPath != want[i].OldPath {
+				t.Errorf("%s[%d] = %+v, expected %+v", what, i, ev, want[i])
+			}
+		}
+	}
+
+	resp := get("/api/changes?prefix=/docs&since=0")
+	var changes struct {
+		Data ChangeSet `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&changes)
+	resp.Body.Close()
+	check("changes", changes.Data.Changes)
+
+	resp = get("/api/events?prefix=/docs&since=0")
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	var events []Event
+	for range want {
+		_, _, data := readSSE(t, r)
+		var ev Event
+		json.Unmarshal([]byte(data), &ev)
+		events = append(events, ev)
+	}
+	check("events", events)
+}
+
+// TestHMACAuth tests signed requests, and that changed, stale or unknown
+// ones are refused
+func TestHMACAuth(t *testing.T) {
+	s := NewAPIServer(newTestFS())
+	s.RegisterRoutes()
+	s.SetAuth(NewHMACAuth([]Credential{{Name: "deploy", Secret: "deploy-secret-0123", Scope: Scope{Access: AccessWrite}}}))
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// send signs one body and sends another, which is usually the same
+	send := func(name, secret string, at time.Time, signed, sent string) int {
+		t.Helper()
+		sig, _ := http.NewRequest("POST", srv.URL+"/api/mkdir", strings.NewReader(signed))
+		if err := SignRequest(sig, name, secret, at); err != nil {
+			t.Fatalf("SignRequest: %v", err)
+		}
+		req, _ := http.NewRequest("POST", srv.URL+"/api/mkdir", strings.NewReader(sent))
+		req.Header.Set("Authorization", sig.Header.Get("Authorization"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	now := time.Now()
+	if code := send("deploy", "deploy-secret-0123", now, `{"path":"/a","mode":493}`, `{"path":"/a","mode":493}`); code != http.StatusOK {
+		t.Errorf("signed = %d", code)
+	}
+	if code := send("deploy", "deploy-secret-0123", now, `{"path":"/b","mode":493}`, `{"path":"/evil","mode":511}`); code != http.StatusUnauthorized {
+		t.Errorf("changed body = %d", code)
+	}
+	if code := send("deploy", "deploy-secret-0123", now.Add(-time.Hour), `{"path":"/c"}`, `{"path":"/c"}`); code != http.StatusUnauthorized {
+		t.Errorf("stale = %d", code)
+	}
+	if code := send("deploy", "wrong-secret-01234", now, `{"path":"/d"}`, `{"path":"/d"}`); code != http.StatusUnauthorized {
+		t.Errorf("wrong secret = %d", code)
+	}
+	if code := send("nobody", "deploy-secret-0123", now, `{"path":"/e"}`, `{"path":"/e"}`); code != http.StatusUnauthorized {
+		t.Errorf("unknown key = %d", code)
+	}
+
+	// Bodies are only read so far before the signature is checked
+	big := strings.Repeat("x", maxSignedBody+1)
+	if code := send("deploy", "deploy-secret-0123", now, "", big); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversize body = %d", code)
+	}
+	req, _ := http.NewRequest("POST", srv.URL+"/api/files/write?path=/big", strings.NewReader(big))
+	if err := SignRequest(req, "deploy", "deploy-secret-0123", now); err != errBodyTooLarge {
+		t.Errorf("signing an oversize body = %v", err)
+	}
+}
+
+// TestCertAuth tests client certificates being matched by common name
+func TestCertAuth(t *testing.T) {
+	a := NewCertAuth([]Credential{{Name: "backup", Scope: Scope{Access: AccessRead}}})
+	verified := func(cn string) *http.Request {
+		r := httptest.NewRequest("GET", "/api/getattr?path=/", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+		return r
+	}
+
+	if p, err := a.Authenticate(verified("backup")); err != nil || p == nil || p.Name != "backup" || p.Access != AccessRead {
+		t.Errorf("known cert = %+v, %v", p, err)
+	}
+	if _, err := a.Authenticate(verified("intruder")); err != errBadCert {
+		t.Errorf("unknown cert = %v", err)
+	}
+	if p, err := a.Authenticate(httptest.NewRequest("GET", "/", nil)); p != nil || err != nil {
+		t.Errorf("no TLS = %+v, %v", p, err)
+	}
+}
+
+// TestAuthConfig tests credentials being checked with the rest of the
+// configuration
+func TestAuthConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Headless = true
+	cfg.Auth = AuthConfig{
+		Tokens: []Credential{
+			{Name: "ci", Secret: "short", Scope: Scope{Access: AccessWrite}},
+			{Name: "ci", Secret: "long-enough-secret", Scope: Scope{Access: "everything"}},
+		},
+		ClientCerts: []Credential{{Name: "backup", Scope: Scope{Access: AccessRead, Paths: []string{"backups"}}}},
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatalf("Validate passed")
+	}
+	for _, want := range []string{
+		"auth.tokens[0].secret: must be at least 16",
+		`auth.tokens[1].name: "ci" is used twice`,
+		`auth.tokens[1].access: "everything"`,
+		`auth.clientCerts[0].paths: "backups"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("errors lack %q:\n%v", want, err)
+		}
+	}
+	if len(cfg.Auth.Authenticators()) != 2 || !cfg.Auth.Enabled() {
+		t.Errorf("authenticators = %v", cfg.Auth.Authenticators())
+	}
+}
@@ -1,10 +1,12 @@
-package main
+package gobox
 
 import (
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 
 	"github.com/winfsp/cgofuse/fuse"
 )
@@ -23,6 +25,74 @@ type Backend interface {
 	Rename(oldpath, newpath string) int
 }
 
+// Flusher is implemented by backends that buffer writes and commit them when
+// the file is closed
+type Flusher interface {
+	Flush(path string) int
+}
+
+// flushBackend commits buffered writes if the backend stages them
+func flushBackend(b Backend, path string) int {
+	if f, ok := b.(Flusher); ok {
+		return f.Flush(path)
+	}
+	return 0
+}
+
+// Syncer is implemented by backends that stage writes, to commit every file
+// still staged at once, such as those left open at shutdown
+type Syncer interface {
+	Sync() int
+}
+
+// syncBackend commits all staged writes if the backend stages them
+func syncBackend(b Backend) int {
+	if s, ok := b.(Syncer); ok {
+		return s.Sync()
+	}
+	return 0
+}
+
+// Unwrapper is implemented by backends that wrap a single other backend,
+// such as caches and fault injectors, so the one beneath can be found
+type Unwrapper interface {
+	Unwrap() Backend
+}
+
+// closeBackend closes b and every backend it wraps that holds anything
+// open, such as archive spools and SSH connections
+func closeBackend(b Backend) error {
+	var errs []error
+	for b != nil {
+		if c, ok := b.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+		u, ok := b.(Unwrapper)
+		if !ok {
+			break
+		}
+		b = u.Unwrap()
+	}
+	return errors.Join(errs...)
+}
+
+// findBackend returns the first backend of type T in the chain of wrappers
+// starting at b
+func findBackend[T Backend](b Backend) (T, bool) {
+	for b != nil {
+		if t, ok := b.(T); ok {
+			return t, true
+		}
+		u, ok := b.(Unwrapper)
+		if !ok {
+			break
+		}
+		b = u.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
 // DirEnt represents a directory entry
 type DirEnt struct {
 	Name string
@@ -31,7 +101,8 @@ type DirEnt struct {
 
 // LocalBackend implements Backend for local filesystem
 type LocalBackend struct {
-	root string // absolute base path (e.g., "D:/Videos")
+	root  string                     // absolute base path (e.g., "D:/Videos")
+	watch atomic.Pointer[localWatch] // set while outside changes are watched
 }
 
 // NewLocalBackend creates a new local backend for the given root directory
@@ -140,6 +211,7 @@ func (b *LocalBackend) Read(path string, buff []byte, ofst int64) (int, int) {
 // Write writes file content
 func (b *LocalBackend) Write(path string, buff []byte, ofst int64) (int, int) {
 	ap := b.abs(path)
+	b.touched(path)
 	f, err := os.OpenFile(ap, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return 0, -fuse.EIO
@@ -157,6 +229,7 @@ func (b *LocalBackend) Write(path string, buff []byte, ofst int64) (int, int) {
 // Truncate changes file size
 func (b *LocalBackend) Truncate(path string, size int64) int {
 	ap := b.abs(path)
+	b.touched(path)
 	if err := os.Truncate(ap, size); err != nil {
 		return -fuse.EIO
 	}
@@ -166,6 +239,7 @@ func (b *LocalBackend) Truncate(path string, size int64) int {
 // Mkdir creates a directory
 func (b *LocalBackend) Mkdir(path string, mode uint32) int {
 	ap := b.abs(path)
+	b.touched(path)
 	if err := os.Mkdir(ap, os.FileMode(mode)); err != nil {
 		if os.IsExist(err) {
 			return -fuse.EEXIST
@@ -178,6 +252,7 @@ func (b *LocalBackend) Mkdir(path string, mode uint32) int {
 // Create creates a file
 func (b *LocalBackend) Create(path string, mode uint32) int {
 	ap := b.abs(path)
+	b.touched(path)
 	f, err := os.OpenFile(ap, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(mode))
 	if err != nil {
 		return -fuse.EIO
@@ -189,6 +264,7 @@ func (b *LocalBackend) Create(path string, mode uint32) int {
 // Unlink deletes a file
 func (b *LocalBackend) Unlink(path string) int {
 	ap := b.abs(path)
+	b.touched(path)
 	if err := os.Remove(ap); err != nil {
 		if os.IsNotExist(err) {
 			return -fuse.ENOENT
@@ -201,6 +277,7 @@ func (b *LocalBackend) Unlink(path string) int {
 // Rmdir removes a directory
 func (b *LocalBackend) Rmdir(path string) int {
 	ap := b.abs(path)
+	b.touched(path)
 	if err := os.Remove(ap); err != nil {
 		if os.IsNotExist(err) {
 			return -fuse.ENOENT
@@ -214,6 +291,7 @@ func (b *LocalBackend) Rmdir(path string) int {
 func (b *LocalBackend) Rename(oldpath, newpath string) int {
 	apOld := b.abs(oldpath)
 	apNew := b.abs(newpath)
+	b.touched(oldpath, newpath)
 	if err := os.Rename(apOld, apNew); err != nil {
 		return -fuse.EIO
 	}
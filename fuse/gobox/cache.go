@@ -0,0 +1,426 @@
+package gobox
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+const (
+	defaultCacheBlockSize = 64 << 10
+	defaultCacheBytes     = 64 << 20
+	defaultMetaTTL        = time.Second
+)
+
+// CacheOptions configures a CacheBackend
+type CacheOptions struct {
+	BlockSize int           // bytes per cached block; default 64 KiB
+	MaxBytes  int64         // total size of cached blocks; default 64 MiB
+	MetaTTL   time.Duration // lifetime of Stat/Readdir results; default 1s
+}
+
+// CacheStats reports cache effectiveness since the wrapper was created
+type CacheStats struct {
+	BlockHits     int64 `json:"blockHits"`
+	BlockMisses   int64 `json:"blockMisses"`
+	Evictions     int64 `json:"evictions"`
+	CachedBytes   int64 `json:"cachedBytes"`
+	CachedBlocks  int   `json:"cachedBlocks"`
+	StatHits      int64 `json:"statHits"`
+	StatMisses    int64 `json:"statMisses"`
+	ReaddirHits   int64 `json:"readdirHits"`
+	ReaddirMisses int64 `json:"readdirMisses"`
+}
+
+// cacheBlock is one block of a file; a short block marks end of file
+type cacheBlock struct {
+	path  string
+	index int64
+	data  []byte
+}
+
+// statEntry is a cached Stat result, including ENOENT
+type statEntry struct {
+	st      fuse.Stat_t
+	errc    int
+	expires time.Time
+}
+
+// dirEntry is a cached Readdir result
+type dirEntry struct {
+	ents    []DirEnt
+	expires time.Time
+}
+
+// CacheBackend wraps a slow Backend with an LRU block cache for file
+// contents and short-lived caches for Stat and Readdir. Changes made through
+// the wrapper invalidate the affected entries; changes made behind its back
+// show up once the metadata expires or the blocks are evicted, or at once if
+// the mount is watched.
+type CacheBackend struct {
+	inner     Backend
+	blockSize int64
+	maxBytes  int64
+	ttl       time.Duration
+
+	mu     sync.Mutex
+	blocks map[string]map[int64]*list.Element // path -> index -> element holding *cacheBlock
+	lru    *list.List                         // front is most recently used
+	stats  map[string]*statEntry
+	dirs   map[string]*dirEntry
+	gen    uint64 // bumped on every invalidation so in-flight fills are dropped
+	st     CacheStats
+}
+
+// NewCacheBackend wraps inner with block and metadata caches
+func NewCacheBackend(inner Backend, opts CacheOptions) *CacheBackend {
+	b := &CacheBackend{
+		inner:     inner,
+		blockSize: int64(opts.BlockSize),
+		maxBytes:  opts.MaxBytes,
+		ttl:       opts.MetaTTL,
+		blocks:    make(map[string]map[int64]*list.Element),
+		lru:       list.New(),
+		stats:     make(map[string]*statEntry),
+		dirs:      make(map[string]*dirEntry),
+	}
+	if b.blockSize <= 0 {
+		b.blockSize = defaultCacheBlockSize
+	}
+	if b.maxBytes <= 0 {
+		b.maxBytes = defaultCacheBytes
+	}
+	if b.ttl <= 0 {
+		b.ttl = defaultMetaTTL
+	}
+	return b
+}
+
+// Unwrap returns the backend being cached
+func (b *CacheBackend) Unwrap() Backend {
+	return b.inner
+}
+
+// Stats returns a snapshot of the cache counters
+func (b *CacheBackend) Stats() CacheStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.st
+	s.CachedBlocks = b.lru.Len()
+	return s
+}
+
+// ============ Invalidation ============
+
+// dropBlock removes a cached block; callers hold b.mu
+func (b *CacheBackend) dropBlock(el *list.Element) {
+	cb := b.lru.Remove(el).(*cacheBlock)
+	b.st.CachedBytes -= int64(len(cb.data))
+	if byIndex := b.blocks[cb.path]; byIndex != nil {
+		delete(byIndex, cb.index)
+		if len(byIndex) == 0 {
+			delete(b.blocks, cb.path)
+		}
+	}
+}
+
+// dropBlocks removes cached blocks of a file that overlap [from, to), plus
+// a short end-of-file block since the file size may have changed
+func (b *CacheBackend) dropBlocks(path string, from, to int64) {
+	for idx, el := range b.blocks[path] {
+		cb := el.Value.(*cacheBlock)
+		start := idx * b.blockSize
+		if start+b.blockSize > from && start < to || int64(len(cb.data)) < b.blockSize {
+			b.dropBlock(el)
+		}
+	}
+}
+
+// invalidate forgets everything cached for a file and its parent listing
+func (b *CacheBackend) invalidate(path string) {
+	b.gen++
+	for _, el := range b.blocks[path] {
+		b.dropBlock(el)
+	}
+	delete(b.stats, path)
+	delete(b.dirs, path)
+	delete(b.dirs, parentPath(path))
+}
+
+// invalidateTree forgets everything cached at or below path
+func (b *CacheBackend) invalidateTree(path string) {
+	b.invalidate(path)
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for p, byIndex := range b.blocks {
+		if strings.HasPrefix(p, prefix) {
+			for _, el := range byIndex {
+				b.dropBlock(el)
+			}
+		}
+	}
+	for p := range b.stats {
+		if strings.HasPrefix(p, prefix) {
+			delete(b.stats, p)
+		}
+	}
+	for p := range b.dirs {
+		if strings.HasPrefix(p, prefix) {
+			delete(b.dirs, p)
+		}
+	}
+}
+
+// ============ Blocks ============
+
+// block returns block idx of a file, reading it from the inner backend on a
+// miss. The lock is released while reading.
+func (b *CacheBackend) block(path string, idx int64) ([]byte, int) {
+	b.mu.Lock()
+	if el, ok := b.blocks[path][idx]; ok {
+		b.lru.MoveToFront(el)
+		b.st.BlockHits++
+		data := el.Value.(*cacheBlock).data
+		b.mu.Unlock()
+		return data, 0
+	}
+	b.st.BlockMisses++
+	gen := b.gen
+	b.mu.Unlock()
+
+	buf := make([]byte, b.blockSize)
+	n, errc := b.inner.Read(path, buf, idx*b.blockSize)
+	if errc != 0 {
+		return nil, errc
+	}
+	data := buf[:n]
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.gen != gen {
+		return data, 0 // invalidated while reading; serve it but don't keep it
+	}
+	if _, ok := b.blocks[path][idx]; ok {
+		return data, 0 // filled concurrently
+	}
+	if b.blocks[path] == nil {
+		b.blocks[path] = make(map[int64]*list.Element)
+	}
+	b.blocks[path][idx] = b.lru.PushFront(&cacheBlock{path: path, index: idx, data: data})
+	b.st.CachedBytes += int64(n)
+	for b.st.CachedBytes > b.maxBytes && b.lru.Len() > 1 {
+		b.dropBlock(b.lru.Back())
+		b.st.Evictions++
+	}
+	return data, 0
+}
+
+// ============ Backend ============
+
+// Stat returns file attributes, cached for the metadata TTL
+func (b *CacheBackend) Stat(path string) (*fuse.Stat_t, int) {
+	b.mu.Lock()
+	if e, ok := b.stats[path]; ok && time.Now().Before(e.expires) {
+		b.st.StatHits++
+		b.mu.Unlock()
+		if e.errc != 0 {
+			return nil, e.errc
+		}
+		st := e.st
+		return &st, 0
+	}
+	b.st.StatMisses++
+	gen := b.gen
+	b.mu.Unlock()
+
+	st, errc := b.inner.Stat(path)
+	if errc != 0 && errc != -fuse.ENOENT {
+		return nil, errc // don't cache transient failures
+	}
+
+	b.mu.Lock()
+	if b.gen == gen {
+		e := &statEntry{errc: errc, expires: time.Now().Add(b.ttl)}
+		if st != nil {
+			e.st = *st
+		}
+		b.stats[path] = e
+	}
+	b.mu.Unlock()
+	return st, errc
+}
+
+// Readdir lists directory entries, cached for the metadata TTL
+func (b *CacheBackend) Readdir(path string) ([]DirEnt, int) {
+	b.mu.Lock()
+	if e, ok := b.dirs[path]; ok && time.Now().Before(e.expires) {
+		b.st.ReaddirHits++
+		b.mu.Unlock()
+		return append([]DirEnt(nil), e.ents...), 0
+	}
+	b.st.ReaddirMisses++
+	gen := b.gen
+	b.mu.Unlock()
+
+	ents, errc := b.inner.Readdir(path)
+	if errc != 0 {
+		return nil, errc
+	}
+
+	b.mu.Lock()
+	if b.gen == gen {
+		expires := time.Now().Add(b.ttl)
+		b.dirs[path] = &dirEntry{ents: append([]DirEnt(nil), ents...), expires: expires}
+		// The listing also answers Stat for each child
+		for _, e := range ents {
+			b.stats[joinPath(path, e.Name)] = &statEntry{st: e.Stat, expires: expires}
+		}
+	}
+	b.mu.Unlock()
+	return ents, 0
+}
+
+// Read serves whole blocks from the cache, filling misses from the inner backend
+func (b *CacheBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	n := 0
+	for n < len(buff) {
+		pos := ofst + int64(n)
+		idx := pos / b.blockSize
+		data, errc := b.block(path, idx)
+		if errc != 0 {
+			if n > 0 {
+				return n, 0
+			}
+			return 0, errc
+		}
+		skip := pos - idx*b.blockSize
+		if skip >= int64(len(data)) {
+			break
+		}
+		n += copy(buff[n:], data[skip:])
+		if int64(len(data)) < b.blockSize {
+			break // end of file
+		}
+	}
+	return n, 0
+}
+
+// Write writes through and drops the blocks it overlaps
+func (b *CacheBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	n, errc := b.inner.Write(path, buff, ofst)
+
+	b.mu.Lock()
+	b.gen++
+	b.dropBlocks(path, ofst, ofst+int64(len(buff)))
+	delete(b.stats, path)
+	delete(b.dirs, parentPath(path))
+	b.mu.Unlock()
+	return n, errc
+}
+
+// Truncate changes file size and drops blocks past the new end
+func (b *CacheBackend) Truncate(path string, size int64) int {
+	errc := b.inner.Truncate(path, size)
+
+	b.mu.Lock()
+	b.gen++
+	b.dropBlocks(path, size, 1<<62)
+	delete(b.stats, path)
+	delete(b.dirs, parentPath(path))
+	b.mu.Unlock()
+	return errc
+}
+
+// Mkdir creates a directory
+func (b *CacheBackend) Mkdir(path string, mode uint32) int {
+	errc := b.inner.Mkdir(path, mode)
+
+	b.mu.Lock()
+	b.invalidate(path)
+	b.mu.Unlock()
+	return errc
+}
+
+// Create creates or truncates a file
+func (b *CacheBackend) Create(path string, mode uint32) int {
+	errc := b.inner.Create(path, mode)
+
+	b.mu.Lock()
+	b.invalidate(path)
+	b.mu.Unlock()
+	return errc
+}
+
+// Unlink deletes a file
+func (b *CacheBackend) Unlink(path string) int {
+	errc := b.inner.Unlink(path)
+
+	b.mu.Lock()
+	b.invalidate(path)
+	b.mu.Unlock()
+	return errc
+}
+
+// Rmdir removes a directory
+func (b *CacheBackend) Rmdir(path string) int {
+	errc := b.inner.Rmdir(path)
+
+	b.mu.Lock()
+	b.invalidateTree(path)
+	b.mu.Unlock()
+	return errc
+}
+
+// Rename moves or renames a file/directory
+func (b *CacheBackend) Rename(oldpath, newpath string) int {
+	errc := b.inner.Rename(oldpath, newpath)
+
+	b.mu.Lock()
+	b.invalidateTree(oldpath)
+	b.invalidateTree(newpath)
+	b.mu.Unlock()
+	return errc
+}
+
+// Flush commits writes staged by the inner backend
+func (b *CacheBackend) Flush(path string) int {
+	errc := flushBackend(b.inner, path)
+
+	b.mu.Lock()
+	b.invalidate(path)
+	b.mu.Unlock()
+	return errc
+}
+
+// Sync commits everything staged by the inner backend, dropping what is
+// cached as the commits may change it
+func (b *CacheBackend) Sync() int {
+	errc := syncBackend(b.inner)
+
+	b.mu.Lock()
+	b.invalidateTree("/")
+	b.mu.Unlock()
+	return errc
+}
+
+// Watch reports outside changes to the inner backend
+func (b *CacheBackend) Watch(notify func(BackendChange)) error {
+	return watchBackend(b.inner, notify)
+}
+
+// Unwatch stops reporting outside changes
+func (b *CacheBackend) Unwatch() {
+	unwatchBackend(b.inner)
+}
+
+// Invalidate forgets everything cached at or below path after it changed
+// behind the wrapper's back
+func (b *CacheBackend) Invalidate(path string) {
+	b.mu.Lock()
+	b.invalidateTree(path)
+	b.mu.Unlock()
+	invalidateBackend(b.inner, path)
+}
@@ -0,0 +1,199 @@
+package gobox
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// countingBackend records how often the wrapped backend is hit
+type countingBackend struct {
+	Backend
+	reads, stats, readdirs int
+}
+
+func (c *countingBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	c.reads++
+	return c.Backend.Read(path, buff, ofst)
+}
+
+func (c *countingBackend) Stat(path string) (*fuse.Stat_t, int) {
+	c.stats++
+	return c.Backend.Stat(path)
+}
+
+func (c *countingBackend) Readdir(path string) ([]DirEnt, int) {
+	c.readdirs++
+	return c.Backend.Readdir(path)
+}
+
+func newCountingMem(t *testing.T, files map[string][]byte) *countingBackend {
+	t.Helper()
+	mem := NewMemBackend()
+	for name, data := range files {
+		mem.Create(name, 0644)
+		mem.Write(name, data, 0)
+	}
+	return &countingBackend{Backend: mem}
+}
+
+// TestCacheBackendBlocks checks repeated reads are served from the cache
+func TestCacheBackendBlocks(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000) // 10000 bytes
+	inner := newCountingMem(t, map[string][]byte{"/f": data})
+	b := NewCacheBackend(inner, CacheOptions{BlockSize: 4096})
+
+	buff := make([]byte, 3000)
+	for i := 0; i < 5; i++ {
+		n, errc := b.Read("/f", buff, 3000) // spans blocks 0 and 1
+		assertSuccess(t, errc, "Read")
+		if !bytes.Equal(buff[:n], data[3000:6000]) {
+			t.Fatalf("Read returned wrong data")
+		}
+	}
+	if inner.reads != 2 {
+		t.Errorf("inner reads = %d, expected 2", inner.reads)
+	}
+
+	// Reading past the short last block stops at end of file
+	n, _ := b.Read("/f", make([]byte, 8000), 8000)
+	if n != 2000 {
+		t.Errorf("Read at end returned %d bytes, expected 2000", n)
+	}
+
+	s := b.Stats()
+	if s.BlockHits != 9 || s.BlockMisses != 3 || s.CachedBlocks != 3 {
+		t.Errorf("stats = %+v, expected 9 hits, 3 misses, 3 blocks", s)
+	}
+}
+
+// TestCacheBackendInvalidation checks changes through the wrapper are visible
+func TestCacheBackendInvalidation(t *testing.T) {
+	inner := newCountingMem(t, map[string][]byte{"/f": []byte("hello world")})
+	b := NewCacheBackend(inner, CacheOptions{BlockSize: 4, MetaTTL: time.Hour})
+
+	read := func(path string) string {
+		buff := make([]byte, 64)
+		n, _ := b.Read(path, buff, 0)
+		return string(buff[:n])
+	}
+
+	read("/f")
+	b.Stat("/f")
+	b.Write("/f", []byte("HELLO"), 0)
+	if got := read("/f"); got != "HELLO world" {
+		t.Errorf("after Write: %q", got)
+	}
+
+	// Appending changes the short final block
+	b.Write("/f", []byte("!!"), 11)
+	if got := read("/f"); got != "HELLO world!!" {
+		t.Errorf("after append: %q", got)
+	}
+	st, _ := b.Stat("/f")
+	if st.Size != 13 {
+		t.Errorf("Stat size after append = %d, expected 13", st.Size)
+	}
+
+	b.Truncate("/f", 5)
+	if got := read("/f"); got != "HELLO" {
+		t.Errorf("after Truncate: %q", got)
+	}
+
+	b.Readdir("/")
+	b.Rename("/f", "/g")
+	if _, errc := b.Stat("/f"); errc != -fuse.ENOENT {
+		t.Errorf("Stat old name returned %d, expected %d", errc, -fuse.ENOENT)
+	}
+	if got := read("/g"); got != "HELLO" {
+		t.Errorf("after Rename: %q", got)
+	}
+	ents, _ := b.Readdir("/")
+	if len(ents) != 1 || ents[0].Name != "g" {
+		t.Errorf("Readdir after Rename = %v, expected [g]", ents)
+	}
+
+	b.Unlink("/g")
+	if _, errc := b.Read("/g", make([]byte, 4), 0); errc != -fuse.ENOENT {
+		t.Errorf("Read after Unlink returned %d, expected %d", errc, -fuse.ENOENT)
+	}
+}
+
+// TestCacheBackendMetadata checks Stat/Readdir caching and expiry
+func TestCacheBackendMetadata(t *testing.T) {
+	inner := newCountingMem(t, map[string][]byte{"/a": []byte("a"), "/b": []byte("bb")})
+	b := NewCacheBackend(inner, CacheOptions{MetaTTL: 50 * time.Millisecond})
+
+	b.Readdir("/")
+	b.Readdir("/")
+	b.Stat("/a") // answered by the listing
+	b.Stat("/missing")
+	b.Stat("/missing")
+	if inner.readdirs != 1 || inner.stats != 1 {
+		t.Errorf("inner readdirs=%d stats=%d, expected 1 and 1", inner.readdirs, inner.stats)
+	}
+
+	// A change behind the wrapper's back shows up after the TTL
+	inner.Backend.Create("/missing", 0644)
+	time.Sleep(60 * time.Millisecond)
+	if _, errc := b.Stat("/missing"); errc != 0 {
+		t.Errorf("Stat after TTL returned %d, expected 0", errc)
+	}
+
+	s := b.Stats()
+	if s.StatHits != 2 || s.ReaddirHits != 1 {
+		t.Errorf("stats = %+v, expected 2 stat hits and 1 readdir hit", s)
+	}
+}
+
+// TestCacheBackendEviction checks the block cache stays within its budget
+func TestCacheBackendEviction(t *testing.T) {
+	data := make([]byte, 100<<10)
+	inner := newCountingMem(t, map[string][]byte{"/f": data})
+	b := NewCacheBackend(inner, CacheOptions{BlockSize: 4096, MaxBytes: 16 << 10})
+
+	b.Read("/f", make([]byte, len(data)), 0)
+	s := b.Stats()
+	if s.CachedBytes > 16<<10 || s.CachedBlocks != 4 || s.Evictions != 21 {
+		t.Errorf("stats = %+v, expected 4 blocks within 16 KiB and 21 evictions", s)
+	}
+
+	// The most recent blocks survive
+	reads := inner.reads
+	b.Read("/f", make([]byte, 4096), int64(len(data)-4096))
+	if inner.reads != reads {
+		t.Errorf("recent block was evicted")
+	}
+}
+
+// TestCacheMount tests enabling the cache on a linked folder
+func TestCacheMount(t *testing.T) {
+	fs := newTestFS()
+	errCode := fs.LinkLocal("/slow", t.TempDir())
+	assertSuccess(t, errCode, "LinkLocal")
+
+	errCode = fs.CacheMount("/slow", CacheOptions{})
+	assertSuccess(t, errCode, "CacheMount")
+	errCode = fs.CacheMount("/slow", CacheOptions{})
+	assertError(t, errCode, -fuse.EEXIST, "CacheMount twice")
+	errCode = fs.CacheMount("/", CacheOptions{})
+	assertError(t, errCode, -fuse.EINVAL, "CacheMount on non-mount")
+
+	errCode, fh := fs.Create("/slow/f.txt", 0, 0644)
+	assertSuccess(t, errCode, "Create")
+	fs.Write("/slow/f.txt", []byte("cached"), 0, fh)
+	buff := make([]byte, 16)
+	fs.Read("/slow/f.txt", buff, 0, fh)
+	n := fs.Read("/slow/f.txt", buff, 0, fh)
+	if string(buff[:n]) != "cached" {
+		t.Errorf("Read = %q, expected %q", buff[:n], "cached")
+	}
+
+	stats, errCode := fs.CacheStats("/slow")
+	assertSuccess(t, errCode, "CacheStats")
+	if stats.BlockHits != 1 || stats.BlockMisses != 1 {
+		t.Errorf("stats = %+v, expected 1 hit and 1 miss", stats)
+	}
+}
@@ -0,0 +1,77 @@
+package gobox
+
+import "github.com/winfsp/cgofuse/fuse"
+
+// CapacityOptions limits what MemFS itself stores; linked backends are not
+// counted. Lowering a limit below current usage only stops further growth.
+type CapacityOptions struct {
+	MaxBytes int64 `json:"maxBytes" yaml:"maxBytes"` // total size of files, in memory or spilled to disk; 0 for no limit
+	MaxFiles int64 `json:"maxFiles" yaml:"maxFiles"` // files and directories, including mount points; 0 for no limit
+}
+
+// CapacityStatus reports the limits and how much of them is used.
+type CapacityStatus struct {
+	CapacityOptions
+	UsedBytes int64 `json:"usedBytes"`
+	Files     int64 `json:"files"`
+}
+
+// SetCapacity changes the capacity limits. Calls that would go over them
+// fail with ENOSPC.
+func (fs *MemFS) SetCapacity(opts CapacityOptions) int {
+	if opts.MaxBytes < 0 || opts.MaxFiles < 0 {
+		return -fuse.EINVAL
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.capacity = opts
+	return 0
+}
+
+// Capacity returns the capacity limits and usage.
+func (fs *MemFS) Capacity() CapacityStatus {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return CapacityStatus{CapacityOptions: fs.capacity, UsedBytes: fs.used, Files: int64(len(fs.nodes))}
+}
+
+// full reports whether no more files or directories may be made.
+// Caller must hold fs.lock.
+func (fs *MemFS) full() bool {
+	return fs.capacity.MaxFiles > 0 && int64(len(fs.nodes)) >= fs.capacity.MaxFiles
+}
+
+// fits fails with ENOSPC if growing n to size would go over the byte limit.
+// Caller must hold fs.lock.
+func (fs *MemFS) fits(n *node, size int64) int {
+	grow := size - n.stat.Size
+	if grow > 0 && fs.capacity.MaxBytes > 0 && fs.used+grow > fs.capacity.MaxBytes {
+		return -fuse.ENOSPC
+	}
+	return 0
+}
+
+// sized adds the change in n's size since it was before to the bytes used.
+// Deferred by calls that resize files; caller must hold fs.lock.
+func (fs *MemFS) sized(n *node, before int64) {
+	fs.used += n.stat.Size - before
+}
+
+// statfsCapacity fills in stat from the capacity limits, leaving the
+// defaults where there is no limit. Caller must hold fs.lock.
+func (fs *MemFS) statfsCapacity(stat *fuse.Statfs_t) {
+	if max := fs.capacity.MaxBytes; max > 0 {
+		free := uint64(0)
+		if fs.used < max {
+			free = uint64(max-fs.used) / stat.Bsize
+		}
+		stat.Blocks = uint64(max) / stat.Bsize
+		stat.Bfree = free
+		stat.Bavail = free
+	}
+	if max := fs.capacity.MaxFiles; max > 0 {
+		stat.Files = uint64(max)
+		stat.Ffree = uint64(max - min(int64(len(fs.nodes)), max))
+	}
+}
@@ -0,0 +1,49 @@
+package gobox
+
+import (
+	"os"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// TestCapacity tests the byte and file limits
+func TestCapacity(t *testing.T) {
+	fs := newTestFS()
+	assertError(t, fs.SetCapacity(CapacityOptions{MaxBytes: -1}), -fuse.EINVAL, "SetCapacity negative")
+	assertSuccess(t, fs.SetCapacity(CapacityOptions{MaxBytes: 8192, MaxFiles: 4}), "SetCapacity")
+
+	writeFile(t, fs, "/a", make([]byte, 6000))
+	errc, fh := fs.Create("/b", os.O_RDWR, 0644)
+	assertSuccess(t, errc, "Create")
+	assertError(t, fs.Write("/b", make([]byte, 3000), 0, fh), -fuse.ENOSPC, "Write over MaxBytes")
+	assertError(t, fs.Truncate("/b", 3000, fh), -fuse.ENOSPC, "Truncate over MaxBytes")
+
+	// Rewriting within a file's size doesn't need more room
+	if n := fs.Write("/a", make([]byte, 100), 0, 0); n != 100 {
+		t.Errorf("overwrite = %d", n)
+	}
+	if n := fs.Write("/b", make([]byte, 2000), 0, fh); n != 2000 {
+		t.Errorf("write within the limit = %d", n)
+	}
+
+	stat := &fuse.Statfs_t{}
+	fs.Statfs("/", stat)
+	if stat.Blocks != 2 || stat.Bfree != 0 || stat.Files != 4 || stat.Ffree != 1 {
+		t.Errorf("statfs = %+v", stat)
+	}
+
+	// The root counts as one entry: "/", "/a", "/b" and one more
+	assertSuccess(t, fs.Mkdir("/d", 0755), "Mkdir")
+	assertError(t, fs.Mkdir("/e", 0755), -fuse.ENOSPC, "Mkdir over MaxFiles")
+	assertError(t, fs.Mknod("/e", 0644, 0), -fuse.ENOSPC, "Mknod over MaxFiles")
+
+	// Deleting and replacing files gives the room back
+	assertSuccess(t, fs.Unlink("/a"), "Unlink")
+	assertSuccess(t, fs.Truncate("/b", 4000, fh), "Truncate after Unlink")
+	writeFile(t, fs, "/c", make([]byte, 100))
+	assertSuccess(t, fs.Rename("/c", "/b"), "Rename over")
+	if c := fs.Capacity(); c.UsedBytes != 100 || c.Files != 3 {
+		t.Errorf("capacity = %+v", c)
+	}
+}
@@ -0,0 +1,195 @@
+package gobox
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// logLines returns n bytes of highly compressible log-like text
+func logLines(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, "2024-01-01T00:00:%02d INFO request %d served in 3ms\n", i%60, i)
+	}
+	return buf.Bytes()[:n]
+}
+
+func newTestCompress(t *testing.T, inner Backend, opts CompressOptions) *CompressBackend {
+	t.Helper()
+	b, err := NewCompressBackend(inner, opts)
+	if err != nil {
+		t.Fatalf("NewCompressBackend failed: %v", err)
+	}
+	return b
+}
+
+// TestCompressBackendRandomAccess compares a compressed file against a plain
+// reference under random writes, truncates and reads
+func TestCompressBackendRandomAccess(t *testing.T) {
+	for _, algo := range []string{"zstd", "deflate", "none"} {
+		t.Run(algo, func(t *testing.T) {
+			inner := NewMemBackend()
+			b := newTestCompress(t, inner, CompressOptions{Algorithm: algo, FrameSize: 4096})
+			assertSuccess(t, b.Create("/app.log", 0644), "Create")
+
+			rng := rand.New(rand.NewSource(1))
+			text := logLines(64 << 10)
+			var want []byte
+			for step := 0; step < 200; step++ {
+				switch rng.Intn(4) {
+				case 0, 1:
+					ofst := rng.Intn(len(want) + 5000)
+					data := text[rng.Intn(len(text)/2):][:rng.Intn(9000)+1]
+					n, errc := b.Write("/app.log", data, int64(ofst))
+					if errc != 0 || n != len(data) {
+						t.Fatalf("step %d: Write at %d = (%d, %d)", step, ofst, n, errc)
+					}
+					if end := ofst + len(data); end > len(want) {
+						want = append(want, make([]byte, end-len(want))...)
+					}
+					copy(want[ofst:], data)
+				case 2:
+					size := rng.Intn(len(want) + 3000)
+					assertSuccess(t, b.Truncate("/app.log", int64(size)), "Truncate")
+					if size < len(want) {
+						want = want[:size]
+					} else {
+						want = append(want, make([]byte, size-len(want))...)
+					}
+				case 3:
+					ofst := rng.Intn(len(want) + 1)
+					buff := make([]byte, rng.Intn(10000))
+					n, errc := b.Read("/app.log", buff, int64(ofst))
+					assertSuccess(t, errc, "Read")
+					if !bytes.Equal(buff[:n], want[ofst:min(ofst+len(buff), len(want))]) {
+						t.Fatalf("step %d: Read at %d returned wrong data", step, ofst)
+					}
+				}
+			}
+
+			st, errc := b.Stat("/app.log")
+			assertSuccess(t, errc, "Stat")
+			if st.Size != int64(len(want)) {
+				t.Errorf("Stat size = %d, expected %d", st.Size, len(want))
+			}
+
+			// A fresh wrapper rebuilds the index from the stored records
+			reopened := newTestCompress(t, inner, CompressOptions{})
+			buff := make([]byte, len(want)+10)
+			n, errc := reopened.Read("/app.log", buff, 0)
+			assertSuccess(t, errc, "Read after reopen")
+			if !bytes.Equal(buff[:n], want) {
+				t.Errorf("Read after reopen returned %d bytes, expected %d", n, len(want))
+			}
+		})
+	}
+}
+
+// TestCompressBackendRatio checks log data actually shrinks on disk
+func TestCompressBackendRatio(t *testing.T) {
+	dir := t.TempDir()
+	b := newTestCompress(t, NewLocalBackend(dir), CompressOptions{Algorithm: "zstd", Level: 3})
+
+	data := logLines(1 << 20)
+	b.Create("/big.log", 0644)
+	for ofst := 0; ofst < len(data); ofst += 128 << 10 {
+		b.Write("/big.log", data[ofst:ofst+128<<10], int64(ofst))
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "big.log"))
+	if err != nil {
+		t.Fatalf("stat stored file: %v", err)
+	}
+	if info.Size() > int64(len(data))/4 {
+		t.Errorf("stored size %d, expected under a quarter of %d", info.Size(), len(data))
+	}
+
+	ents, errc := b.Readdir("/")
+	assertSuccess(t, errc, "Readdir")
+	if len(ents) != 1 || ents[0].Stat.Size != int64(len(data)) {
+		t.Errorf("Readdir / = %v, expected big.log with size %d", ents, len(data))
+	}
+}
+
+// TestCompressBackendCompaction checks rewrites do not grow the file forever
+func TestCompressBackendCompaction(t *testing.T) {
+	inner := NewMemBackend()
+	b := newTestCompress(t, inner, CompressOptions{Algorithm: "none", FrameSize: 4096})
+	b.Create("/hot", 0644)
+
+	data := bytes.Repeat([]byte{0xaa}, 64<<10)
+	for i := 0; i < 100; i++ {
+		b.Write("/hot", data, 0)
+	}
+
+	// 6.4 MB was written; compaction keeps garbage near the live size
+	limit := int64(compactMinGarbage + 3*len(data))
+	st, _ := inner.Stat("/hot")
+	if st.Size > limit {
+		t.Errorf("stored size %d after rewrites, expected compaction below %d", st.Size, limit)
+	}
+	ents, _ := inner.Readdir("/")
+	if len(ents) != 1 {
+		t.Errorf("inner Readdir = %v, expected only the file", ents)
+	}
+
+	buff := make([]byte, len(data))
+	n, errc := b.Read("/hot", buff, 0)
+	assertSuccess(t, errc, "Read")
+	if !bytes.Equal(buff[:n], data) {
+		t.Errorf("Read after compaction returned wrong data")
+	}
+}
+
+// TestCompressBackendRawFiles checks files not written by the wrapper pass through
+func TestCompressBackendRawFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "plain.txt"), []byte("plain text"), 0644)
+	b := newTestCompress(t, NewLocalBackend(dir), CompressOptions{})
+
+	st, errc := b.Stat("/plain.txt")
+	assertSuccess(t, errc, "Stat")
+	if st.Size != 10 {
+		t.Errorf("Stat size = %d, expected 10", st.Size)
+	}
+	b.Write("/plain.txt", []byte("P"), 0)
+	raw, _ := os.ReadFile(filepath.Join(dir, "plain.txt"))
+	if string(raw) != "Plain text" {
+		t.Errorf("raw file = %q, expected %q", raw, "Plain text")
+	}
+
+	if _, err := NewCompressBackend(NewMemBackend(), CompressOptions{Algorithm: "rar"}); err != errUnknownAlgorithm {
+		t.Errorf("unknown algorithm returned %v, expected %v", err, errUnknownAlgorithm)
+	}
+}
+
+// TestLinkCompress tests linking a compressed folder
+func TestLinkCompress(t *testing.T) {
+	fs := newTestFS()
+	tmpDir := t.TempDir()
+
+	errCode := fs.LinkCompress("/logs", tmpDir, CompressOptions{Algorithm: "deflate", Level: 9})
+	assertSuccess(t, errCode, "LinkCompress")
+
+	errCode, fh := fs.Create("/logs/today.log", 0, 0644)
+	assertSuccess(t, errCode, "Create")
+	data := logLines(10000)
+	fs.Write("/logs/today.log", data, 0, fh)
+
+	stat := &fuse.Stat_t{}
+	errCode = fs.Getattr("/logs/today.log", stat, fh)
+	assertSuccess(t, errCode, "Getattr")
+	assertStatSize(t, stat, int64(len(data)), "/logs/today.log")
+
+	errCode = fs.LinkCompress("/bad", tmpDir, CompressOptions{Algorithm: "rar"})
+	assertError(t, errCode, -fuse.EINVAL, "LinkCompress with unknown algorithm")
+
+	errCode = fs.LinkCompress("/bad", tmpDir, CompressOptions{Algorithm: "deflate", Level: 42})
+	assertError(t, errCode, -fuse.EINVAL, "LinkCompress with invalid level")
+}
@@ -0,0 +1,310 @@
+package gobox
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrBadFlags marks command line errors the flag package has already
+// printed, along with the usage
+var ErrBadFlags = errors.New("bad command line")
+
+// Config is everything the fuse binary can be told at startup, from a YAML
+// file, flags, or both
+type Config struct {
+	Listen      string           `yaml:"listen"`      // REST API address in plain HTTP; default ":8080", "" for none
+	Listeners   []ListenerConfig `yaml:"listeners"`   // more places to serve the REST API, with TLS or on Unix sockets
+	Mountpoint  string           `yaml:"mountpoint"`  // drive letter or directory to mount at
+	Headless    bool             `yaml:"headless"`    // serve the REST API only, without mounting
+	FuseOptions []string         `yaml:"fuseOptions"` // passed to the FUSE host as they are, such as ["-o", "allow_other"]
+	Links       []LinkConfig     `yaml:"links"`       // folders linked before mounting
+	Capacity    CapacityOptions  `yaml:"capacity"`
+	Auth        AuthConfig       `yaml:"auth"`     // credentials the REST API accepts; none for an open API
+	LogLevel    string           `yaml:"logLevel"` // debug, info, warn or error; default info
+
+	// ShutdownTimeout bounds how long stopping may take, from draining API
+	// requests to closing the audit log; default 10s, 0 for no limit
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+}
+
+// listeners returns every place the API is served, the plain Listen
+// address first
+func (c *Config) listeners() []ListenerConfig {
+	var ls []ListenerConfig
+	if c.Listen != "" {
+		ls = append(ls, ListenerConfig{Address: c.Listen})
+	}
+	return append(ls, c.Listeners...)
+}
+
+// LinkConfig is a local folder to link at startup
+type LinkConfig struct {
+	Path   string `yaml:"path"`   // where it appears, such as /projects
+	Target string `yaml:"target"` // directory or file on this machine
+}
+
+// DefaultConfig returns the settings used where neither the file nor the
+// flags say otherwise
+func DefaultConfig() *Config {
+	return &Config{Listen: ":8080", LogLevel: "info", ShutdownTimeout: 10 * time.Second}
+}
+
+// ReadConfigFile reads a YAML config file over the defaults. Unknown keys
+// are errors, so typos don't go unnoticed.
+func ReadConfigFile(file string) (*Config, error) {
+	cfg := DefaultConfig()
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return cfg, nil
+}
+
+// listFlag is a flag that may be given more than once
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// LoadConfig builds the configuration from command line arguments: the
+// defaults, then the file named by -config, then the other flags. The first
+// argument after the flags is the mount point and any others are FUSE
+// options, so "fuse X:" and "fuse /mnt/gobox -o allow_other" keep working.
+// The result is validated.
+func LoadConfig(args []string) (*Config, error) {
+	set := flag.NewFlagSet("fuse", flag.ContinueOnError)
+	set.Usage = func() {
+		fmt.Fprintln(set.Output(), "Usage: fuse [flags] [mountpoint [fuse options]]")
+		fmt.Fprintln(set.Output(), "       fuse -headless [flags]")
+		set.PrintDefaults()
+	}
+	var (
+		file, listen, mount, level string
+		socket, tlsListen          string
+		tlsCert, tlsKey            string
+		maxBytes, maxFiles         int64
+		headless                   bool
+		timeout                    time.Duration
+		links, opts                listFlag
+	)
+	set.StringVar(&file, "config", "", "YAML config `file`")
+	set.StringVar(&listen, "listen", "", "REST API `address` (default \":8080\")")
+	set.StringVar(&tlsListen, "tls-listen", "", "also serve the REST API over TLS at `address`")
+	set.StringVar(&tlsCert, "tls-cert", "", "certificate `file` for -tls-listen (default self-signed)")
+	set.StringVar(&tlsKey, "tls-key", "", "private key `file` for -tls-cert")
+	set.StringVar(&socket, "socket", "", "also serve the REST API on a Unix socket at `path`")
+	set.StringVar(&mount, "mount", "", "drive letter or `directory` to mount at")
+	set.BoolVar(&headless, "headless", false, "serve the REST API only, without a FUSE mount")
+	set.Var(&opts, "o", "FUSE mount `option`, may be repeated")
+	set.Var(&links, "link", "link a local folder, as `/path=/target`; may be repeated")
+	set.Int64Var(&maxBytes, "max-bytes", 0, "total `bytes` of files MemFS may hold; 0 for no limit")
+	set.Int64Var(&maxFiles, "max-files", 0, "`number` of files and directories MemFS may hold; 0 for no limit")
+	set.StringVar(&level, "log-level", "", "debug, info, warn or error (default info)")
+	set.DurationVar(&timeout, "shutdown-timeout", 0, "how long stopping may take; 0 for no limit (default 10s)")
+	if err := set.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, err
+		}
+		return nil, ErrBadFlags
+	}
+
+	cfg := DefaultConfig()
+	if file != "" {
+		var err error
+		if cfg, err = ReadConfigFile(file); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	set.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = listen
+		case "mount":
+			cfg.Mountpoint = mount
+		case "headless":
+			cfg.Headless = headless
+		case "o":
+			for _, o := range opts {
+				cfg.FuseOptions = append(cfg.FuseOptions, "-o", o)
+			}
+		case "link":
+			for _, l := range links {
+				p, target, ok := strings.Cut(l, "=")
+				if !ok {
+					errs = append(errs, fmt.Errorf("-link %s: expected /path=/target", l))
+					continue
+				}
+				cfg.Links = append(cfg.Links, LinkConfig{Path: p, Target: target})
+			}
+		case "max-bytes":
+			cfg.Capacity.MaxBytes = maxBytes
+		case "max-files":
+			cfg.Capacity.MaxFiles = maxFiles
+		case "log-level":
+			cfg.LogLevel = level
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = timeout
+		case "socket":
+			cfg.Listeners = append(cfg.Listeners, ListenerConfig{Socket: socket})
+		case "tls-listen":
+			t := &TLSConfig{CertFile: tlsCert, KeyFile: tlsKey, SelfSigned: tlsCert == ""}
+			cfg.Listeners = append(cfg.Listeners, ListenerConfig{Address: tlsListen, TLS: t})
+		}
+	})
+	if (tlsCert != "" || tlsKey != "") && tlsListen == "" {
+		errs = append(errs, errors.New("-tls-cert and -tls-key need -tls-listen"))
+	}
+	if rest := set.Args(); len(rest) > 0 {
+		if mount != "" {
+			errs = append(errs, fmt.Errorf("mount point given both as -mount and as %s", rest[0]))
+		}
+		cfg.Mountpoint = rest[0]
+		cfg.FuseOptions = append(cfg.FuseOptions, rest[1:]...)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks every setting, reporting all problems at once
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Listen != "" {
+		if err := validAddress(c.Listen); err != nil {
+			fail("listen: %v", err)
+		}
+	} else if len(c.Listeners) == 0 {
+		fail("listen: required unless listeners are given")
+	}
+	for i := range c.Listeners {
+		c.Listeners[i].validate(fmt.Sprintf("listeners[%d]", i), fail)
+	}
+
+	switch {
+	case c.Headless:
+		// Nothing is mounted, so a mount point from a shared file is ignored
+	case c.Mountpoint == "":
+		fail("mountpoint: required unless headless")
+	case runtime.GOOS != "windows":
+		// Drive letters don't exist until mounted; directories must
+		if fi, err := os.Stat(c.Mountpoint); err != nil {
+			fail("mountpoint: %v", err)
+		} else if !fi.IsDir() {
+			fail("mountpoint: %s is not a directory", c.Mountpoint)
+		}
+	}
+
+	for i, l := range c.Links {
+		switch {
+		case !strings.HasPrefix(l.Path, "/") || path.Clean(l.Path) != l.Path || l.Path == "/":
+			fail("links[%d].path: %q must be an absolute, clean path below /", i, l.Path)
+		case l.Target == "":
+			fail("links[%d].target: required", i)
+		}
+		for j, other := range c.Links[:i] {
+			if pathUnder(l.Path, other.Path) || pathUnder(other.Path, l.Path) {
+				fail("links[%d].path: %s overlaps links[%d].path %s", i, l.Path, j, other.Path)
+			}
+		}
+		if l.Target == "" {
+			continue
+		}
+		if fi, err := os.Stat(l.Target); err != nil {
+			fail("links[%d].target: %v", i, err)
+		} else if !fi.IsDir() && !fi.Mode().IsRegular() {
+			fail("links[%d].target: %s is not a directory or regular file", i, l.Target)
+		}
+	}
+
+	if c.Capacity.MaxBytes < 0 {
+		fail("capacity.maxBytes: must not be negative")
+	}
+	if c.Capacity.MaxFiles < 0 {
+		fail("capacity.maxFiles: must not be negative")
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		fail("logLevel: %q is not debug, info, warn or error", c.LogLevel)
+	}
+
+	if c.ShutdownTimeout < 0 {
+		fail("shutdownTimeout: must not be negative")
+	}
+
+	c.Auth.validate(fail)
+
+	return errors.Join(errs...)
+}
+
+// Level returns the log level; call Validate first
+func (c *Config) Level() slog.Level {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.LogLevel))
+	return level
+}
+
+// Apply sets fs up as the configuration says: capacity limits first, then
+// the links, making the directories they sit in
+func (c *Config) Apply(fs *MemFS) error {
+	if errc := fs.SetCapacity(c.Capacity); errc != 0 {
+		return fmt.Errorf("capacity: %s", resultLabel(errc))
+	}
+	for i, l := range c.Links {
+		if err := l.apply(fs); err != nil {
+			return fmt.Errorf("links[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// apply links the target at its path, making the directories it sits in
+func (l LinkConfig) apply(fs *MemFS) error {
+	dir := ""
+	for _, name := range strings.Split(strings.Trim(parentPath(l.Path), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		dir += "/" + name
+		if errc := fs.Mkdir(dir, 0755); errc != 0 && errc != -fuse.EEXIST {
+			return fmt.Errorf("making %s: %s", dir, resultLabel(errc))
+		}
+	}
+	if errc := fs.LinkLocal(l.Path, l.Target); errc != 0 {
+		return fmt.Errorf("linking %s at %s: %s", l.Target, l.Path, resultLabel(errc))
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package gobox
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoadConfig tests that flags override the file and the positional
+// arguments of the old command line still work
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	mnt, docs, music := filepath.Join(dir, "mnt"), filepath.Join(dir, "docs"), filepath.Join(dir, "music")
+	for _, d := range []string{mnt, docs, music} {
+		os.Mkdir(d, 0755)
+	}
+	file := filepath.Join(dir, "gobox.yaml")
+	os.WriteFile(file, []byte(`
+listen: "127.0.0.1:9000"
+mountpoint: `+mnt+`
+fuseOptions: ["-o", "ro"]
+links:
+  - path: /home/docs
+    target: `+docs+`
+capacity:
+  maxBytes: 1048576
+logLevel: debug
+shutdownTimeout: 30s
+`), 0644)
+
+	cfg, err := LoadConfig([]string{"-config", file, "-listen", ":9100", "-link", "/music=" + music, "-max-files", "100", mnt, "-o", "allow_other"})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	want := &Config{
+		Listen:      ":9100",
+		Mountpoint:  mnt,
+		FuseOptions: []string{"-o", "ro", "-o", "allow_other"},
+		Links:       []LinkConfig{{"/home/docs", docs}, {"/music", music}},
+		Capacity:    CapacityOptions{MaxBytes: 1 << 20, MaxFiles: 100},
+		LogLevel:    "debug",
+
+		ShutdownTimeout: 30 * time.Second,
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("config = %+v\nexpected %+v", cfg, want)
+	}
+
+	// Without a file, the defaults apply
+	if cfg, err = LoadConfig([]string{mnt}); err != nil || cfg.Listen != ":8080" || cfg.Mountpoint != mnt {
+		t.Errorf("defaults = %+v, %v", cfg, err)
+	}
+
+	// Typos in the file are caught
+	os.WriteFile(file, []byte("listen: \":1\"\nmountpiont: /x\n"), 0644)
+	if _, err := LoadConfig([]string{"-config", file}); err == nil || !strings.Contains(err.Error(), "mountpiont") {
+		t.Errorf("unknown key = %v", err)
+	}
+	if _, err := LoadConfig([]string{"-nope"}); err != ErrBadFlags {
+		t.Errorf("unknown flag = %v", err)
+	}
+}
+
+// TestConfigValidate tests that every problem is reported at once
+func TestConfigValidate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0644)
+	sock := filepath.Join(dir, "sock")
+	if ln, err := net.Listen("unix", sock); err == nil {
+		defer ln.Close()
+	}
+
+	cfg := &Config{
+		Listen:     "localhost:http-alt",
+		Mountpoint: "",
+		Links: []LinkConfig{
+			{Path: "/a", Target: dir},
+			{Path: "/a/b", Target: dir},
+			{Path: "relative", Target: file},
+			{Path: "/c", Target: filepath.Join(dir, "missing")},
+			{Path: "/d", Target: sock},
+		},
+		Capacity: CapacityOptions{MaxBytes: -1},
+		LogLevel: "loud",
+
+		ShutdownTimeout: -time.Second,
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatalf("Validate passed")
+	}
+	for _, want := range []string{
+		`listen: invalid port "http-alt"`,
+		"mountpoint: required",
+		"links[1].path: /a/b overlaps links[0].path /a",
+		`links[2].path: "relative"`,
+		"links[3].target: stat",
+		"links[4].target: " + sock + " is not a directory or regular file",
+		"capacity.maxBytes",
+		`logLevel: "loud"`,
+		"shutdownTimeout",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("errors lack %q:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "links[2].target") {
+		t.Errorf("file target refused:\n%v", err)
+	}
+
+	// Headless servers need no mount point, and ignore one left in a file
+	cfg = DefaultConfig()
+	cfg.Headless = true
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("headless: %v", err)
+	}
+	cfg.Mountpoint = filepath.Join(dir, "missing")
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("headless with mount point: %v", err)
+	}
+	if cfg, err := LoadConfig([]string{"-headless", "-listen", ":0"}); err != nil || !cfg.Headless {
+		t.Errorf("-headless = %+v, %v", cfg, err)
+	}
+}
+
+// TestConfigApply tests links and limits being set up on a MemFS
+func TestConfigApply(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hi"), 0644)
+
+	fs := newTestFS()
+	cfg := &Config{
+		Links:    []LinkConfig{{Path: "/home/me/docs", Target: dir}},
+		Capacity: CapacityOptions{MaxFiles: 50},
+	}
+	if err := cfg.Apply(fs); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got := string(readFile(t, fs, "/home/me/docs/a.txt", 2)); got != "hi" {
+		t.Errorf("linked file = %q", got)
+	}
+	if c := fs.Capacity(); c.MaxFiles != 50 {
+		t.Errorf("capacity = %+v", c)
+	}
+
+	// Files can be linked as well as directories
+	file := &Config{Links: []LinkConfig{{Path: "/a.txt", Target: filepath.Join(dir, "a.txt")}}}
+	if err := file.Validate(); err != nil && strings.Contains(err.Error(), "links[0]") {
+		t.Errorf("Validate file link: %v", err)
+	}
+	if err := file.Apply(fs); err != nil {
+		t.Errorf("Apply file link: %v", err)
+	}
+
+	// Linking over an existing entry names the link that failed
+	if err := cfg.Apply(fs); err == nil || !strings.Contains(err.Error(), "links[0]") || !strings.Contains(err.Error(), "EEXIST") {
+		t.Errorf("second Apply = %v", err)
+	}
+}
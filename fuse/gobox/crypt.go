@@ -0,0 +1,647 @@
+package gobox
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+const (
+	// cryptConfigName holds the salt and key check at the root of the inner backend
+	cryptConfigName = "gobox.crypt"
+
+	cryptMagic      = "GBXC"
+	cryptVersion    = 1
+	cryptHeaderSize = 32 // magic, version, reserved, 16-byte file ID
+	cryptFileIDSize = 16
+
+	cryptChunkSize  = 4096 // plaintext bytes per chunk
+	cryptNonceSize  = 12
+	cryptTagSize    = 16
+	cryptChunkExtra = cryptNonceSize + cryptTagSize
+	cryptChunkFull  = cryptChunkSize + cryptChunkExtra
+
+	// cryptMaxNameLen keeps encrypted names within the usual 255-byte limit
+	cryptMaxNameLen = 255*5/8 - cryptChunkExtra
+
+	defaultCryptIterations = 600000
+)
+
+var (
+	errWrongKey  = errors.New("wrong passphrase or key file")
+	errNoKey     = errors.New("a passphrase or key file is required")
+	errShortKey  = errors.New("key file must hold at least 32 bytes")
+	cryptCheck   = []byte("gobox crypt key check")
+	nameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+)
+
+// CryptOptions selects how a CryptBackend derives its keys
+type CryptOptions struct {
+	Passphrase string // derive the master key with PBKDF2
+	KeyFile    string // or read it from a file of at least 32 bytes (raw or hex)
+	Iterations int    // PBKDF2 iterations for new volumes; defaults to 600000
+}
+
+// cryptConfig is stored unencrypted in the inner backend
+type cryptConfig struct {
+	Version    int    `json:"version"`
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	Check      []byte `json:"check"` // sealed cryptCheck, verifies the key
+}
+
+// CryptBackend wraps another Backend and encrypts file contents and names.
+// Contents are split into 4 KiB chunks sealed with AES-256-GCM, so reads and
+// writes at any offset only touch the chunks they cover.
+type CryptBackend struct {
+	inner    Backend
+	content  cipher.AEAD
+	names    cipher.AEAD
+	nameSalt []byte // HMAC key for deterministic name nonces
+
+	mu sync.Mutex
+}
+
+// NewCryptBackend wraps inner, creating the key configuration on first use
+func NewCryptBackend(inner Backend, opts CryptOptions) (*CryptBackend, error) {
+	cfg, errc := readCryptConfig(inner)
+	isNew := errc == -fuse.ENOENT
+	if errc != 0 && !isNew {
+		return nil, errors.New("cannot read " + cryptConfigName)
+	}
+	if isNew {
+		cfg = &cryptConfig{Version: cryptVersion, Iterations: opts.Iterations}
+		if cfg.Iterations <= 0 {
+			cfg.Iterations = defaultCryptIterations
+		}
+		cfg.Salt = make([]byte, 32)
+		if _, err := rand.Read(cfg.Salt); err != nil {
+			return nil, err
+		}
+	}
+
+	master, err := cryptMasterKey(opts, cfg)
+	if err != nil {
+		return nil, err
+	}
+	b, err := newCryptBackend(inner, master, cfg.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	if isNew {
+		nonce := make([]byte, cryptNonceSize)
+		rand.Read(nonce)
+		cfg.Check = b.content.Seal(nonce, nonce, cryptCheck, nil)
+		if errc := writeCryptConfig(inner, cfg); errc != 0 {
+			return nil, errors.New("cannot write " + cryptConfigName)
+		}
+		return b, nil
+	}
+
+	if len(cfg.Check) < cryptNonceSize {
+		return nil, errWrongKey
+	}
+	plain, err := b.content.Open(nil, cfg.Check[:cryptNonceSize], cfg.Check[cryptNonceSize:], nil)
+	if err != nil || !bytes.Equal(plain, cryptCheck) {
+		return nil, errWrongKey
+	}
+	return b, nil
+}
+
+// cryptMasterKey derives the master secret from a passphrase or key file
+func cryptMasterKey(opts CryptOptions, cfg *cryptConfig) ([]byte, error) {
+	if opts.KeyFile != "" {
+		raw, err := os.ReadFile(opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		// Hex keys may end in a newline; raw keys are used byte for byte
+		if decoded, err := hex.DecodeString(string(bytes.TrimSpace(raw))); err == nil {
+			raw = decoded
+		}
+		if len(raw) < 32 {
+			return nil, errShortKey
+		}
+		return raw, nil
+	}
+	if opts.Passphrase != "" {
+		return pbkdf2.Key(sha256.New, opts.Passphrase, cfg.Salt, cfg.Iterations, 32)
+	}
+	return nil, errNoKey
+}
+
+// newCryptBackend derives the content and name keys from the master secret
+func newCryptBackend(inner Backend, master, salt []byte) (*CryptBackend, error) {
+	contentKey, err := hkdf.Key(sha256.New, master, salt, "gobox content", 32)
+	if err != nil {
+		return nil, err
+	}
+	nameKey, err := hkdf.Key(sha256.New, master, salt, "gobox names", 32)
+	if err != nil {
+		return nil, err
+	}
+	nameSalt, err := hkdf.Key(sha256.New, master, salt, "gobox name nonces", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := newGCM(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	names, err := newGCM(nameKey)
+	if err != nil {
+		return nil, err
+	}
+	return &CryptBackend{inner: inner, content: content, names: names, nameSalt: nameSalt}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readCryptConfig loads the key configuration from the inner backend root
+func readCryptConfig(inner Backend) (*cryptConfig, int) {
+	st, errc := inner.Stat("/" + cryptConfigName)
+	if errc != 0 {
+		return nil, errc
+	}
+	raw := make([]byte, st.Size)
+	n, errc := inner.Read("/"+cryptConfigName, raw, 0)
+	if errc != 0 {
+		return nil, errc
+	}
+
+	var cfg cryptConfig
+	if err := json.Unmarshal(raw[:n], &cfg); err != nil || cfg.Version != cryptVersion {
+		return nil, -fuse.EIO
+	}
+	return &cfg, 0
+}
+
+// writeCryptConfig stores the key configuration in the inner backend root
+func writeCryptConfig(inner Backend, cfg *cryptConfig) int {
+	raw, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return -fuse.EIO
+	}
+	if errc := inner.Create("/"+cryptConfigName, 0600); errc != 0 {
+		return errc
+	}
+	if _, errc := inner.Write("/"+cryptConfigName, raw, 0); errc != 0 {
+		return errc
+	}
+	return flushBackend(inner, "/"+cryptConfigName)
+}
+
+// ============ Names ============
+
+// encryptName seals a single path component. The nonce is derived from the
+// name itself so the same name always maps to the same ciphertext.
+func (b *CryptBackend) encryptName(name string) (string, int) {
+	if len(name) > cryptMaxNameLen {
+		return "", -fuse.ENAMETOOLONG
+	}
+	mac := hmac.New(sha256.New, b.nameSalt)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:cryptNonceSize]
+
+	sealed := b.names.Seal(nonce, nonce, []byte(name), nil)
+	return nameEncoding.EncodeToString(sealed), 0
+}
+
+// decryptName reverses encryptName; ok is false for foreign names
+func (b *CryptBackend) decryptName(enc string) (string, bool) {
+	raw, err := nameEncoding.DecodeString(enc)
+	if err != nil || len(raw) < cryptChunkExtra {
+		return "", false
+	}
+	plain, err := b.names.Open(nil, raw[:cryptNonceSize], raw[cryptNonceSize:], nil)
+	if err != nil {
+		return "", false
+	}
+	return string(plain), true
+}
+
+// encryptPath encrypts every component of a mount-relative path
+func (b *CryptBackend) encryptPath(path string) (string, int) {
+	if path == "/" {
+		return "/", 0
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, part := range parts {
+		enc, errc := b.encryptName(part)
+		if errc != 0 {
+			return "", errc
+		}
+		parts[i] = enc
+	}
+	return "/" + strings.Join(parts, "/"), 0
+}
+
+// ============ Sizes ============
+
+// plainSize converts the stored size of a file to its plaintext size
+func plainSize(stored int64) int64 {
+	body := stored - cryptHeaderSize
+	if body <= 0 {
+		return 0
+	}
+	size := body / cryptChunkFull * cryptChunkSize
+	if rem := body % cryptChunkFull; rem > cryptChunkExtra {
+		size += rem - cryptChunkExtra
+	}
+	return size
+}
+
+// storedSize converts a plaintext size to the stored size of a file
+func storedSize(plain int64) int64 {
+	size := cryptHeaderSize + plain/cryptChunkSize*cryptChunkFull
+	if rem := plain % cryptChunkSize; rem > 0 {
+		size += rem + cryptChunkExtra
+	}
+	return size
+}
+
+// plainStat rewrites sizes of regular files to their plaintext sizes
+func plainStat(st *fuse.Stat_t) {
+	if st.Mode&fuse.S_IFREG != 0 {
+		st.Size = plainSize(st.Size)
+	}
+}
+
+// ============ Chunks ============
+
+// chunkAAD binds a chunk to its file and position
+func chunkAAD(fileID []byte, index int64) []byte {
+	aad := make([]byte, cryptFileIDSize+8)
+	copy(aad, fileID)
+	binary.BigEndian.PutUint64(aad[cryptFileIDSize:], uint64(index))
+	return aad
+}
+
+// readHeader returns the file ID of an encrypted file. Files that are still
+// empty in the inner backend have no header yet and return a nil ID.
+func (b *CryptBackend) readHeader(encPath string) ([]byte, int) {
+	hdr := make([]byte, cryptHeaderSize)
+	n, errc := b.inner.Read(encPath, hdr, 0)
+	if errc != 0 {
+		return nil, errc
+	}
+	if n == 0 {
+		return nil, 0
+	}
+	if n < cryptHeaderSize || string(hdr[:4]) != cryptMagic || hdr[4] != cryptVersion {
+		return nil, -fuse.EIO
+	}
+	return hdr[cryptHeaderSize-cryptFileIDSize:], 0
+}
+
+// writeHeader starts a new encrypted file and returns its ID
+func (b *CryptBackend) writeHeader(encPath string) ([]byte, int) {
+	hdr := make([]byte, cryptHeaderSize)
+	copy(hdr, cryptMagic)
+	hdr[4] = cryptVersion
+	fileID := hdr[cryptHeaderSize-cryptFileIDSize:]
+	if _, err := rand.Read(fileID); err != nil {
+		return nil, -fuse.EIO
+	}
+	if _, errc := b.inner.Write(encPath, hdr, 0); errc != 0 {
+		return nil, errc
+	}
+	return fileID, 0
+}
+
+// readChunks decrypts chunks [first, last] of a file of the given plaintext size
+func (b *CryptBackend) readChunks(encPath string, fileID []byte, size, first, last int64) ([]byte, int) {
+	if first*cryptChunkSize >= size {
+		return nil, 0
+	}
+	if maxChunk := (size - 1) / cryptChunkSize; last > maxChunk {
+		last = maxChunk
+	}
+
+	raw := make([]byte, (last-first+1)*cryptChunkFull)
+	n, errc := b.inner.Read(encPath, raw, cryptHeaderSize+first*cryptChunkFull)
+	if errc != 0 {
+		return nil, errc
+	}
+	raw = raw[:n]
+
+	plain := make([]byte, 0, (last-first+1)*cryptChunkSize)
+	for i := first; len(raw) > 0; i++ {
+		c := raw
+		if len(c) > cryptChunkFull {
+			c = c[:cryptChunkFull]
+		}
+		raw = raw[len(c):]
+		if len(c) <= cryptChunkExtra {
+			return nil, -fuse.EIO
+		}
+		out, err := b.content.Open(plain[len(plain):], c[:cryptNonceSize], c[cryptNonceSize:], chunkAAD(fileID, i))
+		if err != nil {
+			return nil, -fuse.EIO
+		}
+		plain = plain[:len(plain)+len(out)]
+	}
+	return plain, 0
+}
+
+// writeChunks encrypts plain as consecutive chunks starting at chunk first
+func (b *CryptBackend) writeChunks(encPath string, fileID []byte, first int64, plain []byte) int {
+	raw := make([]byte, 0, int64(len(plain))/cryptChunkSize*cryptChunkFull+cryptChunkFull)
+	for i := first; len(plain) > 0; i++ {
+		c := plain
+		if len(c) > cryptChunkSize {
+			c = c[:cryptChunkSize]
+		}
+		plain = plain[len(c):]
+
+		nonce := make([]byte, cryptNonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return -fuse.EIO
+		}
+		raw = append(raw, nonce...)
+		raw = b.content.Seal(raw, nonce, c, chunkAAD(fileID, i))
+	}
+	_, errc := b.inner.Write(encPath, raw, cryptHeaderSize+first*cryptChunkFull)
+	return errc
+}
+
+// update replaces the plaintext range [ofst, ofst+len(data)) and zero-fills
+// any gap past the current end of file
+func (b *CryptBackend) update(encPath string, data []byte, ofst int64) int {
+	st, errc := b.inner.Stat(encPath)
+	if errc != 0 {
+		return errc
+	}
+	if st.Mode&fuse.S_IFDIR != 0 {
+		return -fuse.EISDIR
+	}
+	size := plainSize(st.Size)
+
+	fileID, errc := b.readHeader(encPath)
+	if errc != 0 {
+		return errc
+	}
+	if fileID == nil {
+		if fileID, errc = b.writeHeader(encPath); errc != 0 {
+			return errc
+		}
+	}
+
+	start := ofst
+	if size < start {
+		start = size // zero-fill from the old end of file
+	}
+	end := ofst + int64(len(data))
+	if end <= start {
+		return 0
+	}
+	first := start / cryptChunkSize
+	last := (end - 1) / cryptChunkSize
+
+	// Existing plaintext of the affected chunks, extended as needed
+	plain, errc := b.readChunks(encPath, fileID, size, first, last)
+	if errc != 0 {
+		return errc
+	}
+	base := first * cryptChunkSize
+	if need := end - base; int64(len(plain)) < need {
+		plain = append(plain, make([]byte, need-int64(len(plain)))...)
+	}
+	copy(plain[ofst-base:], data)
+	return b.writeChunks(encPath, fileID, first, plain)
+}
+
+// ============ Backend ============
+
+// Stat returns file attributes with plaintext sizes
+func (b *CryptBackend) Stat(path string) (*fuse.Stat_t, int) {
+	encPath, errc := b.encryptPath(path)
+	if errc != 0 {
+		return nil, errc
+	}
+	st, errc := b.inner.Stat(encPath)
+	if errc != 0 {
+		return nil, errc
+	}
+	plainStat(st)
+	return st, 0
+}
+
+// Readdir lists directory entries with decrypted names
+func (b *CryptBackend) Readdir(path string) ([]DirEnt, int) {
+	encPath, errc := b.encryptPath(path)
+	if errc != 0 {
+		return nil, errc
+	}
+	ents, errc := b.inner.Readdir(encPath)
+	if errc != 0 {
+		return nil, errc
+	}
+
+	out := make([]DirEnt, 0, len(ents))
+	for _, e := range ents {
+		name, ok := b.decryptName(e.Name)
+		if !ok {
+			continue // the config file, or something not written by us
+		}
+		e.Name = name
+		plainStat(&e.Stat)
+		out = append(out, e)
+	}
+	return out, 0
+}
+
+// Read decrypts only the chunks covering the requested range
+func (b *CryptBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	encPath, errc := b.encryptPath(path)
+	if errc != 0 {
+		return 0, errc
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, errc := b.inner.Stat(encPath)
+	if errc != 0 {
+		return 0, errc
+	}
+	if st.Mode&fuse.S_IFDIR != 0 {
+		return 0, -fuse.EISDIR
+	}
+	size := plainSize(st.Size)
+	if ofst >= size || len(buff) == 0 {
+		return 0, 0
+	}
+
+	fileID, errc := b.readHeader(encPath)
+	if errc != 0 {
+		return 0, errc
+	}
+	end := ofst + int64(len(buff))
+	if end > size {
+		end = size
+	}
+	first := ofst / cryptChunkSize
+	plain, errc := b.readChunks(encPath, fileID, size, first, (end-1)/cryptChunkSize)
+	if errc != 0 {
+		return 0, errc
+	}
+
+	skip := ofst - first*cryptChunkSize
+	if skip >= int64(len(plain)) {
+		return 0, 0
+	}
+	return copy(buff[:end-ofst], plain[skip:]), 0
+}
+
+// Write encrypts the affected chunks, re-sealing partially covered ones
+func (b *CryptBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	encPath, errc := b.encryptPath(path)
+	if errc != 0 {
+		return 0, errc
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if errc := b.update(encPath, buff, ofst); errc != 0 {
+		return 0, errc
+	}
+	return len(buff), 0
+}
+
+// Truncate changes the plaintext size of a file
+func (b *CryptBackend) Truncate(path string, size int64) int {
+	encPath, errc := b.encryptPath(path)
+	if errc != 0 {
+		return errc
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, errc := b.inner.Stat(encPath)
+	if errc != 0 {
+		return errc
+	}
+	old := plainSize(st.Size)
+	if size >= old {
+		return b.update(encPath, nil, size)
+	}
+
+	fileID, errc := b.readHeader(encPath)
+	if errc != 0 {
+		return errc
+	}
+	if fileID == nil {
+		return 0
+	}
+
+	// Re-seal the new last chunk if it is cut in the middle
+	if rem := size % cryptChunkSize; rem != 0 {
+		last := size / cryptChunkSize
+		plain, errc := b.readChunks(encPath, fileID, old, last, last)
+		if errc != 0 {
+			return errc
+		}
+		if errc := b.writeChunks(encPath, fileID, last, plain[:rem]); errc != 0 {
+			return errc
+		}
+	}
+	return b.inner.Truncate(encPath, storedSize(size))
+}
+
+// Mkdir creates a directory with an encrypted name
+func (b *CryptBackend) Mkdir(path string, mode uint32) int {
+	encPath, errc := b.encryptPath(path)
+	if errc != 0 {
+		return errc
+	}
+	return b.inner.Mkdir(encPath, mode)
+}
+
+// Create creates an empty encrypted file
+func (b *CryptBackend) Create(path string, mode uint32) int {
+	encPath, errc := b.encryptPath(path)
+	if errc != 0 {
+		return errc
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if errc := b.inner.Create(encPath, mode); errc != 0 {
+		return errc
+	}
+	_, errc = b.writeHeader(encPath)
+	return errc
+}
+
+// Unlink deletes a file
+func (b *CryptBackend) Unlink(path string) int {
+	encPath, errc := b.encryptPath(path)
+	if errc != 0 {
+		return errc
+	}
+	return b.inner.Unlink(encPath)
+}
+
+// Rmdir removes a directory
+func (b *CryptBackend) Rmdir(path string) int {
+	encPath, errc := b.encryptPath(path)
+	if errc != 0 {
+		return errc
+	}
+	return b.inner.Rmdir(encPath)
+}
+
+// Rename moves or renames a file/directory. Contents are bound to a random
+// file ID rather than the path, so nothing needs re-encrypting.
+func (b *CryptBackend) Rename(oldpath, newpath string) int {
+	encOld, errc := b.encryptPath(oldpath)
+	if errc != 0 {
+		return errc
+	}
+	encNew, errc := b.encryptPath(newpath)
+	if errc != 0 {
+		return errc
+	}
+	return b.inner.Rename(encOld, encNew)
+}
+
+// Flush commits writes staged by the inner backend
+func (b *CryptBackend) Flush(path string) int {
+	encPath, errc := b.encryptPath(path)
+	if errc != 0 {
+		return errc
+	}
+	return flushBackend(b.inner, encPath)
+}
+
+// Sync commits everything the inner backend stages
+func (b *CryptBackend) Sync() int {
+	return syncBackend(b.inner)
+}
@@ -0,0 +1,220 @@
+package gobox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// testCryptOptions keeps PBKDF2 cheap so tests stay fast
+var testCryptOptions = CryptOptions{Passphrase: "correct horse", Iterations: 1000}
+
+func newTestCrypt(t *testing.T, inner Backend) *CryptBackend {
+	t.Helper()
+	b, err := NewCryptBackend(inner, testCryptOptions)
+	if err != nil {
+		t.Fatalf("NewCryptBackend failed: %v", err)
+	}
+	return b
+}
+
+// TestCryptBackendRandomAccess compares reads and writes at arbitrary offsets
+// against a plain in-memory reference
+func TestCryptBackendRandomAccess(t *testing.T) {
+	inner := NewMemBackend()
+	b := newTestCrypt(t, inner)
+
+	assertSuccess(t, b.Create("/data.bin", 0644), "Create")
+	var want []byte
+	apply := func(ofst int, data []byte) {
+		if end := ofst + len(data); end > len(want) {
+			want = append(want, make([]byte, end-len(want))...)
+		}
+		copy(want[ofst:], data)
+	}
+
+	writes := []struct {
+		ofst int
+		size int
+	}{
+		{0, 10},                     // inside the first chunk
+		{4090, 20},                  // straddles a chunk boundary
+		{3 * cryptChunkSize, 100},   // past the end, leaves a zero-filled gap
+		{100, 2 * cryptChunkSize},   // overwrites whole chunks
+		{3*cryptChunkSize + 50, 10}, // inside the last partial chunk
+	}
+	for _, w := range writes {
+		data := make([]byte, w.size)
+		rand.Read(data)
+		n, errc := b.Write("/data.bin", data, int64(w.ofst))
+		if errc != 0 || n != len(data) {
+			t.Fatalf("Write at %d = (%d, %d)", w.ofst, n, errc)
+		}
+		apply(w.ofst, data)
+	}
+
+	st, errc := b.Stat("/data.bin")
+	assertSuccess(t, errc, "Stat")
+	if st.Size != int64(len(want)) {
+		t.Errorf("Stat size = %d, expected %d", st.Size, len(want))
+	}
+	inSt, _ := inner.Stat(mustEncryptPath(t, b, "/data.bin"))
+	if inSt.Size != storedSize(int64(len(want))) {
+		t.Errorf("stored size = %d, expected %d", inSt.Size, storedSize(int64(len(want))))
+	}
+
+	for _, ofst := range []int{0, 5, 4095, 4096, 8000, len(want) - 3} {
+		buff := make([]byte, 5000)
+		n, errc := b.Read("/data.bin", buff, int64(ofst))
+		assertSuccess(t, errc, "Read")
+		end := min(ofst+len(buff), len(want))
+		if !bytes.Equal(buff[:n], want[ofst:end]) {
+			t.Errorf("Read at %d returned wrong data (%d bytes)", ofst, n)
+		}
+	}
+}
+
+// TestCryptBackendTruncate checks shrinking and growing files
+func TestCryptBackendTruncate(t *testing.T) {
+	b := newTestCrypt(t, NewMemBackend())
+	b.Create("/f", 0644)
+	data := bytes.Repeat([]byte("abcdefgh"), 1500) // 12000 bytes, three chunks
+	b.Write("/f", data, 0)
+
+	assertSuccess(t, b.Truncate("/f", 5000), "Truncate shrink")
+	assertSuccess(t, b.Truncate("/f", 6000), "Truncate grow")
+
+	buff := make([]byte, 8000)
+	n, errc := b.Read("/f", buff, 0)
+	assertSuccess(t, errc, "Read")
+	want := append(append([]byte{}, data[:5000]...), make([]byte, 1000)...)
+	if !bytes.Equal(buff[:n], want) {
+		t.Errorf("Read after truncate returned %d bytes, expected %d", n, len(want))
+	}
+
+	assertSuccess(t, b.Truncate("/f", 0), "Truncate to zero")
+	st, _ := b.Stat("/f")
+	if st.Size != 0 {
+		t.Errorf("Stat size = %d, expected 0", st.Size)
+	}
+}
+
+// TestCryptBackendNames checks names are hidden from the inner backend
+func TestCryptBackendNames(t *testing.T) {
+	dir := t.TempDir()
+	b := newTestCrypt(t, NewLocalBackend(dir))
+
+	assertSuccess(t, b.Mkdir("/secret plans", 0755), "Mkdir")
+	assertSuccess(t, b.Create("/secret plans/moon.txt", 0644), "Create")
+	b.Write("/secret plans/moon.txt", []byte("launch at dawn"), 0)
+
+	// Nothing readable leaks into the real folder
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if strings.Contains(p, "secret") || strings.Contains(p, "moon") {
+			t.Errorf("plaintext name in inner path %s", p)
+		}
+		if !info.IsDir() {
+			raw, _ := os.ReadFile(p)
+			if bytes.Contains(raw, []byte("dawn")) {
+				t.Errorf("plaintext content in %s", p)
+			}
+		}
+		return nil
+	})
+
+	ents, errc := b.Readdir("/")
+	assertSuccess(t, errc, "Readdir")
+	if len(ents) != 1 || ents[0].Name != "secret plans" {
+		t.Errorf("Readdir / = %v, expected [secret plans]", ents)
+	}
+
+	assertSuccess(t, b.Rename("/secret plans", "/public"), "Rename")
+	buff := make([]byte, 64)
+	n, errc := b.Read("/public/moon.txt", buff, 0)
+	assertSuccess(t, errc, "Read after rename")
+	if string(buff[:n]) != "launch at dawn" {
+		t.Errorf("Read after rename = %q", buff[:n])
+	}
+
+	_, errc = b.Stat("/" + strings.Repeat("x", cryptMaxNameLen+1))
+	assertError(t, errc, -fuse.ENAMETOOLONG, "Stat long name")
+}
+
+// TestCryptBackendKeys checks reopening with the right and wrong keys
+func TestCryptBackendKeys(t *testing.T) {
+	inner := NewMemBackend()
+	b := newTestCrypt(t, inner)
+	b.Create("/f", 0644)
+	b.Write("/f", []byte("hello"), 0)
+
+	if _, err := NewCryptBackend(inner, CryptOptions{Passphrase: "wrong"}); err != errWrongKey {
+		t.Errorf("wrong passphrase returned %v, expected %v", err, errWrongKey)
+	}
+	if _, err := NewCryptBackend(inner, CryptOptions{}); err != errNoKey {
+		t.Errorf("missing key returned %v, expected %v", err, errNoKey)
+	}
+
+	reopened := newTestCrypt(t, inner)
+	buff := make([]byte, 16)
+	n, _ := reopened.Read("/f", buff, 0)
+	if string(buff[:n]) != "hello" {
+		t.Errorf("Read after reopen = %q, expected %q", buff[:n], "hello")
+	}
+
+	// Tampering with stored content is detected
+	encPath := mustEncryptPath(t, b, "/f")
+	inner.Write(encPath, []byte{0xff}, cryptHeaderSize+cryptNonceSize)
+	_, errc := reopened.Read("/f", buff, 0)
+	assertError(t, errc, -fuse.EIO, "Read tampered chunk")
+}
+
+// TestLinkCrypt tests linking an encrypted folder with a key file
+func TestLinkCrypt(t *testing.T) {
+	fs := newTestFS()
+	tmpDir := t.TempDir()
+	store := filepath.Join(tmpDir, "store")
+	os.Mkdir(store, 0755)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	keyFile := filepath.Join(tmpDir, "key")
+	os.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0600)
+
+	errCode := fs.LinkCrypt("/vault", store, CryptOptions{KeyFile: keyFile})
+	assertSuccess(t, errCode, "LinkCrypt")
+
+	errCode, fh := fs.Create("/vault/note.txt", 0, 0644)
+	assertSuccess(t, errCode, "Create")
+	fs.Write("/vault/note.txt", []byte("top secret"), 0, fh)
+
+	stat := &fuse.Stat_t{}
+	errCode = fs.Getattr("/vault/note.txt", stat, fh)
+	assertSuccess(t, errCode, "Getattr")
+	assertStatSize(t, stat, 10, "/vault/note.txt")
+
+	short := filepath.Join(tmpDir, "short")
+	os.WriteFile(short, []byte("tiny"), 0600)
+	errCode = fs.LinkCrypt("/bad", store, CryptOptions{KeyFile: short})
+	assertError(t, errCode, -fuse.EINVAL, "LinkCrypt with short key")
+
+	other := make([]byte, 32)
+	rand.Read(other)
+	os.WriteFile(short, other, 0600)
+	errCode = fs.LinkCrypt("/bad", store, CryptOptions{KeyFile: short})
+	assertError(t, errCode, -fuse.EACCES, "LinkCrypt with wrong key")
+}
+
+func mustEncryptPath(t *testing.T, b *CryptBackend, path string) string {
+	t.Helper()
+	enc, errc := b.encryptPath(path)
+	if errc != 0 {
+		t.Fatalf("encryptPath %s returned %d", path, errc)
+	}
+	return enc
+}
@@ -0,0 +1,223 @@
+package gobox
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType names a kind of filesystem change
+type EventType string
+
+const (
+	EventCreate   EventType = "create"
+	EventWrite    EventType = "write"
+	EventTruncate EventType = "truncate"
+	EventRename   EventType = "rename"
+	EventUnlink   EventType = "unlink"
+	EventMkdir    EventType = "mkdir"
+	EventRmdir    EventType = "rmdir"
+	EventChmod    EventType = "chmod"
+	EventLink     EventType = "link"
+	EventRescan   EventType = "rescan" // outside changes below Path were lost
+)
+
+// Event describes one change to the filesystem
+type Event struct {
+	Seq      uint64    `json:"seq"`                // assigned when published, starting at 1
+	Type     EventType `json:"type"`               // what happened
+	Path     string    `json:"path"`               // path affected, the new path for renames
+	OldPath  string    `json:"oldPath,omitempty"`  // path before a rename
+	Size     int64     `json:"size"`               // bytes written, or the new size after a truncate
+	External bool      `json:"external,omitempty"` // made by another program to a watched folder
+	Time     time.Time `json:"time"`
+}
+
+const (
+	eventHistory = 4096 // events kept for subscribers resuming after a reconnect
+	eventBuffer  = 256  // events queued per subscriber before it is dropped
+)
+
+// pathUnder reports whether p is prefix or lies below it
+func pathUnder(p, prefix string) bool {
+	if prefix == "" || prefix == "/" || p == prefix {
+		return true
+	}
+	return strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// matches reports whether the event concerns something under prefix
+func (e *Event) matches(prefix string) bool {
+	return pathUnder(e.Path, prefix) || (e.OldPath != "" && pathUnder(e.OldPath, prefix))
+}
+
+// EventBus numbers filesystem changes and hands them to subscribers. It
+// keeps the most recent events so a subscriber that reconnects can pick up
+// where it left off. Publishing never blocks: a subscriber that falls too
+// far behind is dropped and has to resume from its last sequence number.
+type EventBus struct {
+	mu      sync.Mutex
+	seq     uint64
+	history []Event // most recent events, oldest first
+	max     int
+	subs    map[*Subscription]struct{}
+}
+
+// Subscription receives the events under a path prefix on C. C is closed
+// when the subscription is closed or drops behind.
+type Subscription struct {
+	C <-chan Event
+
+	ch     chan Event
+	prefix string
+	bus    *EventBus
+	lagged bool
+}
+
+// NewEventBus creates a bus remembering up to history events
+func NewEventBus(history int) *EventBus {
+	return &EventBus{max: history, subs: make(map[*Subscription]struct{})}
+}
+
+// Publish numbers ev, records it and sends it to matching subscribers
+func (b *EventBus) Publish(ev Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	ev.Seq = b.seq
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if b.max > 0 {
+		if len(b.history) == b.max {
+			copy(b.history, b.history[1:])
+			b.history = b.history[:b.max-1]
+		}
+		b.history = append(b.history, ev)
+	}
+
+	for s := range b.subs {
+		if !ev.matches(s.prefix) {
+			continue
+		}
+		select {
+		case s.ch <- ev:
+		default:
+			s.lagged = true
+			b.remove(s)
+		}
+	}
+	return ev
+}
+
+// Seq returns the sequence number of the latest event
+func (b *EventBus) Seq() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.seq
+}
+
+// advance makes the next sequence number follow seq, for a journal carrying
+// on from an earlier run
+func (b *EventBus) advance(seq uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.seq < seq {
+		b.seq = seq
+	}
+}
+
+// Subscribe starts delivering new events under prefix
+func (b *EventBus) Subscribe(prefix string) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.add(prefix)
+}
+
+// SubscribeFrom starts delivering new events under prefix and returns the
+// remembered events after since that match it. complete is false if some
+// events after since have already been forgotten.
+func (b *EventBus) SubscribeFrom(prefix string, since uint64) (s *Subscription, missed []Event, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	complete = since >= b.seq
+	for _, ev := range b.history {
+		if ev.Seq == since+1 {
+			complete = true
+		}
+		if ev.Seq > since && ev.matches(prefix) {
+			missed = append(missed, ev)
+		}
+	}
+
+	return b.add(prefix), missed, complete
+}
+
+// add registers a new subscription; the caller holds b.mu
+func (b *EventBus) add(prefix string) *Subscription {
+	ch := make(chan Event, eventBuffer)
+	s := &Subscription{C: ch, ch: ch, prefix: prefix, bus: b}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// remove detaches s and closes its channel; the caller holds b.mu
+func (b *EventBus) remove(s *Subscription) {
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.ch)
+	}
+}
+
+// Close stops the subscription and closes C
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.bus.remove(s)
+}
+
+// Lagged reports whether the subscription was dropped for falling behind
+func (s *Subscription) Lagged() bool {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	return s.lagged
+}
+
+// Events returns the bus MemFS publishes its changes on
+func (fs *MemFS) Events() *EventBus {
+	return fs.events
+}
+
+// changed publishes an event for path if errc reports success, and returns
+// errc so callers can wrap their result in it
+func (fs *MemFS) changed(errc int, t EventType, path string) int {
+	if errc == 0 {
+		fs.events.Publish(Event{Type: t, Path: path})
+	}
+	return errc
+}
+
+// renamed publishes a rename event if errc reports success, and returns errc
+func (fs *MemFS) renamed(errc int, oldpath, newpath string) int {
+	if errc == 0 {
+		fs.events.Publish(Event{Type: EventRename, Path: newpath, OldPath: oldpath})
+	}
+	return errc
+}
+
+// written publishes a write event for n bytes if n is not an error code,
+// and returns n
+func (fs *MemFS) written(path string, n int) int {
+	if n >= 0 {
+		fs.events.Publish(Event{Type: EventWrite, Path: path, Size: int64(n)})
+	}
+	return n
+}
+
+// truncated publishes a truncate event and returns 0
+func (fs *MemFS) truncated(path string, size int64) int {
+	fs.events.Publish(Event{Type: EventTruncate, Path: path, Size: size})
+	return 0
+}
@@ -0,0 +1,197 @@
+package gobox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextEvent waits for an event on sub
+func nextEvent(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-sub.C:
+		if !ok {
+			t.Fatalf("subscription closed")
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatalf("no event")
+	}
+	return Event{}
+}
+
+// TestEventBus tests numbering, prefix filters, resuming and dropping
+func TestEventBus(t *testing.T) {
+	b := NewEventBus(3)
+	docs := b.Subscribe("/docs")
+	defer docs.Close()
+
+	b.Publish(Event{Type: EventCreate, Path: "/docs/a"})
+	b.Publish(Event{Type: EventCreate, Path: "/docsx"})
+	b.Publish(Event{Type: EventRename, Path: "/tmp/a", OldPath: "/docs/a"})
+	if ev := nextEvent(t, docs); ev.Seq != 1 || ev.Path != "/docs/a" || ev.Time.IsZero() {
+		t.Errorf("first event = %+v", ev)
+	}
+	if ev := nextEvent(t, docs); ev.Seq != 3 || ev.Type != EventRename {
+		t.Errorf("rename out of /docs = %+v", ev)
+	}
+
+	// Resuming within the history is complete; before it is not
+	_, missed, complete := b.SubscribeFrom("", 1)
+	if !complete || len(missed) != 2 || missed[0].Seq != 2 {
+		t.Errorf("SubscribeFrom(1) = %v, %v", missed, complete)
+	}
+	b.Publish(Event{Type: EventUnlink, Path: "/x"})
+	if _, missed, complete = b.SubscribeFrom("", 0); complete || len(missed) != 3 {
+		t.Errorf("SubscribeFrom(0) after history wrapped = %v, %v", missed, complete)
+	}
+	if _, missed, complete = b.SubscribeFrom("", 4); !complete || len(missed) != 0 {
+		t.Errorf("SubscribeFrom(latest) = %v, %v", missed, complete)
+	}
+
+	// A subscriber that stops reading is dropped instead of blocking
+	slow := b.Subscribe("/")
+	for i := 0; i < eventBuffer+1; i++ {
+		b.Publish(Event{Type: EventWrite, Path: "/f"})
+	}
+	n := 0
+	for range slow.C {
+		n++
+	}
+	if n != eventBuffer || !slow.Lagged() {
+		t.Errorf("slow subscriber got %d events, lagged %v", n, slow.Lagged())
+	}
+}
+
+// TestMemFSEvents tests the events MemFS publishes
+func TestMemFSEvents(t *testing.T) {
+	fs := newTestFS()
+	sub := fs.Events().Subscribe("/")
+	defer sub.Close()
+
+	fs.Mkdir("/dir", 0755)
+	_, fh := fs.Create("/dir/f", os.O_RDWR, 0644)
+	fs.Write("/dir/f", []byte("hello"), 0, fh)
+	fs.Truncate("/dir/f", 2, fh)
+	fs.Chmod("/dir/f", 0600)
+	fs.Rename("/dir/f", "/dir/g")
+	fs.Unlink("/dir/g")
+	fs.Rmdir("/dir")
+	fs.LinkBackend("/mnt", NewMemBackend())
+	fs.Mkdir("/mnt/sub", 0755)
+	fs.Unlink("/missing")
+
+	expected := []Event{
+		{Type: EventMkdir, Path: "/dir"},
+		{Type: EventCreate, Path: "/dir/f"},
+		{Type: EventWrite, Path: "/dir/f", Size: 5},
+		{Type: EventTruncate, Path: "/dir/f", Size: 2},
+		{Type: EventChmod, Path: "/dir/f"},
+		{Type: EventRename, Path: "/dir/g", OldPath: "/dir/f"},
+		{Type: EventUnlink, Path: "/dir/g"},
+		{Type: EventRmdir, Path: "/dir"},
+		{Type: EventLink, Path: "/mnt"},
+		{Type: EventMkdir, Path: "/mnt/sub"},
+	}
+	for i, want := range expected {
+		got := nextEvent(t, sub)
+		if got.Seq != uint64(i+1) || got.Type != want.Type || got.Path != want.Path ||
+			got.OldPath != want.OldPath || got.Size != want.Size {
+			t.Errorf("event %d = %+v, expected %+v", i, got, want)
+		}
+	}
+	select {
+	case ev := <-sub.C:
+		t.Errorf("failed call published %+v", ev)
+	default:
+	}
+}
+
+// readSSE reads one Server-Sent Event, skipping comments
+func readSSE(t *testing.T, r *bufio.Reader) (id, event, data string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return id, event, data
+		case strings.HasPrefix(line, "id: "):
+			id = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			event = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			data = line[6:]
+		}
+	}
+}
+
+// TestEventsSSE tests the REST event stream with a prefix and resuming
+func TestEventsSSE(t *testing.T) {
+	fs := newTestFS()
+	s := NewAPIServer(fs)
+	srv := httptest.NewServer(http.HandlerFunc(s.handleEvents))
+	defer srv.Close()
+
+	fs.Mkdir("/docs", 0755)
+	fs.Mkdir("/other", 0755)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?prefix=/docs&since=0", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+
+	// The replayed mkdir, then a live create; /other is filtered out
+	if id, event, _ := readSSE(t, r); id != "1" || event != "mkdir" {
+		t.Errorf("replayed event = %s %s", id, event)
+	}
+	fs.Create("/other/x", os.O_RDWR, 0644)
+	fs.Create("/docs/a", os.O_RDWR, 0644)
+	id, event, data := readSSE(t, r)
+	var ev Event
+	json.Unmarshal([]byte(data), &ev)
+	if id != "4" || event != "create" || ev.Path != "/docs/a" {
+		t.Errorf("live event = %s %s %s", id, event, data)
+	}
+	cancel()
+
+	// Reconnecting with Last-Event-ID picks up what happened meanwhile
+	fs.Unlink("/docs/a")
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?prefix=/docs", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(ev.Seq, 10))
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	if id, event, _ := readSSE(t, bufio.NewReader(resp2.Body)); id != "5" || event != "unlink" {
+		t.Errorf("resumed event = %s %s", id, event)
+	}
+
+	w := httptest.NewRecorder()
+	s.handleEvents(w, httptest.NewRequest(http.MethodGet, "/api/events?since=abc", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad since = %d", w.Code)
+	}
+}
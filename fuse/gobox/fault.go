@@ -0,0 +1,293 @@
+package gobox
+
+import (
+	"errors"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+var (
+	errUnknownFaultOp = errors.New("unknown operation")
+	errBadFaultRule   = errors.New("invalid fault rule")
+)
+
+// faultOps are the operation names a FaultRule can target
+var faultOps = map[string]bool{
+	"stat": true, "readdir": true, "read": true, "write": true, "truncate": true,
+	"mkdir": true, "create": true, "unlink": true, "rmdir": true, "rename": true,
+	"flush": true, "sync": true,
+}
+
+// FaultRule describes a failure to inject into matching calls. A rule with
+// no Errno, ShortRead or PartialWrite only adds its delay.
+type FaultRule struct {
+	ID           int    `json:"id"`           // assigned when the rule is added
+	Op           string `json:"op"`           // operation name, "" for all
+	Path         string `json:"path"`         // path.Match pattern on the path or an ancestor, "" for all
+	Errno        int    `json:"errno"`        // positive errno to fail with, such as 5 for EIO
+	DelayMs      int64  `json:"delayMs"`      // latency added before the call
+	ShortRead    int    `json:"shortRead"`    // reads return at most this many bytes
+	PartialWrite int    `json:"partialWrite"` // writes store only this many bytes
+	Every        int    `json:"every"`        // fire on every Nth matching call; 0 or 1 for all
+	Limit        int    `json:"limit"`        // stop after firing this many times; 0 for no limit
+	Matched      int64  `json:"matched"`      // matching calls seen so far
+	Fired        int64  `json:"fired"`        // calls the rule was applied to
+}
+
+// matches reports whether the rule covers op on p
+func (r *FaultRule) matches(op, p string) bool {
+	if r.Op != "" && r.Op != op {
+		return false
+	}
+	return r.Path == "" || matchPath(r.Path, p)
+}
+
+// matchPath reports whether the path.Match pattern matches p or one of its
+// ancestors, so a pattern naming a directory covers everything below it
+func matchPath(pattern, p string) bool {
+	for {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+		if p == "/" {
+			return false
+		}
+		p = parentPath(p)
+	}
+}
+
+// FaultBackend wraps a Backend and injects failures according to a list of
+// rules that can be changed while it is in use. The first rule that matches
+// a call and is due to fire decides what happens to it.
+type FaultBackend struct {
+	inner Backend
+
+	mu     sync.Mutex
+	rules  []*FaultRule
+	nextID int
+}
+
+// NewFaultBackend wraps inner with no rules, so it behaves like inner
+func NewFaultBackend(inner Backend) *FaultBackend {
+	return &FaultBackend{inner: inner}
+}
+
+// Unwrap returns the backend faults are injected into
+func (b *FaultBackend) Unwrap() Backend {
+	return b.inner
+}
+
+// AddRule appends a rule and returns it with its ID
+func (b *FaultBackend) AddRule(r FaultRule) (FaultRule, error) {
+	if r.Op != "" && !faultOps[r.Op] {
+		return FaultRule{}, errUnknownFaultOp
+	}
+	if _, err := path.Match(r.Path, "/"); err != nil {
+		return FaultRule{}, err
+	}
+	if r.Errno < 0 || r.DelayMs < 0 || r.ShortRead < 0 || r.PartialWrite < 0 || r.Every < 0 || r.Limit < 0 {
+		return FaultRule{}, errBadFaultRule
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	r.ID = b.nextID
+	r.Matched, r.Fired = 0, 0
+	b.rules = append(b.rules, &r)
+	return r, nil
+}
+
+// RemoveRule deletes the rule with the given ID, or every rule if id is 0.
+// It reports whether anything was removed.
+func (b *FaultBackend) RemoveRule(id int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if id == 0 {
+		removed := len(b.rules) > 0
+		b.rules = nil
+		return removed
+	}
+	for i, r := range b.rules {
+		if r.ID == id {
+			b.rules = append(b.rules[:i], b.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Rules returns a snapshot of the rules and their counters
+func (b *FaultBackend) Rules() []FaultRule {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]FaultRule, 0, len(b.rules))
+	for _, r := range b.rules {
+		out = append(out, *r)
+	}
+	return out
+}
+
+// inject picks the rule that fires for op on p, sleeps for its delay and
+// returns a copy of it, or nil if no rule fires
+func (b *FaultBackend) inject(op, p string) *FaultRule {
+	b.mu.Lock()
+	var fire *FaultRule
+	for _, r := range b.rules {
+		if !r.matches(op, p) {
+			continue
+		}
+		r.Matched++
+		if r.Every > 1 && r.Matched%int64(r.Every) != 0 {
+			continue
+		}
+		if r.Limit > 0 && r.Fired >= int64(r.Limit) {
+			continue
+		}
+		r.Fired++
+		c := *r
+		fire = &c
+		break
+	}
+	b.mu.Unlock()
+
+	if fire != nil && fire.DelayMs > 0 {
+		time.Sleep(time.Duration(fire.DelayMs) * time.Millisecond)
+	}
+	return fire
+}
+
+// fail runs the common part of a call: it returns the injected error code,
+// or 0 if the call should go through
+func (b *FaultBackend) fail(op, p string) int {
+	if r := b.inject(op, p); r != nil && r.Errno > 0 {
+		return -r.Errno
+	}
+	return 0
+}
+
+// Stat returns file attributes
+func (b *FaultBackend) Stat(path string) (*fuse.Stat_t, int) {
+	if errc := b.fail("stat", path); errc != 0 {
+		return nil, errc
+	}
+	return b.inner.Stat(path)
+}
+
+// Readdir lists directory contents
+func (b *FaultBackend) Readdir(path string) ([]DirEnt, int) {
+	if errc := b.fail("readdir", path); errc != 0 {
+		return nil, errc
+	}
+	return b.inner.Readdir(path)
+}
+
+// Read reads file content, possibly returning fewer bytes than asked for
+func (b *FaultBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	r := b.inject("read", path)
+	if r != nil && r.Errno > 0 {
+		return 0, -r.Errno
+	}
+	if r != nil && r.ShortRead > 0 && r.ShortRead < len(buff) {
+		buff = buff[:r.ShortRead]
+	}
+	return b.inner.Read(path, buff, ofst)
+}
+
+// Write writes file content, possibly storing only a prefix of it
+func (b *FaultBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	r := b.inject("write", path)
+	if r != nil && r.Errno > 0 {
+		return 0, -r.Errno
+	}
+	if r != nil && r.PartialWrite > 0 && r.PartialWrite < len(buff) {
+		buff = buff[:r.PartialWrite]
+	}
+	return b.inner.Write(path, buff, ofst)
+}
+
+// Truncate changes file size
+func (b *FaultBackend) Truncate(path string, size int64) int {
+	if errc := b.fail("truncate", path); errc != 0 {
+		return errc
+	}
+	return b.inner.Truncate(path, size)
+}
+
+// Mkdir creates a directory
+func (b *FaultBackend) Mkdir(path string, mode uint32) int {
+	if errc := b.fail("mkdir", path); errc != 0 {
+		return errc
+	}
+	return b.inner.Mkdir(path, mode)
+}
+
+// Create creates a new file
+func (b *FaultBackend) Create(path string, mode uint32) int {
+	if errc := b.fail("create", path); errc != 0 {
+		return errc
+	}
+	return b.inner.Create(path, mode)
+}
+
+// Unlink removes a file
+func (b *FaultBackend) Unlink(path string) int {
+	if errc := b.fail("unlink", path); errc != 0 {
+		return errc
+	}
+	return b.inner.Unlink(path)
+}
+
+// Rmdir removes a directory
+func (b *FaultBackend) Rmdir(path string) int {
+	if errc := b.fail("rmdir", path); errc != 0 {
+		return errc
+	}
+	return b.inner.Rmdir(path)
+}
+
+// Rename moves or renames a file/directory; rules match the old path
+func (b *FaultBackend) Rename(oldpath, newpath string) int {
+	if errc := b.fail("rename", oldpath); errc != 0 {
+		return errc
+	}
+	return b.inner.Rename(oldpath, newpath)
+}
+
+// Flush commits writes staged by the inner backend
+func (b *FaultBackend) Flush(path string) int {
+	if errc := b.fail("flush", path); errc != 0 {
+		return errc
+	}
+	return flushBackend(b.inner, path)
+}
+
+// Sync commits everything the inner backend stages, unless a rule for
+// "sync" fails it first
+func (b *FaultBackend) Sync() int {
+	if errc := b.fail("sync", "/"); errc != 0 {
+		return errc
+	}
+	return syncBackend(b.inner)
+}
+
+// Watch reports outside changes to the inner backend
+func (b *FaultBackend) Watch(notify func(BackendChange)) error {
+	return watchBackend(b.inner, notify)
+}
+
+// Unwatch stops reporting outside changes
+func (b *FaultBackend) Unwatch() {
+	unwatchBackend(b.inner)
+}
+
+// Invalidate passes an outside change on to the inner backend
+func (b *FaultBackend) Invalidate(path string) {
+	invalidateBackend(b.inner, path)
+}
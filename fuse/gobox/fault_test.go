@@ -0,0 +1,183 @@
+package gobox
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func newTestFault(t *testing.T) *FaultBackend {
+	t.Helper()
+	mb := NewMemBackend()
+	mb.Mkdir("/logs", 0755)
+	mb.Mkdir("/data", 0755)
+	mb.Mkdir("/data/deep", 0755)
+	for _, p := range []string{"/logs/a.log", "/data/deep/f", "/top.txt"} {
+		mb.Create(p, 0644)
+		mb.Write(p, []byte("0123456789"), 0)
+	}
+	return NewFaultBackend(mb)
+}
+
+func addRule(t *testing.T, b *FaultBackend, r FaultRule) FaultRule {
+	t.Helper()
+	added, err := b.AddRule(r)
+	if err != nil {
+		t.Fatalf("AddRule(%+v): %v", r, err)
+	}
+	return added
+}
+
+// TestFaultBackendMatching tests which calls a rule applies to
+func TestFaultBackendMatching(t *testing.T) {
+	b := newTestFault(t)
+	buff := make([]byte, 10)
+
+	addRule(t, b, FaultRule{Op: "read", Path: "/logs/*.log", Errno: fuse.EIO})
+	_, errc := b.Read("/logs/a.log", buff, 0)
+	assertError(t, errc, -fuse.EIO, "Read matching file")
+	_, errc = b.Stat("/logs/a.log")
+	assertSuccess(t, errc, "Stat is another operation")
+	_, errc = b.Read("/top.txt", buff, 0)
+	assertSuccess(t, errc, "Read another path")
+
+	// A pattern matching a directory covers everything below it
+	addRule(t, b, FaultRule{Path: "/data", Errno: fuse.EACCES})
+	_, errc = b.Stat("/data/deep/f")
+	assertError(t, errc, -fuse.EACCES, "Stat below matching directory")
+	assertError(t, b.Unlink("/data/deep/f"), -fuse.EACCES, "Unlink below matching directory")
+
+	if !b.RemoveRule(1) || b.RemoveRule(1) {
+		t.Errorf("RemoveRule(1) did not remove exactly once")
+	}
+	_, errc = b.Read("/logs/a.log", buff, 0)
+	assertSuccess(t, errc, "Read after RemoveRule")
+	b.RemoveRule(0)
+	if len(b.Rules()) != 0 {
+		t.Errorf("RemoveRule(0) left %d rules", len(b.Rules()))
+	}
+
+	for _, bad := range []FaultRule{{Op: "chmod"}, {Path: "["}, {Errno: -5}, {Every: -1}} {
+		if _, err := b.AddRule(bad); err == nil {
+			t.Errorf("AddRule(%+v) accepted an invalid rule", bad)
+		}
+	}
+}
+
+// TestFaultBackendSchedule tests every-Nth and limited rules
+func TestFaultBackendSchedule(t *testing.T) {
+	b := newTestFault(t)
+
+	addRule(t, b, FaultRule{Op: "stat", Every: 3, Errno: fuse.ETIMEDOUT})
+	var failed []int
+	for i := 1; i <= 7; i++ {
+		if _, errc := b.Stat("/top.txt"); errc != 0 {
+			failed = append(failed, i)
+		}
+	}
+	if len(failed) != 2 || failed[0] != 3 || failed[1] != 6 {
+		t.Errorf("failed calls = %v, expected [3 6]", failed)
+	}
+
+	addRule(t, b, FaultRule{Op: "mkdir", Limit: 1, Errno: fuse.ENOSPC})
+	assertError(t, b.Mkdir("/x", 0755), -fuse.ENOSPC, "first Mkdir")
+	assertSuccess(t, b.Mkdir("/y", 0755), "second Mkdir")
+
+	rules := b.Rules()
+	if rules[0].Matched != 7 || rules[0].Fired != 2 || rules[1].Fired != 1 {
+		t.Errorf("counters = %+v", rules)
+	}
+}
+
+// TestFaultBackendShortIO tests short reads, partial writes and latency
+func TestFaultBackendShortIO(t *testing.T) {
+	b := newTestFault(t)
+	addRule(t, b, FaultRule{Op: "read", ShortRead: 3})
+	addRule(t, b, FaultRule{Op: "write", PartialWrite: 2, DelayMs: 20})
+
+	buff := make([]byte, 10)
+	n, errc := b.Read("/top.txt", buff, 0)
+	if errc != 0 || n != 3 || string(buff[:n]) != "012" {
+		t.Errorf("short Read = (%d, %d) %q", n, errc, buff[:n])
+	}
+
+	start := time.Now()
+	n, errc = b.Write("/top.txt", []byte("abcd"), 0)
+	if errc != 0 || n != 2 {
+		t.Errorf("partial Write = (%d, %d), expected (2, 0)", n, errc)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("Write took %v, expected the 20ms delay", d)
+	}
+	b.RemoveRule(0)
+	n, _ = b.Read("/top.txt", buff, 0)
+	if string(buff[:n]) != "ab23456789" {
+		t.Errorf("contents after partial write = %q", buff[:n])
+	}
+}
+
+// TestFaultInject tests injecting faults into a MemFS mount
+func TestFaultInject(t *testing.T) {
+	fs := newTestFS()
+	fs.LinkBackend("/flaky", NewMemBackend())
+
+	rule, errCode := fs.FaultInject("/flaky", FaultRule{Op: "create", Path: "/*.tmp", Errno: fuse.ENOSPC})
+	assertSuccess(t, errCode, "FaultInject")
+	errCode, _ = fs.Create("/flaky/a.tmp", os.O_RDWR, 0644)
+	assertError(t, errCode, -fuse.ENOSPC, "Create matching file")
+	errCode, _ = fs.Create("/flaky/a.txt", os.O_RDWR, 0644)
+	assertSuccess(t, errCode, "Create other file")
+
+	rules, errCode := fs.FaultRules("/flaky")
+	assertSuccess(t, errCode, "FaultRules")
+	if len(rules) != 1 || rules[0].ID != rule.ID || rules[0].Fired != 1 {
+		t.Errorf("FaultRules = %+v", rules)
+	}
+
+	assertError(t, fs.FaultClear("/flaky", 99), -fuse.ENOENT, "FaultClear unknown rule")
+	assertSuccess(t, fs.FaultClear("/flaky", rule.ID), "FaultClear")
+	errCode, _ = fs.Create("/flaky/a.tmp", os.O_RDWR, 0644)
+	assertSuccess(t, errCode, "Create after FaultClear")
+
+	_, errCode = fs.FaultInject("/", FaultRule{Errno: fuse.EIO})
+	assertError(t, errCode, -fuse.EINVAL, "FaultInject on in-memory directory")
+	_, errCode = fs.FaultInject("/flaky", FaultRule{Op: "fsync"})
+	assertError(t, errCode, -fuse.EINVAL, "FaultInject with unknown operation")
+}
+
+// TestFaultInjectWrapped tests mounts keeping their cache and mirror
+// controls once faults are injected in front of them
+func TestFaultInjectWrapped(t *testing.T) {
+	fs := newTestFS()
+	fs.LinkBackend("/cached", NewMemBackend())
+	assertSuccess(t, fs.CacheMount("/cached", CacheOptions{}), "CacheMount")
+	_, errCode := fs.FaultInject("/cached", FaultRule{Op: "read", Errno: fuse.EIO})
+	assertSuccess(t, errCode, "FaultInject")
+
+	_, errCode = fs.CacheStats("/cached")
+	assertSuccess(t, errCode, "CacheStats behind faults")
+	assertError(t, fs.CacheMount("/cached", CacheOptions{}), -fuse.EEXIST, "second CacheMount")
+
+	// More rules go to the same wrapper
+	_, errCode = fs.FaultInject("/cached", FaultRule{Op: "write", Errno: fuse.EIO})
+	assertSuccess(t, errCode, "second FaultInject")
+	rules, _ := fs.FaultRules("/cached")
+	if len(rules) != 2 {
+		t.Errorf("FaultRules = %+v", rules)
+	}
+
+	fs.LinkBackend("/mirror", NewMirrorBackend(NewMemBackend(), NewMemBackend()))
+	_, errCode = fs.FaultInject("/mirror", FaultRule{Op: "stat", Errno: fuse.EIO})
+	assertSuccess(t, errCode, "FaultInject on mirror")
+	_, errCode = fs.MirrorStatus("/mirror")
+	assertSuccess(t, errCode, "MirrorStatus behind faults")
+	assertSuccess(t, fs.MirrorResync("/mirror", false), "MirrorResync behind faults")
+	// A cache added later doesn't hide the faults behind it
+	assertSuccess(t, fs.CacheMount("/mirror", CacheOptions{}), "CacheMount on mirror")
+	rules, _ = fs.FaultRules("/mirror")
+	if len(rules) != 1 {
+		t.Errorf("FaultRules behind a cache = %+v", rules)
+	}
+}
@@ -0,0 +1,460 @@
+package gobox
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+const (
+	gitRefTTL          = time.Second // how long a snapshot of the refs is reused
+	gitBlobCacheBytes  = 64 << 20    // total size of cached blob contents
+	gitBlobCacheMaxOne = 16 << 20    // larger blobs are streamed instead of cached
+)
+
+// gitRefs is a snapshot of the repository's refs by their short names
+type gitRefs struct {
+	names  map[string]plumbing.ReferenceName // short name -> full ref name
+	taken  time.Time
+	newest time.Time // newest commit time, used for the virtual directories
+}
+
+// gitBlob is a cached blob's contents
+type gitBlob struct {
+	hash plumbing.Hash
+	data []byte
+}
+
+// gitStream is an open reader over a large blob, reused by sequential reads
+type gitStream struct {
+	rc  io.ReadCloser
+	pos int64
+}
+
+// GitBackend implements a read-only Backend over a git repository's object
+// database. The root lists branches, tags and HEAD; "/<ref>/<path>" is the
+// tree of the commit that ref points to. Any revision git understands, such
+// as a commit hash or "main~2", also works as the first component even
+// though it is not listed. Ref names containing slashes appear as nested
+// directories. All times under a ref are its commit's committer time.
+type GitBackend struct {
+	repo        *git.Repository
+	streamAbove int64 // blobs larger than this are streamed instead of cached
+
+	mu      sync.Mutex
+	refs    *gitRefs
+	blobs   map[plumbing.Hash]*list.Element // element holds *gitBlob
+	lru     *list.List
+	cached  int64
+	streams map[plumbing.Hash]*gitStream
+}
+
+// NewGitBackend opens a bare or non-bare repository
+func NewGitBackend(repoPath string) (*GitBackend, error) {
+	repo, err := git.PlainOpen(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	return &GitBackend{
+		repo:        repo,
+		streamAbove: gitBlobCacheMaxOne,
+		blobs:       make(map[plumbing.Hash]*list.Element),
+		lru:         list.New(),
+		streams:     make(map[plumbing.Hash]*gitStream),
+	}, nil
+}
+
+// Close releases open blob readers
+func (b *GitBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for h, s := range b.streams {
+		s.rc.Close()
+		delete(b.streams, h)
+	}
+	return nil
+}
+
+// ============ Refs ============
+
+// snapshot returns the current refs, re-reading them once gitRefTTL has
+// passed. Callers hold b.mu.
+func (b *GitBackend) snapshot() *gitRefs {
+	if b.refs != nil && time.Since(b.refs.taken) < gitRefTTL {
+		return b.refs
+	}
+	refs := &gitRefs{names: make(map[string]plumbing.ReferenceName), taken: time.Now()}
+	iter, err := b.repo.References()
+	if err != nil {
+		b.refs = refs
+		return refs
+	}
+	// Branches win over tags, and tags over remote-tracking branches
+	rank := func(n plumbing.ReferenceName) int {
+		switch {
+		case n.IsBranch():
+			return 0
+		case n.IsTag():
+			return 1
+		default:
+			return 2
+		}
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		n := ref.Name()
+		if !n.IsBranch() && !n.IsTag() && !n.IsRemote() {
+			return nil
+		}
+		short := n.Short()
+		if strings.HasSuffix(short, "/HEAD") {
+			return nil // origin/HEAD duplicates the remote's default branch
+		}
+		if old, ok := refs.names[short]; !ok || rank(n) < rank(old) {
+			refs.names[short] = n
+		}
+		return nil
+	})
+	if _, err := b.repo.Head(); err == nil {
+		refs.names["HEAD"] = plumbing.HEAD
+	}
+	for _, n := range refs.names {
+		if c, err := b.commit(string(n)); err == nil && c.Committer.When.After(refs.newest) {
+			refs.newest = c.Committer.When
+		}
+	}
+	b.refs = refs
+	return refs
+}
+
+// commit resolves a revision to its commit
+func (b *GitBackend) commit(rev string) (*object.Commit, error) {
+	h, err := b.repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, err
+	}
+	return b.repo.CommitObject(*h)
+}
+
+// gitLocation is what a mount-relative path refers to
+type gitLocation struct {
+	commit *object.Commit // nil for the root and ref-name directories
+	rest   string         // path inside the commit's tree, "" for its root
+	prefix string         // ref-name directory, e.g. "feature" for feature/x
+}
+
+// locate splits a path into a ref and a path inside its tree, taking the
+// longest ref name that matches. Callers hold b.mu.
+func (b *GitBackend) locate(path string) (gitLocation, int) {
+	if path == "/" {
+		return gitLocation{}, 0
+	}
+	refs := b.snapshot()
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i := len(parts); i > 0; i-- {
+		name := strings.Join(parts[:i], "/")
+		full, ok := refs.names[name]
+		if !ok {
+			continue
+		}
+		c, err := b.commit(string(full))
+		if err != nil {
+			return gitLocation{}, -fuse.EIO
+		}
+		return gitLocation{commit: c, rest: strings.Join(parts[i:], "/")}, 0
+	}
+
+	// A directory of ref names sharing a prefix
+	prefix := strings.Join(parts, "/")
+	for name := range refs.names {
+		if strings.HasPrefix(name, prefix+"/") {
+			return gitLocation{prefix: prefix}, 0
+		}
+	}
+
+	// Any other revision, resolved but not listed
+	if c, err := b.commit(parts[0]); err == nil {
+		return gitLocation{commit: c, rest: strings.Join(parts[1:], "/")}, 0
+	}
+	return gitLocation{}, -fuse.ENOENT
+}
+
+func gitDirStat(t time.Time) fuse.Stat_t {
+	ts := fuse.NewTimespec(t)
+	return fuse.Stat_t{Mode: fuse.S_IFDIR | 0555, Nlink: 2, Atim: ts, Mtim: ts, Ctim: ts}
+}
+
+// entryStat builds attributes for a tree entry. Symlinks are shown as
+// regular files holding the link target, and submodules as empty
+// directories. Callers hold b.mu.
+func (b *GitBackend) entryStat(e object.TreeEntry, t time.Time) (fuse.Stat_t, int) {
+	switch e.Mode {
+	case filemode.Dir, filemode.Submodule:
+		return gitDirStat(t), 0
+	}
+	size, err := b.repo.Storer.EncodedObjectSize(e.Hash)
+	if err != nil {
+		return fuse.Stat_t{}, -fuse.EIO
+	}
+	ts := fuse.NewTimespec(t)
+	st := fuse.Stat_t{Mode: fuse.S_IFREG | 0444, Nlink: 1, Size: size, Atim: ts, Mtim: ts, Ctim: ts}
+	if e.Mode == filemode.Executable {
+		st.Mode = fuse.S_IFREG | 0555
+	}
+	return st, 0
+}
+
+// treeEntry finds the entry at rest inside a commit's tree. Callers hold b.mu.
+func (b *GitBackend) treeEntry(c *object.Commit, rest string) (*object.TreeEntry, int) {
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, -fuse.EIO
+	}
+	e, err := tree.FindEntry(rest)
+	if err != nil {
+		if errors.Is(err, object.ErrEntryNotFound) || errors.Is(err, object.ErrDirectoryNotFound) {
+			return nil, -fuse.ENOENT
+		}
+		return nil, -fuse.EIO
+	}
+	return e, 0
+}
+
+// ============ Blobs ============
+
+// readBlob copies blob content at ofst into buff. Small blobs are cached
+// whole; large ones keep a reader open for sequential access. Callers hold
+// b.mu.
+func (b *GitBackend) readBlob(h plumbing.Hash, size int64, buff []byte, ofst int64) (int, int) {
+	if ofst >= size {
+		return 0, 0
+	}
+	if el, ok := b.blobs[h]; ok {
+		b.lru.MoveToFront(el)
+		return copy(buff, el.Value.(*gitBlob).data[ofst:]), 0
+	}
+
+	blob, err := b.repo.BlobObject(h)
+	if err != nil {
+		return 0, -fuse.EIO
+	}
+	if size <= b.streamAbove {
+		rc, err := blob.Reader()
+		if err != nil {
+			return 0, -fuse.EIO
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return 0, -fuse.EIO
+		}
+		b.blobs[h] = b.lru.PushFront(&gitBlob{hash: h, data: data})
+		b.cached += int64(len(data))
+		for b.cached > gitBlobCacheBytes && b.lru.Len() > 1 {
+			old := b.lru.Remove(b.lru.Back()).(*gitBlob)
+			delete(b.blobs, old.hash)
+			b.cached -= int64(len(old.data))
+		}
+		return copy(buff, data[min(ofst, int64(len(data))):]), 0
+	}
+
+	s, ok := b.streams[h]
+	if ok && s.pos > ofst {
+		s.rc.Close()
+		delete(b.streams, h)
+		ok = false
+	}
+	if !ok {
+		rc, err := blob.Reader()
+		if err != nil {
+			return 0, -fuse.EIO
+		}
+		s = &gitStream{rc: rc}
+		b.streams[h] = s
+	}
+	if skip := ofst - s.pos; skip > 0 {
+		n, err := io.CopyN(io.Discard, s.rc, skip)
+		s.pos += n
+		if err != nil {
+			return 0, 0
+		}
+	}
+	n, err := io.ReadFull(s.rc, buff)
+	s.pos += int64(n)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return n, -fuse.EIO
+	}
+	if s.pos >= size {
+		s.rc.Close()
+		delete(b.streams, h)
+	}
+	return n, 0
+}
+
+// ============ Backend ============
+
+// Stat returns file attributes
+func (b *GitBackend) Stat(path string) (*fuse.Stat_t, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	loc, errc := b.locate(path)
+	if errc != 0 {
+		return nil, errc
+	}
+	if loc.commit == nil {
+		st := gitDirStat(b.snapshot().newest)
+		return &st, 0
+	}
+	when := loc.commit.Committer.When
+	if loc.rest == "" {
+		st := gitDirStat(when)
+		return &st, 0
+	}
+	e, errc := b.treeEntry(loc.commit, loc.rest)
+	if errc != 0 {
+		return nil, errc
+	}
+	st, errc := b.entryStat(*e, when)
+	if errc != 0 {
+		return nil, errc
+	}
+	return &st, 0
+}
+
+// Readdir lists refs at the root and tree entries below a ref
+func (b *GitBackend) Readdir(path string) ([]DirEnt, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	loc, errc := b.locate(path)
+	if errc != 0 {
+		return nil, errc
+	}
+
+	if loc.commit == nil {
+		refs := b.snapshot()
+		prefix := ""
+		if loc.prefix != "" {
+			prefix = loc.prefix + "/"
+		}
+		seen := make(map[string]bool)
+		var out []DirEnt
+		for name := range refs.names {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			child, _, _ := strings.Cut(strings.TrimPrefix(name, prefix), "/")
+			if seen[child] {
+				continue
+			}
+			seen[child] = true
+			out = append(out, DirEnt{Name: child, Stat: gitDirStat(refs.newest)})
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+		return out, 0
+	}
+
+	tree, err := loc.commit.Tree()
+	if err != nil {
+		return nil, -fuse.EIO
+	}
+	if loc.rest != "" {
+		e, errc := b.treeEntry(loc.commit, loc.rest)
+		if errc != 0 {
+			return nil, errc
+		}
+		switch e.Mode {
+		case filemode.Submodule:
+			return nil, 0
+		case filemode.Dir:
+		default:
+			return nil, -fuse.ENOTDIR
+		}
+		if tree, err = b.repo.TreeObject(e.Hash); err != nil {
+			return nil, -fuse.EIO
+		}
+	}
+
+	when := loc.commit.Committer.When
+	out := make([]DirEnt, 0, len(tree.Entries))
+	for _, e := range tree.Entries {
+		st, errc := b.entryStat(e, when)
+		if errc != 0 {
+			return nil, errc
+		}
+		out = append(out, DirEnt{Name: e.Name, Stat: st})
+	}
+	return out, 0
+}
+
+// Read reads blob content
+func (b *GitBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	loc, errc := b.locate(path)
+	if errc != 0 {
+		return 0, errc
+	}
+	if loc.commit == nil || loc.rest == "" {
+		return 0, -fuse.EISDIR
+	}
+	e, errc := b.treeEntry(loc.commit, loc.rest)
+	if errc != 0 {
+		return 0, errc
+	}
+	if e.Mode == filemode.Dir || e.Mode == filemode.Submodule {
+		return 0, -fuse.EISDIR
+	}
+	size, err := b.repo.Storer.EncodedObjectSize(e.Hash)
+	if err != nil {
+		return 0, -fuse.EIO
+	}
+	return b.readBlob(e.Hash, size, buff, ofst)
+}
+
+// Write is not supported on git repositories
+func (b *GitBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	return 0, -fuse.EROFS
+}
+
+// Truncate is not supported on git repositories
+func (b *GitBackend) Truncate(path string, size int64) int {
+	return -fuse.EROFS
+}
+
+// Mkdir is not supported on git repositories
+func (b *GitBackend) Mkdir(path string, mode uint32) int {
+	return -fuse.EROFS
+}
+
+// Create is not supported on git repositories
+func (b *GitBackend) Create(path string, mode uint32) int {
+	return -fuse.EROFS
+}
+
+// Unlink is not supported on git repositories
+func (b *GitBackend) Unlink(path string) int {
+	return -fuse.EROFS
+}
+
+// Rmdir is not supported on git repositories
+func (b *GitBackend) Rmdir(path string) int {
+	return -fuse.EROFS
+}
+
+// Rename is not supported on git repositories
+func (b *GitBackend) Rename(oldpath, newpath string) int {
+	return -fuse.EROFS
+}
@@ -0,0 +1,221 @@
+package gobox
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+var (
+	gitTime1 = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	gitTime2 = time.Date(2024, 6, 7, 8, 9, 10, 0, time.UTC)
+)
+
+// testRepo builds a repository with two commits on master, a feature/x
+// branch and tag v1.0 on the first commit, and returns its work tree and
+// both commit hashes
+func testRepo(t *testing.T) (string, plumbing.Hash, plumbing.Hash) {
+	t.Helper()
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, _ := repo.Worktree()
+	write := func(name, data string, mode os.FileMode) {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(data), mode)
+		if _, err := wt.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func(msg string, when time.Time) plumbing.Hash {
+		sig := &object.Signature{Name: "dev", Email: "dev@example.com", When: when}
+		h, err := wt.Commit(msg, &git.CommitOptions{Author: sig, Committer: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	write("README.md", "first\n", 0644)
+	write("src/main.go", "package main\n", 0644)
+	write("build.sh", "#!/bin/sh\n", 0755)
+	c1 := commit("first", gitTime1)
+	repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/feature/x", c1))
+	sig := &object.Signature{Name: "dev", Email: "dev@example.com", When: gitTime1}
+	if _, err := repo.CreateTag("v1.0", c1, &git.CreateTagOptions{Tagger: sig, Message: "v1.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	write("README.md", "second version\n", 0644)
+	c2 := commit("second", gitTime2)
+	return dir, c1, c2
+}
+
+func readAll(t *testing.T, b Backend, path string) string {
+	t.Helper()
+	buff := make([]byte, 256)
+	n, errc := b.Read(path, buff, 0)
+	assertSuccess(t, errc, "Read "+path)
+	return string(buff[:n])
+}
+
+// TestGitBackendRefs tests the ref directories at the top of the mount
+func TestGitBackendRefs(t *testing.T) {
+	dir, c1, _ := testRepo(t)
+	b, err := NewGitBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	names := func(path string) []string {
+		ents, errc := b.Readdir(path)
+		assertSuccess(t, errc, "Readdir "+path)
+		var out []string
+		for _, e := range ents {
+			out = append(out, e.Name)
+		}
+		return out
+	}
+	if got, want := names("/"), []string{"HEAD", "feature", "master", "v1.0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Readdir / = %v, expected %v", got, want)
+	}
+	if got, want := names("/feature"), []string{"x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Readdir /feature = %v, expected %v", got, want)
+	}
+	if got, want := names("/master"), []string{"README.md", "build.sh", "src"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Readdir /master = %v, expected %v", got, want)
+	}
+
+	if got := readAll(t, b, "/master/README.md"); got != "second version\n" {
+		t.Errorf("master README = %q", got)
+	}
+	if got := readAll(t, b, "/v1.0/README.md"); got != "first\n" {
+		t.Errorf("v1.0 README = %q", got)
+	}
+	if got := readAll(t, b, "/feature/x/src/main.go"); got != "package main\n" {
+		t.Errorf("feature/x main.go = %q", got)
+	}
+
+	// Unlisted revisions resolve too
+	if got := readAll(t, b, "/master~1/README.md"); got != "first\n" {
+		t.Errorf("master~1 README = %q", got)
+	}
+	if got := readAll(t, b, "/"+c1.String()[:10]+"/README.md"); got != "first\n" {
+		t.Errorf("abbreviated hash README = %q", got)
+	}
+	_, errc := b.Stat("/nosuchref")
+	assertError(t, errc, -fuse.ENOENT, "Stat unknown ref")
+}
+
+// TestGitBackendStat tests attributes derived from commits and tree entries
+func TestGitBackendStat(t *testing.T) {
+	dir, _, _ := testRepo(t)
+	b, err := NewGitBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	st, errc := b.Stat("/master/README.md")
+	assertSuccess(t, errc, "Stat")
+	assertStatSize(t, st, int64(len("second version\n")), "/master/README.md")
+	if st.Mtim.Sec != gitTime2.Unix() {
+		t.Errorf("master mtime = %d, expected %d", st.Mtim.Sec, gitTime2.Unix())
+	}
+	st, _ = b.Stat("/v1.0/src")
+	if st.Mode&fuse.S_IFDIR == 0 || st.Mtim.Sec != gitTime1.Unix() {
+		t.Errorf("v1.0/src mode %o mtime %d, expected a directory at %d", st.Mode, st.Mtim.Sec, gitTime1.Unix())
+	}
+	st, _ = b.Stat("/master/build.sh")
+	if st.Mode != fuse.S_IFREG|0555 {
+		t.Errorf("build.sh mode = %o, expected executable", st.Mode)
+	}
+	st, _ = b.Stat("/")
+	if st.Mtim.Sec != gitTime2.Unix() {
+		t.Errorf("root mtime = %d, expected the newest commit", st.Mtim.Sec)
+	}
+
+	_, errc = b.Stat("/master/missing")
+	assertError(t, errc, -fuse.ENOENT, "Stat missing file")
+	_, errc = b.Readdir("/master/README.md")
+	assertError(t, errc, -fuse.ENOTDIR, "Readdir on a file")
+	_, errc = b.Read("/master/src", make([]byte, 4), 0)
+	assertError(t, errc, -fuse.EISDIR, "Read a directory")
+	assertError(t, b.Create("/master/new", 0644), -fuse.EROFS, "Create")
+	assertError(t, b.Unlink("/master/README.md"), -fuse.EROFS, "Unlink")
+}
+
+// TestGitBackendBareStreaming tests a bare clone and streamed large blobs
+func TestGitBackendBareStreaming(t *testing.T) {
+	dir, _, _ := testRepo(t)
+	bare := t.TempDir()
+	repo, err := git.PlainInit(bare, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{dir}})
+	err = repo.Fetch(&git.FetchOptions{RefSpecs: []config.RefSpec{"refs/heads/*:refs/heads/*"}})
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+
+	b, err := NewGitBackend(bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	b.streamAbove = 4 // stream everything but tiny blobs
+
+	want := []byte("second version\n")
+	var got []byte
+	buff := make([]byte, 5)
+	for ofst := int64(0); ; ofst += 5 {
+		n, errc := b.Read("/master/README.md", buff, ofst)
+		assertSuccess(t, errc, "Read")
+		if n == 0 {
+			break
+		}
+		got = append(got, buff[:n]...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("streamed read = %q, expected %q", got, want)
+	}
+	// Reading backwards reopens the stream
+	n, _ := b.Read("/master/README.md", buff, 0)
+	if string(buff[:n]) != "secon" {
+		t.Errorf("Read after rewind = %q", buff[:n])
+	}
+}
+
+// TestLinkGit tests linking a repository into MemFS
+func TestLinkGit(t *testing.T) {
+	dir, _, _ := testRepo(t)
+	fs := newTestFS()
+
+	errCode := fs.LinkGit("/repo", dir)
+	assertSuccess(t, errCode, "LinkGit")
+	var stat fuse.Stat_t
+	errCode = fs.Getattr("/repo/v1.0/README.md", &stat, 0)
+	assertSuccess(t, errCode, "Getattr")
+	assertStatSize(t, &stat, int64(len("first\n")), "/repo/v1.0/README.md")
+	errCode = fs.Mkdir("/repo/master/new", 0755)
+	assertError(t, errCode, -fuse.EROFS, "Mkdir in git tree")
+
+	errCode = fs.LinkGit("/notrepo", t.TempDir())
+	assertError(t, errCode, -fuse.EINVAL, "LinkGit on plain directory")
+	errCode = fs.LinkGit("/missing", filepath.Join(t.TempDir(), "missing"))
+	assertError(t, errCode, -fuse.ENOENT, "LinkGit on missing path")
+}
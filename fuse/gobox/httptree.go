@@ -0,0 +1,532 @@
+package gobox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+	"golang.org/x/net/html"
+)
+
+const (
+	defaultHTTPTTL     = 30 * time.Second
+	httpHeadWorkers    = 8       // concurrent HEADs while listing a directory
+	maxHTTPListingSize = 8 << 20 // index pages and manifests larger than this are refused
+)
+
+var errHTTPConfig = errors.New("an http or https URL is required")
+
+// HTTPOptions selects a static tree published over HTTP
+type HTTPOptions struct {
+	URL      string            // root of the tree, e.g. https://artifacts.example.com/builds
+	Manifest string            // optional manifest relative to URL; index pages are parsed otherwise
+	Header   map[string]string // extra request headers, e.g. Authorization
+	TTL      time.Duration     // lifetime of HEAD results, listings and the manifest; default 30s
+	Client   *http.Client
+}
+
+// httpManifest is the JSON manifest format: every file in the tree with
+// its size and optional modification time. Paths ending in "/" are
+// directories, which is only needed for empty ones.
+type httpManifest struct {
+	Files []struct {
+		Path  string    `json:"path"`
+		Size  int64     `json:"size"`
+		MTime time.Time `json:"mtime"`
+	} `json:"files"`
+}
+
+// httpTree is a parsed manifest
+type httpTree struct {
+	entries map[string]*archiveEntry
+	expires time.Time
+}
+
+// HTTPBackend implements a read-only Backend over a tree of static files on
+// an HTTP server. Directories are listed from the server's index pages, or
+// from a JSON manifest when one is configured. Reads are Range requests and
+// Stat results come from cached HEAD requests.
+type HTTPBackend struct {
+	base     *url.URL
+	manifest string
+	header   map[string]string
+	ttl      time.Duration
+	client   *http.Client
+
+	mu    sync.Mutex
+	heads map[string]*statEntry
+	dirs  map[string]*dirEntry
+	tree  *httpTree
+}
+
+// NewHTTPBackend creates a backend for a static tree; it does not connect
+func NewHTTPBackend(opts HTTPOptions) (*HTTPBackend, error) {
+	base, err := url.Parse(strings.TrimSuffix(opts.URL, "/"))
+	if err != nil || base.Host == "" || base.Scheme != "http" && base.Scheme != "https" {
+		return nil, errHTTPConfig
+	}
+	base.RawPath = ""
+	base.RawQuery = ""
+
+	b := &HTTPBackend{
+		base:     base,
+		manifest: strings.TrimPrefix(opts.Manifest, "/"),
+		header:   opts.Header,
+		ttl:      opts.TTL,
+		client:   opts.Client,
+		heads:    make(map[string]*statEntry),
+		dirs:     make(map[string]*dirEntry),
+	}
+	if b.ttl <= 0 {
+		b.ttl = defaultHTTPTTL
+	}
+	if b.client == nil {
+		b.client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	return b, nil
+}
+
+// ============ Requests ============
+
+// httpErrno maps an HTTP status to an error code
+func httpErrno(status int) int {
+	switch status {
+	case http.StatusNotFound, http.StatusGone:
+		return -fuse.ENOENT
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return -fuse.EACCES
+	default:
+		return -fuse.EIO
+	}
+}
+
+// url returns the URL of a mount-relative path; directories get a trailing
+// slash as index pages expect
+func (b *HTTPBackend) url(path string, dir bool) *url.URL {
+	u := *b.base
+	if path != "/" {
+		u.Path += path
+	}
+	if dir {
+		u.Path += "/"
+	}
+	return &u
+}
+
+// do sends a request with the configured headers
+func (b *HTTPBackend) do(method string, u *url.URL, header http.Header) (*http.Response, int) {
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, -fuse.EIO
+	}
+	for name, value := range b.header {
+		req.Header.Set(name, value)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, -fuse.EIO
+	}
+	return resp, 0
+}
+
+// get fetches a listing or manifest body
+func (b *HTTPBackend) get(u *url.URL) ([]byte, *url.URL, int) {
+	resp, errc := b.do(http.MethodGet, u, nil)
+	if errc != 0 {
+		return nil, nil, errc
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, httpErrno(resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPListingSize+1))
+	if err != nil || len(data) > maxHTTPListingSize {
+		return nil, nil, -fuse.EIO
+	}
+	return data, resp.Request.URL, 0
+}
+
+func httpFileStat(size int64, mtime time.Time) fuse.Stat_t {
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	ts := fuse.NewTimespec(mtime)
+	return fuse.Stat_t{Mode: fuse.S_IFREG | 0444, Nlink: 1, Size: size, Atim: ts, Mtim: ts, Ctim: ts}
+}
+
+func httpDirStat(mtime time.Time) fuse.Stat_t {
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	ts := fuse.NewTimespec(mtime)
+	return fuse.Stat_t{Mode: fuse.S_IFDIR | 0555, Nlink: 2, Atim: ts, Mtim: ts, Ctim: ts}
+}
+
+// head stats a path with HEAD, caching the result (including ENOENT).
+// Servers that redirect to a trailing slash, or answer one, mark a directory.
+func (b *HTTPBackend) head(path string) (fuse.Stat_t, int) {
+	b.mu.Lock()
+	if e, ok := b.heads[path]; ok && time.Now().Before(e.expires) {
+		b.mu.Unlock()
+		return e.st, e.errc
+	}
+	b.mu.Unlock()
+
+	var st fuse.Stat_t
+	resp, errc := b.do(http.MethodHead, b.url(path, false), nil)
+	if errc != 0 {
+		return st, errc // don't cache transient failures
+	}
+	resp.Body.Close()
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	switch {
+	case resp.StatusCode == http.StatusOK && strings.HasSuffix(resp.Request.URL.Path, "/"):
+		st = httpDirStat(mtime)
+	case resp.StatusCode == http.StatusOK:
+		st = httpFileStat(max(resp.ContentLength, 0), mtime)
+	case resp.StatusCode == http.StatusNotFound:
+		// Some servers only answer for directories with the slash
+		dresp, derrc := b.do(http.MethodHead, b.url(path, true), nil)
+		if derrc != 0 {
+			return st, derrc
+		}
+		dresp.Body.Close()
+		if dresp.StatusCode == http.StatusOK {
+			mtime, _ = http.ParseTime(dresp.Header.Get("Last-Modified"))
+			st = httpDirStat(mtime)
+		} else {
+			errc = -fuse.ENOENT
+		}
+	default:
+		return st, httpErrno(resp.StatusCode)
+	}
+
+	b.mu.Lock()
+	b.heads[path] = &statEntry{st: st, errc: errc, expires: time.Now().Add(b.ttl)}
+	b.mu.Unlock()
+	return st, errc
+}
+
+// ============ Listings ============
+
+// parseIndex extracts the direct children of dir from an index page
+func parseIndex(page []byte, dir *url.URL) (files, dirs []string) {
+	seen := make(map[string]bool)
+	z := html.NewTokenizer(bytes.NewReader(page))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return files, dirs
+		case html.StartTagToken:
+			tag, hasAttr := z.TagName()
+			for string(tag) == "a" && hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				if string(key) != "href" {
+					continue
+				}
+				name, isDir, ok := indexChild(dir, string(val))
+				if ok && !seen[name] {
+					seen[name] = true
+					if isDir {
+						dirs = append(dirs, name)
+					} else {
+						files = append(files, name)
+					}
+				}
+				break
+			}
+		}
+	}
+}
+
+// indexChild resolves a link on the index page of dir and returns the child
+// it names. Links that leave the directory, go up, or carry a query (such as
+// column sorting links) are not children.
+func indexChild(dir *url.URL, href string) (name string, isDir, ok bool) {
+	ref, err := url.Parse(href)
+	if err != nil {
+		return "", false, false
+	}
+	u := dir.ResolveReference(ref)
+	if u.Host != dir.Host || u.RawQuery != "" || !strings.HasPrefix(u.Path, dir.Path) {
+		return "", false, false
+	}
+	name = strings.TrimPrefix(u.Path, dir.Path)
+	isDir = strings.HasSuffix(name, "/")
+	name = strings.TrimSuffix(name, "/")
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", false, false
+	}
+	return name, isDir, true
+}
+
+// listIndex lists a directory from its index page, stating files with
+// concurrent HEAD requests
+func (b *HTTPBackend) listIndex(path string) ([]DirEnt, int) {
+	b.mu.Lock()
+	if e, ok := b.dirs[path]; ok && time.Now().Before(e.expires) {
+		b.mu.Unlock()
+		return append([]DirEnt(nil), e.ents...), 0
+	}
+	b.mu.Unlock()
+
+	page, final, errc := b.get(b.url(path, true))
+	if errc != 0 {
+		if path != "/" && errc == -fuse.ENOENT {
+			if st, serr := b.head(path); serr == 0 && st.Mode&fuse.S_IFDIR == 0 {
+				return nil, -fuse.ENOTDIR
+			}
+		}
+		return nil, errc
+	}
+	if !strings.HasSuffix(final.Path, "/") {
+		return nil, -fuse.ENOTDIR // redirected from dir/ back to a file
+	}
+	files, dirs := parseIndex(page, final)
+
+	out := make([]DirEnt, len(files), len(files)+len(dirs))
+	sem := make(chan struct{}, httpHeadWorkers)
+	var wg sync.WaitGroup
+	var failed int
+	var failMu sync.Mutex
+	for i, name := range files {
+		out[i].Name = name
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			st, errc := b.head(joinPath(path, name))
+			if errc != 0 {
+				failMu.Lock()
+				failed = errc
+				failMu.Unlock()
+				return
+			}
+			out[i].Stat = st
+		}()
+	}
+	wg.Wait()
+	if failed != 0 && failed != -fuse.ENOENT {
+		return nil, failed
+	}
+	// Drop links to files that have disappeared since the page was rendered
+	kept := out[:0]
+	for _, e := range out {
+		if e.Stat.Mode != 0 {
+			kept = append(kept, e)
+		}
+	}
+	out = kept
+	for _, name := range dirs {
+		out = append(out, DirEnt{Name: name, Stat: httpDirStat(time.Time{})})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+
+	b.mu.Lock()
+	expires := time.Now().Add(b.ttl)
+	b.dirs[path] = &dirEntry{ents: append([]DirEnt(nil), out...), expires: expires}
+	for _, e := range out {
+		if e.Stat.Mode&fuse.S_IFDIR != 0 {
+			b.heads[joinPath(path, e.Name)] = &statEntry{st: e.Stat, expires: expires}
+		}
+	}
+	b.mu.Unlock()
+	return out, 0
+}
+
+// loadManifest returns the parsed manifest, fetching it again once the
+// TTL has passed
+func (b *HTTPBackend) loadManifest() (*httpTree, int) {
+	b.mu.Lock()
+	if b.tree != nil && time.Now().Before(b.tree.expires) {
+		defer b.mu.Unlock()
+		return b.tree, 0
+	}
+	b.mu.Unlock()
+
+	data, _, errc := b.get(b.url("/"+b.manifest, false))
+	if errc != 0 {
+		return nil, errc
+	}
+	var m httpManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, -fuse.EIO
+	}
+
+	now := time.Now()
+	t := &httpTree{entries: map[string]*archiveEntry{"/": {stat: httpDirStat(now)}}, expires: now.Add(b.ttl)}
+	var addDir func(p string) *archiveEntry
+	addDir = func(p string) *archiveEntry {
+		if e, ok := t.entries[p]; ok {
+			return e
+		}
+		parent := addDir(parentPath(p))
+		_, name := split(p)
+		parent.children = append(parent.children, name)
+		e := &archiveEntry{stat: httpDirStat(now)}
+		t.entries[p] = e
+		return e
+	}
+	for _, f := range m.Files {
+		p := cleanArchivePath(f.Path)
+		if p == "/" {
+			continue
+		}
+		if strings.HasSuffix(f.Path, "/") {
+			addDir(p)
+			continue
+		}
+		if _, ok := t.entries[p]; ok {
+			continue
+		}
+		parent := addDir(parentPath(p))
+		_, name := split(p)
+		parent.children = append(parent.children, name)
+		t.entries[p] = &archiveEntry{stat: httpFileStat(f.Size, f.MTime)}
+	}
+
+	b.mu.Lock()
+	b.tree = t
+	b.mu.Unlock()
+	return t, 0
+}
+
+// Probe fetches the root listing or the manifest
+func (b *HTTPBackend) Probe() int {
+	_, errc := b.Readdir("/")
+	return errc
+}
+
+// ============ Backend ============
+
+// Stat returns file attributes from the manifest or a cached HEAD
+func (b *HTTPBackend) Stat(path string) (*fuse.Stat_t, int) {
+	if b.manifest != "" {
+		t, errc := b.loadManifest()
+		if errc != 0 {
+			return nil, errc
+		}
+		e, ok := t.entries[path]
+		if !ok {
+			return nil, -fuse.ENOENT
+		}
+		st := e.stat
+		return &st, 0
+	}
+
+	if path == "/" {
+		st := httpDirStat(time.Time{})
+		return &st, 0
+	}
+	st, errc := b.head(path)
+	if errc != 0 {
+		return nil, errc
+	}
+	return &st, 0
+}
+
+// Readdir lists directory entries from the manifest or an index page
+func (b *HTTPBackend) Readdir(path string) ([]DirEnt, int) {
+	if b.manifest == "" {
+		return b.listIndex(path)
+	}
+
+	t, errc := b.loadManifest()
+	if errc != 0 {
+		return nil, errc
+	}
+	e, ok := t.entries[path]
+	if !ok {
+		return nil, -fuse.ENOENT
+	}
+	if e.stat.Mode&fuse.S_IFDIR == 0 {
+		return nil, -fuse.ENOTDIR
+	}
+	out := make([]DirEnt, 0, len(e.children))
+	for _, name := range e.children {
+		out = append(out, DirEnt{Name: name, Stat: t.entries[joinPath(path, name)].stat})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, 0
+}
+
+// Read fetches the requested range with a Range request
+func (b *HTTPBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	if len(buff) == 0 {
+		return 0, 0
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", ofst, ofst+int64(len(buff))-1)}}
+	resp, errc := b.do(http.MethodGet, b.url(path, false), header)
+	if errc != 0 {
+		return 0, errc
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// Range ignored by the server; skip to the offset
+		if _, err := io.CopyN(io.Discard, resp.Body, ofst); err != nil {
+			return 0, 0
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, 0 // at or past end of file
+	default:
+		return 0, httpErrno(resp.StatusCode)
+	}
+
+	n, err := io.ReadFull(resp.Body, buff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return n, -fuse.EIO
+	}
+	return n, 0
+}
+
+// Write is not supported on HTTP trees
+func (b *HTTPBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	return 0, -fuse.EROFS
+}
+
+// Truncate is not supported on HTTP trees
+func (b *HTTPBackend) Truncate(path string, size int64) int {
+	return -fuse.EROFS
+}
+
+// Mkdir is not supported on HTTP trees
+func (b *HTTPBackend) Mkdir(path string, mode uint32) int {
+	return -fuse.EROFS
+}
+
+// Create is not supported on HTTP trees
+func (b *HTTPBackend) Create(path string, mode uint32) int {
+	return -fuse.EROFS
+}
+
+// Unlink is not supported on HTTP trees
+func (b *HTTPBackend) Unlink(path string) int {
+	return -fuse.EROFS
+}
+
+// Rmdir is not supported on HTTP trees
+func (b *HTTPBackend) Rmdir(path string) int {
+	return -fuse.EROFS
+}
+
+// Rename is not supported on HTTP trees
+func (b *HTTPBackend) Rename(oldpath, newpath string) int {
+	return -fuse.EROFS
+}
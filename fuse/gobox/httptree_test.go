@@ -0,0 +1,246 @@
+package gobox
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+const testHTTPToken = "Bearer artifacts"
+
+// staticServer serves a directory with net/http's FileServer, which renders
+// index pages and honours Range. It requires a token and counts requests.
+type staticServer struct {
+	dir string
+
+	mu         sync.Mutex
+	heads      int
+	rangedGets int
+}
+
+func newStaticServer(t *testing.T, files map[string]string, extra http.Handler) (*staticServer, *httptest.Server) {
+	t.Helper()
+	s := &staticServer{dir: t.TempDir()}
+	for name, data := range files {
+		p := filepath.Join(s.dir, filepath.FromSlash(name))
+		if name[len(name)-1] == '/' {
+			os.MkdirAll(p, 0755)
+			continue
+		}
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(data), 0644)
+	}
+	fileServer := http.FileServer(http.Dir(s.dir))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != testHTTPToken {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		s.mu.Lock()
+		if r.Method == http.MethodHead {
+			s.heads++
+		}
+		if r.Header.Get("Range") != "" {
+			s.rangedGets++
+		}
+		s.mu.Unlock()
+		if extra != nil && r.URL.Path == "/manifest.json" {
+			extra.ServeHTTP(w, r)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func newTestHTTP(t *testing.T, srv *httptest.Server, manifest string) *HTTPBackend {
+	t.Helper()
+	b, err := NewHTTPBackend(HTTPOptions{
+		URL:      srv.URL,
+		Manifest: manifest,
+		Header:   map[string]string{"Authorization": testHTTPToken},
+		TTL:      time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewHTTPBackend: %v", err)
+	}
+	return b
+}
+
+// TestParseIndex checks which links on an index page count as children
+func TestParseIndex(t *testing.T) {
+	page := []byte(`<html><body><h1>Index of /builds/</h1>
+<a href="?C=N;O=D">Name</a> <a href="/icons/back.gif">icon</a>
+<a href="../">Parent Directory</a>
+<a href="v1.2/">v1.2/</a>
+<a href="app%20linux.tar.gz">app linux.tar.gz</a>
+<a href="/builds/notes.txt">notes.txt</a>
+<a href="http://elsewhere.example.com/builds/x">x</a>
+<a href="v1.2/">duplicate</a>
+</body></html>`)
+	dir, _ := url.Parse("http://artifacts.example.com/builds/")
+
+	files, dirs := parseIndex(page, dir)
+	if want := []string{"app linux.tar.gz", "notes.txt"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("files = %q, expected %q", files, want)
+	}
+	if want := []string{"v1.2"}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("dirs = %q, expected %q", dirs, want)
+	}
+}
+
+// TestHTTPBackendIndex tests listing and stating from index pages
+func TestHTTPBackendIndex(t *testing.T) {
+	s, srv := newStaticServer(t, map[string]string{
+		"a.txt":        "hello",
+		"sub/b.txt":    "world!",
+		"sub/empty/":   "",
+		"sub/deep/c.o": "x",
+	}, nil)
+	b := newTestHTTP(t, srv, "")
+
+	ents, errc := b.Readdir("/")
+	assertSuccess(t, errc, "Readdir /")
+	if len(ents) != 2 || ents[0].Name != "a.txt" || ents[0].Stat.Size != 5 || ents[1].Name != "sub" {
+		t.Fatalf("Readdir / = %v, expected [a.txt sub]", ents)
+	}
+	if ents[1].Stat.Mode&fuse.S_IFDIR == 0 {
+		t.Errorf("sub is not a directory")
+	}
+
+	// Stat is answered from the HEADs made while listing
+	heads := s.heads
+	st, errc := b.Stat("/a.txt")
+	assertSuccess(t, errc, "Stat")
+	assertStatSize(t, st, 5, "/a.txt")
+	if st.Mode&0222 != 0 {
+		t.Errorf("file mode %o is writable", st.Mode)
+	}
+	if s.heads != heads {
+		t.Errorf("Stat after Readdir sent %d HEADs", s.heads-heads)
+	}
+
+	ents, errc = b.Readdir("/sub")
+	assertSuccess(t, errc, "Readdir /sub")
+	if len(ents) != 3 || ents[0].Name != "b.txt" || ents[1].Name != "deep" || ents[2].Name != "empty" {
+		t.Errorf("Readdir /sub = %v, expected [b.txt deep empty]", ents)
+	}
+
+	// A directory found by HEAD alone, through the trailing-slash redirect
+	st, errc = newTestHTTP(t, srv, "").Stat("/sub/deep")
+	assertSuccess(t, errc, "Stat directory")
+	if st.Mode&fuse.S_IFDIR == 0 {
+		t.Errorf("Stat /sub/deep mode = %o, expected a directory", st.Mode)
+	}
+
+	_, errc = b.Stat("/missing")
+	assertError(t, errc, -fuse.ENOENT, "Stat missing")
+	heads = s.heads
+	b.Stat("/missing")
+	if s.heads != heads {
+		t.Errorf("ENOENT was not cached")
+	}
+	_, errc = b.Readdir("/a.txt")
+	assertError(t, errc, -fuse.ENOTDIR, "Readdir on a file")
+	assertError(t, b.Create("/new", 0644), -fuse.EROFS, "Create")
+}
+
+// TestHTTPBackendRangedRead checks reads use Range requests
+func TestHTTPBackendRangedRead(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	s, srv := newStaticServer(t, map[string]string{"big.bin": string(data)}, nil)
+	b := newTestHTTP(t, srv, "")
+
+	buff := make([]byte, 100)
+	n, errc := b.Read("/big.bin", buff, 9950)
+	assertSuccess(t, errc, "Read")
+	if !bytes.Equal(buff[:n], data[9950:]) {
+		t.Errorf("Read near end returned %q", buff[:n])
+	}
+	n, errc = b.Read("/big.bin", buff, int64(len(data)))
+	if errc != 0 || n != 0 {
+		t.Errorf("Read at end = (%d, %d), expected (0, 0)", n, errc)
+	}
+	if s.rangedGets != 2 {
+		t.Errorf("ranged GETs = %d, expected 2", s.rangedGets)
+	}
+	_, errc = b.Read("/missing", buff, 0)
+	assertError(t, errc, -fuse.ENOENT, "Read missing")
+}
+
+// TestHTTPBackendManifest tests listing from a JSON manifest
+func TestHTTPBackendManifest(t *testing.T) {
+	manifest := `{"files": [
+		{"path": "release/app.tar.gz", "size": 7, "mtime": "2024-05-01T12:00:00Z"},
+		{"path": "release/notes.md", "size": 3},
+		{"path": "nightly/"}
+	]}`
+	served := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(manifest))
+	})
+	s, srv := newStaticServer(t, map[string]string{"release/app.tar.gz": "tarball"}, served)
+	b := newTestHTTP(t, srv, "manifest.json")
+
+	assertSuccess(t, b.Probe(), "Probe")
+	ents, errc := b.Readdir("/")
+	assertSuccess(t, errc, "Readdir /")
+	if len(ents) != 2 || ents[0].Name != "nightly" || ents[1].Name != "release" {
+		t.Fatalf("Readdir / = %v, expected [nightly release]", ents)
+	}
+	st, errc := b.Stat("/release/app.tar.gz")
+	assertSuccess(t, errc, "Stat")
+	assertStatSize(t, st, 7, "/release/app.tar.gz")
+	if st.Mtim.Sec != time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("mtime = %d, expected the manifest's", st.Mtim.Sec)
+	}
+	_, errc = b.Stat("/release/missing")
+	assertError(t, errc, -fuse.ENOENT, "Stat missing")
+	if s.heads != 0 {
+		t.Errorf("manifest mode sent %d HEADs", s.heads)
+	}
+
+	buff := make([]byte, 16)
+	n, _ := b.Read("/release/app.tar.gz", buff, 0)
+	if string(buff[:n]) != "tarball" {
+		t.Errorf("Read = %q", buff[:n])
+	}
+}
+
+// TestLinkHTTP tests linking a static tree into MemFS
+func TestLinkHTTP(t *testing.T) {
+	_, srv := newStaticServer(t, map[string]string{"docs/readme.txt": "read me"}, nil)
+	fs := newTestFS()
+
+	opts := HTTPOptions{URL: srv.URL, Header: map[string]string{"Authorization": testHTTPToken}}
+	errCode := fs.LinkHTTP("/artifacts", opts)
+	assertSuccess(t, errCode, "LinkHTTP")
+
+	errCode, fh := fs.Open("/artifacts/docs/readme.txt", os.O_RDONLY)
+	assertSuccess(t, errCode, "Open")
+	buff := make([]byte, 16)
+	n := fs.Read("/artifacts/docs/readme.txt", buff, 0, fh)
+	if string(buff[:max(n, 0)]) != "read me" {
+		t.Errorf("Read = %q, expected %q", buff[:max(n, 0)], "read me")
+	}
+	errCode = fs.Mkdir("/artifacts/new", 0755)
+	assertError(t, errCode, -fuse.EROFS, "Mkdir in HTTP tree")
+
+	errCode = fs.LinkHTTP("/denied", HTTPOptions{URL: srv.URL})
+	assertError(t, errCode, -fuse.EACCES, "LinkHTTP without token")
+	opts.Manifest = "missing.json"
+	errCode = fs.LinkHTTP("/nomanifest", opts)
+	assertError(t, errCode, -fuse.ENOENT, "LinkHTTP with missing manifest")
+	errCode = fs.LinkHTTP("/invalid", HTTPOptions{URL: "not a url"})
+	assertError(t, errCode, -fuse.EINVAL, "LinkHTTP with bad URL")
+}
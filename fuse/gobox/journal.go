@@ -0,0 +1,368 @@
+package gobox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+const (
+	defaultJournalEntries = 100000
+	maxChangesPerQuery    = 10000
+)
+
+// JournalOptions configures the change journal
+type JournalOptions struct {
+	Path       string `json:"path"`       // file the journal is kept in; "" keeps it in memory only
+	MaxEntries int    `json:"maxEntries"` // changes to keep; 0 for 100000
+}
+
+// JournalStatus describes the journal
+type JournalStatus struct {
+	Path    string `json:"path,omitempty"`
+	Entries int    `json:"entries"` // changes currently kept
+	Oldest  uint64 `json:"oldest"`  // sequence number of the oldest kept change
+	Latest  uint64 `json:"latest"`  // sequence number of the latest change
+	Error   string `json:"error,omitempty"`
+}
+
+// ChangeSet is the answer to a "changes since" query
+type ChangeSet struct {
+	Changes []Event `json:"changes"`
+	Cursor  uint64  `json:"cursor"` // pass back to get the changes after these
+	Reset   bool    `json:"reset"`  // the cursor is unknown or too old; rescan, then continue from Cursor
+	More    bool    `json:"more"`   // the limit was reached; ask again right away
+}
+
+// Journal keeps the most recent changes published on an EventBus in
+// sequence order, so clients can ask for what changed since a cursor. It
+// holds at least MaxEntries changes. When kept in a file, it is appended to
+// as changes arrive, compacted as it grows, and sequence numbers carry on
+// where they left off after a restart.
+type Journal struct {
+	mu      sync.Mutex
+	entries []Event // oldest first
+	max     int
+	latest  uint64
+	wake    chan struct{} // closed when changes are added
+	sub     *Subscription
+	closed  bool
+
+	path  string
+	file  *os.File
+	w     *bufio.Writer
+	lines int // lines in the file
+	err   error
+}
+
+// OpenJournal creates a journal, loading the changes already in opts.Path
+func OpenJournal(opts JournalOptions) (*Journal, error) {
+	j := &Journal{max: opts.MaxEntries, wake: make(chan struct{}), path: opts.Path}
+	if j.max <= 0 {
+		j.max = defaultJournalEntries
+	}
+	if j.path == "" {
+		return j, nil
+	}
+
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	if err := j.rewrite(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// load reads the journal file, ignoring a line cut short by a crash
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		var ev Event
+		if json.Unmarshal(sc.Bytes(), &ev) != nil || ev.Seq <= j.latest {
+			continue
+		}
+		j.entries = append(j.entries, ev)
+		j.latest = ev.Seq
+		j.trim()
+	}
+	return sc.Err()
+}
+
+// rewrite replaces the file with the kept changes; the caller holds j.mu
+// or owns j exclusively
+func (j *Journal) rewrite() error {
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for i := range j.entries {
+		enc.Encode(&j.entries[i])
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = tmp
+	j.w = bufio.NewWriter(tmp)
+	j.lines = len(j.entries)
+	return nil
+}
+
+// trim forgets the oldest changes once there are a quarter more than max,
+// so the copy is paid for rarely
+func (j *Journal) trim() {
+	if len(j.entries) > j.max+j.max/4 {
+		j.entries = append([]Event(nil), j.entries[len(j.entries)-j.max:]...)
+	}
+}
+
+// add records changes, skipping any already recorded, and wakes waiters
+func (j *Journal) add(evs ...Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	added := false
+	for _, ev := range evs {
+		if ev.Seq <= j.latest {
+			continue
+		}
+		j.entries = append(j.entries, ev)
+		j.latest = ev.Seq
+		j.trim()
+		added = true
+
+		if j.w != nil && j.err == nil {
+			data, _ := json.Marshal(ev)
+			j.w.Write(append(data, '\n'))
+			j.lines++
+		}
+	}
+	if !added {
+		return
+	}
+
+	if j.w != nil && j.err == nil {
+		j.err = j.w.Flush()
+		if j.err == nil && j.lines > 2*j.max {
+			j.err = j.rewrite()
+		}
+	}
+	close(j.wake)
+	j.wake = make(chan struct{})
+}
+
+// follow records everything published on bus until the journal is closed.
+// If it falls behind it picks up again from the bus history; changes the
+// bus no longer has are recorded as a rescan of the whole tree.
+func (j *Journal) follow(bus *EventBus) {
+	for {
+		j.mu.Lock()
+		if j.closed {
+			j.mu.Unlock()
+			return
+		}
+		last := j.latest
+		sub, missed, complete := bus.SubscribeFrom("", last)
+		j.sub = sub
+		j.mu.Unlock()
+
+		if !complete {
+			j.add(Event{Seq: last + 1, Type: EventRescan, Path: "/", Time: time.Now()})
+		}
+		j.add(missed...)
+		for ev := range sub.C {
+			j.add(ev)
+		}
+		if !sub.Lagged() {
+			return
+		}
+	}
+}
+
+// Close stops recording and closes the file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.closed = true
+	if j.sub != nil {
+		j.sub.Close()
+	}
+	if j.file == nil {
+		return nil
+	}
+	err := j.w.Flush()
+	if cerr := j.file.Close(); err == nil {
+		err = cerr
+	}
+	j.file, j.w = nil, nil
+	return err
+}
+
+// Status describes the journal
+func (j *Journal) Status() JournalStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := JournalStatus{Path: j.path, Entries: len(j.entries), Latest: j.latest}
+	if len(j.entries) > 0 {
+		s.Oldest = j.entries[0].Seq
+	}
+	if j.err != nil {
+		s.Error = j.err.Error()
+	}
+	return s
+}
+
+// Since returns up to limit changes under prefix after cursor
+func (j *Journal) Since(cursor uint64, prefix string, limit int) ChangeSet {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	cs, _ := j.since(cursor, prefix, limit)
+	return cs
+}
+
+// since does the work of Since and also returns the channel closed by the
+// next change; the caller holds j.mu
+func (j *Journal) since(cursor uint64, prefix string, limit int) (ChangeSet, chan struct{}) {
+	if limit <= 0 || limit > maxChangesPerQuery {
+		limit = maxChangesPerQuery
+	}
+	cs := ChangeSet{Changes: []Event{}, Cursor: j.latest}
+
+	// A cursor from before the oldest kept change, or from a journal that
+	// has since been reset, can't be answered
+	oldest := j.latest + 1
+	if len(j.entries) > 0 {
+		oldest = j.entries[0].Seq
+	}
+	if cursor > j.latest || cursor+1 < oldest {
+		cs.Reset = true
+		return cs, j.wake
+	}
+
+	i := sort.Search(len(j.entries), func(i int) bool { return j.entries[i].Seq > cursor })
+	for ; i < len(j.entries); i++ {
+		ev := &j.entries[i]
+		if !ev.matches(prefix) {
+			continue
+		}
+		if len(cs.Changes) == limit {
+			cs.Cursor = cs.Changes[limit-1].Seq
+			cs.More = true
+			break
+		}
+		cs.Changes = append(cs.Changes, *ev)
+	}
+	return cs, j.wake
+}
+
+// Wait is Since, but if there are no changes yet it waits for one until
+// ctx is done
+func (j *Journal) Wait(ctx context.Context, cursor uint64, prefix string, limit int) ChangeSet {
+	for {
+		j.mu.Lock()
+		cs, wake := j.since(cursor, prefix, limit)
+		j.mu.Unlock()
+		if len(cs.Changes) > 0 || cs.Reset {
+			return cs
+		}
+
+		// Changes outside prefix move the cursor on without answering
+		cursor = cs.Cursor
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return cs
+		}
+	}
+}
+
+// ============ MemFS ============
+
+// EnableJournal starts recording changes in a journal that can be asked
+// what changed since a cursor
+func (fs *MemFS) EnableJournal(opts JournalOptions) int {
+	if opts.MaxEntries < 0 {
+		return -fuse.EINVAL
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.journal != nil {
+		return -fuse.EEXIST
+	}
+	j, err := OpenJournal(opts)
+	if err != nil {
+		return -fuse.EIO
+	}
+
+	// Sequence numbers carry on from the journal's. Changes published before
+	// it was enabled are not in it: a journal loaded from a file records
+	// them as a rescan, an empty one just starts after them.
+	fs.events.advance(j.latest)
+	if seq := fs.events.Seq(); seq > j.latest {
+		if j.latest > 0 {
+			j.add(Event{Seq: seq, Type: EventRescan, Path: "/", Time: time.Now()})
+		} else {
+			j.latest = seq
+		}
+	}
+	fs.journal = j
+	go j.follow(fs.events)
+	return 0
+}
+
+// DisableJournal stops recording changes and closes the journal file
+func (fs *MemFS) DisableJournal() int {
+	fs.lock.Lock()
+	j := fs.journal
+	fs.journal = nil
+	fs.lock.Unlock()
+
+	if j == nil {
+		return -fuse.EINVAL
+	}
+	if j.Close() != nil {
+		return -fuse.EIO
+	}
+	return 0
+}
+
+// Journal returns the change journal, or nil if it is not enabled
+func (fs *MemFS) Journal() *Journal {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.journal
+}
@@ -0,0 +1,177 @@
+package gobox
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// waitChanges asks j for changes after cursor, giving the journal a moment
+// to catch up with the event bus
+func waitChanges(t *testing.T, j *Journal, cursor uint64, prefix string, limit int) ChangeSet {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return j.Wait(ctx, cursor, prefix, limit)
+}
+
+// settle waits until the journal has recorded everything published so far
+func settle(t *testing.T, fs *MemFS) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); fs.Journal().Status().Latest < fs.Events().Seq(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("journal stuck at %d of %d", fs.Journal().Status().Latest, fs.Events().Seq())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestJournalSince tests cursors, prefixes, limits and resets
+func TestJournalSince(t *testing.T) {
+	fs := newTestFS()
+	fs.Mkdir("/before", 0755)
+	assertSuccess(t, fs.EnableJournal(JournalOptions{MaxEntries: 8}), "EnableJournal")
+	defer fs.DisableJournal()
+	assertError(t, fs.EnableJournal(JournalOptions{}), -fuse.EEXIST, "EnableJournal twice")
+	j := fs.Journal()
+	start := j.Status().Latest // changes before enabling are not in the journal
+
+	fs.Mkdir("/projects", 0755)
+	fs.Mkdir("/other", 0755)
+	writeFile(t, fs, "/projects/a", []byte("x"))
+	writeFile(t, fs, "/other/b", []byte("y"))
+	settle(t, fs)
+
+	cs := j.Since(start, "/projects", 0)
+	if len(cs.Changes) != 3 || cs.Changes[0].Path != "/projects" || cs.Changes[2].Type != EventWrite {
+		t.Fatalf("changes under /projects = %+v", cs.Changes)
+	}
+	if cs.Reset || cs.More || cs.Cursor != fs.Events().Seq() {
+		t.Errorf("cursor = %+v, expected the latest sequence number", cs)
+	}
+	if cs = j.Since(cs.Cursor, "/projects", 0); len(cs.Changes) != 0 || cs.Reset {
+		t.Errorf("nothing new = %+v", cs)
+	}
+
+	// A limit stops at the last change returned
+	cs = j.Since(start, "/", 2)
+	if len(cs.Changes) != 2 || !cs.More || cs.Cursor != cs.Changes[1].Seq {
+		t.Errorf("limited = %+v", cs)
+	}
+	if next := j.Since(cs.Cursor, "/", 0); len(next.Changes) != 4 || next.Changes[0].Seq != cs.Cursor+1 {
+		t.Errorf("after limited = %+v", next)
+	}
+
+	// Cursors from before the journal or past its end must start over
+	if cs = j.Since(start-1, "/", 0); !cs.Reset {
+		t.Errorf("cursor from before enabling = %+v", cs)
+	}
+	if cs = j.Since(1000, "/", 0); !cs.Reset || cs.Cursor != j.Status().Latest {
+		t.Errorf("cursor from the future = %+v", cs)
+	}
+
+	// Only the most recent changes are kept
+	for i := 0; i < 20; i++ {
+		fs.Chmod("/projects/a", 0600)
+	}
+	settle(t, fs)
+	st := j.Status()
+	if st.Entries < 8 || st.Entries > 10 {
+		t.Errorf("kept %d changes with MaxEntries 8", st.Entries)
+	}
+	if cs = j.Since(start, "/", 0); !cs.Reset {
+		t.Errorf("cursor older than the kept changes = %+v", cs)
+	}
+}
+
+// TestJournalPersist tests that a journal file survives a restart
+func TestJournalPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "changes.jsonl")
+
+	fs := newTestFS()
+	assertSuccess(t, fs.EnableJournal(JournalOptions{Path: path}), "EnableJournal")
+	fs.Mkdir("/projects", 0755)
+	writeFile(t, fs, "/projects/a", []byte("x"))
+	settle(t, fs)
+	last := fs.Journal().Status().Latest
+	assertSuccess(t, fs.DisableJournal(), "DisableJournal")
+
+	// A line cut short by a crash is skipped
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"seq":99,"type":"wri`)
+	f.Close()
+
+	fs2 := newTestFS()
+	assertSuccess(t, fs2.EnableJournal(JournalOptions{Path: path}), "EnableJournal after restart")
+	defer fs2.DisableJournal()
+	j := fs2.Journal()
+	if st := j.Status(); st.Latest != last || st.Entries != 3 {
+		t.Fatalf("reloaded journal = %+v, expected %d entries up to %d", st, 3, last)
+	}
+
+	// Sequence numbers carry on, so old cursors stay valid
+	fs2.Mkdir("/projects", 0755)
+	cs := waitChanges(t, j, last, "/projects", 0)
+	if len(cs.Changes) != 1 || cs.Changes[0].Seq != last+1 || cs.Changes[0].Type != EventMkdir {
+		t.Errorf("change after restart = %+v", cs)
+	}
+	if cs = j.Since(0, "/", 0); len(cs.Changes) != 4 || cs.Reset {
+		t.Errorf("whole journal = %+v", cs)
+	}
+}
+
+// TestChangesLongPoll tests the REST changes query
+func TestChangesLongPoll(t *testing.T) {
+	fs := newTestFS()
+	s := NewAPIServer(fs)
+
+	w := httptest.NewRecorder()
+	s.handleChanges(w, httptest.NewRequest(http.MethodGet, "/api/changes", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("changes without a journal = %d", w.Code)
+	}
+
+	assertSuccess(t, fs.EnableJournal(JournalOptions{}), "EnableJournal")
+	defer fs.DisableJournal()
+	fs.Mkdir("/projects", 0755)
+	settle(t, fs)
+	cursor := fs.Journal().Status().Latest
+
+	// Changes outside the prefix don't end the wait
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		fs.Mkdir("/other", 0755)
+		time.Sleep(50 * time.Millisecond)
+		fs.Mkdir("/projects/new", 0755)
+	}()
+	start := time.Now()
+	w = httptest.NewRecorder()
+	s.handleChanges(w, httptest.NewRequest(http.MethodGet,
+		"/api/changes?prefix=/projects&waitMs=2000&since="+strconv.FormatUint(cursor, 10), nil))
+	var resp struct {
+		Data ChangeSet `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Data.Changes) != 1 || resp.Data.Changes[0].Path != "/projects/new" {
+		t.Errorf("long poll = %+v", resp.Data)
+	}
+	if d := time.Since(start); d < 90*time.Millisecond || d > time.Second {
+		t.Errorf("long poll returned after %v", d)
+	}
+
+	// Without waitMs it answers at once
+	start = time.Now()
+	w = httptest.NewRecorder()
+	s.handleChanges(w, httptest.NewRequest(http.MethodGet, "/api/changes?since=3", nil))
+	if w.Code != http.StatusOK || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("plain query = %d after %v", w.Code, time.Since(start))
+	}
+}
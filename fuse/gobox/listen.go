@@ -0,0 +1,297 @@
+package gobox
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSocketMode = 0660
+	selfSignedFor     = 365 * 24 * time.Hour
+)
+
+var errSocketInUse = errors.New("socket in use by another server")
+
+// ListenerConfig is a place the REST API listens, over TCP or a Unix
+// socket, in plain HTTP or TLS
+type ListenerConfig struct {
+	Address string     `yaml:"address"` // host:port; a host of one interface's IP binds to that interface only
+	Socket  string     `yaml:"socket"`  // Unix socket path, instead of address
+	Mode    uint32     `yaml:"mode"`    // socket permissions; default 0660
+	Access  Access     `yaml:"access"`  // granted to anyone who can open the socket when auth is on; none to still require credentials
+	TLS     *TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig sets up TLS on a listener
+type TLSConfig struct {
+	CertFile          string `yaml:"certFile"`
+	KeyFile           string `yaml:"keyFile"`
+	SelfSigned        bool   `yaml:"selfSigned"`        // make a certificate at startup, or once into certFile and keyFile if given
+	ClientCA          string `yaml:"clientCA"`          // PEM file of CAs that client certificates are verified against
+	RequireClientCert bool   `yaml:"requireClientCert"` // refuse connections without a verified client certificate
+}
+
+// name identifies the listener in errors and logs
+func (l *ListenerConfig) name() string {
+	if l.Socket != "" {
+		return "unix:" + l.Socket
+	}
+	return l.Address
+}
+
+// validAddress checks a host:port address
+func validAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// validate reports problems with the listener through fail
+func (l *ListenerConfig) validate(key string, fail func(format string, args ...any)) {
+	switch {
+	case l.Address == "" && l.Socket == "":
+		fail("%s: address or socket required", key)
+	case l.Address != "" && l.Socket != "":
+		fail("%s: address and socket both given", key)
+	case l.Address != "":
+		if err := validAddress(l.Address); err != nil {
+			fail("%s.address: %v", key, err)
+		}
+		if l.Mode != 0 || l.Access != "" {
+			fail("%s: mode and access are for sockets only", key)
+		}
+	}
+	if l.Mode > 0777 {
+		fail("%s.mode: %o is not a permission mode", key, l.Mode)
+	}
+	if l.Access != "" && l.Access.level() == 0 {
+		fail("%s.access: %q is not read, write or admin", key, l.Access)
+	}
+
+	t := l.TLS
+	if t == nil {
+		return
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		fail("%s.tls: certFile and keyFile go together", key)
+	} else if t.CertFile == "" && !t.SelfSigned {
+		fail("%s.tls: certFile and keyFile, or selfSigned, required", key)
+	} else if t.CertFile != "" && !t.SelfSigned {
+		for _, f := range []string{t.CertFile, t.KeyFile} {
+			if _, err := os.Stat(f); err != nil {
+				fail("%s.tls: %v", key, err)
+			}
+		}
+	}
+	if t.ClientCA != "" {
+		if _, err := os.Stat(t.ClientCA); err != nil {
+			fail("%s.tls.clientCA: %v", key, err)
+		}
+	} else if t.RequireClientCert {
+		fail("%s.tls.requireClientCert: needs clientCA", key)
+	}
+}
+
+// listen opens the listener. Stale sockets left by a server that died are
+// replaced; live ones are not.
+func (l *ListenerConfig) listen() (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if l.Socket == "" {
+		if ln, err = net.Listen("tcp", l.Address); err != nil {
+			return nil, err
+		}
+	} else {
+		if fi, serr := os.Lstat(l.Socket); serr == nil && fi.Mode()&os.ModeSocket != 0 {
+			if c, derr := net.Dial("unix", l.Socket); derr == nil {
+				c.Close()
+				return nil, fmt.Errorf("%s: %w", l.Socket, errSocketInUse)
+			}
+			os.Remove(l.Socket)
+		}
+		mode := l.Mode
+		if mode == 0 {
+			mode = defaultSocketMode
+		}
+		if ln, err = listenSocket(l.Socket, os.FileMode(mode)); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.TLS != nil {
+		cfg, err := l.TLS.config(ln.Addr())
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, cfg)
+	}
+	return ln, nil
+}
+
+// listenSocket listens on a Unix socket at path with the given mode. The
+// socket is made in a directory only this process can enter and moved into
+// place once its mode is set, so no one gets to connect while it is more
+// open than that.
+func listenSocket(path string, mode os.FileMode) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".gobox-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, mode); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &socketListener{UnixListener: ln, path: path}, nil
+}
+
+// socketListener is a Unix socket moved to path after it was made, which
+// removes the socket there when closed
+type socketListener struct {
+	*net.UnixListener
+	path   string
+	remove sync.Once
+}
+
+func (l *socketListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *socketListener) Close() error {
+	err := l.UnixListener.Close()
+	l.remove.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// handler wraps the API for this listener, granting socket callers the
+// configured access
+func (l *ListenerConfig) handler(api http.Handler) http.Handler {
+	if l.Socket == "" || l.Access == "" {
+		return api
+	}
+	return withPeer(api, &Principal{Name: "unix:" + l.Socket, Scope: Scope{Access: l.Access}})
+}
+
+// config builds the server TLS configuration for a listener on addr
+func (t *TLSConfig) config(addr net.Addr) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case t.SelfSigned && t.CertFile != "":
+		cert, err = tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if errors.Is(err, os.ErrNotExist) {
+			cert, err = selfSigned(addr, t.CertFile, t.KeyFile)
+		}
+	case t.SelfSigned:
+		cert, err = selfSigned(addr, "", "")
+	default:
+		cert, err = tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if t.ClientCA != "" {
+		pem, err := os.ReadFile(t.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", t.ClientCA)
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg, nil
+}
+
+// selfSigned makes a certificate for localhost, this machine's name and
+// the address listened on, writing it to certFile and keyFile if given so
+// clients can trust it across restarts. Its fingerprint is logged for
+// clients that pin it instead.
+func selfSigned(addr net.Addr, certFile, keyFile string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "gobox"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, err := os.Hostname(); err == nil {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	if a, ok := addr.(*net.TCPAddr); ok && !a.IP.IsUnspecified() && !a.IP.IsLoopback() {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, a.IP)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if certFile != "" {
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	sum := sha256.Sum256(der)
+	slog.Info("made a self-signed certificate", "listen", addr.String(), "sha256", hex.EncodeToString(sum[:]), "certFile", certFile)
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
@@ -0,0 +1,274 @@
+package gobox
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// socketClient sends requests over the Unix socket at path
+func socketClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+// get sends a GET with an optional bearer token and returns the status
+func get(t *testing.T, c *http.Client, url, token string) int {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestListeners tests plain, self-signed TLS and Unix socket listeners
+// serving the same API at once
+func TestListeners(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "api.sock")
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	cfg := DefaultConfig()
+	cfg.Listen, cfg.Headless = "127.0.0.1:0", true
+	cfg.Listeners = []ListenerConfig{
+		{Address: "127.0.0.1:0", TLS: &TLSConfig{CertFile: certFile, KeyFile: keyFile, SelfSigned: true}},
+		{Socket: sock, Access: AccessRead},
+	}
+	cfg.Auth.Tokens = []Credential{{Name: "ci", Secret: "ci-secret-0123456", Scope: Scope{Access: AccessAdmin}}}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	addrs := srv.Addrs()
+	if len(addrs) != 3 || srv.Addr() != addrs[0] || !strings.HasPrefix(srv.URL(), "http://") {
+		t.Fatalf("Addrs = %v, URL = %s", addrs, srv.URL())
+	}
+	if code := get(t, http.DefaultClient, srv.URL()+"/api/statfs", ""); code != http.StatusUnauthorized {
+		t.Errorf("plain without token = %d", code)
+	}
+
+	// The certificate was written out, so clients can trust it
+	pemData, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatalf("certificate not written: %v", err)
+	}
+	if fi, err := os.Stat(keyFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key file = %v, %v", fi, err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pemData)
+	tlsClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	tlsURL := "https://localhost:" + strings.TrimPrefix(addrs[1].String(), "127.0.0.1:")
+	if code := get(t, tlsClient, tlsURL+"/api/statfs", "ci-secret-0123456"); code != http.StatusOK {
+		t.Errorf("TLS = %d", code)
+	}
+
+	// The socket grants read access to anyone who can open it
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != defaultSocketMode {
+		t.Errorf("socket = %v, %v", fi, err)
+	}
+	unix := socketClient(sock)
+	if code := get(t, unix, "http://gobox/api/statfs", ""); code != http.StatusOK {
+		t.Errorf("socket read = %d", code)
+	}
+	if code := get(t, unix, "http://gobox/api/statfs", "wrong-secret-0123"); code != http.StatusUnauthorized {
+		t.Errorf("socket with a wrong token = %d", code)
+	}
+	resp, err := unix.Post("http://gobox/api/mkdir", "application/json", strings.NewReader(`{"path":"/a","mode":493}`))
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("socket write = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+}
+
+// TestSocketReuse tests stale sockets being replaced and live ones refused
+func TestSocketReuse(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "api.sock")
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l := &ListenerConfig{Socket: sock, Mode: 0600}
+	ln, err := l.listen()
+	if err != nil {
+		t.Fatalf("stale socket: %v", err)
+	}
+	defer ln.Close()
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket = %v, %v", fi, err)
+	}
+	if _, err := l.listen(); !errors.Is(err, errSocketInUse) {
+		t.Errorf("live socket = %v", err)
+	}
+
+	// A socket that can't be moved into place is not left listening
+	dir := t.TempDir()
+	blocked := filepath.Join(dir, "api.sock")
+	os.MkdirAll(filepath.Join(blocked, "in-the-way"), 0755)
+	if ln, err := (&ListenerConfig{Socket: blocked}).listen(); err == nil {
+		ln.Close()
+		t.Errorf("listening over a directory succeeded")
+	}
+	if ents, _ := os.ReadDir(dir); len(ents) != 1 {
+		t.Errorf("left behind: %v", ents)
+	}
+}
+
+// writeCert signs a certificate for cn with parent's key, or self-signs it
+// as a CA when parent is nil, and writes it to dir
+func writeCert(t *testing.T, dir, cn string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	issuer, signer := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, cn+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// TestClientCA tests client certificates verified against a CA and
+// matched to credentials
+func TestClientCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeCert(t, dir, "ca", nil)
+	client := writeCert(t, dir, "backup", &ca)
+
+	cfg := DefaultConfig()
+	cfg.Listen, cfg.Headless = "", true
+	cfg.Listeners = []ListenerConfig{{Address: "127.0.0.1:0", TLS: &TLSConfig{
+		SelfSigned: true, ClientCA: filepath.Join(dir, "ca.pem"), RequireClientCert: true,
+	}}}
+	cfg.Auth.ClientCerts = []Credential{{Name: "backup", Scope: Scope{Access: AccessRead}}}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer srv.Shutdown(context.Background())
+	if !strings.HasPrefix(srv.URL(), "https://") {
+		t.Fatalf("URL = %s", srv.URL())
+	}
+
+	with := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true, Certificates: certs,
+		}}}
+	}
+	if code := get(t, with(client), srv.URL()+"/api/statfs", ""); code != http.StatusOK {
+		t.Errorf("client certificate = %d", code)
+	}
+	if code := get(t, with(client), srv.URL()+"/api/cache/stats?path=/", ""); code != http.StatusForbidden {
+		t.Errorf("client certificate beyond its access = %d", code)
+	}
+	if _, err := with().Get(srv.URL() + "/api/statfs"); err == nil {
+		t.Errorf("no client certificate was accepted")
+	}
+}
+
+// TestListenerConfig tests listener settings from flags and their checks
+func TestListenerConfig(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := LoadConfig([]string{"-headless", "-listen", "", "-socket", filepath.Join(dir, "s"), "-tls-listen", "127.0.0.1:8443"})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	ls := cfg.listeners()
+	if len(ls) != 2 || ls[0].Socket == "" || ls[1].TLS == nil || !ls[1].TLS.SelfSigned {
+		t.Errorf("listeners = %+v", ls)
+	}
+	if _, err := LoadConfig([]string{"-headless", "-tls-cert", "c.pem"}); err == nil || !strings.Contains(err.Error(), "need -tls-listen") {
+		t.Errorf("-tls-cert alone = %v", err)
+	}
+
+	cfg = DefaultConfig()
+	cfg.Listen, cfg.Headless = "", true
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "listen: required") {
+		t.Errorf("no listeners = %v", err)
+	}
+	cfg.Listeners = []ListenerConfig{
+		{},
+		{Address: "127.0.0.1:8443", Socket: "/run/gobox.sock"},
+		{Address: "127.0.0.1:99999", Mode: 0600},
+		{Socket: "/run/gobox.sock", Mode: 01777, Access: "root"},
+		{Address: ":8443", TLS: &TLSConfig{CertFile: "c.pem"}},
+		{Address: ":8443", TLS: &TLSConfig{}},
+		{Address: ":8443", TLS: &TLSConfig{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: filepath.Join(dir, "missing.key")}},
+		{Address: ":8443", TLS: &TLSConfig{SelfSigned: true, RequireClientCert: true}},
+	}
+	err = cfg.Validate()
+	if err == nil {
+		t.Fatalf("Validate passed")
+	}
+	for _, want := range []string{
+		"listeners[0]: address or socket required",
+		"listeners[1]: address and socket both given",
+		`listeners[2].address: invalid port "99999"`,
+		"listeners[2]: mode and access are for sockets only",
+		"listeners[3].mode: 1777 is not a permission mode",
+		`listeners[3].access: "root"`,
+		"listeners[4].tls: certFile and keyFile go together",
+		"listeners[5].tls: certFile and keyFile, or selfSigned, required",
+		"listeners[6].tls: stat",
+		"listeners[7].tls.requireClientCert: needs clientCA",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("errors lack %q:\n%v", want, err)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package gobox
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// memEntry is a file or directory held by a MemBackend
+type memEntry struct {
+	stat fuse.Stat_t
+	data []byte
+}
+
+// MemBackend implements Backend entirely in memory. It is mainly useful as a
+// scratch layer for other backends, such as the upper layer of an overlay.
+type MemBackend struct {
+	mu      sync.Mutex
+	entries map[string]*memEntry
+}
+
+// NewMemBackend creates an empty in-memory backend
+func NewMemBackend() *MemBackend {
+	now := fuse.Now()
+	return &MemBackend{
+		entries: map[string]*memEntry{
+			"/": {stat: fuse.Stat_t{
+				Mode:  fuse.S_IFDIR | 0755,
+				Nlink: 2,
+				Atim:  now,
+				Mtim:  now,
+				Ctim:  now,
+			}},
+		},
+	}
+}
+
+// parentDir returns the parent entry of path, or an error code
+func (b *MemBackend) parentDir(path string) (*memEntry, int) {
+	parent, _ := split(path)
+	if parent == "" {
+		parent = "/"
+	}
+	pe, ok := b.entries[parent]
+	if !ok {
+		return nil, -fuse.ENOENT
+	}
+	if pe.stat.Mode&fuse.S_IFDIR == 0 {
+		return nil, -fuse.ENOTDIR
+	}
+	return pe, 0
+}
+
+// Stat returns file attributes
+func (b *MemBackend) Stat(path string) (*fuse.Stat_t, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[path]
+	if !ok {
+		return nil, -fuse.ENOENT
+	}
+	st := e.stat
+	return &st, 0
+}
+
+// Readdir lists directory entries
+func (b *MemBackend) Readdir(path string) ([]DirEnt, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[path]
+	if !ok {
+		return nil, -fuse.ENOENT
+	}
+	if e.stat.Mode&fuse.S_IFDIR == 0 {
+		return nil, -fuse.ENOTDIR
+	}
+
+	prefix := path
+	if prefix != "/" {
+		prefix += "/"
+	}
+	var out []DirEnt
+	for p, child := range b.entries {
+		if p == path || !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(p, prefix)
+		if strings.Contains(name, "/") {
+			continue
+		}
+		out = append(out, DirEnt{Name: name, Stat: child.stat})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, 0
+}
+
+// Read reads file content
+func (b *MemBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[path]
+	if !ok {
+		return 0, -fuse.ENOENT
+	}
+	if e.stat.Mode&fuse.S_IFDIR != 0 {
+		return 0, -fuse.EISDIR
+	}
+	if ofst >= int64(len(e.data)) {
+		return 0, 0
+	}
+	return copy(buff, e.data[ofst:]), 0
+}
+
+// Write writes file content
+func (b *MemBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[path]
+	if !ok {
+		return 0, -fuse.ENOENT
+	}
+	if e.stat.Mode&fuse.S_IFDIR != 0 {
+		return 0, -fuse.EISDIR
+	}
+
+	end := ofst + int64(len(buff))
+	if end > int64(len(e.data)) {
+		newData := make([]byte, end)
+		copy(newData, e.data)
+		e.data = newData
+	}
+	copy(e.data[ofst:], buff)
+
+	e.stat.Size = int64(len(e.data))
+	e.stat.Mtim = fuse.Now()
+	return len(buff), 0
+}
+
+// Truncate changes file size
+func (b *MemBackend) Truncate(path string, size int64) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[path]
+	if !ok {
+		return -fuse.ENOENT
+	}
+	if e.stat.Mode&fuse.S_IFDIR != 0 {
+		return -fuse.EISDIR
+	}
+
+	if size < int64(len(e.data)) {
+		e.data = e.data[:size]
+	} else if size > int64(len(e.data)) {
+		newData := make([]byte, size)
+		copy(newData, e.data)
+		e.data = newData
+	}
+	e.stat.Size = size
+	e.stat.Mtim = fuse.Now()
+	return 0
+}
+
+// Mkdir creates a directory
+func (b *MemBackend) Mkdir(path string, mode uint32) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.entries[path]; ok {
+		return -fuse.EEXIST
+	}
+	pe, errc := b.parentDir(path)
+	if errc != 0 {
+		return errc
+	}
+
+	now := fuse.Now()
+	b.entries[path] = &memEntry{stat: fuse.Stat_t{
+		Mode:  fuse.S_IFDIR | (mode & 07777),
+		Nlink: 2,
+		Atim:  now,
+		Mtim:  now,
+		Ctim:  now,
+	}}
+	pe.stat.Nlink++
+	return 0
+}
+
+// Create creates a file, truncating it if it already exists
+func (b *MemBackend) Create(path string, mode uint32) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e, ok := b.entries[path]; ok {
+		if e.stat.Mode&fuse.S_IFDIR != 0 {
+			return -fuse.EISDIR
+		}
+		e.data = nil
+		e.stat.Size = 0
+		e.stat.Mtim = fuse.Now()
+		return 0
+	}
+	if _, errc := b.parentDir(path); errc != 0 {
+		return errc
+	}
+
+	now := fuse.Now()
+	b.entries[path] = &memEntry{stat: fuse.Stat_t{
+		Mode:  fuse.S_IFREG | (mode & 07777),
+		Nlink: 1,
+		Atim:  now,
+		Mtim:  now,
+		Ctim:  now,
+	}}
+	return 0
+}
+
+// Unlink deletes a file
+func (b *MemBackend) Unlink(path string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[path]
+	if !ok {
+		return -fuse.ENOENT
+	}
+	if e.stat.Mode&fuse.S_IFDIR != 0 {
+		return -fuse.EISDIR
+	}
+	delete(b.entries, path)
+	return 0
+}
+
+// Rmdir removes an empty directory
+func (b *MemBackend) Rmdir(path string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if path == "/" {
+		return -fuse.EBUSY
+	}
+	e, ok := b.entries[path]
+	if !ok {
+		return -fuse.ENOENT
+	}
+	if e.stat.Mode&fuse.S_IFDIR == 0 {
+		return -fuse.ENOTDIR
+	}
+	for p := range b.entries {
+		if strings.HasPrefix(p, path+"/") {
+			return -fuse.ENOTEMPTY
+		}
+	}
+
+	delete(b.entries, path)
+	if pe, errc := b.parentDir(path); errc == 0 {
+		pe.stat.Nlink--
+	}
+	return 0
+}
+
+// Rename moves or renames a file/directory
+func (b *MemBackend) Rename(oldpath, newpath string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[oldpath]
+	if !ok {
+		return -fuse.ENOENT
+	}
+	if oldpath == newpath {
+		return 0
+	}
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return -fuse.EINVAL
+	}
+	if _, errc := b.parentDir(newpath); errc != 0 {
+		return errc
+	}
+
+	if target, ok := b.entries[newpath]; ok {
+		if target.stat.Mode&fuse.S_IFDIR != 0 {
+			if e.stat.Mode&fuse.S_IFDIR == 0 {
+				return -fuse.EISDIR
+			}
+			for p := range b.entries {
+				if strings.HasPrefix(p, newpath+"/") {
+					return -fuse.ENOTEMPTY
+				}
+			}
+		} else if e.stat.Mode&fuse.S_IFDIR != 0 {
+			return -fuse.ENOTDIR
+		}
+	}
+
+	delete(b.entries, oldpath)
+	b.entries[newpath] = e
+
+	if e.stat.Mode&fuse.S_IFDIR != 0 {
+		oldPrefix := oldpath + "/"
+		newPrefix := newpath + "/"
+		for p, child := range b.entries {
+			if strings.HasPrefix(p, oldPrefix) {
+				delete(b.entries, p)
+				b.entries[newPrefix+strings.TrimPrefix(p, oldPrefix)] = child
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,61 @@
+package gobox
+
+import (
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// TestMemBackendFileLifecycle tests create, write, read, truncate and unlink
+func TestMemBackendFileLifecycle(t *testing.T) {
+	b := NewMemBackend()
+
+	assertSuccess(t, b.Create("/file.txt", 0644), "Create")
+	if n, errc := b.Write("/file.txt", []byte("hello world"), 0); errc != 0 || n != 11 {
+		t.Fatalf("Write returned (%d, %d), expected (11, 0)", n, errc)
+	}
+
+	buff := make([]byte, 5)
+	n, errc := b.Read("/file.txt", buff, 6)
+	assertSuccess(t, errc, "Read")
+	if string(buff[:n]) != "world" {
+		t.Errorf("Read at offset 6 = %q, expected %q", buff[:n], "world")
+	}
+
+	assertSuccess(t, b.Truncate("/file.txt", 5), "Truncate")
+	st, errc := b.Stat("/file.txt")
+	assertSuccess(t, errc, "Stat")
+	assertStatSize(t, st, 5, "/file.txt")
+
+	assertSuccess(t, b.Unlink("/file.txt"), "Unlink")
+	_, errc = b.Stat("/file.txt")
+	assertError(t, errc, -fuse.ENOENT, "Stat after Unlink")
+}
+
+// TestMemBackendDirectories tests mkdir, readdir, rename and rmdir
+func TestMemBackendDirectories(t *testing.T) {
+	b := NewMemBackend()
+
+	assertSuccess(t, b.Mkdir("/dir", 0755), "Mkdir")
+	assertError(t, b.Mkdir("/dir", 0755), -fuse.EEXIST, "Mkdir existing")
+	assertError(t, b.Mkdir("/missing/dir", 0755), -fuse.ENOENT, "Mkdir with missing parent")
+	assertSuccess(t, b.Create("/dir/b.txt", 0644), "Create b")
+	assertSuccess(t, b.Create("/dir/a.txt", 0644), "Create a")
+
+	ents, errc := b.Readdir("/dir")
+	assertSuccess(t, errc, "Readdir")
+	if len(ents) != 2 || ents[0].Name != "a.txt" || ents[1].Name != "b.txt" {
+		t.Errorf("Readdir = %v, expected [a.txt b.txt]", ents)
+	}
+
+	assertError(t, b.Rmdir("/dir"), -fuse.ENOTEMPTY, "Rmdir non-empty")
+
+	assertSuccess(t, b.Rename("/dir", "/moved"), "Rename")
+	if _, errc := b.Stat("/moved/a.txt"); errc != 0 {
+		t.Errorf("child not moved with directory: %d", errc)
+	}
+
+	b.Unlink("/moved/a.txt")
+	b.Unlink("/moved/b.txt")
+	assertSuccess(t, b.Rmdir("/moved"), "Rmdir")
+}
@@ -0,0 +1,1475 @@
+package gobox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// node represents a file or directory in memory or backed by a filesystem.
+type node struct {
+	stat        fuse.Stat_t
+	data        []byte
+	backend     Backend // nil if in-memory
+	backendPath string  // mount-relative path under backend
+	tier        tierInfo
+}
+
+// MemFS is an in-memory filesystem.
+type MemFS struct {
+	fuse.FileSystemBase
+	lock     sync.Mutex
+	nodes    map[string]*node
+	tier     *tierManager // nil unless tiering is enabled
+	events   *EventBus
+	metrics  *Metrics
+	capacity CapacityOptions
+	used     int64                                 // bytes in files MemFS holds itself
+	journal  *Journal                              // nil unless the change journal is enabled
+	audit    *AuditLog                             // nil unless the audit log is enabled
+	notify   func(path string, action uint32) bool // tells the kernel about outside changes
+	writers  map[string]int                        // handles open for writing on linked files, by path
+}
+
+// fhWriter is the handle Open and Create return for linked files opened
+// for writing. Writes staged by the backend are committed when the last of
+// these is released. Every other open gets 0.
+const fhWriter = 1
+
+// NewMemFS creates a new in-memory filesystem with a root directory.
+func NewMemFS() *MemFS {
+	fs := &MemFS{
+		nodes:   make(map[string]*node),
+		events:  NewEventBus(eventHistory),
+		writers: make(map[string]int),
+	}
+	fs.metrics = newMetrics(fs)
+	now := fuse.Now()
+	fs.nodes["/"] = &node{
+		stat: fuse.Stat_t{
+			Mode:  fuse.S_IFDIR | 0755,
+			Nlink: 2,
+			Atim:  now,
+			Mtim:  now,
+			Ctim:  now,
+		},
+	}
+	return fs
+}
+
+// split returns parent directory and base name.
+func split(path string) (string, string) {
+	path = strings.TrimSuffix(path, "/")
+	i := strings.LastIndex(path, "/")
+	if i == -1 {
+		return "", path
+	}
+	if i == 0 {
+		return "/", path[1:]
+	}
+	return path[:i], path[i+1:]
+}
+
+// resolveBackend finds the nearest ancestor node with a backend and returns the backend and relative path.
+// Returns (nil, path) if no backend is found in ancestors.
+func (fs *MemFS) resolveBackend(path string) (Backend, string) {
+	current := path
+	for {
+		if n, ok := fs.nodes[current]; ok && n.backend != nil {
+			// Found a backend node; compute relative path
+			relPath := strings.TrimPrefix(path, current)
+			if relPath == "" {
+				relPath = "/"
+			}
+			return n.backend, relPath
+		}
+
+		if current == "/" {
+			break
+		}
+		// Move to parent
+		current, _ = split(current)
+		if current == "" {
+			current = "/"
+		}
+	}
+	return nil, path
+}
+
+// LinkLocal mounts a real folder/file at a mount path.
+func (fs *MemFS) LinkLocal(mountPath string, targetRoot string) int {
+	return fs.LinkBackend(mountPath, NewLocalBackend(targetRoot))
+}
+
+// LinkArchive mounts a zip, tar or tar.gz file as a read-only directory.
+func (fs *MemFS) LinkArchive(mountPath string, archivePath string) int {
+	ab, err := NewArchiveBackend(archivePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return -fuse.ENOENT
+		}
+		if err == errUnsupportedArchive {
+			return -fuse.EINVAL
+		}
+		return -fuse.EIO
+	}
+
+	if res := fs.LinkBackend(mountPath, ab); res != 0 {
+		ab.Close()
+		return res
+	}
+	return 0
+}
+
+// LinkOverlay mounts a writable in-memory layer over one or more read-only
+// lower layers, listed from topmost to bottommost. Each lower layer is either
+// a real folder or an archive file.
+func (fs *MemFS) LinkOverlay(mountPath string, lowerRoots []string) (errc int) {
+	if len(lowerRoots) == 0 {
+		return -fuse.EINVAL
+	}
+
+	lowers := make([]Backend, 0, len(lowerRoots))
+	defer func() {
+		// Archives opened for the layers are closed unless the overlay is linked
+		if errc != 0 {
+			for _, l := range lowers {
+				closeBackend(l)
+			}
+		}
+	}()
+	for _, root := range lowerRoots {
+		info, err := os.Stat(root)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return -fuse.ENOENT
+			}
+			return -fuse.EIO
+		}
+		if info.IsDir() {
+			lowers = append(lowers, NewLocalBackend(root))
+			continue
+		}
+		ab, err := NewArchiveBackend(root)
+		if err != nil {
+			if err == errUnsupportedArchive {
+				return -fuse.EINVAL
+			}
+			return -fuse.EIO
+		}
+		lowers = append(lowers, ab)
+	}
+
+	return fs.LinkBackend(mountPath, NewOverlayBackend(NewMemBackend(), lowers...))
+}
+
+// LinkCrypt mounts a real folder whose contents and names are stored
+// encrypted. The folder is initialised with a new key on first use.
+func (fs *MemFS) LinkCrypt(mountPath string, targetRoot string, opts CryptOptions) int {
+	info, err := os.Stat(targetRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return -fuse.ENOENT
+		}
+		return -fuse.EIO
+	}
+	if !info.IsDir() {
+		return -fuse.ENOTDIR
+	}
+
+	cb, err := NewCryptBackend(NewLocalBackend(targetRoot), opts)
+	if err != nil {
+		switch {
+		case err == errWrongKey:
+			return -fuse.EACCES
+		case err == errNoKey || err == errShortKey:
+			return -fuse.EINVAL
+		case os.IsNotExist(err):
+			return -fuse.ENOENT
+		}
+		return -fuse.EIO
+	}
+	return fs.LinkBackend(mountPath, cb)
+}
+
+// LinkCompress mounts a real folder whose files are stored compressed.
+// Files already in the folder are left as they are.
+func (fs *MemFS) LinkCompress(mountPath string, targetRoot string, opts CompressOptions) int {
+	info, err := os.Stat(targetRoot)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return -fuse.ENOENT
+		}
+		return -fuse.EIO
+	}
+	if !info.IsDir() {
+		return -fuse.ENOTDIR
+	}
+
+	cb, err := NewCompressBackend(NewLocalBackend(targetRoot), opts)
+	if err != nil {
+		if err == errUnknownAlgorithm || err == errCompressLevel {
+			return -fuse.EINVAL
+		}
+		return -fuse.EIO
+	}
+	return fs.LinkBackend(mountPath, cb)
+}
+
+// LinkS3 mounts a bucket prefix on an S3-compatible service.
+func (fs *MemFS) LinkS3(mountPath string, opts S3Options) int {
+	sb, err := NewS3Backend(opts)
+	if err != nil {
+		return -fuse.EINVAL
+	}
+	if errc := sb.Probe(); errc != 0 {
+		return errc
+	}
+	return fs.LinkBackend(mountPath, sb)
+}
+
+// LinkWebDAV mounts a collection on a WebDAV server.
+func (fs *MemFS) LinkWebDAV(mountPath string, opts WebDAVOptions) int {
+	wb, err := NewWebDAVBackend(opts)
+	if err != nil {
+		return -fuse.EINVAL
+	}
+	if errc := wb.Probe(); errc != 0 {
+		return errc
+	}
+	return fs.LinkBackend(mountPath, wb)
+}
+
+// LinkSFTP mounts a directory on an SSH server.
+func (fs *MemFS) LinkSFTP(mountPath string, opts SFTPOptions) int {
+	sb, err := NewSFTPBackend(opts)
+	if err != nil {
+		return -fuse.EINVAL
+	}
+	if errc := sb.Probe(); errc != 0 {
+		sb.Close()
+		return errc
+	}
+	return fs.LinkBackend(mountPath, sb)
+}
+
+// LinkHTTP mounts a static tree published over HTTP, read-only.
+func (fs *MemFS) LinkHTTP(mountPath string, opts HTTPOptions) int {
+	hb, err := NewHTTPBackend(opts)
+	if err != nil {
+		return -fuse.EINVAL
+	}
+	if errc := hb.Probe(); errc != 0 {
+		return errc
+	}
+	return fs.LinkBackend(mountPath, hb)
+}
+
+// LinkGit mounts a git repository read-only, with one directory per ref.
+func (fs *MemFS) LinkGit(mountPath string, repoPath string) int {
+	if _, err := os.Stat(repoPath); err != nil {
+		if os.IsNotExist(err) {
+			return -fuse.ENOENT
+		}
+		return -fuse.EIO
+	}
+	gb, err := NewGitBackend(repoPath)
+	if err != nil {
+		if err == git.ErrRepositoryNotExists {
+			return -fuse.EINVAL
+		}
+		return -fuse.EIO
+	}
+
+	if res := fs.LinkBackend(mountPath, gb); res != 0 {
+		gb.Close()
+		return res
+	}
+	return 0
+}
+
+// LinkMirror mounts real folders that are kept identical: every change is
+// written to all of them and reads come from the first healthy one.
+func (fs *MemFS) LinkMirror(mountPath string, targetRoots []string) int {
+	if len(targetRoots) < 2 {
+		return -fuse.EINVAL
+	}
+
+	children := make([]Backend, 0, len(targetRoots))
+	for _, root := range targetRoots {
+		info, err := os.Stat(root)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return -fuse.ENOENT
+			}
+			return -fuse.EIO
+		}
+		if !info.IsDir() {
+			return -fuse.ENOTDIR
+		}
+		children = append(children, NewLocalBackend(root))
+	}
+	return fs.LinkBackend(mountPath, NewMirrorBackend(children...))
+}
+
+// backendAt returns the backend linked exactly at mountPath.
+// Caller must hold fs.lock.
+func (fs *MemFS) backendAt(mountPath string) (*node, int) {
+	n, ok := fs.nodes[mountPath]
+	if !ok {
+		return nil, -fuse.ENOENT
+	}
+	if n.backend == nil {
+		return nil, -fuse.EINVAL
+	}
+	return n, 0
+}
+
+// CacheMount wraps the backend linked at mountPath in a CacheBackend.
+func (fs *MemFS) CacheMount(mountPath string, opts CacheOptions) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, errc := fs.backendAt(mountPath)
+	if errc != 0 {
+		return errc
+	}
+	if _, ok := findBackend[*CacheBackend](n.backend); ok {
+		return -fuse.EEXIST
+	}
+	n.backend = NewCacheBackend(n.backend, opts)
+	return 0
+}
+
+// CacheStats returns the cache counters of the mount at mountPath.
+func (fs *MemFS) CacheStats(mountPath string) (CacheStats, int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, errc := fs.backendAt(mountPath)
+	if errc != 0 {
+		return CacheStats{}, errc
+	}
+	cb, ok := findBackend[*CacheBackend](n.backend)
+	if !ok {
+		return CacheStats{}, -fuse.EINVAL
+	}
+	return cb.Stats(), 0
+}
+
+// mirrorAt returns the MirrorBackend linked at mountPath.
+func (fs *MemFS) mirrorAt(mountPath string) (*MirrorBackend, int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, errc := fs.backendAt(mountPath)
+	if errc != 0 {
+		return nil, errc
+	}
+	mb, ok := findBackend[*MirrorBackend](n.backend)
+	if !ok {
+		return nil, -fuse.EINVAL
+	}
+	return mb, 0
+}
+
+// MirrorStatus returns the health of each copy behind the mirror at mountPath.
+func (fs *MemFS) MirrorStatus(mountPath string) (MirrorStatus, int) {
+	mb, errc := fs.mirrorAt(mountPath)
+	if errc != 0 {
+		return MirrorStatus{}, errc
+	}
+	return mb.Status(), 0
+}
+
+// MirrorResync repairs the copies behind the mirror at mountPath. The
+// mirror stays usable while it runs; paths changed meanwhile are copied
+// again.
+func (fs *MemFS) MirrorResync(mountPath string, full bool) int {
+	mb, errc := fs.mirrorAt(mountPath)
+	if errc != 0 {
+		return errc
+	}
+	return mb.Resync(full)
+}
+
+// FaultInject adds a fault rule to the mount at mountPath, wrapping its
+// backend in a FaultBackend first if needed. Rule paths are relative to the
+// mount point.
+func (fs *MemFS) FaultInject(mountPath string, rule FaultRule) (FaultRule, int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, errc := fs.backendAt(mountPath)
+	if errc != 0 {
+		return FaultRule{}, errc
+	}
+	fb, wrapped := findBackend[*FaultBackend](n.backend)
+	if !wrapped {
+		fb = NewFaultBackend(n.backend)
+	}
+	added, err := fb.AddRule(rule)
+	if err != nil {
+		return FaultRule{}, -fuse.EINVAL
+	}
+	if !wrapped {
+		n.backend = fb
+	}
+	return added, 0
+}
+
+// FaultRules returns the fault rules of the mount at mountPath.
+func (fs *MemFS) FaultRules(mountPath string) ([]FaultRule, int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, errc := fs.backendAt(mountPath)
+	if errc != 0 {
+		return nil, errc
+	}
+	fb, ok := findBackend[*FaultBackend](n.backend)
+	if !ok {
+		return []FaultRule{}, 0
+	}
+	return fb.Rules(), 0
+}
+
+// FaultClear removes the fault rule with the given ID from the mount at
+// mountPath, or all of its rules if id is 0.
+func (fs *MemFS) FaultClear(mountPath string, id int) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, errc := fs.backendAt(mountPath)
+	if errc != 0 {
+		return errc
+	}
+	fb, ok := findBackend[*FaultBackend](n.backend)
+	if !ok {
+		if id == 0 {
+			return 0
+		}
+		return -fuse.ENOENT
+	}
+	if !fb.RemoveRule(id) && id != 0 {
+		return -fuse.ENOENT
+	}
+	return 0
+}
+
+// ThrottleMount limits the bandwidth and operation rate of the mount at
+// mountPath, or changes the limits if it is already throttled.
+func (fs *MemFS) ThrottleMount(mountPath string, opts ThrottleOptions) int {
+	if opts.BytesPerSec < 0 || opts.OpsPerSec < 0 {
+		return -fuse.EINVAL
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, errc := fs.backendAt(mountPath)
+	if errc != 0 {
+		return errc
+	}
+	if tb, ok := findBackend[*ThrottleBackend](n.backend); ok {
+		tb.SetLimits(opts)
+		return 0
+	}
+	n.backend = NewThrottleBackend(n.backend, opts)
+	return 0
+}
+
+// ThrottleStatus returns the state of every throttled mount by mount path.
+func (fs *MemFS) ThrottleStatus() map[string]ThrottleStatus {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	out := make(map[string]ThrottleStatus)
+	for p, n := range fs.nodes {
+		if tb, ok := findBackend[*ThrottleBackend](n.backend); ok {
+			out[p] = tb.Status()
+		}
+	}
+	return out
+}
+
+// WatchMount starts reporting changes other programs make to the storage
+// behind the mount at mountPath. Each change is published as an external
+// event, dropped from caches in front of the backend and passed to the
+// notifier. Only local folders can be watched, and only on Linux.
+func (fs *MemFS) WatchMount(mountPath string) int {
+	fs.lock.Lock()
+	n, errc := fs.backendAt(mountPath)
+	var b Backend
+	if errc == 0 {
+		b = n.backend
+	}
+	fs.lock.Unlock()
+	if errc != 0 {
+		return errc
+	}
+
+	// The initial scan of a large tree can take a while; do it unlocked
+	err := watchBackend(b, func(c BackendChange) {
+		fs.external(mountPath, c)
+	})
+	switch {
+	case err == errWatchUnsupported:
+		return -fuse.ENOTSUP
+	case err == errWatchActive:
+		return -fuse.EEXIST
+	case os.IsNotExist(err):
+		return -fuse.ENOENT
+	case err != nil:
+		return -fuse.EIO
+	}
+	return 0
+}
+
+// UnwatchMount stops reporting outside changes to the mount at mountPath.
+func (fs *MemFS) UnwatchMount(mountPath string) int {
+	fs.lock.Lock()
+	n, errc := fs.backendAt(mountPath)
+	var b Backend
+	if errc == 0 {
+		b = n.backend
+	}
+	fs.lock.Unlock()
+	if errc != 0 {
+		return errc
+	}
+	unwatchBackend(b)
+	return 0
+}
+
+// LinkBackend mounts an arbitrary backend at a mount path.
+func (fs *MemFS) LinkBackend(mountPath string, b Backend) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	// Check if path already exists
+	if _, ok := fs.nodes[mountPath]; ok {
+		return -fuse.EEXIST
+	}
+
+	// Check parent exists and is a directory
+	parent, _ := split(mountPath)
+	if parent == "" {
+		parent = "/"
+	}
+	pn, ok := fs.nodes[parent]
+	if !ok {
+		return -fuse.ENOENT
+	}
+	if pn.stat.Mode&fuse.S_IFDIR == 0 {
+		return -fuse.ENOTDIR
+	}
+
+	// Create backend node
+	now := fuse.Now()
+	fs.nodes[mountPath] = &node{
+		stat: fuse.Stat_t{
+			Mode:  fuse.S_IFDIR | 0755,
+			Nlink: 2,
+			Atim:  now,
+			Mtim:  now,
+			Ctim:  now,
+		},
+		backend:     newMeteredBackend(b, mountPath, fs.metrics),
+		backendPath: "/",
+	}
+
+	// Increment parent link count
+	pn.stat.Nlink++
+
+	return fs.changed(0, EventLink, mountPath)
+}
+
+// Getattr gets file attributes.
+func (fs *MemFS) Getattr(path string, stat *fuse.Stat_t, fh uint64) (errc int) {
+	defer fs.metrics.observe("getattr", time.Now(), &errc)
+	fs.lock.Lock()
+	n, ok := fs.nodes[path]
+	if ok && n.backend == nil {
+		*stat = n.stat
+		fs.lock.Unlock()
+		return 0
+	}
+	// Stat through the node's own backend or an ancestor's
+	backend, relPath := fs.resolveBackend(path)
+	fs.lock.Unlock()
+	if backend == nil {
+		return -fuse.ENOENT
+	}
+
+	// Backends do their own locking; a slow or throttled one must not hold
+	// up the rest of the filesystem
+	st, err := backend.Stat(relPath)
+	if err != 0 {
+		return err
+	}
+	*stat = *st
+	return 0
+}
+
+// Mkdir creates a directory.
+func (fs *MemFS) Mkdir(path string, mode uint32) (errc int) {
+	defer fs.metrics.observe("mkdir", time.Now(), &errc)
+	fs.lock.Lock()
+	if _, ok := fs.nodes[path]; ok {
+		fs.lock.Unlock()
+		return -fuse.EEXIST
+	}
+
+	parent, basename := split(path)
+	if parent == "" {
+		parent = "/"
+	}
+	var backend Backend
+	var relPath string
+	pn, ok := fs.nodes[parent]
+	switch {
+	case !ok:
+		// Try to resolve parent via backend
+		backend, relPath = fs.resolveBackend(parent)
+		if backend == nil {
+			fs.lock.Unlock()
+			return -fuse.ENOENT
+		}
+	case pn.stat.Mode&fuse.S_IFDIR == 0:
+		fs.lock.Unlock()
+		return -fuse.ENOTDIR
+	case pn.backend != nil:
+		// The relative path is just the basename since parent is the backend node
+		backend, relPath = pn.backend, "/"+basename
+	}
+	if backend != nil {
+		fs.lock.Unlock()
+		err := backend.Mkdir(relPath, mode)
+		return fs.changed(err, EventMkdir, path)
+	}
+	defer fs.lock.Unlock()
+
+	if fs.full() {
+		return -fuse.ENOSPC
+	}
+
+	now := fuse.Now()
+	fs.nodes[path] = &node{
+		stat: fuse.Stat_t{
+			Mode:  fuse.S_IFDIR | mode,
+			Nlink: 2,
+			Atim:  now,
+			Mtim:  now,
+			Ctim:  now,
+		},
+	}
+	pn.stat.Nlink++
+	return fs.changed(0, EventMkdir, path)
+}
+
+// Rmdir removes a directory.
+func (fs *MemFS) Rmdir(path string) (errc int) {
+	defer fs.metrics.observe("rmdir", time.Now(), &errc)
+
+	// Cannot remove root
+	if path == "/" {
+		return -fuse.ENOENT
+	}
+
+	fs.lock.Lock()
+	n, ok := fs.nodes[path]
+	if !ok {
+		// Try to resolve via backend
+		backend, relPath := fs.resolveBackend(path)
+		fs.lock.Unlock()
+		if backend != nil {
+			err := backend.Rmdir(relPath)
+			return fs.changed(err, EventRmdir, path)
+		}
+		return -fuse.ENOENT
+	}
+	if n.stat.Mode&fuse.S_IFDIR == 0 {
+		fs.lock.Unlock()
+		return -fuse.ENOTDIR
+	}
+
+	// Check if directory has a backend; if so, remove through backend
+	if n.backend != nil {
+		backend, relPath := n.backend, n.backendPath
+		fs.lock.Unlock()
+		if err := backend.Rmdir(relPath); err != 0 {
+			return err
+		}
+
+		// Also remove from in-memory nodes, unless relinked meanwhile
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		if fs.nodes[path] != n {
+			return fs.changed(0, EventRmdir, path)
+		}
+		parent, _ := split(path)
+		if parent == "" {
+			parent = "/"
+		}
+		if pn, ok := fs.nodes[parent]; ok {
+			pn.stat.Nlink--
+		}
+		delete(fs.nodes, path)
+		return fs.changed(0, EventRmdir, path)
+	}
+	defer fs.lock.Unlock()
+
+	// Check if directory is empty
+	prefix := path
+	if prefix != "/" {
+		prefix += "/"
+	}
+	for p := range fs.nodes {
+		if strings.HasPrefix(p, prefix) && p != path {
+			return -fuse.ENOTEMPTY
+		}
+	}
+
+	parent, _ := split(path)
+	if parent == "" {
+		parent = "/"
+	}
+	if pn, ok := fs.nodes[parent]; ok {
+		pn.stat.Nlink--
+	}
+	delete(fs.nodes, path)
+	return fs.changed(0, EventRmdir, path)
+}
+
+// Mknod creates a file node.
+func (fs *MemFS) Mknod(path string, mode uint32, dev uint64) (errc int) {
+	defer fs.metrics.observe("mknod", time.Now(), &errc)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if _, ok := fs.nodes[path]; ok {
+		return -fuse.EEXIST
+	}
+
+	parent, _ := split(path)
+	if _, ok := fs.nodes[parent]; !ok {
+		return -fuse.ENOENT
+	}
+	if fs.full() {
+		return -fuse.ENOSPC
+	}
+
+	now := fuse.Now()
+	fs.nodes[path] = &node{
+		stat: fuse.Stat_t{
+			Mode:  fuse.S_IFREG | mode,
+			Nlink: 1,
+			Atim:  now,
+			Mtim:  now,
+			Ctim:  now,
+		},
+		data: []byte{},
+	}
+	return fs.changed(0, EventCreate, path)
+}
+
+// Unlink removes a file.
+func (fs *MemFS) Unlink(path string) (errc int) {
+	defer fs.metrics.observe("unlink", time.Now(), &errc)
+	fs.lock.Lock()
+	n, ok := fs.nodes[path]
+	if !ok {
+		// Try to resolve via backend
+		backend, relPath := fs.resolveBackend(path)
+		fs.lock.Unlock()
+		if backend != nil {
+			err := backend.Unlink(relPath)
+			return fs.changed(err, EventUnlink, path)
+		}
+		return -fuse.ENOENT
+	}
+	if n.stat.Mode&fuse.S_IFDIR != 0 {
+		fs.lock.Unlock()
+		return -fuse.EISDIR
+	}
+
+	// If node has a backend, delete through it
+	if n.backend != nil {
+		backend, relPath := n.backend, n.backendPath
+		fs.lock.Unlock()
+		if err := backend.Unlink(relPath); err != 0 {
+			return err
+		}
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		if fs.nodes[path] == n {
+			delete(fs.nodes, path)
+		}
+		return fs.changed(0, EventUnlink, path)
+	}
+	defer fs.lock.Unlock()
+
+	fs.tier.drop(n)
+	fs.used -= n.stat.Size
+	delete(fs.nodes, path)
+	return fs.changed(0, EventUnlink, path)
+}
+
+// Rename moves/renames a file or directory.
+func (fs *MemFS) Rename(oldpath string, newpath string) (errc int) {
+	defer fs.metrics.observe("rename", time.Now(), &errc)
+	fs.lock.Lock()
+	n, ok := fs.nodes[oldpath]
+	if !ok {
+		// Try to resolve via backend
+		backend, relPath := fs.resolveBackend(oldpath)
+		newBackend, newRelPath := fs.resolveBackend(newpath)
+		fs.lock.Unlock()
+		if backend != nil {
+			// Can only rename within same backend
+			if backend != newBackend {
+				return -fuse.EIO
+			}
+			err := backend.Rename(relPath, newRelPath)
+			if err == 0 {
+				fs.moveWriters(oldpath, newpath)
+			}
+			return fs.renamed(err, oldpath, newpath)
+		}
+		return -fuse.ENOENT
+	}
+
+	// Check new parent exists
+	newParent, _ := split(newpath)
+	if newParent == "" {
+		newParent = "/"
+	}
+	if _, ok := fs.nodes[newParent]; !ok {
+		fs.lock.Unlock()
+		return -fuse.ENOENT
+	}
+
+	// If node has a backend, rename through it
+	if n.backend != nil {
+		backend, relPath := n.backend, n.backendPath
+		fs.lock.Unlock()
+		if err := backend.Rename(relPath, newpath); err != 0 {
+			return err
+		}
+		fs.lock.Lock()
+		if fs.nodes[oldpath] == n {
+			delete(fs.nodes, oldpath)
+			fs.nodes[newpath] = n
+		}
+		fs.lock.Unlock()
+		fs.moveWriters(oldpath, newpath)
+		return fs.renamed(0, oldpath, newpath)
+	}
+	defer fs.lock.Unlock()
+
+	// Remove existing target if any
+	if old, ok := fs.nodes[newpath]; ok {
+		fs.tier.drop(old)
+		fs.used -= old.stat.Size
+		delete(fs.nodes, newpath)
+	}
+
+	// Move node
+	delete(fs.nodes, oldpath)
+	fs.nodes[newpath] = n
+
+	// If directory, update children paths
+	if n.stat.Mode&fuse.S_IFDIR != 0 {
+		oldPrefix := oldpath + "/"
+		newPrefix := newpath + "/"
+		for p, child := range fs.nodes {
+			if strings.HasPrefix(p, oldPrefix) {
+				newChildPath := newPrefix + strings.TrimPrefix(p, oldPrefix)
+				delete(fs.nodes, p)
+				fs.nodes[newChildPath] = child
+			}
+		}
+	}
+
+	return fs.renamed(0, oldpath, newpath)
+}
+
+// Open opens a file.
+func (fs *MemFS) Open(path string, flags int) (errc int, fh uint64) {
+	defer fs.metrics.observe("open", time.Now(), &errc)
+	fs.lock.Lock()
+	n, ok := fs.nodes[path]
+	if ok {
+		fs.lock.Unlock()
+		if n.stat.Mode&fuse.S_IFDIR != 0 {
+			return -fuse.EISDIR, 0
+		}
+		return 0, 0
+	}
+	// Try to resolve via backend
+	backend, relPath := fs.resolveBackend(path)
+	fs.lock.Unlock()
+	if backend == nil {
+		return -fuse.ENOENT, 0
+	}
+
+	// Check if it's a file by calling Stat
+	stat, err := backend.Stat(relPath)
+	if err != 0 {
+		return err, 0
+	}
+	if stat.Mode&fuse.S_IFDIR != 0 {
+		return -fuse.EISDIR, 0
+	}
+	if flags&fuse.O_ACCMODE == fuse.O_RDONLY {
+		return 0, 0
+	}
+	return 0, fs.writer(path)
+}
+
+// writer counts a handle opened for writing on a linked file and returns
+// it.
+func (fs *MemFS) writer(path string) uint64 {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.writers[path]++
+	return fhWriter
+}
+
+// moveWriters carries the open write handles under oldpath over to newpath.
+func (fs *MemFS) moveWriters(oldpath, newpath string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for p, count := range fs.writers {
+		if p == oldpath || strings.HasPrefix(p, oldpath+"/") {
+			delete(fs.writers, p)
+			fs.writers[newpath+strings.TrimPrefix(p, oldpath)] += count
+		}
+	}
+}
+
+// lastWriter reports whether fh is the only handle open for writing on
+// path, and with release set also stops counting it.
+func (fs *MemFS) lastWriter(path string, fh uint64, release bool) bool {
+	if fh != fhWriter {
+		return false
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	count := fs.writers[path]
+	if count > 1 {
+		if release {
+			fs.writers[path] = count - 1
+		}
+		return false
+	}
+	if release {
+		delete(fs.writers, path)
+	}
+	return true
+}
+
+// Flush is called on every close of a file. Backends that stage writes
+// commit them here, once no other handle has the file open for writing, so
+// errors reach the closing process.
+func (fs *MemFS) Flush(path string, fh uint64) (errc int) {
+	defer fs.metrics.observe("flush", time.Now(), &errc)
+	if !fs.lastWriter(path, fh, false) {
+		return 0
+	}
+	return fs.flush(path)
+}
+
+// flush commits staged writes to path.
+func (fs *MemFS) flush(path string) int {
+	fs.lock.Lock()
+	_, inMemory := fs.nodes[path]
+	backend, relPath := fs.resolveBackend(path)
+	fs.lock.Unlock()
+
+	if inMemory || backend == nil {
+		return 0
+	}
+	// Uploads can be slow; run them unlocked
+	return flushBackend(backend, relPath)
+}
+
+// Release is called when a handle to a file is closed. Staged writes are
+// committed when the last handle open for writing goes, so a file being
+// written in several steps isn't uploaded half-done by others closing it.
+func (fs *MemFS) Release(path string, fh uint64) (errc int) {
+	defer fs.metrics.observe("release", time.Now(), &errc)
+	if !fs.lastWriter(path, fh, true) {
+		return 0
+	}
+	return fs.flush(path)
+}
+
+// linked returns every backend linked into the tree.
+// Caller must hold fs.lock.
+func (fs *MemFS) linked() []Backend {
+	var backends []Backend
+	for _, n := range fs.nodes {
+		if n.backend != nil {
+			backends = append(backends, n.backend)
+		}
+	}
+	return backends
+}
+
+// Sync commits the writes every linked backend still stages, such as those
+// to files nobody closed. It returns the first error.
+func (fs *MemFS) Sync() int {
+	fs.lock.Lock()
+	backends := fs.linked()
+	fs.lock.Unlock()
+
+	// Uploads can be slow; run them unlocked
+	errc := 0
+	for _, b := range backends {
+		if e := syncBackend(b); e != 0 && errc == 0 {
+			errc = e
+		}
+	}
+	return errc
+}
+
+// Close prepares MemFS for the process to exit: it commits staged writes,
+// stops watching linked folders, closes linked backends, the change journal
+// and audit log, and deletes the tiering spill directory. Spilled file contents are lost,
+// so the filesystem should not be used afterwards.
+func (fs *MemFS) Close() error {
+	var errs []error
+	if errc := fs.Sync(); errc != 0 {
+		errs = append(errs, fmt.Errorf("committing staged writes: %s", resultLabel(errc)))
+	}
+
+	fs.lock.Lock()
+	backends := fs.linked()
+	t, j, l := fs.tier, fs.journal, fs.audit
+	fs.tier, fs.journal, fs.audit = nil, nil, nil
+	fs.lock.Unlock()
+
+	for _, b := range backends {
+		unwatchBackend(b)
+		if err := closeBackend(b); err != nil {
+			errs = append(errs, fmt.Errorf("closing linked backend: %w", err))
+		}
+	}
+	if j != nil {
+		if err := j.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing change journal: %w", err))
+		}
+	}
+	if l != nil {
+		if err := l.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing audit log: %w", err))
+		}
+	}
+	t.discard()
+	return errors.Join(errs...)
+}
+
+// ioBackend returns the backend serving a file and the file's path there,
+// or a nil backend for files held in memory.
+func (fs *MemFS) ioBackend(path string) (Backend, string, int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, ok := fs.nodes[path]
+	if !ok {
+		backend, relPath := fs.resolveBackend(path)
+		if backend == nil {
+			return nil, "", -fuse.ENOENT
+		}
+		return backend, relPath, 0
+	}
+	if n.stat.Mode&fuse.S_IFDIR != 0 {
+		return nil, "", -fuse.EISDIR
+	}
+	return n.backend, n.backendPath, 0
+}
+
+// Read reads data from a file.
+func (fs *MemFS) Read(path string, buff []byte, ofst int64, fh uint64) (errc int) {
+	defer fs.metrics.observe("read", time.Now(), &errc)
+	// Backends do their own locking; reading from a slow or throttled one
+	// must not hold up the rest of the filesystem
+	backend, relPath, errc := fs.ioBackend(path)
+	if errc != 0 {
+		return errc
+	}
+	if backend != nil {
+		bytesRead, err := backend.Read(relPath, buff, ofst)
+		if err != 0 {
+			return err
+		}
+		return bytesRead
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, ok := fs.nodes[path]
+	if !ok || n.backend != nil {
+		// Removed or linked over since ioBackend looked
+		return -fuse.ENOENT
+	}
+	if n.stat.Mode&fuse.S_IFDIR != 0 {
+		return -fuse.EISDIR
+	}
+
+	if errc := fs.tier.touch(n); errc != 0 {
+		return errc
+	}
+	if n.tier.spill != "" {
+		return fs.tier.readAt(n, buff, ofst)
+	}
+
+	size := int64(len(n.data))
+	if ofst >= size {
+		return 0
+	}
+
+	end := ofst + int64(len(buff))
+	if end > size {
+		end = size
+	}
+
+	return copy(buff, n.data[ofst:end])
+}
+
+// Write writes data to a file.
+func (fs *MemFS) Write(path string, buff []byte, ofst int64, fh uint64) (errc int) {
+	defer fs.metrics.observe("write", time.Now(), &errc)
+	// As in Read, backends are written to without holding fs.lock
+	backend, relPath, errc := fs.ioBackend(path)
+	if errc != 0 {
+		return errc
+	}
+	if backend != nil {
+		bytesWritten, err := backend.Write(relPath, buff, ofst)
+		if err != 0 {
+			return err
+		}
+		return fs.written(path, bytesWritten)
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, ok := fs.nodes[path]
+	if !ok || n.backend != nil {
+		// Removed or linked over since ioBackend looked
+		return -fuse.ENOENT
+	}
+	if n.stat.Mode&fuse.S_IFDIR != 0 {
+		return -fuse.EISDIR
+	}
+
+	if errc := fs.fits(n, ofst+int64(len(buff))); errc != 0 {
+		return errc
+	}
+	defer fs.sized(n, n.stat.Size)
+	if errc := fs.tier.touch(n); errc != 0 {
+		return errc
+	}
+	if n.tier.spill != "" {
+		return fs.written(path, fs.tier.writeAt(n, buff, ofst))
+	}
+
+	end := ofst + int64(len(buff))
+	if end > int64(len(n.data)) {
+		newData := make([]byte, end)
+		copy(newData, n.data)
+		n.data = newData
+	}
+	copy(n.data[ofst:], buff)
+
+	n.stat.Size = int64(len(n.data))
+	n.stat.Mtim = fuse.Now()
+	fs.tier.account(n, nil)
+	return fs.written(path, len(buff))
+}
+
+// Truncate changes the size of a file.
+func (fs *MemFS) Truncate(path string, size int64, fh uint64) (errc int) {
+	defer fs.metrics.observe("truncate", time.Now(), &errc)
+	fs.lock.Lock()
+	n, ok := fs.nodes[path]
+	if ok && n.stat.Mode&fuse.S_IFDIR != 0 {
+		fs.lock.Unlock()
+		return -fuse.EISDIR
+	}
+	if !ok || n.backend != nil {
+		// Truncate through the node's own backend or an ancestor's
+		backend, relPath := fs.resolveBackend(path)
+		fs.lock.Unlock()
+		if backend == nil {
+			return -fuse.ENOENT
+		}
+		if err := backend.Truncate(relPath, size); err != 0 {
+			return err
+		}
+		return fs.truncated(path, size)
+	}
+	defer fs.lock.Unlock()
+
+	if errc := fs.fits(n, size); errc != 0 {
+		return errc
+	}
+	defer fs.sized(n, n.stat.Size)
+	if errc := fs.tier.touch(n); errc != 0 {
+		return errc
+	}
+	if n.tier.spill != "" {
+		if errc := fs.tier.truncate(n, size); errc != 0 {
+			return errc
+		}
+		return fs.truncated(path, size)
+	}
+
+	if size < int64(len(n.data)) {
+		n.data = n.data[:size]
+	} else if size > int64(len(n.data)) {
+		newData := make([]byte, size)
+		copy(newData, n.data)
+		n.data = newData
+	}
+
+	n.stat.Size = size
+	n.stat.Mtim = fuse.Now()
+	fs.tier.account(n, nil)
+	return fs.truncated(path, size)
+}
+
+// Readdir reads directory entries.
+func (fs *MemFS) Readdir(path string,
+	fill func(name string, stat *fuse.Stat_t, ofst int64) bool,
+	ofst int64, fh uint64) (errc int) {
+	defer fs.metrics.observe("readdir", time.Now(), &errc)
+
+	fs.lock.Lock()
+
+	// Check if path exists in nodes first
+	n, ok := fs.nodes[path]
+	if !ok || n.backend != nil {
+		// This is a backend node itself, or a path under a backend in an
+		// ancestor; list it through the backend, unlocked
+		backend, relPath := fs.resolveBackend(path)
+		fs.lock.Unlock()
+		if backend == nil {
+			return -fuse.ENOENT
+		}
+		ents, err := backend.Readdir(relPath)
+		if err != 0 {
+			return err
+		}
+		fill(".", nil, 0)
+		fill("..", nil, 0)
+		for _, e := range ents {
+			// Skip Windows system files
+			if e.Name == "desktop.ini" || e.Name == "thumbs.db" {
+				continue
+			}
+			fill(e.Name, &e.Stat, 0)
+		}
+		return 0
+	}
+	defer fs.lock.Unlock()
+
+	// In-memory path
+	if n.stat.Mode&fuse.S_IFDIR == 0 {
+		return -fuse.ENOTDIR
+	}
+
+	fill(".", nil, 0)
+	fill("..", nil, 0)
+
+	prefix := path
+	if prefix != "/" {
+		prefix += "/"
+	}
+
+	for p, n := range fs.nodes {
+		if p == path {
+			continue
+		}
+		if strings.HasPrefix(p, prefix) {
+			suffix := strings.TrimPrefix(p, prefix)
+			// Only direct children (no nested paths)
+			if !strings.Contains(suffix, "/") {
+				fill(suffix, &n.stat, 0)
+			}
+		}
+	}
+
+	return 0
+}
+
+// Opendir opens a directory.
+func (fs *MemFS) Opendir(path string) (errc int, fh uint64) {
+	defer fs.metrics.observe("opendir", time.Now(), &errc)
+	fs.lock.Lock()
+	n, ok := fs.nodes[path]
+	if ok {
+		fs.lock.Unlock()
+		if n.stat.Mode&fuse.S_IFDIR == 0 {
+			return -fuse.ENOTDIR, 0
+		}
+		return 0, 0
+	}
+	// Try to resolve via backend
+	backend, relPath := fs.resolveBackend(path)
+	fs.lock.Unlock()
+	if backend == nil {
+		return -fuse.ENOENT, 0
+	}
+
+	// Check if it's a directory by calling Stat
+	stat, err := backend.Stat(relPath)
+	if err != 0 {
+		return err, 0
+	}
+	if stat.Mode&fuse.S_IFDIR == 0 {
+		return -fuse.ENOTDIR, 0
+	}
+	return 0, 0
+}
+
+// Utimens sets file access and modification times.
+func (fs *MemFS) Utimens(path string, tmsp []fuse.Timespec) (errc int) {
+	defer fs.metrics.observe("utimens", time.Now(), &errc)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, ok := fs.nodes[path]
+	if !ok {
+		return -fuse.ENOENT
+	}
+
+	if tmsp == nil {
+		now := fuse.Now()
+		n.stat.Atim = now
+		n.stat.Mtim = now
+	} else {
+		n.stat.Atim = tmsp[0]
+		n.stat.Mtim = tmsp[1]
+	}
+	return 0
+}
+
+// Create creates and opens a file.
+func (fs *MemFS) Create(path string, flags int, mode uint32) (errc int, fh uint64) {
+	defer fs.metrics.observe("create", time.Now(), &errc)
+	fs.lock.Lock()
+	parent, basename := split(path)
+	if parent == "" {
+		parent = "/"
+	}
+	var backend Backend
+	var relPath string
+	pn, ok := fs.nodes[parent]
+	if !ok {
+		// Try to resolve via backend
+		backend, relPath = fs.resolveBackend(path)
+		if backend == nil {
+			fs.lock.Unlock()
+			return -fuse.ENOENT, 0
+		}
+	} else if pn.backend != nil {
+		// The relative path is just the basename since parent is the backend node
+		backend, relPath = pn.backend, "/"+basename
+	}
+	if backend != nil {
+		fs.lock.Unlock()
+		if err := backend.Create(relPath, mode); err != 0 {
+			return err, 0
+		}
+		return fs.changed(0, EventCreate, path), fs.writer(path)
+	}
+	defer fs.lock.Unlock()
+
+	if fs.full() {
+		return -fuse.ENOSPC, 0
+	}
+
+	now := fuse.Now()
+	fs.nodes[path] = &node{
+		stat: fuse.Stat_t{
+			Mode:  fuse.S_IFREG | mode,
+			Nlink: 1,
+			Atim:  now,
+			Mtim:  now,
+			Ctim:  now,
+		},
+		data: []byte{},
+	}
+	return fs.changed(0, EventCreate, path), 0
+}
+
+// Statfs gets filesystem statistics.
+func (fs *MemFS) Statfs(path string, stat *fuse.Statfs_t) (errc int) {
+	defer fs.metrics.observe("statfs", time.Now(), &errc)
+	stat.Bsize = 4096
+	stat.Frsize = 4096
+	stat.Blocks = 1000000
+	stat.Bfree = 1000000
+	stat.Bavail = 1000000
+	stat.Files = 1000000
+	stat.Ffree = 1000000
+	stat.Namemax = 255
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.statfsCapacity(stat)
+	return 0
+}
+
+// Chmod changes file mode.
+func (fs *MemFS) Chmod(path string, mode uint32) (errc int) {
+	defer fs.metrics.observe("chmod", time.Now(), &errc)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, ok := fs.nodes[path]
+	if !ok {
+		return -fuse.ENOENT
+	}
+
+	n.stat.Mode = (n.stat.Mode & fuse.S_IFMT) | mode
+	n.stat.Ctim = fuse.Now()
+	return fs.changed(0, EventChmod, path)
+}
+
+// Chown changes file owner/group.
+func (fs *MemFS) Chown(path string, uid uint32, gid uint32) (errc int) {
+	defer fs.metrics.observe("chown", time.Now(), &errc)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	n, ok := fs.nodes[path]
+	if !ok {
+		return -fuse.ENOENT
+	}
+
+	if uid != ^uint32(0) {
+		n.stat.Uid = uid
+	}
+	if gid != ^uint32(0) {
+		n.stat.Gid = gid
+	}
+	n.stat.Ctim = fuse.Now()
+	return 0
+}
+
+// unused import guard
+var _ = time.Now
@@ -1,4 +1,4 @@
-package main
+package gobox
 
 import (
 	"math/rand"
@@ -1210,3 +1210,40 @@ func TestResolveBackend(t *testing.T) {
 		t.Errorf("resolveBackend returned relPath %s, expected /subpath/file.txt", relPath)
 	}
 }
+
+// closingBackend counts calls to Close
+type closingBackend struct {
+	Backend
+	closed int
+}
+
+func (b *closingBackend) Close() error {
+	b.closed++
+	return nil
+}
+
+// TestCloseBackends tests Close closing linked backends, including those
+// behind wrappers, overlays and mirrors
+func TestCloseBackends(t *testing.T) {
+	fs := newTestFS()
+	plain := &closingBackend{Backend: NewMemBackend()}
+	wrapped := &closingBackend{Backend: NewMemBackend()}
+	lower := &closingBackend{Backend: NewMemBackend()}
+	child := &closingBackend{Backend: NewMemBackend()}
+
+	fs.LinkBackend("/plain", plain)
+	fs.LinkBackend("/wrapped", wrapped)
+	assertSuccess(t, fs.ThrottleMount("/wrapped", ThrottleOptions{OpsPerSec: 100}), "ThrottleMount")
+	assertSuccess(t, fs.CacheMount("/wrapped", CacheOptions{}), "CacheMount")
+	fs.LinkBackend("/overlay", NewOverlayBackend(NewMemBackend(), lower))
+	fs.LinkBackend("/mirror", NewMirrorBackend(NewMemBackend(), child))
+
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	for name, b := range map[string]*closingBackend{"plain": plain, "wrapped": wrapped, "overlay lower": lower, "mirror child": child} {
+		if b.closed != 1 {
+			t.Errorf("%s backend closed %d times, expected once", name, b.closed)
+		}
+	}
+}
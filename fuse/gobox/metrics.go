@@ -0,0 +1,313 @@
+package gobox
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// latencyBuckets span in-memory calls of a few microseconds up to slow
+// network backends
+var latencyBuckets = prometheus.ExponentialBuckets(10e-6, 4, 11) // 10µs to ~10s
+
+// errnoNames label results by errno name rather than by number, which
+// differs between platforms
+var errnoNames = map[int]string{
+	fuse.EPERM:        "EPERM",
+	fuse.ENOENT:       "ENOENT",
+	fuse.EIO:          "EIO",
+	fuse.EBADF:        "EBADF",
+	fuse.EAGAIN:       "EAGAIN",
+	fuse.EACCES:       "EACCES",
+	fuse.EEXIST:       "EEXIST",
+	fuse.EXDEV:        "EXDEV",
+	fuse.ENOTDIR:      "ENOTDIR",
+	fuse.EISDIR:       "EISDIR",
+	fuse.EINVAL:       "EINVAL",
+	fuse.ENOSPC:       "ENOSPC",
+	fuse.EROFS:        "EROFS",
+	fuse.ENAMETOOLONG: "ENAMETOOLONG",
+	fuse.ENOSYS:       "ENOSYS",
+	fuse.ENOTEMPTY:    "ENOTEMPTY",
+	fuse.ETIMEDOUT:    "ETIMEDOUT",
+	fuse.ENOTSUP:      "ENOTSUP",
+}
+
+// resultLabel turns a result code into a label value: "ok" for success,
+// otherwise the errno name
+func resultLabel(errc int) string {
+	if errc >= 0 {
+		return "ok"
+	}
+	if name, ok := errnoNames[-errc]; ok {
+		return name
+	}
+	return "errno_" + strconv.Itoa(-errc)
+}
+
+// Metrics holds the Prometheus collectors of a MemFS, its backends and the
+// API server in front of it. Each MemFS has its own registry so that
+// several can live in one process.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	ops     *prometheus.CounterVec   // op, result
+	opTime  *prometheus.HistogramVec // op
+	bytes   *prometheus.CounterVec   // direction
+	handles prometheus.Gauge
+
+	backendOps   *prometheus.CounterVec   // mount, op, result
+	backendTime  *prometheus.HistogramVec // mount, op
+	backendBytes *prometheus.CounterVec   // mount, direction
+
+	requests    *prometheus.CounterVec   // handler, method, code
+	requestTime *prometheus.HistogramVec // handler, method
+}
+
+// newMetrics creates the collectors for fs and registers them, along with
+// the Go runtime and process collectors
+func newMetrics(fs *MemFS) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		ops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gobox_fs_operations_total",
+			Help: "Filesystem operations by operation and result.",
+		}, []string{"op", "result"}),
+		opTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gobox_fs_operation_duration_seconds",
+			Help:    "Time taken by filesystem operations, including waiting for locks.",
+			Buckets: latencyBuckets,
+		}, []string{"op"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gobox_fs_bytes_total",
+			Help: "Bytes read and written through the filesystem.",
+		}, []string{"direction"}),
+		handles: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gobox_fs_open_handles",
+			Help: "Files opened or created and not yet released.",
+		}),
+		backendOps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gobox_backend_operations_total",
+			Help: "Backend calls by mount point, operation and result.",
+		}, []string{"mount", "op", "result"}),
+		backendTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gobox_backend_operation_duration_seconds",
+			Help:    "Time taken by backend calls.",
+			Buckets: latencyBuckets,
+		}, []string{"mount", "op"}),
+		backendBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gobox_backend_bytes_total",
+			Help: "Bytes read from and written to backends.",
+		}, []string{"mount", "direction"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gobox_http_requests_total",
+			Help: "REST API requests by endpoint, method and status code.",
+		}, []string{"handler", "method", "code"}),
+		requestTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gobox_http_request_duration_seconds",
+			Help:    "Time taken to answer REST API requests.",
+			Buckets: latencyBuckets,
+		}, []string{"handler", "method"}),
+	}
+
+	m.registry.MustRegister(
+		m.ops, m.opTime, m.bytes, m.handles,
+		m.backendOps, m.backendTime, m.backendBytes,
+		m.requests, m.requestTime,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gobox_memfs_nodes",
+			Help: "Files and directories MemFS keeps entries for.",
+		}, func() float64 {
+			fs.lock.Lock()
+			defer fs.lock.Unlock()
+			return float64(len(fs.nodes))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gobox_memfs_memory_bytes",
+			Help: "Bytes of file contents held in memory.",
+		}, func() float64 {
+			fs.lock.Lock()
+			defer fs.lock.Unlock()
+			var total int
+			for _, n := range fs.nodes {
+				total += len(n.data)
+			}
+			return float64(total)
+		}),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Registry returns the registry the metrics are kept in, for adding
+// collectors of one's own
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observe records a MemFS operation that started at start. Meant to be
+// deferred with a pointer to the operation's result, which for reads and
+// writes is the byte count.
+func (m *Metrics) observe(op string, start time.Time, errc *int) {
+	m.opTime.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	m.ops.WithLabelValues(op, resultLabel(*errc)).Inc()
+	switch {
+	case (op == "read" || op == "write") && *errc > 0:
+		m.bytes.WithLabelValues(op).Add(float64(*errc))
+	case (op == "open" || op == "create") && *errc == 0:
+		m.handles.Inc()
+	case op == "release":
+		m.handles.Dec()
+	}
+}
+
+// instrument counts and times the requests h answers
+func (m *Metrics) instrument(pattern string, h http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": pattern}
+	h = promhttp.InstrumentHandlerCounter(m.requests.MustCurryWith(labels), h)
+	return promhttp.InstrumentHandlerDuration(m.requestTime.MustCurryWith(labels), h)
+}
+
+// ============ Metered Backend ============
+
+// meteredBackend counts and times the calls MemFS makes to a linked
+// backend. LinkBackend puts it directly around the backend, so caches and
+// throttles added later sit outside it and only calls that reach the
+// backend are measured.
+type meteredBackend struct {
+	inner Backend
+	mount string
+	m     *Metrics
+}
+
+// newMeteredBackend wraps b, labelling its metrics with mount
+func newMeteredBackend(b Backend, mount string, m *Metrics) *meteredBackend {
+	return &meteredBackend{inner: b, mount: mount, m: m}
+}
+
+// Unwrap returns the backend being measured
+func (b *meteredBackend) Unwrap() Backend {
+	return b.inner
+}
+
+// observe records a call that started at start
+func (b *meteredBackend) observe(op string, start time.Time, errc int) {
+	b.m.backendTime.WithLabelValues(b.mount, op).Observe(time.Since(start).Seconds())
+	b.m.backendOps.WithLabelValues(b.mount, op, resultLabel(errc)).Inc()
+}
+
+func (b *meteredBackend) Stat(path string) (*fuse.Stat_t, int) {
+	start := time.Now()
+	st, errc := b.inner.Stat(path)
+	b.observe("stat", start, errc)
+	return st, errc
+}
+
+func (b *meteredBackend) Readdir(path string) ([]DirEnt, int) {
+	start := time.Now()
+	ents, errc := b.inner.Readdir(path)
+	b.observe("readdir", start, errc)
+	return ents, errc
+}
+
+func (b *meteredBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	start := time.Now()
+	n, errc := b.inner.Read(path, buff, ofst)
+	b.observe("read", start, errc)
+	b.m.backendBytes.WithLabelValues(b.mount, "read").Add(float64(n))
+	return n, errc
+}
+
+func (b *meteredBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	start := time.Now()
+	n, errc := b.inner.Write(path, buff, ofst)
+	b.observe("write", start, errc)
+	b.m.backendBytes.WithLabelValues(b.mount, "write").Add(float64(n))
+	return n, errc
+}
+
+func (b *meteredBackend) Truncate(path string, size int64) int {
+	start := time.Now()
+	errc := b.inner.Truncate(path, size)
+	b.observe("truncate", start, errc)
+	return errc
+}
+
+func (b *meteredBackend) Mkdir(path string, mode uint32) int {
+	start := time.Now()
+	errc := b.inner.Mkdir(path, mode)
+	b.observe("mkdir", start, errc)
+	return errc
+}
+
+func (b *meteredBackend) Create(path string, mode uint32) int {
+	start := time.Now()
+	errc := b.inner.Create(path, mode)
+	b.observe("create", start, errc)
+	return errc
+}
+
+func (b *meteredBackend) Unlink(path string) int {
+	start := time.Now()
+	errc := b.inner.Unlink(path)
+	b.observe("unlink", start, errc)
+	return errc
+}
+
+func (b *meteredBackend) Rmdir(path string) int {
+	start := time.Now()
+	errc := b.inner.Rmdir(path)
+	b.observe("rmdir", start, errc)
+	return errc
+}
+
+func (b *meteredBackend) Rename(oldpath, newpath string) int {
+	start := time.Now()
+	errc := b.inner.Rename(oldpath, newpath)
+	b.observe("rename", start, errc)
+	return errc
+}
+
+func (b *meteredBackend) Flush(path string) int {
+	start := time.Now()
+	errc := flushBackend(b.inner, path)
+	b.observe("flush", start, errc)
+	return errc
+}
+
+func (b *meteredBackend) Sync() int {
+	start := time.Now()
+	errc := syncBackend(b.inner)
+	b.observe("sync", start, errc)
+	return errc
+}
+
+func (b *meteredBackend) Watch(notify func(BackendChange)) error {
+	return watchBackend(b.inner, notify)
+}
+
+func (b *meteredBackend) Unwatch() {
+	unwatchBackend(b.inner)
+}
+
+func (b *meteredBackend) Invalidate(path string) {
+	invalidateBackend(b.inner, path)
+}
+
+// ============ MemFS ============
+
+// Metrics returns the filesystem's metrics
+func (fs *MemFS) Metrics() *Metrics {
+	return fs.metrics
+}
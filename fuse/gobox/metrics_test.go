@@ -0,0 +1,96 @@
+package gobox
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// scrape returns the metrics of fs in the exposition format
+func scrape(t *testing.T, fs *MemFS) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	fs.Metrics().Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("scrape = %d", w.Code)
+	}
+	body, _ := io.ReadAll(w.Body)
+	return string(body)
+}
+
+// TestMetrics tests the filesystem, backend and handle metrics
+func TestMetrics(t *testing.T) {
+	fs := newTestFS()
+	fs.Mkdir("/docs", 0755)
+	fs.Mkdir("/docs", 0755)
+	writeFile(t, fs, "/docs/a", []byte("hello"))
+	readFile(t, fs, "/docs/a", 5)
+
+	mem := NewMemBackend()
+	assertSuccess(t, fs.LinkBackend("/mem", mem), "LinkBackend")
+	errc, fh := fs.Create("/mem/b", os.O_RDWR, 0644)
+	assertSuccess(t, errc, "Create")
+	fs.Write("/mem/b", []byte("abc"), 0, fh)
+	fs.Getattr("/mem/missing", &fuse.Stat_t{}, 0)
+
+	out := scrape(t, fs)
+	for _, want := range []string{
+		`gobox_fs_operations_total{op="mkdir",result="ok"} 1`,
+		`gobox_fs_operations_total{op="mkdir",result="EEXIST"} 1`,
+		`gobox_fs_operations_total{op="getattr",result="ENOENT"} 1`,
+		`gobox_fs_bytes_total{direction="write"} 8`,
+		`gobox_fs_bytes_total{direction="read"} 5`,
+		`gobox_fs_operation_duration_seconds_count{op="write"} 2`,
+		`gobox_backend_operations_total{mount="/mem",op="create",result="ok"} 1`,
+		`gobox_backend_operations_total{mount="/mem",op="stat",result="ENOENT"} 1`,
+		`gobox_backend_bytes_total{direction="write",mount="/mem"} 3`,
+		`gobox_memfs_memory_bytes 5`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+
+	// Handles stay open until released; writeFile leaves its own open
+	before := strings.Contains(out, "gobox_fs_open_handles 2\n")
+	fs.Release("/mem/b", fh)
+	if !before || !strings.Contains(scrape(t, fs), "gobox_fs_open_handles 1\n") {
+		t.Errorf("open handles not tracked")
+	}
+
+	// The mirror behind a metered mount is still found
+	assertSuccess(t, fs.LinkBackend("/m", NewMirrorBackend(NewMemBackend(), NewMemBackend())), "LinkBackend mirror")
+	if _, errc := fs.MirrorStatus("/m"); errc != 0 {
+		t.Errorf("MirrorStatus = %d", errc)
+	}
+}
+
+// TestMetricsAPI tests that REST requests are counted per endpoint and
+// that /metrics is served
+func TestMetricsAPI(t *testing.T) {
+	fs := newTestFS()
+	s := NewAPIServer(fs)
+	h := fs.Metrics().instrument("/api/mkdir", http.HandlerFunc(s.handleMkdir))
+
+	for _, body := range []string{`{"path":"/x","mode":493}`, `{"path":"/x","mode":493}`, `bad`} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/mkdir", strings.NewReader(body)))
+	}
+
+	out := scrape(t, fs)
+	for _, want := range []string{
+		`gobox_http_requests_total{code="200",handler="/api/mkdir",method="post"} 1`,
+		`gobox_http_requests_total{code="409",handler="/api/mkdir",method="post"} 1`,
+		`gobox_http_requests_total{code="400",handler="/api/mkdir",method="post"} 1`,
+		`gobox_http_request_duration_seconds_count{handler="/api/mkdir",method="post"} 3`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
@@ -0,0 +1,570 @@
+package gobox
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// mirrorChunk is the buffer size used when copying files during a resync
+const mirrorChunk = 128 << 10
+
+// mirrorChild is one copy of the mirrored tree and what is known to differ
+// on it
+type mirrorChild struct {
+	b         Backend
+	divergent map[string]bool // paths whose last change did not apply here
+	lastErr   int             // error that took the child out of rotation, 0 if none
+}
+
+// healthy reports whether reads may be served by the child
+func (c *mirrorChild) healthy() bool {
+	return c.lastErr == 0 && len(c.divergent) == 0
+}
+
+// MirrorChildStatus describes one child of a mirror
+type MirrorChildStatus struct {
+	Index     int      `json:"index"`
+	Healthy   bool     `json:"healthy"`
+	LastError int      `json:"lastError"`
+	Divergent []string `json:"divergent"`
+}
+
+// MirrorStatus reports the health of every child of a mirror
+type MirrorStatus struct {
+	Children []MirrorChildStatus `json:"children"`
+}
+
+// MirrorBackend implements Backend over N children holding the same tree.
+// Every change is applied to all children in parallel; reads go to the first
+// healthy child in the order given. A child that fails a change the others
+// accepted is marked divergent for that path and skipped for reads until
+// Resync copies the affected paths back from a healthy child.
+type MirrorBackend struct {
+	mu       sync.Mutex // serialises changes so every child sees the same order
+	children []*mirrorChild
+	resync   sync.Mutex // one resync at a time
+
+	state   sync.Mutex      // guards divergent and lastErr of every child, and changed
+	changed map[string]bool // paths changed while a resync copies, nil otherwise
+}
+
+// NewMirrorBackend creates a mirror over children, listed in order of read
+// preference
+func NewMirrorBackend(children ...Backend) *MirrorBackend {
+	b := &MirrorBackend{}
+	for _, c := range children {
+		b.children = append(b.children, &mirrorChild{b: c, divergent: make(map[string]bool)})
+	}
+	return b
+}
+
+// Close closes every child that holds anything open
+func (b *MirrorBackend) Close() error {
+	var errs []error
+	for _, c := range b.children {
+		errs = append(errs, closeBackend(c.b))
+	}
+	return errors.Join(errs...)
+}
+
+// Status returns a snapshot of the children's health
+func (b *MirrorBackend) Status() MirrorStatus {
+	b.state.Lock()
+	defer b.state.Unlock()
+
+	var s MirrorStatus
+	for i, c := range b.children {
+		paths := make([]string, 0, len(c.divergent))
+		for p := range c.divergent {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		s.Children = append(s.Children, MirrorChildStatus{
+			Index:     i,
+			Healthy:   c.healthy(),
+			LastError: c.lastErr,
+			Divergent: paths,
+		})
+	}
+	return s
+}
+
+// ============ Reads ============
+
+// mirrorFallback reports whether a read error is worth retrying on another
+// child, as opposed to an answer every child would give
+func mirrorFallback(errc int) bool {
+	switch errc {
+	case 0, -fuse.ENOENT, -fuse.ENOTDIR, -fuse.EISDIR, -fuse.EINVAL:
+		return false
+	}
+	return true
+}
+
+// readOrder returns the children to read from: healthy ones first, in
+// preference order, then the rest
+func (b *MirrorBackend) readOrder() []*mirrorChild {
+	b.state.Lock()
+	defer b.state.Unlock()
+
+	order := make([]*mirrorChild, 0, len(b.children))
+	for _, c := range b.children {
+		if c.healthy() {
+			order = append(order, c)
+		}
+	}
+	for _, c := range b.children {
+		if !c.healthy() {
+			order = append(order, c)
+		}
+	}
+	return order
+}
+
+// read runs fn on the preferred child, moving down the list when a child
+// fails with an I/O error. Failing children are taken out of rotation.
+func (b *MirrorBackend) read(fn func(Backend) int) int {
+	errc := -fuse.EIO
+	for _, c := range b.readOrder() {
+		errc = fn(c.b)
+		if !mirrorFallback(errc) {
+			return errc
+		}
+		b.state.Lock()
+		c.lastErr = errc
+		b.state.Unlock()
+	}
+	return errc
+}
+
+// Stat returns file attributes
+func (b *MirrorBackend) Stat(path string) (*fuse.Stat_t, int) {
+	var st *fuse.Stat_t
+	errc := b.read(func(c Backend) int {
+		var errc int
+		st, errc = c.Stat(path)
+		return errc
+	})
+	return st, errc
+}
+
+// Readdir lists directory contents
+func (b *MirrorBackend) Readdir(path string) ([]DirEnt, int) {
+	var ents []DirEnt
+	errc := b.read(func(c Backend) int {
+		var errc int
+		ents, errc = c.Readdir(path)
+		return errc
+	})
+	return ents, errc
+}
+
+// Read reads file content
+func (b *MirrorBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	var n int
+	errc := b.read(func(c Backend) int {
+		var errc int
+		n, errc = c.Read(path, buff, ofst)
+		return errc
+	})
+	return n, errc
+}
+
+// ============ Changes ============
+
+// mirrorResult is what one child returned for a change
+type mirrorResult struct {
+	n    int
+	errc int
+}
+
+// apply runs fn on every child in parallel and returns the mirror's answer:
+// the first success if any child succeeded, otherwise the preferred child's
+// error. Children whose result differs are marked divergent at paths.
+func (b *MirrorBackend) apply(paths []string, fn func(Backend) (int, int)) (int, int) {
+	results := make([]mirrorResult, len(b.children))
+	var wg sync.WaitGroup
+	for i, c := range b.children {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, errc := fn(c.b)
+			results[i] = mirrorResult{n, errc}
+		}()
+	}
+	wg.Wait()
+
+	want := results[0]
+	for _, r := range results {
+		if r.errc == 0 {
+			want = r
+			break
+		}
+	}
+
+	b.state.Lock()
+	defer b.state.Unlock()
+	if b.changed != nil {
+		for _, p := range paths {
+			b.changed[p] = true
+		}
+	}
+	for i, r := range results {
+		if r == want {
+			continue
+		}
+		for _, p := range paths {
+			b.children[i].divergent[p] = true
+		}
+	}
+	return want.n, want.errc
+}
+
+// change applies a change that returns only an error code
+func (b *MirrorBackend) change(paths []string, fn func(Backend) int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, errc := b.apply(paths, func(c Backend) (int, int) { return 0, fn(c) })
+	return errc
+}
+
+// Write writes file content
+func (b *MirrorBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.apply([]string{path}, func(c Backend) (int, int) {
+		return c.Write(path, buff, ofst)
+	})
+}
+
+// Truncate changes file size
+func (b *MirrorBackend) Truncate(path string, size int64) int {
+	return b.change([]string{path}, func(c Backend) int { return c.Truncate(path, size) })
+}
+
+// Mkdir creates a directory
+func (b *MirrorBackend) Mkdir(path string, mode uint32) int {
+	return b.change([]string{path}, func(c Backend) int { return c.Mkdir(path, mode) })
+}
+
+// Create creates a new file
+func (b *MirrorBackend) Create(path string, mode uint32) int {
+	return b.change([]string{path}, func(c Backend) int { return c.Create(path, mode) })
+}
+
+// Unlink removes a file
+func (b *MirrorBackend) Unlink(path string) int {
+	return b.change([]string{path}, func(c Backend) int { return c.Unlink(path) })
+}
+
+// Rmdir removes a directory
+func (b *MirrorBackend) Rmdir(path string) int {
+	return b.change([]string{path}, func(c Backend) int { return c.Rmdir(path) })
+}
+
+// Rename moves or renames a file/directory
+func (b *MirrorBackend) Rename(oldpath, newpath string) int {
+	return b.change([]string{oldpath, newpath}, func(c Backend) int { return c.Rename(oldpath, newpath) })
+}
+
+// Flush commits writes staged by the children
+func (b *MirrorBackend) Flush(path string) int {
+	return b.change([]string{path}, func(c Backend) int { return flushBackend(c, path) })
+}
+
+// Sync commits everything every child stages
+func (b *MirrorBackend) Sync() int {
+	return b.change(nil, syncBackend)
+}
+
+// ============ Resync ============
+
+// resyncPasses is how many times Resync copies again what changed under
+// it before its last pass holds changes off
+const resyncPasses = 4
+
+// Resync brings unhealthy children back in line with the preferred healthy
+// child by copying every divergent path from it. With full set, every child
+// is compared against it over the whole tree instead. Changes go on while
+// it copies.
+func (b *MirrorBackend) Resync(full bool) int {
+	b.resync.Lock()
+	defer b.resync.Unlock()
+
+	b.state.Lock()
+	src := -1
+	for i, c := range b.children {
+		if c.healthy() {
+			src = i
+			break
+		}
+	}
+	b.state.Unlock()
+	if src < 0 {
+		// Nothing is known to be right; there is no side to copy from
+		return -fuse.EIO
+	}
+
+	for i, c := range b.children {
+		if i == src {
+			continue
+		}
+
+		b.state.Lock()
+		var paths []string
+		if full {
+			paths = []string{"/"}
+		} else if !c.healthy() {
+			for p := range c.divergent {
+				paths = append(paths, p)
+			}
+			if len(paths) == 0 {
+				// Only a read failed; look at the whole tree
+				paths = []string{"/"}
+			}
+		}
+		b.state.Unlock()
+		if len(paths) == 0 {
+			continue
+		}
+		if errc := b.resyncChild(b.children[src], c, paths); errc != 0 {
+			return errc
+		}
+	}
+	return 0
+}
+
+// resyncChild copies paths from src to dst without holding changes off.
+// Paths changed meanwhile are copied again in another pass, and dst only
+// counts as healthy once a pass sees no changes. The last pass holds
+// changes off, so a busy mirror still gets there.
+func (b *MirrorBackend) resyncChild(src, dst *mirrorChild, paths []string) int {
+	ms := mirrorSync{src: src.b, dst: dst.b}
+	b.state.Lock()
+	b.changed = make(map[string]bool)
+	b.state.Unlock()
+	defer func() {
+		b.state.Lock()
+		b.changed = nil
+		b.state.Unlock()
+	}()
+
+	for pass := 1; ; pass++ {
+		last := pass == resyncPasses
+		if last {
+			b.mu.Lock()
+		}
+		errc := ms.paths(paths)
+		if !last {
+			b.mu.Lock()
+		}
+
+		// No change is in flight now
+		b.state.Lock()
+		again := make([]string, 0, len(b.changed))
+		for p := range b.changed {
+			again = append(again, p)
+		}
+		clear(b.changed)
+		if errc == 0 && !src.healthy() {
+			errc = -fuse.EIO
+		}
+		done := true
+		switch {
+		case errc != 0 && !last && len(again) > 0:
+			// Likely tripped over a change; go through all of it again
+			paths, done = append(again, paths...), false
+		case errc != 0:
+			dst.lastErr = errc
+		case len(again) == 0:
+			dst.divergent = make(map[string]bool)
+			dst.lastErr = 0
+		default:
+			paths, done = again, false
+		}
+		b.state.Unlock()
+		b.mu.Unlock()
+		if done {
+			return errc
+		}
+	}
+}
+
+// mirrorSync copies a tree from one child to another
+type mirrorSync struct {
+	src, dst Backend
+}
+
+// paths makes each of paths on dst match src, parents first so their
+// children have somewhere to go
+func (m mirrorSync) paths(paths []string) int {
+	sort.Strings(paths)
+	for _, p := range paths {
+		errc := m.ancestors(p)
+		if errc == 0 {
+			errc = m.path(p)
+		}
+		if errc != 0 {
+			return errc
+		}
+	}
+	return 0
+}
+
+// ancestors creates the directories above path that dst is missing
+func (m mirrorSync) ancestors(path string) int {
+	if path == "/" {
+		return 0
+	}
+	dir := "/"
+	parts := strings.Split(strings.TrimPrefix(parentPath(path), "/"), "/")
+	for _, part := range parts {
+		if part == "" {
+			break
+		}
+		dir = joinPath(dir, part)
+		if _, errc := m.dst.Stat(dir); errc == 0 {
+			continue
+		}
+		st, errc := m.src.Stat(dir)
+		if errc != 0 {
+			// The parent is gone on the source too; path will be removed
+			return 0
+		}
+		if errc := m.dst.Mkdir(dir, st.Mode&0777); errc != 0 {
+			return errc
+		}
+	}
+	return 0
+}
+
+// path makes path on dst match src, recursively for directories
+func (m mirrorSync) path(path string) int {
+	sst, serrc := m.src.Stat(path)
+	dst, derrc := m.dst.Stat(path)
+	if serrc != 0 && serrc != -fuse.ENOENT {
+		return serrc
+	}
+	if derrc != 0 && derrc != -fuse.ENOENT {
+		return derrc
+	}
+
+	if derrc == 0 && (serrc != 0 || sst.Mode&fuse.S_IFMT != dst.Mode&fuse.S_IFMT) {
+		if errc := m.remove(path, dst); errc != 0 {
+			return errc
+		}
+		dst = nil
+	}
+	if serrc != 0 {
+		return 0
+	}
+
+	if sst.Mode&fuse.S_IFDIR == 0 {
+		return m.file(path, sst, dst)
+	}
+
+	if dst == nil {
+		if errc := m.dst.Mkdir(path, sst.Mode&0777); errc != 0 {
+			return errc
+		}
+	}
+	sents, errc := m.src.Readdir(path)
+	if errc != 0 {
+		return errc
+	}
+	dents, errc := m.dst.Readdir(path)
+	if errc != 0 {
+		return errc
+	}
+	keep := make(map[string]bool, len(sents))
+	for _, e := range sents {
+		keep[e.Name] = true
+	}
+	for _, e := range dents {
+		if !keep[e.Name] {
+			if errc := m.remove(joinPath(path, e.Name), &e.Stat); errc != 0 {
+				return errc
+			}
+		}
+	}
+	for _, e := range sents {
+		if errc := m.path(joinPath(path, e.Name)); errc != 0 {
+			return errc
+		}
+	}
+	return 0
+}
+
+// file copies a file's content unless dst already holds the same bytes.
+// have is dst's current attributes, nil if it has no such file.
+func (m mirrorSync) file(path string, st, have *fuse.Stat_t) int {
+	size := st.Size
+	if have != nil && have.Size == size && m.same(path, size) {
+		return 0
+	}
+	if have == nil {
+		if errc := m.dst.Create(path, st.Mode&0777); errc != 0 {
+			return errc
+		}
+	} else if errc := m.dst.Truncate(path, 0); errc != 0 {
+		return errc
+	}
+
+	buff := make([]byte, mirrorChunk)
+	for ofst := int64(0); ofst < size; {
+		n, errc := m.src.Read(path, buff, ofst)
+		if errc != 0 {
+			return errc
+		}
+		if n == 0 {
+			break
+		}
+		if _, errc := m.dst.Write(path, buff[:n], ofst); errc != 0 {
+			return errc
+		}
+		ofst += int64(n)
+	}
+	return flushBackend(m.dst, path)
+}
+
+// same reports whether src and dst hold the same bytes at path
+func (m mirrorSync) same(path string, size int64) bool {
+	a := make([]byte, mirrorChunk)
+	c := make([]byte, mirrorChunk)
+	for ofst := int64(0); ofst < size; {
+		n, errc := m.src.Read(path, a, ofst)
+		if errc != 0 || n == 0 {
+			return false
+		}
+		k, errc := m.dst.Read(path, c, ofst)
+		if errc != 0 || k != n || !bytes.Equal(a[:n], c[:k]) {
+			return false
+		}
+		ofst += int64(n)
+	}
+	return true
+}
+
+// remove deletes path from dst, recursively for directories
+func (m mirrorSync) remove(path string, st *fuse.Stat_t) int {
+	if st.Mode&fuse.S_IFDIR == 0 {
+		return m.dst.Unlink(path)
+	}
+	ents, errc := m.dst.Readdir(path)
+	if errc != 0 {
+		return errc
+	}
+	for _, e := range ents {
+		if errc := m.remove(joinPath(path, e.Name), &e.Stat); errc != 0 {
+			return errc
+		}
+	}
+	return m.dst.Rmdir(path)
+}
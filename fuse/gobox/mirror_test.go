@@ -0,0 +1,269 @@
+package gobox
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// brokenBackend fails every call with EIO while down is set
+type brokenBackend struct {
+	Backend
+	down bool
+}
+
+func (b *brokenBackend) Stat(path string) (*fuse.Stat_t, int) {
+	if b.down {
+		return nil, -fuse.EIO
+	}
+	return b.Backend.Stat(path)
+}
+
+func (b *brokenBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	if b.down {
+		return 0, -fuse.EIO
+	}
+	return b.Backend.Read(path, buff, ofst)
+}
+
+func (b *brokenBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	if b.down {
+		return 0, -fuse.EIO
+	}
+	return b.Backend.Write(path, buff, ofst)
+}
+
+func (b *brokenBackend) Mkdir(path string, mode uint32) int {
+	if b.down {
+		return -fuse.EIO
+	}
+	return b.Backend.Mkdir(path, mode)
+}
+
+func (b *brokenBackend) Create(path string, mode uint32) int {
+	if b.down {
+		return -fuse.EIO
+	}
+	return b.Backend.Create(path, mode)
+}
+
+func (b *brokenBackend) Unlink(path string) int {
+	if b.down {
+		return -fuse.EIO
+	}
+	return b.Backend.Unlink(path)
+}
+
+// gatedBackend holds up the first Write until release is closed
+type gatedBackend struct {
+	Backend
+	held    atomic.Bool
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *gatedBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	if b.held.CompareAndSwap(false, true) {
+		close(b.entered)
+		<-b.release
+	}
+	return b.Backend.Write(path, buff, ofst)
+}
+
+func readString(t *testing.T, b Backend, path string) string {
+	t.Helper()
+	buff := make([]byte, 64)
+	n, errc := b.Read(path, buff, 0)
+	assertSuccess(t, errc, "Read "+path)
+	return string(buff[:n])
+}
+
+// TestMirrorBackendFanOut tests that changes reach every child
+func TestMirrorBackendFanOut(t *testing.T) {
+	a, c := NewMemBackend(), NewMemBackend()
+	b := NewMirrorBackend(a, c)
+
+	assertSuccess(t, b.Mkdir("/docs", 0755), "Mkdir")
+	assertSuccess(t, b.Create("/docs/a.txt", 0644), "Create")
+	n, errc := b.Write("/docs/a.txt", []byte("hello"), 0)
+	if errc != 0 || n != 5 {
+		t.Fatalf("Write = (%d, %d)", n, errc)
+	}
+	assertSuccess(t, b.Rename("/docs/a.txt", "/docs/b.txt"), "Rename")
+	for i, child := range []Backend{a, c} {
+		if got := readString(t, child, "/docs/b.txt"); got != "hello" {
+			t.Errorf("child %d holds %q", i, got)
+		}
+	}
+
+	// Errors every child agrees on are not divergence
+	assertError(t, b.Mkdir("/docs", 0755), -fuse.EEXIST, "Mkdir existing")
+	assertError(t, b.Unlink("/missing"), -fuse.ENOENT, "Unlink missing")
+	for _, cs := range b.Status().Children {
+		if !cs.Healthy || len(cs.Divergent) != 0 {
+			t.Errorf("child %d = %+v, expected healthy", cs.Index, cs)
+		}
+	}
+}
+
+// TestMirrorBackendDivergence tests failover and resync after a child fails
+func TestMirrorBackendDivergence(t *testing.T) {
+	first := &brokenBackend{Backend: NewMemBackend()}
+	second := NewMemBackend()
+	b := NewMirrorBackend(first, second)
+
+	b.Create("/keep.txt", 0644)
+	b.Write("/keep.txt", []byte("old"), 0)
+	b.Create("/gone.txt", 0644)
+
+	first.down = true
+	assertSuccess(t, b.Mkdir("/new", 0755), "Mkdir while degraded")
+	assertSuccess(t, b.Create("/new/f.txt", 0644), "Create while degraded")
+	b.Write("/new/f.txt", []byte("fresh"), 0)
+	b.Write("/keep.txt", []byte("NEW"), 0)
+	assertSuccess(t, b.Unlink("/gone.txt"), "Unlink while degraded")
+
+	status := b.Status()
+	want := []string{"/gone.txt", "/keep.txt", "/new", "/new/f.txt"}
+	if status.Children[0].Healthy || !reflect.DeepEqual(status.Children[0].Divergent, want) {
+		t.Errorf("child 0 = %+v, expected divergent at %v", status.Children[0], want)
+	}
+	if !status.Children[1].Healthy {
+		t.Errorf("child 1 = %+v, expected healthy", status.Children[1])
+	}
+
+	// Reads go to the healthy child even once the first one is back
+	first.down = false
+	if got := readString(t, b, "/keep.txt"); got != "NEW" {
+		t.Errorf("Read /keep.txt = %q, expected the healthy copy", got)
+	}
+
+	assertSuccess(t, b.Resync(false), "Resync")
+	if got := readString(t, first, "/new/f.txt"); got != "fresh" {
+		t.Errorf("resynced /new/f.txt = %q", got)
+	}
+	if got := readString(t, first, "/keep.txt"); got != "NEW" {
+		t.Errorf("resynced /keep.txt = %q", got)
+	}
+	_, errc := first.Stat("/gone.txt")
+	assertError(t, errc, -fuse.ENOENT, "resynced /gone.txt")
+	if cs := b.Status().Children[0]; !cs.Healthy || len(cs.Divergent) != 0 {
+		t.Errorf("child 0 after resync = %+v, expected healthy", cs)
+	}
+}
+
+// TestMirrorBackendResyncBusy tests changes going on while a resync copies,
+// and those that raced the copy being copied again
+func TestMirrorBackendResyncBusy(t *testing.T) {
+	src := NewMemBackend()
+	dst := &gatedBackend{Backend: NewMemBackend(), entered: make(chan struct{}), release: make(chan struct{})}
+	b := NewMirrorBackend(src, dst)
+
+	// Written behind the mirror's back, so only a full resync sees it
+	src.Create("/big", 0644)
+	src.Write("/big", []byte("old content"), 0)
+
+	done := make(chan int)
+	go func() { done <- b.Resync(true) }()
+	<-dst.entered
+
+	// The copy of /big to dst is held up with the old content
+	changed := make(chan struct{})
+	go func() {
+		defer close(changed)
+		assertSuccess(t, b.Mkdir("/d", 0755), "Mkdir during resync")
+		if n, errc := b.Write("/big", []byte("NEW"), 0); errc != 0 || n != 3 {
+			t.Errorf("Write during resync = (%d, %d)", n, errc)
+		}
+	}()
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Errorf("changes waited for a resync")
+	}
+	close(dst.release)
+	<-changed
+
+	assertSuccess(t, <-done, "Resync")
+	for _, c := range []Backend{src, dst} {
+		if got := readString(t, c, "/big"); got != "NEW content" {
+			t.Errorf("/big after resync = %q", got)
+		}
+		if _, errc := c.Stat("/d"); errc != 0 {
+			t.Errorf("Stat /d after resync = %d", errc)
+		}
+	}
+	if cs := b.Status().Children[1]; !cs.Healthy {
+		t.Errorf("child 1 after resync = %+v, expected healthy", cs)
+	}
+}
+
+// TestMirrorBackendReadFailover tests that a failing read moves to the next
+// child and a full resync repairs changes made behind the mirror's back
+func TestMirrorBackendReadFailover(t *testing.T) {
+	first := &brokenBackend{Backend: NewMemBackend()}
+	second := NewMemBackend()
+	b := NewMirrorBackend(first, second)
+	b.Create("/a.txt", 0644)
+	b.Write("/a.txt", []byte("mirrored"), 0)
+
+	first.down = true
+	if got := readString(t, b, "/a.txt"); got != "mirrored" {
+		t.Errorf("Read = %q", got)
+	}
+	if cs := b.Status().Children[0]; cs.Healthy || cs.LastError != -fuse.EIO {
+		t.Errorf("child 0 = %+v, expected out of rotation with EIO", cs)
+	}
+
+	first.down = false
+	first.Backend.Write("/a.txt", []byte("MIRRORED"), 0)
+	first.Backend.Mkdir("/stray", 0755)
+	assertSuccess(t, b.Resync(true), "full Resync")
+	if got := readString(t, first, "/a.txt"); got != "mirrored" {
+		t.Errorf("after full resync /a.txt = %q", got)
+	}
+	_, errc := first.Stat("/stray")
+	assertError(t, errc, -fuse.ENOENT, "stray directory after full resync")
+	if cs := b.Status().Children[0]; !cs.Healthy {
+		t.Errorf("child 0 after resync = %+v, expected healthy", cs)
+	}
+}
+
+// TestLinkMirror tests mirroring two real folders through MemFS
+func TestLinkMirror(t *testing.T) {
+	d1, d2 := t.TempDir(), t.TempDir()
+	fs := newTestFS()
+
+	errCode := fs.LinkMirror("/safe", []string{d1, d2})
+	assertSuccess(t, errCode, "LinkMirror")
+	errCode, fh := fs.Create("/safe/notes.txt", os.O_RDWR, 0644)
+	assertSuccess(t, errCode, "Create")
+	fs.Write("/safe/notes.txt", []byte("twice"), 0, fh)
+	fs.Flush("/safe/notes.txt", fh)
+	for _, d := range []string{d1, d2} {
+		data, err := os.ReadFile(filepath.Join(d, "notes.txt"))
+		if err != nil || string(data) != "twice" {
+			t.Errorf("%s holds %q, %v", d, data, err)
+		}
+	}
+
+	status, errCode := fs.MirrorStatus("/safe")
+	assertSuccess(t, errCode, "MirrorStatus")
+	if len(status.Children) != 2 {
+		t.Errorf("MirrorStatus = %+v, expected two children", status)
+	}
+	assertSuccess(t, fs.MirrorResync("/safe", true), "MirrorResync")
+
+	errCode = fs.LinkMirror("/one", []string{d1})
+	assertError(t, errCode, -fuse.EINVAL, "LinkMirror with one folder")
+	errCode = fs.LinkMirror("/missing", []string{d1, filepath.Join(d2, "missing")})
+	assertError(t, errCode, -fuse.ENOENT, "LinkMirror with missing folder")
+	fs.LinkLocal("/plain", d1)
+	_, errCode = fs.MirrorStatus("/plain")
+	assertError(t, errCode, -fuse.EINVAL, "MirrorStatus on a plain mount")
+}
@@ -0,0 +1,500 @@
+package gobox
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+const (
+	// whiteoutPrefix marks a deleted name in an upper layer, as in aufs/overlayfs
+	whiteoutPrefix = ".wh."
+	// opaqueMarker hides everything below a directory in the layers underneath
+	opaqueMarker = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+	// copyUpChunk is the buffer size used when copying files up
+	copyUpChunk = 128 << 10
+)
+
+// OverlayBackend implements a union Backend: one writable upper layer over
+// any number of read-only lower layers. Lookups go top-down and stop at the
+// first layer that has the path. Files are copied up on first modification,
+// and deletions of lower entries are recorded as whiteouts in the upper layer.
+type OverlayBackend struct {
+	mu     sync.Mutex
+	layers []Backend // layers[0] is the upper layer
+}
+
+// NewOverlayBackend creates an overlay with the given upper layer and lower
+// layers, listed from topmost to bottommost
+func NewOverlayBackend(upper Backend, lowers ...Backend) *OverlayBackend {
+	return &OverlayBackend{layers: append([]Backend{upper}, lowers...)}
+}
+
+// Close closes every layer that holds anything open
+func (b *OverlayBackend) Close() error {
+	var errs []error
+	for _, l := range b.layers {
+		errs = append(errs, closeBackend(l))
+	}
+	return errors.Join(errs...)
+}
+
+// joinPath appends a name to a mount-relative directory path
+func joinPath(dir, name string) string {
+	if dir == "/" {
+		return "/" + name
+	}
+	return dir + "/" + name
+}
+
+// parentPath returns the parent of a mount-relative path
+func parentPath(path string) string {
+	parent, _ := split(path)
+	if parent == "" {
+		return "/"
+	}
+	return parent
+}
+
+// isWhiteoutName reports whether a name is reserved for overlay bookkeeping
+func isWhiteoutName(name string) bool {
+	return strings.HasPrefix(name, whiteoutPrefix)
+}
+
+// whiteoutPath returns the whiteout marker path for path
+func whiteoutPath(path string) string {
+	parent, name := split(path)
+	if parent == "" {
+		parent = "/"
+	}
+	return joinPath(parent, whiteoutPrefix+name)
+}
+
+// exists reports whether a layer has an entry at path
+func exists(layer Backend, path string) bool {
+	_, errc := layer.Stat(path)
+	return errc == 0
+}
+
+// hides reports whether a layer masks path from the layers below it, either
+// with a whiteout, an opaque ancestor, or a non-directory ancestor
+func hides(layer Backend, path string) bool {
+	if path == "/" {
+		return false
+	}
+	if exists(layer, whiteoutPath(path)) {
+		return true
+	}
+
+	// Walk the ancestors from the root down
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	dir := "/"
+	for i, part := range parts {
+		if exists(layer, joinPath(dir, opaqueMarker)) {
+			return true
+		}
+		if i == len(parts)-1 {
+			break
+		}
+		dir = joinPath(dir, part)
+		st, errc := layer.Stat(dir)
+		if errc == 0 && st.Mode&fuse.S_IFDIR == 0 {
+			return true
+		}
+		if exists(layer, whiteoutPath(dir)) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup finds the topmost layer holding path. Caller must hold b.mu.
+func (b *OverlayBackend) lookup(path string) (int, *fuse.Stat_t, int) {
+	for i, layer := range b.layers {
+		if st, errc := layer.Stat(path); errc == 0 {
+			return i, st, 0
+		}
+		if hides(layer, path) {
+			break
+		}
+	}
+	return -1, nil, -fuse.ENOENT
+}
+
+// Stat returns file attributes
+func (b *OverlayBackend) Stat(path string) (*fuse.Stat_t, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, st, errc := b.lookup(path)
+	return st, errc
+}
+
+// readdir merges the listings of every layer that contributes to path.
+// Caller must hold b.mu.
+func (b *OverlayBackend) readdir(path string) ([]DirEnt, int) {
+	_, st, errc := b.lookup(path)
+	if errc != 0 {
+		return nil, errc
+	}
+	if st.Mode&fuse.S_IFDIR == 0 {
+		return nil, -fuse.ENOTDIR
+	}
+
+	seen := make(map[string]bool)
+	var out []DirEnt
+	for _, layer := range b.layers {
+		st, errc := layer.Stat(path)
+		if errc == 0 && st.Mode&fuse.S_IFDIR != 0 {
+			ents, errc := layer.Readdir(path)
+			if errc != 0 {
+				return nil, errc
+			}
+
+			opaque := false
+			for _, e := range ents {
+				switch {
+				case e.Name == opaqueMarker:
+					opaque = true
+				case isWhiteoutName(e.Name):
+					// Hide the name in every layer below this one
+					seen[strings.TrimPrefix(e.Name, whiteoutPrefix)] = true
+				case !seen[e.Name]:
+					seen[e.Name] = true
+					out = append(out, e)
+				}
+			}
+			if opaque {
+				break
+			}
+		} else if errc == 0 {
+			// A file shadows directories in lower layers
+			break
+		}
+		if hides(layer, path) {
+			break
+		}
+	}
+	return out, 0
+}
+
+// Readdir lists directory entries
+func (b *OverlayBackend) Readdir(path string) ([]DirEnt, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.readdir(path)
+}
+
+// Read reads file content from the topmost layer holding it
+func (b *OverlayBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i, _, errc := b.lookup(path)
+	if errc != 0 {
+		return 0, errc
+	}
+	return b.layers[i].Read(path, buff, ofst)
+}
+
+// copyUpDir makes sure dir and its ancestors exist in the upper layer.
+// Caller must hold b.mu.
+func (b *OverlayBackend) copyUpDir(dir string) int {
+	upper := b.layers[0]
+	if dir == "/" || exists(upper, dir) {
+		return 0
+	}
+
+	_, st, errc := b.lookup(dir)
+	if errc != 0 {
+		return errc
+	}
+	if st.Mode&fuse.S_IFDIR == 0 {
+		return -fuse.ENOTDIR
+	}
+	if errc := b.copyUpDir(parentPath(dir)); errc != 0 {
+		return errc
+	}
+	return upper.Mkdir(dir, st.Mode&07777)
+}
+
+// copyUp makes sure path exists in the upper layer, copying file contents
+// from the topmost lower layer that has it. Caller must hold b.mu.
+func (b *OverlayBackend) copyUp(path string) int {
+	i, st, errc := b.lookup(path)
+	if errc != 0 {
+		return errc
+	}
+	if i == 0 {
+		return 0
+	}
+	if st.Mode&fuse.S_IFDIR != 0 {
+		return b.copyUpDir(path)
+	}
+
+	if errc := b.copyUpDir(parentPath(path)); errc != 0 {
+		return errc
+	}
+	upper, lower := b.layers[0], b.layers[i]
+	if errc := upper.Create(path, st.Mode&07777); errc != 0 {
+		return errc
+	}
+
+	buff := make([]byte, copyUpChunk)
+	for ofst := int64(0); ofst < st.Size; {
+		n, errc := lower.Read(path, buff, ofst)
+		if errc == 0 && n == 0 {
+			errc = -fuse.EIO // lower layer shrank underneath us
+		}
+		if errc == 0 {
+			_, errc = upper.Write(path, buff[:n], ofst)
+		}
+		if errc != 0 {
+			upper.Unlink(path)
+			return errc
+		}
+		ofst += int64(n)
+	}
+	return 0
+}
+
+// prepareCreate checks that path can be created and readies the upper layer.
+// It reports whether a whiteout was removed. Caller must hold b.mu.
+func (b *OverlayBackend) prepareCreate(path string) (bool, int) {
+	_, name := split(path)
+	if isWhiteoutName(name) {
+		return false, -fuse.EINVAL
+	}
+	if _, _, errc := b.lookup(path); errc == 0 {
+		return false, -fuse.EEXIST
+	}
+
+	parent := parentPath(path)
+	_, st, errc := b.lookup(parent)
+	if errc != 0 {
+		return false, errc
+	}
+	if st.Mode&fuse.S_IFDIR == 0 {
+		return false, -fuse.ENOTDIR
+	}
+	if errc := b.copyUpDir(parent); errc != 0 {
+		return false, errc
+	}
+
+	upper := b.layers[0]
+	wh := whiteoutPath(path)
+	if !exists(upper, wh) {
+		return false, 0
+	}
+	if errc := upper.Unlink(wh); errc != 0 {
+		return false, errc
+	}
+	return true, 0
+}
+
+// whiteout hides path in the lower layers if it is still visible there.
+// Caller must hold b.mu.
+func (b *OverlayBackend) whiteout(path string) int {
+	if _, _, errc := b.lookup(path); errc != 0 {
+		return 0
+	}
+	if errc := b.copyUpDir(parentPath(path)); errc != 0 {
+		return errc
+	}
+	return b.layers[0].Create(whiteoutPath(path), 0)
+}
+
+// Write copies the file up and writes to the upper layer
+func (b *OverlayBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if errc := b.copyUp(path); errc != 0 {
+		return 0, errc
+	}
+	return b.layers[0].Write(path, buff, ofst)
+}
+
+// Truncate copies the file up and truncates it in the upper layer
+func (b *OverlayBackend) Truncate(path string, size int64) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if errc := b.copyUp(path); errc != 0 {
+		return errc
+	}
+	return b.layers[0].Truncate(path, size)
+}
+
+// Mkdir creates a directory in the upper layer
+func (b *OverlayBackend) Mkdir(path string, mode uint32) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	replaced, errc := b.prepareCreate(path)
+	if errc != 0 {
+		return errc
+	}
+	upper := b.layers[0]
+	if errc := upper.Mkdir(path, mode); errc != 0 {
+		return errc
+	}
+	// A directory recreated over a whiteout must not show the old contents
+	if replaced {
+		return upper.Create(joinPath(path, opaqueMarker), 0)
+	}
+	return 0
+}
+
+// Create creates a file in the upper layer
+func (b *OverlayBackend) Create(path string, mode uint32) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Creating an existing file truncates it, like the other backends
+	if i, st, errc := b.lookup(path); errc == 0 {
+		if st.Mode&fuse.S_IFDIR != 0 {
+			return -fuse.EISDIR
+		}
+		if i != 0 {
+			if errc := b.copyUpDir(parentPath(path)); errc != 0 {
+				return errc
+			}
+		}
+		return b.layers[0].Create(path, mode)
+	}
+
+	if _, errc := b.prepareCreate(path); errc != 0 {
+		return errc
+	}
+	return b.layers[0].Create(path, mode)
+}
+
+// Unlink removes a file from the upper layer and whiteouts lower copies
+func (b *OverlayBackend) Unlink(path string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i, st, errc := b.lookup(path)
+	if errc != 0 {
+		return errc
+	}
+	if st.Mode&fuse.S_IFDIR != 0 {
+		return -fuse.EISDIR
+	}
+	if i == 0 {
+		if errc := b.layers[0].Unlink(path); errc != 0 {
+			return errc
+		}
+	}
+	return b.whiteout(path)
+}
+
+// Rmdir removes an empty directory from the merged view
+func (b *OverlayBackend) Rmdir(path string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if path == "/" {
+		return -fuse.EBUSY
+	}
+	ents, errc := b.readdir(path)
+	if errc != 0 {
+		return errc
+	}
+	if len(ents) != 0 {
+		return -fuse.ENOTEMPTY
+	}
+
+	upper := b.layers[0]
+	if st, errc := upper.Stat(path); errc == 0 && st.Mode&fuse.S_IFDIR != 0 {
+		// Only bookkeeping entries can be left in the upper directory
+		marks, errc := upper.Readdir(path)
+		if errc != 0 {
+			return errc
+		}
+		for _, m := range marks {
+			if errc := upper.Unlink(joinPath(path, m.Name)); errc != 0 {
+				return errc
+			}
+		}
+		if errc := upper.Rmdir(path); errc != 0 {
+			return errc
+		}
+	}
+	return b.whiteout(path)
+}
+
+// Rename moves a file within the overlay by copying it up first. Directories
+// that exist in a lower layer cannot be moved and return EXDEV, as in overlayfs.
+func (b *OverlayBackend) Rename(oldpath, newpath string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, name := split(newpath)
+	if isWhiteoutName(name) {
+		return -fuse.EINVAL
+	}
+	_, st, errc := b.lookup(oldpath)
+	if errc != 0 {
+		return errc
+	}
+	if st.Mode&fuse.S_IFDIR != 0 {
+		for _, lower := range b.layers[1:] {
+			if exists(lower, oldpath) {
+				return -fuse.EXDEV
+			}
+		}
+	}
+	if _, tst, errc := b.lookup(newpath); errc == 0 && tst.Mode&fuse.S_IFDIR != 0 {
+		if st.Mode&fuse.S_IFDIR == 0 {
+			return -fuse.EISDIR
+		}
+		// Replacing a directory that exists below the upper layer is not supported
+		for _, lower := range b.layers[1:] {
+			if exists(lower, newpath) {
+				return -fuse.EXDEV
+			}
+		}
+	}
+
+	if errc := b.copyUp(oldpath); errc != 0 {
+		return errc
+	}
+	if errc := b.copyUpDir(parentPath(newpath)); errc != 0 {
+		return errc
+	}
+
+	upper := b.layers[0]
+	replaced := false
+	if wh := whiteoutPath(newpath); exists(upper, wh) {
+		if errc := upper.Unlink(wh); errc != 0 {
+			return errc
+		}
+		replaced = true
+	}
+	if errc := upper.Rename(oldpath, newpath); errc != 0 {
+		return errc
+	}
+	// As in Mkdir, a directory landing on a whiteout must stay opaque
+	if replaced && st.Mode&fuse.S_IFDIR != 0 && !exists(upper, joinPath(newpath, opaqueMarker)) {
+		if errc := upper.Create(joinPath(newpath, opaqueMarker), 0); errc != 0 {
+			return errc
+		}
+	}
+	return b.whiteout(oldpath)
+}
+
+// Flush commits writes staged by the upper layer
+func (b *OverlayBackend) Flush(path string) int {
+	return flushBackend(b.layers[0], path)
+}
+
+// Sync commits everything the writable layer stages
+func (b *OverlayBackend) Sync() int {
+	return syncBackend(b.layers[0])
+}
@@ -0,0 +1,162 @@
+package gobox
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// newTestOverlay builds an overlay with an in-memory upper layer over a
+// local lower layer containing base.txt and dir/inner.txt
+func newTestOverlay(t *testing.T) (*OverlayBackend, string) {
+	t.Helper()
+	lowerDir := t.TempDir()
+	os.WriteFile(filepath.Join(lowerDir, "base.txt"), []byte("lower data"), 0644)
+	os.Mkdir(filepath.Join(lowerDir, "dir"), 0755)
+	os.WriteFile(filepath.Join(lowerDir, "dir", "inner.txt"), []byte("inner"), 0644)
+
+	return NewOverlayBackend(NewMemBackend(), NewLocalBackend(lowerDir)), lowerDir
+}
+
+func overlayNames(t *testing.T, b *OverlayBackend, path string) []string {
+	t.Helper()
+	ents, errc := b.Readdir(path)
+	assertSuccess(t, errc, "Readdir "+path)
+	names := make([]string, 0, len(ents))
+	for _, e := range ents {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestOverlayCopyUp tests that writes go to the upper layer only
+func TestOverlayCopyUp(t *testing.T) {
+	b, lowerDir := newTestOverlay(t)
+
+	if n, errc := b.Write("/base.txt", []byte("UPPER"), 0); errc != 0 || n != 5 {
+		t.Fatalf("Write returned (%d, %d), expected (5, 0)", n, errc)
+	}
+
+	buff := make([]byte, 32)
+	n, errc := b.Read("/base.txt", buff, 0)
+	assertSuccess(t, errc, "Read")
+	if string(buff[:n]) != "UPPER data" {
+		t.Errorf("Read = %q, expected %q", buff[:n], "UPPER data")
+	}
+
+	// The lower layer is untouched
+	content, _ := os.ReadFile(filepath.Join(lowerDir, "base.txt"))
+	if string(content) != "lower data" {
+		t.Errorf("lower file = %q, expected %q", content, "lower data")
+	}
+
+	// Copy-up of a nested file creates its parent in the upper layer
+	assertSuccess(t, b.Truncate("/dir/inner.txt", 2), "Truncate")
+	if _, errc := b.layers[0].Stat("/dir"); errc != 0 {
+		t.Errorf("parent directory not copied up: %d", errc)
+	}
+	st, _ := b.Stat("/dir/inner.txt")
+	assertStatSize(t, st, 2, "/dir/inner.txt")
+}
+
+// TestOverlayWhiteout tests that deletes hide lower entries
+func TestOverlayWhiteout(t *testing.T) {
+	b, lowerDir := newTestOverlay(t)
+
+	assertSuccess(t, b.Unlink("/base.txt"), "Unlink")
+	_, errc := b.Stat("/base.txt")
+	assertError(t, errc, -fuse.ENOENT, "Stat after Unlink")
+	if _, err := os.Stat(filepath.Join(lowerDir, "base.txt")); err != nil {
+		t.Errorf("lower file removed: %v", err)
+	}
+	if names := overlayNames(t, b, "/"); len(names) != 1 || names[0] != "dir" {
+		t.Errorf("Readdir / = %v, expected [dir]", names)
+	}
+
+	// Recreating a deleted file starts empty
+	assertSuccess(t, b.Create("/base.txt", 0644), "Create over whiteout")
+	st, _ := b.Stat("/base.txt")
+	assertStatSize(t, st, 0, "/base.txt")
+
+	// A removed and recreated directory does not show old contents
+	assertSuccess(t, b.Unlink("/dir/inner.txt"), "Unlink inner")
+	assertSuccess(t, b.Rmdir("/dir"), "Rmdir")
+	assertSuccess(t, b.Mkdir("/dir", 0755), "Mkdir over whiteout")
+	if names := overlayNames(t, b, "/dir"); len(names) != 0 {
+		t.Errorf("Readdir recreated /dir = %v, expected empty", names)
+	}
+
+	// Bookkeeping names are reserved
+	assertError(t, b.Create("/.wh.evil", 0644), -fuse.EINVAL, "Create whiteout name")
+}
+
+// TestOverlayReaddirMerge tests merging of upper and lower listings
+func TestOverlayReaddirMerge(t *testing.T) {
+	b, _ := newTestOverlay(t)
+
+	assertSuccess(t, b.Create("/dir/new.txt", 0644), "Create")
+	names := overlayNames(t, b, "/dir")
+	if len(names) != 2 || names[0] != "inner.txt" || names[1] != "new.txt" {
+		t.Errorf("Readdir /dir = %v, expected [inner.txt new.txt]", names)
+	}
+	assertError(t, b.Rmdir("/dir"), -fuse.ENOTEMPTY, "Rmdir non-empty")
+}
+
+// TestOverlayRename tests renaming lower files and directories
+func TestOverlayRename(t *testing.T) {
+	b, _ := newTestOverlay(t)
+
+	assertSuccess(t, b.Rename("/base.txt", "/renamed.txt"), "Rename file")
+	_, errc := b.Stat("/base.txt")
+	assertError(t, errc, -fuse.ENOENT, "Stat old name")
+
+	buff := make([]byte, 32)
+	n, _ := b.Read("/renamed.txt", buff, 0)
+	if string(buff[:n]) != "lower data" {
+		t.Errorf("Read renamed = %q, expected %q", buff[:n], "lower data")
+	}
+
+	// Lower directories cannot be moved
+	assertError(t, b.Rename("/dir", "/dir2"), -fuse.EXDEV, "Rename lower directory")
+
+	// Upper-only directories can
+	assertSuccess(t, b.Mkdir("/fresh", 0755), "Mkdir")
+	assertSuccess(t, b.Rename("/fresh", "/fresh2"), "Rename upper directory")
+}
+
+// TestLinkOverlay tests linking an overlay through MemFS
+func TestLinkOverlay(t *testing.T) {
+	fs := newTestFS()
+	lowerDir := t.TempDir()
+	os.WriteFile(filepath.Join(lowerDir, "data.csv"), []byte("a,b"), 0644)
+
+	assertSuccess(t, fs.LinkOverlay("/work", []string{lowerDir}), "LinkOverlay")
+
+	data := []byte("x,y")
+	if n := fs.Write("/work/data.csv", data, 0, 0); n != len(data) {
+		t.Errorf("Write returned %d, expected %d", n, len(data))
+	}
+	content, _ := os.ReadFile(filepath.Join(lowerDir, "data.csv"))
+	if string(content) != "a,b" {
+		t.Errorf("lower file = %q, expected %q", content, "a,b")
+	}
+
+	assertError(t, fs.LinkOverlay("/none", nil), -fuse.EINVAL, "LinkOverlay without lowers")
+
+	// Archives opened for earlier layers are closed when a later one fails
+	// or the overlay can't be linked
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open files can't be counted here")
+	}
+	zip := writeTestZip(t, t.TempDir())
+	assertError(t, fs.LinkOverlay("/bad", []string{zip, filepath.Join(lowerDir, "missing")}), -fuse.ENOENT, "LinkOverlay with a missing layer")
+	assertError(t, fs.LinkOverlay("/work", []string{zip}), -fuse.EEXIST, "LinkOverlay over a link")
+	if after, _ := os.ReadDir("/proc/self/fd"); len(after) != len(fds) {
+		t.Errorf("%d files open after failed links, expected %d", len(after), len(fds))
+	}
+}
@@ -0,0 +1,159 @@
+package gobox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const (
+	readChunk = 256 << 10 // bytes of a file read at a time when sending it
+	maxRanges = 32        // ranges a request may ask for before it gets the whole file instead
+)
+
+var (
+	errBadRange  = errors.New("invalid range")
+	errNoOverlap = errors.New("no range overlaps the file")
+)
+
+// byteRange is length bytes of a file from start
+type byteRange struct {
+	start, length int64
+}
+
+// contentRange is the Content-Range header for r of a file of size bytes
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseDigits parses a non-negative decimal number without a sign
+func parseDigits(s string) (int64, bool) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// parseRange parses a Range header for a file of size bytes. Ranges past
+// the end are dropped and those running over it are cut short; if none are
+// left, the error is errNoOverlap. Units other than bytes give no ranges and
+// no error, so the header is ignored.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+	var ranges []byteRange
+	dropped := false
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, errBadRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		if first == "" {
+			// "-n" is the last n bytes
+			n, ok := parseDigits(last)
+			if !ok {
+				return nil, errBadRange
+			}
+			if n == 0 || size == 0 {
+				dropped = true
+				continue
+			}
+			n = min(n, size)
+			ranges = append(ranges, byteRange{start: size - n, length: n})
+			continue
+		}
+
+		start, ok := parseDigits(first)
+		if !ok {
+			return nil, errBadRange
+		}
+		end := size - 1
+		if last != "" {
+			if end, ok = parseDigits(last); !ok || end < start {
+				return nil, errBadRange
+			}
+		}
+		if start >= size {
+			dropped = true
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: min(end, size-1) - start + 1})
+	}
+
+	switch {
+	case len(ranges) > 0:
+		return ranges, nil
+	case dropped:
+		return nil, errNoOverlap
+	}
+	return nil, errBadRange
+}
+
+// rangePartHeader is the header of one part of a multipart/byteranges body
+func rangePartHeader(r byteRange, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {"application/octet-stream"},
+		"Content-Range": {r.contentRange(size)},
+	}
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+// multipartSize is the length of the multipart/byteranges body sending
+// ranges of a file of size bytes, so it can be given as Content-Length
+func multipartSize(boundary string, ranges []byteRange, size int64) int64 {
+	var c countingWriter
+	mw := multipart.NewWriter(&c)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		mw.CreatePart(rangePartHeader(r, size))
+		c += countingWriter(r.length)
+	}
+	mw.Close()
+	return int64(c)
+}
+
+// sendRange streams r of an open file to w in chunks of buf at the pace t
+// allows, so memory use doesn't grow with the file. buf[:have] already
+// holds the first bytes of r.
+func (s *APIServer) sendRange(ctx context.Context, w io.Writer, t *throttle, path string, fh uint64, buf []byte, have int, r byteRange) error {
+	off, end := r.start, r.start+r.length
+	for {
+		if have > 0 {
+			if err := writeThrottled(ctx, w, t, buf[:have]); err != nil {
+				return err
+			}
+			off += int64(have)
+		}
+		if off >= end {
+			return nil
+		}
+		have = s.fs.Read(path, buf[:min(int64(len(buf)), end-off)], off, fh)
+		if have < 0 {
+			return fmt.Errorf("reading %s at %d: %s", path, off, resultLabel(have))
+		}
+		if have == 0 {
+			return fmt.Errorf("%s ended at %d, before %d", path, off, end)
+		}
+	}
+}
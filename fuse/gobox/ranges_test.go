@@ -0,0 +1,229 @@
+package gobox
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// TestParseRange tests Range headers being resolved against a file size
+func TestParseRange(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		size   int64
+		want   []byteRange
+		err    error
+	}{
+		{"bytes=0-99", 1000, []byteRange{{0, 100}}, nil},
+		{"bytes=900-", 1000, []byteRange{{900, 100}}, nil},
+		{"bytes=-100", 1000, []byteRange{{900, 100}}, nil},
+		{"bytes=-5000", 1000, []byteRange{{0, 1000}}, nil},
+		{"bytes=990-2000", 1000, []byteRange{{990, 10}}, nil},
+		{"bytes=0-0, 10-19,,-1", 1000, []byteRange{{0, 1}, {10, 10}, {999, 1}}, nil},
+		{"bytes=0-9,1000-", 1000, []byteRange{{0, 10}}, nil},
+		{"bytes=1000-", 1000, nil, errNoOverlap},
+		{"bytes=-0", 1000, nil, errNoOverlap},
+		{"bytes=0-", 0, nil, errNoOverlap},
+		{"bytes=10-5", 1000, nil, errBadRange},
+		{"bytes=+1-5", 1000, nil, errBadRange},
+		{"bytes=5", 1000, nil, errBadRange},
+		{"bytes=", 1000, nil, errBadRange},
+		{"items=0-5", 1000, nil, nil},
+	} {
+		got, err := parseRange(c.header, c.size)
+		if err != c.err || len(got) != len(c.want) {
+			t.Errorf("parseRange(%q, %d) = %v, %v", c.header, c.size, got, err)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("parseRange(%q, %d) = %v", c.header, c.size, got)
+			}
+		}
+	}
+}
+
+// TestFileReadRanges tests partial reads through offset and length, Range
+// headers and HEAD requests
+func TestFileReadRanges(t *testing.T) {
+	fs := newTestFS()
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	errc, fh := fs.Create("/f", os.O_RDWR, 0644)
+	assertSuccess(t, errc, "Create")
+	fs.Write("/f", data, 0, fh)
+	fs.Release("/f", fh)
+	modified := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	assertSuccess(t, fs.Utimens("/f", []fuse.Timespec{fuse.NewTimespec(modified), fuse.NewTimespec(modified)}), "Utimens")
+	s := NewAPIServer(fs)
+
+	read := func(method, target string, header ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, target, nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.handleFileRead(w, r)
+		if w.Code < 300 && w.Header().Get("Content-Length") != "" && method == http.MethodGet {
+			if n, _ := strconv.Atoi(w.Header().Get("Content-Length")); n != w.Body.Len() {
+				t.Errorf("%s %v: Content-Length %d, body %d bytes", target, header, n, w.Body.Len())
+			}
+		}
+		return w
+	}
+
+	w := read("GET", "/api/files/read?path=/f")
+	if w.Code != http.StatusOK || w.Body.String() != string(data) ||
+		w.Header().Get("Accept-Ranges") != "bytes" || w.Header().Get("Last-Modified") != modified.Format(http.TimeFormat) {
+		t.Errorf("whole file = %d %q %v", w.Code, w.Body, w.Header())
+	}
+
+	for _, c := range []struct {
+		target string
+		header []string
+		code   int
+		body   string
+	}{
+		{"/api/files/read?path=/f&offset=10", nil, http.StatusOK, "abcdefghijklmnopqrstuvwxyz"},
+		{"/api/files/read?path=/f&offset=10&length=3", nil, http.StatusOK, "abc"},
+		{"/api/files/read?path=/f&length=0", nil, http.StatusOK, ""},
+		{"/api/files/read?path=/f&offset=100", nil, http.StatusOK, ""},
+		{"/api/files/read?path=/f&length=-1", nil, http.StatusBadRequest, ""},
+		{"/api/files/read?path=/f&offset=0", []string{"Range", "bytes=0-1"}, http.StatusBadRequest, ""},
+		{"/api/files/read?path=/f", []string{"Range", "bytes=10-12"}, http.StatusPartialContent, "abc"},
+		{"/api/files/read?path=/f", []string{"Range", "bytes=-3"}, http.StatusPartialContent, "xyz"},
+		{"/api/files/read?path=/f", []string{"Range", "bytes=100-"}, http.StatusRequestedRangeNotSatisfiable, ""},
+		{"/api/files/read?path=/f", []string{"Range", "bytes=0-1,0-35"}, http.StatusOK, string(data)},
+		{"/api/files/read?path=/f", []string{"Range", "bytes=0-1", "If-Range", modified.Format(http.TimeFormat)}, http.StatusPartialContent, "01"},
+		{"/api/files/read?path=/f", []string{"Range", "bytes=0-1", "If-Range", modified.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK, string(data)},
+		{"/api/files/read?path=/missing", []string{"Range", "bytes=0-1"}, http.StatusNotFound, ""},
+		{"/api/files/read?path=/", nil, http.StatusBadRequest, ""},
+	} {
+		w := read("GET", c.target, c.header...)
+		if w.Code != c.code || (c.code < 300 && w.Body.String() != c.body) {
+			t.Errorf("%s %v = %d %q, expected %d %q", c.target, c.header, w.Code, w.Body, c.code, c.body)
+		}
+	}
+
+	w = read("GET", "/api/files/read?path=/f", "Range", "bytes=10-12")
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 10-12/36" {
+		t.Errorf("Content-Range = %q", cr)
+	}
+	w = read("GET", "/api/files/read?path=/f", "Range", "bytes=100-")
+	if cr := w.Header().Get("Content-Range"); cr != "bytes */36" {
+		t.Errorf("unsatisfiable Content-Range = %q", cr)
+	}
+
+	w = read("HEAD", "/api/files/read?path=/f", "Range", "bytes=0-9")
+	if w.Code != http.StatusPartialContent || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "10" {
+		t.Errorf("HEAD = %d, %d bytes, %v", w.Code, w.Body.Len(), w.Header())
+	}
+
+	// Several ranges come as multipart/byteranges
+	w = read("GET", "/api/files/read?path=/f", "Range", "bytes=0-1, 10-12, -2")
+	mediaType, params, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.Code != http.StatusPartialContent || mediaType != "multipart/byteranges" {
+		t.Fatalf("multiple ranges = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, want := range []struct{ cr, body string }{
+		{"bytes 0-1/36", "01"},
+		{"bytes 10-12/36", "abc"},
+		{"bytes 34-35/36", "yz"},
+	} {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("NextPart: %v", err)
+		}
+		body, _ := io.ReadAll(p)
+		if p.Header.Get("Content-Range") != want.cr || string(body) != want.body {
+			t.Errorf("part = %v %q, expected %s %q", p.Header, body, want.cr, want.body)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("after the last part: %v", err)
+	}
+}
+
+// chunkBackend is a MemBackend that remembers the largest read asked of it
+// and can fail reads
+type chunkBackend struct {
+	*MemBackend
+	mu      sync.Mutex
+	largest int
+	fail    bool
+}
+
+func (b *chunkBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	b.mu.Lock()
+	b.largest = max(b.largest, len(buff))
+	fail := b.fail
+	b.mu.Unlock()
+	if fail {
+		return 0, -fuse.EIO
+	}
+	return b.MemBackend.Read(path, buff, ofst)
+}
+
+// TestFileReadStreams tests large files being sent in bounded chunks, and
+// read errors getting an error status
+func TestFileReadStreams(t *testing.T) {
+	fs := newTestFS()
+	b := &chunkBackend{MemBackend: NewMemBackend()}
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*readChunk/16+5)
+	b.Create("/big", 0644)
+	b.MemBackend.Write("/big", data, 0)
+	assertSuccess(t, fs.LinkBackend("/linked", b), "LinkBackend")
+	s := NewAPIServer(fs)
+
+	w := httptest.NewRecorder()
+	s.handleFileRead(w, httptest.NewRequest("GET", "/api/files/read?path=/linked/big", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("read = %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if b.largest > readChunk {
+		t.Errorf("largest read = %d bytes, expected at most %d", b.largest, readChunk)
+	}
+
+	b.fail = true
+	w = httptest.NewRecorder()
+	s.handleFileRead(w, httptest.NewRequest("GET", "/api/files/read?path=/linked/big", nil))
+	if w.Code != http.StatusInternalServerError || w.Body.Len() != 0 {
+		t.Errorf("failing read = %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
+
+// TestFileReadNoCommit tests reads not committing writes staged for the file
+func TestFileReadNoCommit(t *testing.T) {
+	fs := newTestFS()
+	b := &stagingBackend{MemBackend: NewMemBackend()}
+	b.Create("/f", 0644)
+	b.MemBackend.Write("/f", []byte("staged"), 0)
+	assertSuccess(t, fs.LinkBackend("/stage", b), "LinkBackend")
+	s := NewAPIServer(fs)
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w := httptest.NewRecorder()
+		s.handleFileRead(w, httptest.NewRequest(method, "/api/files/read?path=/stage/f", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s = %d", method, w.Code)
+		}
+	}
+	if len(b.flushed) != 0 {
+		t.Errorf("reads committed %v", b.flushed)
+	}
+	if !strings.Contains(scrape(t, fs), "gobox_fs_open_handles 0\n") {
+		t.Errorf("reads left handles open")
+	}
+}
@@ -0,0 +1,888 @@
+package gobox
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+const (
+	defaultS3Region   = "us-east-1"
+	defaultS3PartSize = 8 << 20 // S3 requires at least 5 MiB for all but the last part
+	s3Service         = "s3"
+	s3TimeFormat      = "20060102T150405Z"
+)
+
+var errS3Config = errors.New("endpoint and bucket are required")
+
+// S3Options selects a bucket prefix on an S3-compatible service
+type S3Options struct {
+	Endpoint     string // e.g. https://s3.amazonaws.com or http://localhost:9000
+	Region       string // default us-east-1
+	Bucket       string
+	Prefix       string // optional key prefix the mount is rooted at
+	AccessKey    string // falls back to AWS_ACCESS_KEY_ID
+	SecretKey    string // falls back to AWS_SECRET_ACCESS_KEY
+	SessionToken string // falls back to AWS_SESSION_TOKEN
+	PartSize     int64  // multipart part size; default 8 MiB
+	Client       *http.Client
+}
+
+// s3Stage holds a file being written until it is flushed
+type s3Stage struct {
+	f     *os.File
+	size  int64
+	dirty bool
+}
+
+// S3Backend implements Backend on top of the S3 REST API using path-style
+// requests. Directories are key prefixes, optionally with an empty "dir/"
+// marker object so empty directories survive. Writes are staged in a local
+// temporary file and uploaded when the file is flushed.
+type S3Backend struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+	prefix   string
+	access   string
+	secret   string
+	token    string
+	partSize int64
+	client   *http.Client
+
+	mu     sync.Mutex
+	stages map[string]*s3Stage
+}
+
+// NewS3Backend creates a backend for a bucket prefix
+func NewS3Backend(opts S3Options) (*S3Backend, error) {
+	if opts.Endpoint == "" || opts.Bucket == "" {
+		return nil, errS3Config
+	}
+	ep, err := url.Parse(strings.TrimSuffix(opts.Endpoint, "/"))
+	if err != nil || ep.Host == "" {
+		return nil, errS3Config
+	}
+
+	b := &S3Backend{
+		endpoint: ep,
+		region:   opts.Region,
+		bucket:   opts.Bucket,
+		prefix:   strings.Trim(opts.Prefix, "/"),
+		access:   opts.AccessKey,
+		secret:   opts.SecretKey,
+		token:    opts.SessionToken,
+		partSize: opts.PartSize,
+		client:   opts.Client,
+		stages:   make(map[string]*s3Stage),
+	}
+	if b.prefix != "" {
+		b.prefix += "/"
+	}
+	if b.region == "" {
+		b.region = defaultS3Region
+	}
+	if b.access == "" && b.secret == "" {
+		b.access = os.Getenv("AWS_ACCESS_KEY_ID")
+		b.secret = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		b.token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if b.partSize <= 0 {
+		b.partSize = defaultS3PartSize
+	}
+	if b.client == nil {
+		b.client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	return b, nil
+}
+
+// ============ Signing ============
+
+// s3Escape percent-encodes everything except unreserved characters, as
+// SigV4 canonicalization requires. Slashes are kept when path is true.
+func s3Escape(s string, path bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || path && c == '/' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// signV4 adds AWS Signature Version 4 headers to req
+func signV4(req *http.Request, payloadHash, access, secret, token, region string, now time.Time) {
+	amzDate := now.UTC().Format(s3TimeFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	signature, signed := s3Signature(req, payloadHash, secret, region, amzDate)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s/%s/%s/aws4_request,SignedHeaders=%s,Signature=%s",
+		access, date, region, s3Service, signed, signature))
+}
+
+// s3Signature computes the SigV4 signature of a request that already
+// carries its X-Amz-* headers
+func s3Signature(req *http.Request, payloadHash, secret, region, amzDate string) (signature, signedHeaders string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-type" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders = strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var canonQuery []string
+	for _, k := range keys {
+		vals := query[k]
+		sort.Strings(vals)
+		for _, v := range vals {
+			canonQuery = append(canonQuery, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(canonQuery, "&"),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := date + "/" + region + "/" + s3Service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign)), signedHeaders
+}
+
+// ============ Requests ============
+
+// s3Error is the XML error body returned by S3
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3Errno maps an HTTP status to an error code
+func s3Errno(status int) int {
+	switch status {
+	case http.StatusNotFound:
+		return -fuse.ENOENT
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return -fuse.EACCES
+	default:
+		return -fuse.EIO
+	}
+}
+
+// key converts a mount-relative path to an object key
+func (b *S3Backend) key(path string) string {
+	return b.prefix + strings.TrimPrefix(path, "/")
+}
+
+// do sends a signed request for an object key (or the bucket when key is "")
+func (b *S3Backend) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, int) {
+	u := *b.endpoint
+	u.Path = b.endpoint.Path + "/" + b.bucket + "/" + key
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, -fuse.EIO
+	}
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signV4(req, sha256Hex(body), b.access, b.secret, b.token, b.region, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, -fuse.EIO
+	}
+	return resp, 0
+}
+
+// call sends a request and returns the response body of a 2xx response
+func (b *S3Backend) call(method, key string, query url.Values, header http.Header, body []byte) ([]byte, http.Header, int) {
+	resp, errc := b.do(method, key, query, header, body)
+	if errc != 0 {
+		return nil, nil, errc
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, -fuse.EIO
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, nil, s3Errno(resp.StatusCode)
+	}
+	// Copy and CompleteMultipartUpload can fail after sending 200
+	if method != http.MethodGet && bytes.Contains(data, []byte("<Error>")) {
+		var e s3Error
+		if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+			return nil, nil, -fuse.EIO
+		}
+	}
+	return data, resp.Header, 0
+}
+
+// s3Object and s3ListResult mirror the ListObjectsV2 response
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3ListResult struct {
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// list runs ListObjectsV2 for a prefix, following continuation tokens.
+// With a delimiter only the direct children are returned. A positive limit
+// stops after that many keys.
+func (b *S3Backend) list(prefix, delimiter string, limit int) ([]s3Object, []string, int) {
+	var objects []s3Object
+	var prefixes []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			q.Set("delimiter", delimiter)
+		}
+		if limit > 0 {
+			q.Set("max-keys", strconv.Itoa(limit))
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		data, _, errc := b.call(http.MethodGet, "", q, nil, nil)
+		if errc != 0 {
+			return nil, nil, errc
+		}
+
+		var res s3ListResult
+		if err := xml.Unmarshal(data, &res); err != nil {
+			return nil, nil, -fuse.EIO
+		}
+		objects = append(objects, res.Contents...)
+		for _, p := range res.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" || limit > 0 {
+			return objects, prefixes, 0
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// Probe checks the bucket is reachable with the configured credentials
+func (b *S3Backend) Probe() int {
+	_, _, errc := b.list(b.prefix, "/", 1)
+	return errc
+}
+
+// head returns the size and modification time of an object
+func (b *S3Backend) head(key string) (int64, time.Time, int) {
+	resp, errc := b.do(http.MethodHead, key, nil, nil, nil)
+	if errc != 0 {
+		return 0, time.Time{}, errc
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return 0, time.Time{}, s3Errno(resp.StatusCode)
+	}
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, mtime, 0
+}
+
+// isDir reports whether any key exists under path/
+func (b *S3Backend) isDir(path string) (bool, int) {
+	if path == "/" {
+		return true, 0
+	}
+	objects, prefixes, errc := b.list(b.key(path)+"/", "/", 1)
+	if errc != 0 {
+		return false, errc
+	}
+	return len(objects) > 0 || len(prefixes) > 0, 0
+}
+
+func s3FileStat(size int64, mtime time.Time) fuse.Stat_t {
+	ts := fuse.NewTimespec(mtime)
+	return fuse.Stat_t{
+		Mode:  fuse.S_IFREG | 0644,
+		Nlink: 1,
+		Size:  size,
+		Atim:  ts,
+		Mtim:  ts,
+		Ctim:  ts,
+	}
+}
+
+func s3DirStat() fuse.Stat_t {
+	now := fuse.Now()
+	return fuse.Stat_t{
+		Mode:  fuse.S_IFDIR | 0755,
+		Nlink: 2,
+		Atim:  now,
+		Mtim:  now,
+		Ctim:  now,
+	}
+}
+
+// ============ Staging ============
+
+// stage returns the local copy of a file being written, downloading the
+// current object first. Callers hold b.mu.
+func (b *S3Backend) stage(path string) (*s3Stage, int) {
+	if s, ok := b.stages[path]; ok {
+		return s, 0
+	}
+	size, _, errc := b.head(b.key(path))
+	if errc != 0 {
+		return nil, errc
+	}
+
+	f, err := os.CreateTemp("", "gobox-s3-*")
+	if err != nil {
+		return nil, -fuse.EIO
+	}
+	s := &s3Stage{f: f, size: size}
+	if size > 0 {
+		resp, errc := b.do(http.MethodGet, b.key(path), nil, nil, nil)
+		if errc == 0 {
+			if resp.StatusCode/100 != 2 {
+				errc = s3Errno(resp.StatusCode)
+			} else if n, err := io.Copy(f, resp.Body); err != nil {
+				errc = -fuse.EIO
+			} else {
+				s.size = n
+			}
+			resp.Body.Close()
+		}
+		if errc != 0 {
+			b.discard(s)
+			return nil, errc
+		}
+	}
+	b.stages[path] = s
+	return s, 0
+}
+
+// discard removes a stage's temporary file
+func (b *S3Backend) discard(s *s3Stage) {
+	name := s.f.Name()
+	s.f.Close()
+	os.Remove(name)
+}
+
+// upload stores a staged file, using a multipart upload when it is larger
+// than one part
+func (b *S3Backend) upload(key string, s *s3Stage) int {
+	if s.size <= b.partSize {
+		data := make([]byte, s.size)
+		if _, err := s.f.ReadAt(data, 0); err != nil && err != io.EOF {
+			return -fuse.EIO
+		}
+		_, _, errc := b.call(http.MethodPut, key, nil, nil, data)
+		return errc
+	}
+
+	data, _, errc := b.call(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if errc != 0 {
+		return errc
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(data, &initiated); err != nil || initiated.UploadID == "" {
+		return -fuse.EIO
+	}
+	uploadID := initiated.UploadID
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []part
+	buf := make([]byte, b.partSize)
+	for ofst, num := int64(0), 1; ofst < s.size; ofst, num = ofst+b.partSize, num+1 {
+		n, err := s.f.ReadAt(buf[:min(b.partSize, s.size-ofst)], ofst)
+		if err != nil && err != io.EOF {
+			errc = -fuse.EIO
+			break
+		}
+		q := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {uploadID}}
+		_, header, perr := b.call(http.MethodPut, key, q, nil, buf[:n])
+		if perr != 0 {
+			errc = perr
+			break
+		}
+		parts = append(parts, part{PartNumber: num, ETag: header.Get("ETag")})
+	}
+
+	if errc == 0 {
+		body, err := xml.Marshal(struct {
+			XMLName xml.Name `xml:"CompleteMultipartUpload"`
+			Parts   []part   `xml:"Part"`
+		}{Parts: parts})
+		if err != nil {
+			errc = -fuse.EIO
+		} else {
+			_, _, errc = b.call(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+		}
+	}
+	if errc != 0 {
+		b.call(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	}
+	return errc
+}
+
+// Flush uploads a staged file if it was modified
+func (b *S3Backend) Flush(path string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flush(path)
+}
+
+// Sync uploads every staged file that was modified, keeping those that
+// fail staged and returning the first error
+func (b *S3Backend) Sync() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	errc := 0
+	for path := range b.stages {
+		if e := b.flush(path); e != 0 && errc == 0 {
+			errc = e
+		}
+	}
+	return errc
+}
+
+// flush uploads and drops the stage of path; callers hold b.mu
+func (b *S3Backend) flush(path string) int {
+	s, ok := b.stages[path]
+	if !ok {
+		return 0
+	}
+	errc := 0
+	if s.dirty {
+		errc = b.upload(b.key(path), s)
+	}
+	if errc == 0 {
+		delete(b.stages, path)
+		b.discard(s)
+	}
+	return errc
+}
+
+// flushTree uploads and drops the stages of path and everything below it,
+// returning the first error; callers hold b.mu
+func (b *S3Backend) flushTree(path string) int {
+	errc := b.flush(path)
+	for p := range b.stages {
+		if strings.HasPrefix(p, path+"/") {
+			if e := b.flush(p); e != 0 && errc == 0 {
+				errc = e
+			}
+		}
+	}
+	return errc
+}
+
+// ============ Backend ============
+
+// Stat returns object attributes, or a directory for a key prefix
+func (b *S3Backend) Stat(path string) (*fuse.Stat_t, int) {
+	if path == "/" {
+		st := s3DirStat()
+		return &st, 0
+	}
+
+	b.mu.Lock()
+	if s, ok := b.stages[path]; ok {
+		st := s3FileStat(s.size, time.Now())
+		b.mu.Unlock()
+		return &st, 0
+	}
+	b.mu.Unlock()
+
+	size, mtime, errc := b.head(b.key(path))
+	if errc == 0 {
+		st := s3FileStat(size, mtime)
+		return &st, 0
+	}
+	if errc != -fuse.ENOENT {
+		return nil, errc
+	}
+	dir, errc := b.isDir(path)
+	if errc != 0 {
+		return nil, errc
+	}
+	if !dir {
+		return nil, -fuse.ENOENT
+	}
+	st := s3DirStat()
+	return &st, 0
+}
+
+// Readdir lists the direct children of a prefix
+func (b *S3Backend) Readdir(path string) ([]DirEnt, int) {
+	prefix := b.prefix
+	if path != "/" {
+		prefix = b.key(path) + "/"
+	}
+	objects, prefixes, errc := b.list(prefix, "/", 0)
+	if errc != 0 {
+		return nil, errc
+	}
+	if path != "/" && len(objects) == 0 && len(prefixes) == 0 {
+		if _, _, errc := b.head(b.key(path)); errc == 0 {
+			return nil, -fuse.ENOTDIR
+		}
+		return nil, -fuse.ENOENT
+	}
+
+	out := make([]DirEnt, 0, len(objects)+len(prefixes))
+	for _, p := range prefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")
+		out = append(out, DirEnt{Name: name, Stat: s3DirStat()})
+	}
+	for _, o := range objects {
+		name := strings.TrimPrefix(o.Key, prefix)
+		if name == "" {
+			continue // the directory marker itself
+		}
+		out = append(out, DirEnt{Name: name, Stat: s3FileStat(o.Size, o.LastModified)})
+	}
+
+	// Include staged files that have not been uploaded yet
+	b.mu.Lock()
+	for p, s := range b.stages {
+		if parentPath(p) == path {
+			_, name := split(p)
+			found := false
+			for i := range out {
+				if out[i].Name == name {
+					out[i].Stat.Size = s.size
+					found = true
+				}
+			}
+			if !found {
+				out = append(out, DirEnt{Name: name, Stat: s3FileStat(s.size, time.Now())})
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, 0
+}
+
+// Read fetches the requested range with a ranged GET
+func (b *S3Backend) Read(path string, buff []byte, ofst int64) (int, int) {
+	b.mu.Lock()
+	if s, ok := b.stages[path]; ok {
+		defer b.mu.Unlock()
+		n, err := s.f.ReadAt(buff, ofst)
+		if err != nil && err != io.EOF {
+			return 0, -fuse.EIO
+		}
+		return n, 0
+	}
+	b.mu.Unlock()
+
+	if len(buff) == 0 {
+		return 0, 0
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", ofst, ofst+int64(len(buff))-1)}}
+	resp, errc := b.do(http.MethodGet, b.key(path), nil, header, nil)
+	if errc != 0 {
+		return 0, errc
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// Range ignored by the server; skip to the offset
+		if _, err := io.CopyN(io.Discard, resp.Body, ofst); err != nil {
+			return 0, 0
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, 0 // at or past end of object
+	default:
+		return 0, s3Errno(resp.StatusCode)
+	}
+
+	n, err := io.ReadFull(resp.Body, buff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return n, -fuse.EIO
+	}
+	return n, 0
+}
+
+// Write stages data locally until the file is flushed
+func (b *S3Backend) Write(path string, buff []byte, ofst int64) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, errc := b.stage(path)
+	if errc != 0 {
+		return 0, errc
+	}
+	n, err := s.f.WriteAt(buff, ofst)
+	if err != nil {
+		return 0, -fuse.EIO
+	}
+	s.dirty = true
+	if end := ofst + int64(n); end > s.size {
+		s.size = end
+	}
+	return n, 0
+}
+
+// Truncate resizes a file. Files not being written are uploaded right away,
+// since a truncate by path is not followed by a close.
+func (b *S3Backend) Truncate(path string, size int64) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, staged := b.stages[path]
+	if !staged && size == 0 {
+		if _, _, errc := b.head(b.key(path)); errc != 0 {
+			return errc
+		}
+		_, _, errc := b.call(http.MethodPut, b.key(path), nil, nil, nil)
+		return errc
+	}
+	s, errc := b.stage(path)
+	if errc != 0 {
+		return errc
+	}
+	if err := s.f.Truncate(size); err != nil {
+		return -fuse.EIO
+	}
+	s.size = size
+	s.dirty = true
+	if !staged {
+		return b.flush(path)
+	}
+	return 0
+}
+
+// Mkdir creates an empty "dir/" marker object
+func (b *S3Backend) Mkdir(path string, mode uint32) int {
+	if _, errc := b.Stat(path); errc == 0 {
+		return -fuse.EEXIST
+	} else if errc != -fuse.ENOENT {
+		return errc
+	}
+	_, _, errc := b.call(http.MethodPut, b.key(path)+"/", nil, nil, nil)
+	return errc
+}
+
+// Create uploads an empty object so the file is visible immediately
+func (b *S3Backend) Create(path string, mode uint32) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s, ok := b.stages[path]; ok {
+		delete(b.stages, path)
+		b.discard(s)
+	}
+	_, _, errc := b.call(http.MethodPut, b.key(path), nil, nil, nil)
+	return errc
+}
+
+// Unlink deletes an object
+func (b *S3Backend) Unlink(path string) int {
+	b.mu.Lock()
+	if s, ok := b.stages[path]; ok {
+		delete(b.stages, path)
+		b.discard(s)
+	}
+	b.mu.Unlock()
+
+	if _, _, errc := b.head(b.key(path)); errc != 0 {
+		if dir, _ := b.isDir(path); dir {
+			return -fuse.EISDIR
+		}
+		return errc
+	}
+	_, _, errc := b.call(http.MethodDelete, b.key(path), nil, nil, nil)
+	return errc
+}
+
+// Rmdir removes an empty directory's marker object
+func (b *S3Backend) Rmdir(path string) int {
+	if path == "/" {
+		return -fuse.EBUSY
+	}
+	prefix := b.key(path) + "/"
+	objects, prefixes, errc := b.list(prefix, "/", 2)
+	if errc != 0 {
+		return errc
+	}
+	if len(objects) == 0 && len(prefixes) == 0 {
+		if _, _, errc := b.head(b.key(path)); errc == 0 {
+			return -fuse.ENOTDIR
+		}
+		return -fuse.ENOENT
+	}
+	for _, o := range objects {
+		if o.Key != prefix {
+			return -fuse.ENOTEMPTY
+		}
+	}
+	if len(prefixes) > 0 {
+		return -fuse.ENOTEMPTY
+	}
+	_, _, errc = b.call(http.MethodDelete, prefix, nil, nil, nil)
+	return errc
+}
+
+// copyObject copies one object server-side
+func (b *S3Backend) copyObject(src, dst string) int {
+	header := http.Header{"X-Amz-Copy-Source": {s3Escape("/"+b.bucket+"/"+src, true)}}
+	_, _, errc := b.call(http.MethodPut, dst, nil, header, nil)
+	return errc
+}
+
+// Rename copies objects to their new keys and deletes the old ones. S3 has
+// no rename, so moving a directory copies every object below it. Files
+// staged below oldpath are uploaded first so they move too.
+func (b *S3Backend) Rename(oldpath, newpath string) int {
+	b.mu.Lock()
+	errc := b.flushTree(oldpath)
+	if s, ok := b.stages[newpath]; ok {
+		delete(b.stages, newpath)
+		b.discard(s)
+	}
+	b.mu.Unlock()
+	if errc != 0 {
+		return errc
+	}
+	if oldpath == newpath {
+		return 0
+	}
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return -fuse.EINVAL
+	}
+
+	st, errc := b.Stat(oldpath)
+	if errc != 0 {
+		return errc
+	}
+	if target, errc := b.Stat(newpath); errc == 0 {
+		if target.Mode&fuse.S_IFDIR != 0 {
+			if st.Mode&fuse.S_IFDIR == 0 {
+				return -fuse.EISDIR
+			}
+			if errc := b.Rmdir(newpath); errc != 0 {
+				return errc
+			}
+		} else if st.Mode&fuse.S_IFDIR != 0 {
+			return -fuse.ENOTDIR
+		}
+	}
+
+	if st.Mode&fuse.S_IFDIR == 0 {
+		if errc := b.copyObject(b.key(oldpath), b.key(newpath)); errc != 0 {
+			return errc
+		}
+		_, _, errc := b.call(http.MethodDelete, b.key(oldpath), nil, nil, nil)
+		return errc
+	}
+
+	oldPrefix := b.key(oldpath) + "/"
+	newPrefix := b.key(newpath) + "/"
+	objects, _, errc := b.list(oldPrefix, "", 0)
+	if errc != 0 {
+		return errc
+	}
+	for _, o := range objects {
+		if errc := b.copyObject(o.Key, newPrefix+strings.TrimPrefix(o.Key, oldPrefix)); errc != 0 {
+			return errc
+		}
+	}
+	for _, o := range objects {
+		if _, _, errc := b.call(http.MethodDelete, o.Key, nil, nil, nil); errc != 0 {
+			return errc
+		}
+	}
+	return 0
+}
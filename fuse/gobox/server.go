@@ -0,0 +1,396 @@
+package gobox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// errHeadless is returned by Mount on a server configured not to mount
+var errHeadless = errors.New("headless server has no mount")
+
+// Server runs a MemFS with its REST API, either mounted through FUSE or
+// headless, where the API is the only way in. Headless servers need no
+// /dev/fuse, so tests and CI machines can embed one:
+//
+//	cfg := gobox.DefaultConfig()
+//	cfg.Listen, cfg.Headless = "127.0.0.1:0", true
+//	srv, err := gobox.NewServer(cfg)
+//	...
+//	err = srv.Start()
+//	defer srv.Shutdown(context.Background())
+//	resp, err := http.Get(srv.URL() + "/api/statfs")
+type Server struct {
+	fs  *MemFS
+	api *APIServer
+
+	mu        sync.Mutex
+	cfg       *Config
+	lns       []net.Listener // in the order of cfg.listeners()
+	https     []*http.Server
+	host      *fuse.FileSystemHost // set once Mount starts
+	unmounted chan struct{}        // closed when Mount returns
+
+	stopOnce sync.Once
+	stopped  chan struct{} // closed when Shutdown has finished
+	stopErr  error
+}
+
+// NewServer validates cfg and sets up a MemFS as it says, ready to Start
+func NewServer(cfg *Config) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	fs := NewMemFS()
+	if err := cfg.Apply(fs); err != nil {
+		return nil, err
+	}
+	api := NewAPIServer(fs)
+	api.RegisterRoutes()
+	api.SetAuth(cfg.Auth.Authenticators()...)
+	return &Server{
+		cfg:       cfg,
+		fs:        fs,
+		api:       api,
+		unmounted: make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}, nil
+}
+
+// FS returns the filesystem the server exposes
+func (s *Server) FS() *MemFS {
+	return s.fs
+}
+
+// Handler returns the REST API, for serving it some other way than Start
+func (s *Server) Handler() http.Handler {
+	return s.api
+}
+
+// Config returns the configuration in effect, including reloaded changes
+func (s *Server) Config() *Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// Start opens every configured listener and serves the REST API on each in
+// the background. All are listening before it returns, so the API is
+// reachable as soon as Start succeeds; if any can't be opened, none are.
+func (s *Server) Start() error {
+	cfg := s.Config()
+	ls := cfg.listeners()
+	lns := make([]net.Listener, 0, len(ls))
+	for i := range ls {
+		ln, err := ls[i].listen()
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return fmt.Errorf("listening on %s: %w", ls[i].name(), err)
+		}
+		lns = append(lns, ln)
+	}
+
+	https := make([]*http.Server, len(lns))
+	for i, ln := range lns {
+		https[i] = &http.Server{Handler: ls[i].handler(s.api)}
+		slog.Info("starting API server", "listen", ls[i].name(), "addr", ln.Addr().String(), "tls", ls[i].TLS != nil)
+		if ip, ok := ln.Addr().(*net.TCPAddr); ok && !ip.IP.IsLoopback() && !cfg.Auth.Enabled() {
+			slog.Warn("API is open to anyone who can reach it; configure auth to restrict it", "listen", ln.Addr().String())
+		}
+	}
+	s.mu.Lock()
+	s.lns, s.https = lns, https
+	s.mu.Unlock()
+
+	for i, ln := range lns {
+		go func() {
+			if err := https[i].Serve(ln); err != nil && err != http.ErrServerClosed {
+				slog.Error("API server stopped", "listen", ls[i].name(), "err", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// Addrs returns the addresses the API listens on, in the order configured,
+// with the plain listen address first; nil before Start
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []net.Addr
+	for _, ln := range s.lns {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+// Addr returns the first TCP address the API listens on, which tells the
+// port chosen for ":0"; nil before Start or when it only listens on sockets
+func (s *Server) Addr() net.Addr {
+	addr, _ := s.firstTCP()
+	return addr
+}
+
+// firstTCP returns the first TCP listener's address and whether it is TLS
+func (s *Server) firstTCP() (net.Addr, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ls := s.cfg.listeners()
+	for i, ln := range s.lns {
+		if _, ok := ln.Addr().(*net.TCPAddr); ok {
+			return ln.Addr(), ls[i].TLS != nil
+		}
+	}
+	return nil, false
+}
+
+// URL returns the base URL clients on this machine can reach the API at,
+// such as "http://127.0.0.1:8080" or "https://localhost:8443", for the
+// first TCP listener; empty before Start or when it only listens on sockets
+func (s *Server) URL() string {
+	a, secure := s.firstTCP()
+	addr, ok := a.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	host := addr.IP.String()
+	if addr.IP.IsUnspecified() {
+		host = "localhost"
+	}
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, fmt.Sprint(addr.Port))
+}
+
+// Mount mounts the filesystem at the configured mount point and blocks
+// until it is unmounted. It fails for headless servers.
+func (s *Server) Mount() error {
+	cfg := s.Config()
+	if cfg.Headless {
+		return errHeadless
+	}
+	host := fuse.NewFileSystemHost(newAuditFS(s.fs))
+	s.fs.SetNotifier(host.Notify)
+	s.mu.Lock()
+	s.host = host
+	s.mu.Unlock()
+	defer close(s.unmounted)
+
+	slog.Info("mounting", "mountpoint", cfg.Mountpoint, "options", cfg.FuseOptions)
+	if !host.Mount(cfg.Mountpoint, cfg.FuseOptions) {
+		return fmt.Errorf("mounting at %s failed", cfg.Mountpoint)
+	}
+	return nil
+}
+
+// Run starts the server, mounts it unless headless, and manages it until
+// it stops. SIGINT and SIGTERM arriving on sigs shut it down within the
+// configured timeout. SIGHUP reloads the configuration from reload, if not
+// nil. Run also stops, returning nil, when the filesystem is unmounted from
+// outside, and returns the error if mounting fails.
+func (s *Server) Run(sigs <-chan os.Signal, reload func() (*Config, error)) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	mounted := make(chan error, 1)
+	if s.Config().Headless {
+		slog.Info("running headless; the REST API is the only way in")
+	} else {
+		go func() { mounted <- s.Mount() }()
+	}
+
+	for {
+		var err error
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				s.reload(reload)
+				continue
+			}
+			slog.Info("shutting down", "signal", sig.String())
+		case err = <-mounted:
+			if err == nil {
+				slog.Info("unmounted from outside; shutting down")
+			}
+		}
+
+		ctx := context.Background()
+		if timeout := s.Config().ShutdownTimeout; timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return errors.Join(err, s.Shutdown(ctx))
+	}
+}
+
+// reload reads the configuration again for SIGHUP, keeping the running one
+// if anything is wrong with it
+func (s *Server) reload(reload func() (*Config, error)) {
+	if reload == nil {
+		slog.Warn("SIGHUP ignored; no configuration to reload")
+		return
+	}
+	cfg, err := reload()
+	if err == nil {
+		err = s.Reload(cfg)
+	}
+	if err != nil {
+		slog.Error("reloading configuration", "err", err)
+	}
+}
+
+// Reload applies a changed configuration to the running server: the log
+// level, capacity limits, API credentials, shutdown timeout and links that
+// weren't there before. Settings only read at startup, such as the
+// listeners and mount point, and changes to existing links are logged and
+// left as they were until a restart.
+func (s *Server) Reload(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.cfg
+	var restart []string
+	if cfg.Listen != old.Listen {
+		restart = append(restart, "listen")
+	}
+	if !reflect.DeepEqual(cfg.Listeners, old.Listeners) {
+		restart = append(restart, "listeners")
+	}
+	if cfg.Headless != old.Headless {
+		restart = append(restart, "headless")
+	}
+	if !old.Headless && cfg.Mountpoint != old.Mountpoint {
+		restart = append(restart, "mountpoint")
+	}
+	if !old.Headless && !slices.Equal(cfg.FuseOptions, old.FuseOptions) {
+		restart = append(restart, "fuseOptions")
+	}
+
+	targets := make(map[string]string)
+	for _, l := range old.Links {
+		targets[l.Path] = l.Target
+	}
+	var added []int
+	for i, l := range cfg.Links {
+		target, ok := targets[l.Path]
+		switch {
+		case !ok:
+			added = append(added, i)
+		case target != l.Target:
+			restart = append(restart, fmt.Sprintf("links[%d]", i))
+		}
+		delete(targets, l.Path)
+	}
+	for p := range targets {
+		restart = append(restart, "link at "+p)
+	}
+
+	// The links added still have to fit in with those kept. Links can't be
+	// taken back, so if one fails those made before it are kept on record,
+	// and the next reload doesn't try them again; nothing else changes.
+	if errc := s.fs.SetCapacity(cfg.Capacity); errc != 0 {
+		return fmt.Errorf("capacity: %s", resultLabel(errc))
+	}
+	links := slices.Clip(old.Links)
+	for _, i := range added {
+		if err := cfg.Links[i].apply(s.fs); err != nil {
+			s.fs.SetCapacity(old.Capacity)
+			kept := *old
+			kept.Links = links
+			s.cfg = &kept
+			return fmt.Errorf("links[%d]: %w", i, err)
+		}
+		links = append(links, cfg.Links[i])
+	}
+	slog.SetLogLoggerLevel(cfg.Level())
+	s.api.SetAuth(cfg.Auth.Authenticators()...)
+
+	next := *cfg
+	next.Listen, next.Listeners, next.Headless = old.Listen, old.Listeners, old.Headless
+	next.Mountpoint, next.FuseOptions = old.Mountpoint, old.FuseOptions
+	next.Links = links
+	s.cfg = &next
+
+	slog.Info("configuration reloaded", "linked", len(added))
+	if len(restart) > 0 {
+		slog.Warn("some changes need a restart", "settings", restart)
+	}
+	return nil
+}
+
+// Shutdown stops the server in an order that loses nothing: it stops
+// taking API requests and waits for those in flight, releases handles API
+// clients left open, unmounts and waits for the FUSE host to finish, then
+// commits staged writes and closes the journal and audit log. Unmounting
+// before the final commit means no write can slip in after it. Shutdown
+// returns when done or when ctx is, whichever is first; calling it again
+// waits for the first call.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		go func() {
+			s.stopErr = s.shutdown(ctx)
+			close(s.stopped)
+		}()
+	})
+	select {
+	case <-s.stopped:
+		return s.stopErr
+	case <-ctx.Done():
+		return fmt.Errorf("shutdown incomplete: %w", ctx.Err())
+	}
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	var errs []error
+	s.mu.Lock()
+	https := s.https
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	drained := make([]error, len(https))
+	for i, h := range https {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			drained[i] = h.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(drained...); err != nil {
+		errs = append(errs, fmt.Errorf("draining API requests: %w", err))
+	}
+	if errc := s.api.ReleaseHandles(); errc != 0 {
+		errs = append(errs, fmt.Errorf("releasing API handles: %s", resultLabel(errc)))
+	}
+
+	s.mu.Lock()
+	host := s.host
+	s.mu.Unlock()
+	if host != nil {
+		host.Unmount()
+		<-s.unmounted
+	}
+
+	if err := s.fs.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	slog.Info("stopped")
+	return errors.Join(errs...)
+}
@@ -0,0 +1,371 @@
+package gobox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// startHeadless starts an in-process headless server on a free port
+func startHeadless(t *testing.T) *Server {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Listen, cfg.Headless = "127.0.0.1:0", true
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return srv
+}
+
+// TestServerHeadless tests the REST API served without a mount, two
+// instances side by side, and shutting down
+func TestServerHeadless(t *testing.T) {
+	a, b := startHeadless(t), startHeadless(t)
+	if a.URL() == b.URL() {
+		t.Fatalf("both servers at %s", a.URL())
+	}
+	if err := a.Mount(); err != errHeadless {
+		t.Errorf("Mount = %v", err)
+	}
+
+	resp, err := http.Post(a.URL()+"/api/mkdir", "application/json", strings.NewReader(`{"path":"/scratch","mode":493}`))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("mkdir = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	resp, err = http.Post(a.URL()+"/api/files/write?path=/scratch/a.txt", "application/octet-stream", strings.NewReader("shared"))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("write = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get(a.URL() + "/api/files/read?path=/scratch/a.txt")
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "shared" {
+		t.Errorf("read = %q", data)
+	}
+	assertSuccess(t, a.FS().Getattr("/scratch/a.txt", &fuse.Stat_t{}, 0), "Getattr through FS")
+
+	// Each server has its own filesystem and routes
+	resp, err = http.Get(b.URL() + "/api/files/read?path=/scratch/a.txt")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("read from second server = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get(b.URL() + "/metrics")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("metrics = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	url := a.URL()
+	if err := a.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if resp, err := http.Get(url + "/api/statfs"); err == nil {
+		resp.Body.Close()
+		t.Errorf("API still serving after Shutdown")
+	}
+}
+
+// stagingBackend is a MemBackend that counts commits, and whose /slow file
+// takes a while to stat. If hold is set, a flush sends on it once started
+// and then waits for it to be closed.
+type stagingBackend struct {
+	*MemBackend
+	mu      sync.Mutex
+	flushed []string
+	synced  int
+	hold    chan struct{}
+}
+
+func (b *stagingBackend) Stat(path string) (*fuse.Stat_t, int) {
+	if path == "/slow" {
+		time.Sleep(200 * time.Millisecond)
+	}
+	return b.MemBackend.Stat(path)
+}
+
+func (b *stagingBackend) Flush(path string) int {
+	if b.hold != nil {
+		b.hold <- struct{}{}
+		<-b.hold
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushed = append(b.flushed, path)
+	return 0
+}
+
+func (b *stagingBackend) Sync() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.synced++
+	return 0
+}
+
+// TestServerShutdown tests that shutting down finishes requests in flight,
+// releases handles clients left open, commits staged writes and closes the
+// audit log
+func TestServerShutdown(t *testing.T) {
+	srv := startHeadless(t)
+	fs := srv.FS()
+	b := &stagingBackend{MemBackend: NewMemBackend()}
+	b.Create("/slow", 0644)
+	assertSuccess(t, fs.LinkBackend("/stage", b), "LinkBackend")
+	assertSuccess(t, fs.EnableAudit(AuditOptions{Path: filepath.Join(t.TempDir(), "audit.log")}), "EnableAudit")
+
+	resp, err := http.Post(srv.URL()+"/api/create", "application/json", strings.NewReader(`{"path":"/stage/open.txt","mode":420}`))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("create = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	slow := make(chan int)
+	go func() {
+		resp, err := http.Get(srv.URL() + "/api/getattr?path=/stage/slow")
+		if err != nil {
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if code := <-slow; code != http.StatusOK {
+		t.Errorf("request in flight = %d, expected 200", code)
+	}
+	b.mu.Lock()
+	if !slices.Contains(b.flushed, "/open.txt") || b.synced != 1 {
+		t.Errorf("flushed %v, synced %d times", b.flushed, b.synced)
+	}
+	b.mu.Unlock()
+	if fs.Audit() != nil {
+		t.Errorf("audit log still open")
+	}
+
+	// Shutting down again waits for the first
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+}
+
+// TestFileWriteCommits tests each REST write being committed once
+func TestFileWriteCommits(t *testing.T) {
+	srv := startHeadless(t)
+	b := &stagingBackend{MemBackend: NewMemBackend()}
+	assertSuccess(t, srv.FS().LinkBackend("/stage", b), "LinkBackend")
+
+	// The first write creates the file and the second opens it
+	for _, data := range []string{"first", "second"} {
+		resp, err := http.Post(srv.URL()+"/api/files/write?path=/stage/a.txt", "application/octet-stream", strings.NewReader(data))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("write %q = %v, %v", data, resp, err)
+		}
+		resp.Body.Close()
+	}
+	b.mu.Lock()
+	if !slices.Equal(b.flushed, []string{"/a.txt", "/a.txt"}) {
+		t.Errorf("flushed %v, expected once per write", b.flushed)
+	}
+	b.flushed = nil
+	b.mu.Unlock()
+
+	// Chunks sent through a handle are committed once, on release
+	post := func(target, body string) (int, Response) {
+		t.Helper()
+		resp, err := http.Post(srv.URL()+target, "application/octet-stream", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST %s: %v", target, err)
+		}
+		defer resp.Body.Close()
+		var out Response
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+	code, out := post("/api/create", `{"path":"/stage/b.txt","mode":420}`)
+	if code != http.StatusOK {
+		t.Fatalf("create = %d", code)
+	}
+	handle := strconv.FormatUint(uint64(out.Data.(map[string]any)["handle"].(float64)), 10)
+	for i, chunk := range []string{"abc", "def", "gh"} {
+		target := fmt.Sprintf("/api/files/write?path=/stage/b.txt&handle=%s&offset=%d", handle, 3*i)
+		if code, _ := post(target, chunk); code != http.StatusOK {
+			t.Fatalf("chunk %d = %d", i, code)
+		}
+	}
+	if code, _ := post("/api/files/write?path=/stage/a.txt&handle="+handle, "x"); code != http.StatusBadRequest {
+		t.Errorf("handle for another path = %d", code)
+	}
+	// Reading the file or closing other handles to it doesn't commit the
+	// upload half-done
+	resp, err := http.Get(srv.URL() + "/api/files/read?path=/stage/b.txt")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("read during upload = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+	fs := srv.FS()
+	for _, flags := range []int{fuse.O_RDONLY, fuse.O_RDWR} {
+		errc, fh := fs.Open("/stage/b.txt", flags)
+		assertSuccess(t, errc, "Open")
+		assertSuccess(t, fs.Flush("/stage/b.txt", fh), "Flush")
+		assertSuccess(t, fs.Release("/stage/b.txt", fh), "Release")
+	}
+	b.mu.Lock()
+	if len(b.flushed) != 0 {
+		t.Errorf("flushed %v before release", b.flushed)
+	}
+	b.mu.Unlock()
+
+	release := `{"path":"/stage/b.txt","handle":` + handle + `}`
+	if code, _ := post("/api/release", release); code != http.StatusOK {
+		t.Fatalf("release = %d", code)
+	}
+	if code, _ := post("/api/release", release); code != http.StatusBadRequest {
+		t.Errorf("second release = %d", code)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !slices.Equal(b.flushed, []string{"/b.txt"}) {
+		t.Errorf("flushed %v, expected once on release", b.flushed)
+	}
+	buf := make([]byte, 16)
+	if n, _ := b.MemBackend.Read("/b.txt", buf, 0); string(buf[:n]) != "abcdefgh" {
+		t.Errorf("contents = %q", buf[:n])
+	}
+}
+
+// TestFlushUnlocked tests a slow commit not holding up the rest of the
+// filesystem
+func TestFlushUnlocked(t *testing.T) {
+	fs := newTestFS()
+	b := &stagingBackend{MemBackend: NewMemBackend(), hold: make(chan struct{})}
+	b.Create("/a.txt", 0644)
+	assertSuccess(t, fs.LinkBackend("/stage", b), "LinkBackend")
+
+	errc, fh := fs.Open("/stage/a.txt", fuse.O_WRONLY)
+	assertSuccess(t, errc, "Open")
+	flushed := make(chan int)
+	go func() { flushed <- fs.Release("/stage/a.txt", fh) }()
+	<-b.hold
+	done := make(chan int)
+	go func() { done <- fs.Mkdir("/other", 0755) }()
+	select {
+	case errc := <-done:
+		assertSuccess(t, errc, "Mkdir during a commit")
+	case <-time.After(time.Second):
+		t.Errorf("Mkdir waited for the commit")
+		defer func() { <-done }()
+	}
+	close(b.hold)
+	assertSuccess(t, <-flushed, "Release")
+}
+
+// TestServerReloadPartial tests a reload that fails partway through its
+// links keeping the old limits, and the links it made on record
+func TestServerReloadPartial(t *testing.T) {
+	srv := startHeadless(t)
+	assertSuccess(t, srv.FS().Mkdir("/taken", 0755), "Mkdir")
+
+	next := *srv.Config()
+	next.Capacity.MaxFiles = 50
+	next.Links = []LinkConfig{{Path: "/a", Target: t.TempDir()}, {Path: "/taken", Target: t.TempDir()}, {Path: "/b", Target: t.TempDir()}}
+	for range 2 {
+		if err := srv.Reload(&next); err == nil || !strings.Contains(err.Error(), "links[1]") {
+			t.Errorf("Reload = %v, expected links[1] to fail", err)
+		}
+	}
+	if got := srv.Config(); len(got.Links) != 1 || got.Links[0].Path != "/a" || got.Capacity.MaxFiles != 0 {
+		t.Errorf("config after failed reloads = %+v", got)
+	}
+	if c := srv.FS().Capacity(); c.MaxFiles != 0 {
+		t.Errorf("capacity after failed reloads = %+v", c)
+	}
+
+	assertSuccess(t, srv.FS().Rmdir("/taken"), "Rmdir")
+	if err := srv.Reload(&next); err != nil {
+		t.Fatalf("Reload once fixed: %v", err)
+	}
+	if got := srv.Config(); len(got.Links) != 3 || got.Capacity.MaxFiles != 50 {
+		t.Errorf("config after reload = %+v", got)
+	}
+	assertSuccess(t, srv.FS().Getattr("/b", &fuse.Stat_t{}, 0), "Getattr on the last link")
+}
+
+// TestServerRun tests SIGHUP reloading the configuration and SIGTERM
+// stopping the server
+func TestServerRun(t *testing.T) {
+	docs := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.Listen, cfg.Headless = "127.0.0.1:0", true
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	reloads := []func(*Config){
+		func(c *Config) {
+			c.Listen = "127.0.0.1:1" // needs a restart
+			c.Links = []LinkConfig{{Path: "/docs", Target: docs}}
+			c.Capacity.MaxFiles = 50
+			c.ShutdownTimeout = time.Minute
+		},
+		func(c *Config) { c.LogLevel = "loud" },
+	}
+	reload := func() (*Config, error) {
+		c := *srv.Config()
+		reloads[0](&c)
+		reloads = reloads[1:]
+		return &c, nil
+	}
+
+	sigs := make(chan os.Signal) // unbuffered, so each send waits for the one before
+	done := make(chan error)
+	go func() { done <- srv.Run(sigs, reload) }()
+	sigs <- syscall.SIGHUP
+	sigs <- syscall.SIGHUP
+	url := srv.URL()
+	sigs <- syscall.SIGTERM
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	got := srv.Config()
+	if got.Listen != cfg.Listen || got.ShutdownTimeout != time.Minute || got.LogLevel != "info" || len(got.Links) != 1 {
+		t.Errorf("config after reloads = %+v", got)
+	}
+	if c := srv.FS().Capacity(); c.MaxFiles != 50 {
+		t.Errorf("capacity = %+v", c)
+	}
+	assertSuccess(t, srv.FS().Getattr("/docs", &fuse.Stat_t{}, 0), "Getattr on reloaded link")
+	if resp, err := http.Get(url + "/api/statfs"); err == nil {
+		resp.Body.Close()
+		t.Errorf("API still serving after SIGTERM")
+	}
+}
@@ -0,0 +1,1031 @@
+package gobox
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	defaultSFTPKeepAlive = 30 * time.Second
+	defaultSFTPTimeout   = 15 * time.Second
+	sftpChunkSize        = 32 << 10 // largest READ/WRITE every server must accept
+	sftpVersion          = 3
+)
+
+// SFTP v3 packet types
+const (
+	sftpInit     = 1
+	sftpVersionP = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpSetstat  = 9
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpExtended = 200
+)
+
+// SFTP v3 status codes, open flags and attribute flags
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpOpUnsupported    = 8
+
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+
+	sftpPosixRename = "posix-rename@openssh.com"
+)
+
+var (
+	errSFTPConfig   = errors.New("address and a private key are required")
+	errSFTPConnLost = errors.New("sftp connection lost")
+	errSFTPProtocol = errors.New("malformed sftp packet")
+)
+
+// sftpStatusError is a non-OK SSH_FXP_STATUS reply
+type sftpStatusError struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftpStatusError) Error() string {
+	return "sftp: " + e.msg
+}
+
+// SFTPOptions selects a directory on an SSH server
+type SFTPOptions struct {
+	Addr           string // host or host:port; port defaults to 22
+	User           string // defaults to $USER
+	KeyFile        string // private key file, or set Key
+	Key            []byte // PEM private key
+	Passphrase     string // for an encrypted key
+	HostKey        string // expected host key in authorized_keys format
+	KnownHostsFile string // used when HostKey is empty; default ~/.ssh/known_hosts
+	Root           string // remote directory; default the login directory
+	KeepAlive      time.Duration
+	Timeout        time.Duration // dial and handshake timeout
+}
+
+// SFTPBackend implements Backend over SFTP v3. One SSH connection is
+// shared by all operations and requests on it are pipelined. A keepalive
+// detects dead connections, and an operation that finds the connection
+// gone reconnects and is retried once; changes that can't safely run twice
+// are only retried once a look shows they didn't take effect. The client
+// is written here on top of golang.org/x/crypto/ssh, which the module
+// already requires, rather than adding github.com/pkg/sftp and what it
+// depends on.
+type SFTPBackend struct {
+	addr      string
+	config    *ssh.ClientConfig
+	root      string
+	keepAlive time.Duration
+
+	mu   sync.Mutex
+	conn *sftpConn
+	home string // absolute remote root, resolved on first connect
+}
+
+// NewSFTPBackend checks the options and loads the key; it does not connect
+func NewSFTPBackend(opts SFTPOptions) (*SFTPBackend, error) {
+	if opts.Addr == "" || opts.KeyFile == "" && len(opts.Key) == 0 {
+		return nil, errSFTPConfig
+	}
+	addr := opts.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	key := opts.Key
+	if opts.KeyFile != "" {
+		var err error
+		if key, err = os.ReadFile(opts.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	var signer ssh.Signer
+	var err error
+	if opts.Passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(opts.Passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hostKey ssh.HostKeyCallback
+	if opts.HostKey != "" {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(opts.HostKey))
+		if err != nil {
+			return nil, err
+		}
+		hostKey = ssh.FixedHostKey(pub)
+	} else {
+		file := opts.KnownHostsFile
+		if file == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			file = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		if hostKey, err = knownhosts.New(file); err != nil {
+			return nil, err
+		}
+	}
+
+	user := opts.User
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	b := &SFTPBackend{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKey,
+			Timeout:         opts.Timeout,
+		},
+		root:      opts.Root,
+		keepAlive: opts.KeepAlive,
+	}
+	if b.config.Timeout <= 0 {
+		b.config.Timeout = defaultSFTPTimeout
+	}
+	if b.keepAlive <= 0 {
+		b.keepAlive = defaultSFTPKeepAlive
+	}
+	return b, nil
+}
+
+// ============ Packets ============
+
+// sftpBuf builds a packet payload
+type sftpBuf []byte
+
+func (p sftpBuf) u32(v uint32) sftpBuf { return binary.BigEndian.AppendUint32(p, v) }
+func (p sftpBuf) u64(v uint64) sftpBuf { return binary.BigEndian.AppendUint64(p, v) }
+
+func (p sftpBuf) str(s string) sftpBuf {
+	return append(p.u32(uint32(len(s))), s...)
+}
+
+func (p sftpBuf) bytes(b []byte) sftpBuf {
+	return append(p.u32(uint32(len(b))), b...)
+}
+
+// sftpParser reads a packet payload; a short payload sets bad
+type sftpParser struct {
+	b   []byte
+	bad bool
+}
+
+func (p *sftpParser) u32() uint32 {
+	if len(p.b) < 4 {
+		p.bad = true
+		return 0
+	}
+	v := binary.BigEndian.Uint32(p.b)
+	p.b = p.b[4:]
+	return v
+}
+
+func (p *sftpParser) u64() uint64 {
+	if len(p.b) < 8 {
+		p.bad = true
+		return 0
+	}
+	v := binary.BigEndian.Uint64(p.b)
+	p.b = p.b[8:]
+	return v
+}
+
+func (p *sftpParser) str() string {
+	n := p.u32()
+	if p.bad || uint32(len(p.b)) < n {
+		p.bad = true
+		return ""
+	}
+	s := string(p.b[:n])
+	p.b = p.b[n:]
+	return s
+}
+
+// attrs decodes an ATTRS structure into file attributes
+func (p *sftpParser) attrs() fuse.Stat_t {
+	var st fuse.Stat_t
+	flags := p.u32()
+	if flags&sftpAttrSize != 0 {
+		st.Size = int64(p.u64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		st.Uid = p.u32()
+		st.Gid = p.u32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		st.Mode = p.u32()
+	}
+	if flags&sftpAttrACModTime != 0 {
+		st.Atim = fuse.NewTimespec(time.Unix(int64(p.u32()), 0))
+		st.Mtim = fuse.NewTimespec(time.Unix(int64(p.u32()), 0))
+		st.Ctim = st.Mtim
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := p.u32(); n > 0 && !p.bad; n-- {
+			p.str()
+			p.str()
+		}
+	}
+	st.Nlink = 1
+	if st.Mode&fuse.S_IFMT == fuse.S_IFDIR {
+		st.Nlink = 2
+	}
+	return st
+}
+
+// sftpModeAttrs encodes ATTRS carrying only permissions
+func sftpModeAttrs(p sftpBuf, mode uint32) sftpBuf {
+	return p.u32(sftpAttrPermissions).u32(mode & 07777)
+}
+
+// readSFTPPacket reads one length-prefixed packet
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 1 || n > 1<<20 {
+		return 0, nil, errSFTPProtocol
+	}
+	data := make([]byte, n-1)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return hdr[4], data, nil
+}
+
+// writeSFTPPacket writes one length-prefixed packet
+func writeSFTPPacket(w io.Writer, typ byte, payload []byte) error {
+	pkt := sftpBuf(make([]byte, 0, 5+len(payload))).u32(uint32(1 + len(payload)))
+	pkt = append(pkt, typ)
+	_, err := w.Write(append(pkt, payload...))
+	return err
+}
+
+// ============ Connection ============
+
+// sftpReply is a response packet with the request id stripped
+type sftpReply struct {
+	typ  byte
+	data []byte
+}
+
+// sftpConn is one SSH connection running the sftp subsystem. Requests may
+// be sent concurrently; a reader goroutine matches replies by id.
+type sftpConn struct {
+	client *ssh.Client
+	w      io.WriteCloser
+	wmu    sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan sftpReply
+	exts    map[string]string
+	err     error
+	done    chan struct{}
+}
+
+// dialSFTP connects, starts the sftp subsystem and negotiates version 3
+func dialSFTP(addr string, config *ssh.ClientConfig, keepAlive time.Duration) (*sftpConn, error) {
+	client, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	c := &sftpConn{
+		client:  client,
+		w:       w,
+		pending: make(map[uint32]chan sftpReply),
+		exts:    make(map[string]string),
+		done:    make(chan struct{}),
+	}
+	if err := writeSFTPPacket(w, sftpInit, sftpBuf(nil).u32(sftpVersion)); err != nil {
+		client.Close()
+		return nil, err
+	}
+	typ, data, err := readSFTPPacket(r)
+	if err == nil && typ != sftpVersionP {
+		err = errSFTPProtocol
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	p := &sftpParser{b: data}
+	p.u32() // server version
+	for len(p.b) > 0 && !p.bad {
+		name := p.str()
+		c.exts[name] = p.str()
+	}
+
+	go c.readLoop(r)
+	go c.keepAliveLoop(keepAlive)
+	return c, nil
+}
+
+// readLoop delivers replies until the connection fails
+func (c *sftpConn) readLoop(r io.Reader) {
+	for {
+		typ, data, err := readSFTPPacket(r)
+		if err == nil && len(data) < 4 {
+			err = errSFTPProtocol
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		id := binary.BigEndian.Uint32(data)
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- sftpReply{typ: typ, data: data[4:]}
+		}
+	}
+}
+
+// keepAliveLoop pings the server and closes the connection when a ping is
+// not answered within the interval
+func (c *sftpConn) keepAliveLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		answered := make(chan error, 1)
+		go func() {
+			_, _, err := c.client.SendRequest("keepalive@openssh.com", true, nil)
+			answered <- err
+		}()
+		select {
+		case err := <-answered:
+			if err != nil {
+				c.fail(err)
+				return
+			}
+		case <-time.After(interval):
+			c.fail(errSFTPConnLost)
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// fail marks the connection dead and releases every waiting request
+func (c *sftpConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.client.Close()
+}
+
+// alive reports whether the connection is still usable
+func (c *sftpConn) alive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// send issues a request and returns the channel its reply arrives on
+func (c *sftpConn) send(typ byte, payload sftpBuf) chan sftpReply {
+	ch := make(chan sftpReply, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		close(ch)
+		return ch
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	c.wmu.Lock()
+	err := writeSFTPPacket(c.w, typ, append(sftpBuf(nil).u32(id), payload...))
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+	return ch
+}
+
+// wait returns the reply to a request, turning a STATUS reply into an error
+func (c *sftpConn) wait(ch chan sftpReply) (sftpReply, error) {
+	r, ok := <-ch
+	if !ok {
+		return r, errSFTPConnLost
+	}
+	if r.typ == sftpStatus {
+		p := &sftpParser{b: r.data}
+		code := p.u32()
+		msg := p.str()
+		if code == sftpOK {
+			return r, nil
+		}
+		return r, &sftpStatusError{code: code, msg: msg}
+	}
+	return r, nil
+}
+
+// call sends a request and waits for its reply
+func (c *sftpConn) call(typ byte, payload sftpBuf) (sftpReply, error) {
+	return c.wait(c.send(typ, payload))
+}
+
+// ============ Requests ============
+
+func (c *sftpConn) stat(p string) (fuse.Stat_t, error) {
+	r, err := c.call(sftpStat, sftpBuf(nil).str(p))
+	if err != nil {
+		return fuse.Stat_t{}, err
+	}
+	if r.typ != sftpAttrs {
+		return fuse.Stat_t{}, errSFTPProtocol
+	}
+	parser := &sftpParser{b: r.data}
+	st := parser.attrs()
+	if parser.bad {
+		return st, errSFTPProtocol
+	}
+	return st, nil
+}
+
+func (c *sftpConn) realpath(p string) (string, error) {
+	r, err := c.call(sftpRealpath, sftpBuf(nil).str(p))
+	if err != nil {
+		return "", err
+	}
+	parser := &sftpParser{b: r.data}
+	if r.typ != sftpName || parser.u32() < 1 {
+		return "", errSFTPProtocol
+	}
+	name := parser.str()
+	if parser.bad {
+		return "", errSFTPProtocol
+	}
+	return name, nil
+}
+
+// handle sends a request that returns a handle (OPEN or OPENDIR)
+func (c *sftpConn) handle(typ byte, payload sftpBuf) (string, error) {
+	r, err := c.call(typ, payload)
+	if err != nil {
+		return "", err
+	}
+	parser := &sftpParser{b: r.data}
+	h := parser.str()
+	if r.typ != sftpHandle || parser.bad {
+		return "", errSFTPProtocol
+	}
+	return h, nil
+}
+
+func (c *sftpConn) open(p string, pflags, mode uint32) (string, error) {
+	return c.handle(sftpOpen, sftpModeAttrs(sftpBuf(nil).str(p).u32(pflags), mode))
+}
+
+func (c *sftpConn) close(h string) error {
+	_, err := c.call(sftpClose, sftpBuf(nil).str(h))
+	return err
+}
+
+// simple sends a request whose only reply is a status
+func (c *sftpConn) simple(typ byte, payload sftpBuf) error {
+	_, err := c.call(typ, payload)
+	return err
+}
+
+func (c *sftpConn) readdir(p string) ([]DirEnt, error) {
+	h, err := c.handle(sftpOpendir, sftpBuf(nil).str(p))
+	if err != nil {
+		return nil, err
+	}
+	defer c.close(h)
+
+	var out []DirEnt
+	for {
+		r, err := c.call(sftpReaddir, sftpBuf(nil).str(h))
+		if se, ok := err.(*sftpStatusError); ok && se.code == sftpEOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if r.typ != sftpName {
+			return nil, errSFTPProtocol
+		}
+		parser := &sftpParser{b: r.data}
+		for n := parser.u32(); n > 0 && !parser.bad; n-- {
+			name := parser.str()
+			parser.str() // longname
+			st := parser.attrs()
+			if name != "." && name != ".." {
+				out = append(out, DirEnt{Name: name, Stat: st})
+			}
+		}
+		if parser.bad {
+			return nil, errSFTPProtocol
+		}
+	}
+}
+
+// read fills buff from an open handle, pipelining one request per chunk
+func (c *sftpConn) read(h string, buff []byte, ofst int64) (int, error) {
+	var chans []chan sftpReply
+	for pos := 0; pos < len(buff); pos += sftpChunkSize {
+		size := min(sftpChunkSize, len(buff)-pos)
+		chans = append(chans, c.send(sftpRead, sftpBuf(nil).str(h).u64(uint64(ofst)+uint64(pos)).u32(uint32(size))))
+	}
+
+	n := 0
+	var err error
+	short := false
+	for i, ch := range chans {
+		r, rerr := c.wait(ch)
+		if err != nil || short {
+			continue // drain the remaining replies
+		}
+		if se, ok := rerr.(*sftpStatusError); ok && se.code == sftpEOF {
+			short = true
+			continue
+		}
+		if rerr != nil {
+			err = rerr
+			continue
+		}
+		parser := &sftpParser{b: r.data}
+		data := parser.str()
+		if r.typ != sftpData || parser.bad {
+			err = errSFTPProtocol
+			continue
+		}
+		n += copy(buff[i*sftpChunkSize:], data)
+		if len(data) < min(sftpChunkSize, len(buff)-i*sftpChunkSize) {
+			short = true
+		}
+	}
+	if err != nil && n == 0 {
+		return 0, err
+	}
+	return n, nil
+}
+
+// write stores buff at ofst through an open handle, pipelining chunks
+func (c *sftpConn) write(h string, buff []byte, ofst int64) error {
+	var chans []chan sftpReply
+	for pos := 0; pos < len(buff); pos += sftpChunkSize {
+		end := min(pos+sftpChunkSize, len(buff))
+		chans = append(chans, c.send(sftpWrite, sftpBuf(nil).str(h).u64(uint64(ofst)+uint64(pos)).bytes(buff[pos:end])))
+	}
+	var err error
+	for _, ch := range chans {
+		if _, werr := c.wait(ch); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// ============ Backend helpers ============
+
+// sftpErrno maps an error from a request to an error code
+func sftpErrno(err error) int {
+	var se *sftpStatusError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &se):
+		switch se.code {
+		case sftpNoSuchFile:
+			return -fuse.ENOENT
+		case sftpPermissionDenied:
+			return -fuse.EACCES
+		case sftpOpUnsupported:
+			return -fuse.ENOSYS
+		}
+	case strings.Contains(err.Error(), "unable to authenticate"),
+		strings.Contains(err.Error(), "knownhosts:"),
+		strings.Contains(err.Error(), "host key mismatch"):
+		return -fuse.EACCES
+	}
+	return -fuse.EIO
+}
+
+// isSFTPFailure reports whether err is the generic SSH_FX_FAILURE status,
+// which servers return for EEXIST, ENOTEMPTY and similar conditions
+func isSFTPFailure(err error) bool {
+	se, ok := err.(*sftpStatusError)
+	return ok && se.code == sftpFailure
+}
+
+// remote converts a mount-relative path to a remote path; callers hold a
+// connection, so b.home is resolved
+func (b *SFTPBackend) remote(path string) string {
+	switch {
+	case path == "/":
+		return b.home
+	case b.home == "/":
+		return path
+	default:
+		return b.home + path
+	}
+}
+
+// connect returns the shared connection, dialing a new one if needed
+func (b *SFTPBackend) connect() (*sftpConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn != nil && b.conn.alive() {
+		return b.conn, nil
+	}
+	c, err := dialSFTP(b.addr, b.config, b.keepAlive)
+	if err != nil {
+		return nil, err
+	}
+	if b.home == "" {
+		root := b.root
+		if root == "" {
+			root = "."
+		}
+		home, err := c.realpath(root)
+		if err != nil {
+			c.fail(err)
+			return nil, err
+		}
+		b.home = strings.TrimSuffix(home, "/")
+		if b.home == "" {
+			b.home = "/"
+		}
+	}
+	b.conn = c
+	return c, nil
+}
+
+// with runs fn on the shared connection, reconnecting and retrying once if
+// the connection turns out to be dead. fn must be safe to run twice.
+func (b *SFTPBackend) with(fn func(c *sftpConn) error) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var c *sftpConn
+		if c, err = b.connect(); err != nil {
+			return err
+		}
+		if err = fn(c); err != errSFTPConnLost {
+			return err
+		}
+	}
+	return err
+}
+
+// change runs fn, a change that can't safely run twice, on the shared
+// connection. If the connection dies before the reply, the server may
+// have made the change anyway, so it is only retried if done reports it
+// wasn't.
+func (b *SFTPBackend) change(fn func(c *sftpConn) error, done func(c *sftpConn) bool) error {
+	c, err := b.connect()
+	if err != nil {
+		return err
+	}
+	if err = fn(c); err != errSFTPConnLost {
+		return err
+	}
+	return b.with(func(c *sftpConn) error {
+		if done(c) {
+			return nil
+		}
+		return fn(c)
+	})
+}
+
+// sftpExists reports whether p is there, as a directory if dir is set
+func sftpExists(c *sftpConn, p string, dir bool) bool {
+	st, err := c.stat(p)
+	return err == nil && (!dir || st.Mode&fuse.S_IFMT == fuse.S_IFDIR)
+}
+
+// sftpGone reports whether p is known not to be there
+func sftpGone(c *sftpConn, p string) bool {
+	_, err := c.stat(p)
+	return sftpErrno(err) == -fuse.ENOENT
+}
+
+// Probe connects and checks the remote root is a directory
+func (b *SFTPBackend) Probe() int {
+	st, errc := b.Stat("/")
+	if errc != 0 {
+		return errc
+	}
+	if st.Mode&fuse.S_IFMT != fuse.S_IFDIR {
+		return -fuse.ENOTDIR
+	}
+	return 0
+}
+
+// Close drops the SSH connection
+func (b *SFTPBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn != nil {
+		b.conn.fail(errSFTPConnLost)
+		b.conn = nil
+	}
+	return nil
+}
+
+// ============ Backend ============
+
+// Stat returns file attributes
+func (b *SFTPBackend) Stat(path string) (*fuse.Stat_t, int) {
+	var st fuse.Stat_t
+	err := b.with(func(c *sftpConn) (err error) {
+		st, err = c.stat(b.remote(path))
+		return err
+	})
+	if err != nil {
+		return nil, sftpErrno(err)
+	}
+	return &st, 0
+}
+
+// Readdir lists directory entries
+func (b *SFTPBackend) Readdir(path string) ([]DirEnt, int) {
+	var ents []DirEnt
+	errc := 0
+	err := b.with(func(c *sftpConn) (err error) {
+		ents, err = c.readdir(b.remote(path))
+		if isSFTPFailure(err) {
+			if st, serr := c.stat(b.remote(path)); serr == nil && st.Mode&fuse.S_IFMT != fuse.S_IFDIR {
+				errc = -fuse.ENOTDIR
+			}
+		}
+		return err
+	})
+	if errc != 0 {
+		return nil, errc
+	}
+	if err != nil {
+		return nil, sftpErrno(err)
+	}
+	return ents, 0
+}
+
+// Read reads data from a file
+func (b *SFTPBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	n := 0
+	err := b.with(func(c *sftpConn) error {
+		h, err := c.open(b.remote(path), sftpFlagRead, 0)
+		if err != nil {
+			return err
+		}
+		defer c.close(h)
+		n, err = c.read(h, buff, ofst)
+		return err
+	})
+	if err != nil {
+		return 0, sftpErrno(err)
+	}
+	return n, 0
+}
+
+// Write writes data to a file
+func (b *SFTPBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	err := b.with(func(c *sftpConn) error {
+		h, err := c.open(b.remote(path), sftpFlagWrite, 0)
+		if err != nil {
+			return err
+		}
+		if err := c.write(h, buff, ofst); err != nil {
+			c.close(h)
+			return err
+		}
+		return c.close(h)
+	})
+	if err != nil {
+		return 0, sftpErrno(err)
+	}
+	return len(buff), 0
+}
+
+// Truncate changes file size
+func (b *SFTPBackend) Truncate(path string, size int64) int {
+	return sftpErrno(b.with(func(c *sftpConn) error {
+		return c.simple(sftpSetstat, sftpBuf(nil).str(b.remote(path)).u32(sftpAttrSize).u64(uint64(size)))
+	}))
+}
+
+// Mkdir creates a directory
+func (b *SFTPBackend) Mkdir(path string, mode uint32) int {
+	errc := 0
+	err := b.change(func(c *sftpConn) error {
+		err := c.simple(sftpMkdir, sftpModeAttrs(sftpBuf(nil).str(b.remote(path)), mode))
+		if isSFTPFailure(err) {
+			if _, serr := c.stat(b.remote(path)); serr == nil {
+				errc = -fuse.EEXIST
+			}
+		}
+		return err
+	}, func(c *sftpConn) bool { return sftpExists(c, b.remote(path), true) })
+	if errc != 0 {
+		return errc
+	}
+	return sftpErrno(err)
+}
+
+// Create creates or truncates a file
+func (b *SFTPBackend) Create(path string, mode uint32) int {
+	return sftpErrno(b.with(func(c *sftpConn) error {
+		h, err := c.open(b.remote(path), sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc, mode)
+		if err != nil {
+			return err
+		}
+		return c.close(h)
+	}))
+}
+
+// Unlink deletes a file
+func (b *SFTPBackend) Unlink(path string) int {
+	errc := 0
+	err := b.change(func(c *sftpConn) error {
+		err := c.simple(sftpRemove, sftpBuf(nil).str(b.remote(path)))
+		if isSFTPFailure(err) {
+			if st, serr := c.stat(b.remote(path)); serr == nil && st.Mode&fuse.S_IFMT == fuse.S_IFDIR {
+				errc = -fuse.EISDIR
+			}
+		}
+		return err
+	}, func(c *sftpConn) bool { return sftpGone(c, b.remote(path)) })
+	if errc != 0 {
+		return errc
+	}
+	return sftpErrno(err)
+}
+
+// Rmdir removes an empty directory
+func (b *SFTPBackend) Rmdir(path string) int {
+	if path == "/" {
+		return -fuse.EBUSY
+	}
+	errc := 0
+	err := b.change(func(c *sftpConn) error {
+		err := c.simple(sftpRmdir, sftpBuf(nil).str(b.remote(path)))
+		if isSFTPFailure(err) {
+			st, serr := c.stat(b.remote(path))
+			switch {
+			case serr != nil:
+			case st.Mode&fuse.S_IFMT != fuse.S_IFDIR:
+				errc = -fuse.ENOTDIR
+			default:
+				if ents, rerr := c.readdir(b.remote(path)); rerr == nil && len(ents) > 0 {
+					errc = -fuse.ENOTEMPTY
+				}
+			}
+		}
+		return err
+	}, func(c *sftpConn) bool { return sftpGone(c, b.remote(path)) })
+	if errc != 0 {
+		return errc
+	}
+	return sftpErrno(err)
+}
+
+// Rename moves or renames a file/directory, replacing the target. Servers
+// without posix-rename get the target removed first.
+func (b *SFTPBackend) Rename(oldpath, newpath string) int {
+	if oldpath == newpath {
+		return 0
+	}
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return -fuse.EINVAL
+	}
+	errc := 0
+	err := b.change(func(c *sftpConn) error {
+		from, to := b.remote(oldpath), b.remote(newpath)
+		st, err := c.stat(from)
+		if err != nil {
+			return err
+		}
+		if target, terr := c.stat(to); terr == nil {
+			srcDir := st.Mode&fuse.S_IFMT == fuse.S_IFDIR
+			dstDir := target.Mode&fuse.S_IFMT == fuse.S_IFDIR
+			switch {
+			case dstDir && !srcDir:
+				errc = -fuse.EISDIR
+				return nil
+			case srcDir && !dstDir:
+				errc = -fuse.ENOTDIR
+				return nil
+			case dstDir:
+				if ents, err := c.readdir(to); err != nil {
+					return err
+				} else if len(ents) > 0 {
+					errc = -fuse.ENOTEMPTY
+					return nil
+				}
+			}
+		}
+
+		if _, ok := c.exts[sftpPosixRename]; ok {
+			return c.simple(sftpExtended, sftpBuf(nil).str(sftpPosixRename).str(from).str(to))
+		}
+		if target, terr := c.stat(to); terr == nil {
+			typ := byte(sftpRemove)
+			if target.Mode&fuse.S_IFMT == fuse.S_IFDIR {
+				typ = sftpRmdir
+			}
+			if err := c.simple(typ, sftpBuf(nil).str(to)); err != nil {
+				return err
+			}
+		}
+		return c.simple(sftpRename, sftpBuf(nil).str(from).str(to))
+	}, func(c *sftpConn) bool {
+		return sftpGone(c, b.remote(oldpath)) && sftpExists(c, b.remote(newpath), false)
+	})
+	if errc != 0 {
+		return errc
+	}
+	return sftpErrno(err)
+}
@@ -0,0 +1,535 @@
+package gobox
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpServer is an in-process SSH server whose sftp subsystem serves a
+// local directory as "/". Only the requests SFTPBackend sends are handled.
+type sftpServer struct {
+	dir     string
+	addr    string
+	hostKey string // authorized_keys line
+	userKey []byte // PEM private key accepted by the server
+
+	mu         sync.Mutex
+	conns      []net.Conn
+	dials      int
+	keepalives int
+	lose       byte // request type carried out once with the reply lost
+}
+
+func newSFTPServer(t *testing.T) *sftpServer {
+	t.Helper()
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPub, userPriv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(userPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, _ := ssh.NewPublicKey(userPub)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), allowed.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sftpServer{
+		dir:     t.TempDir(),
+		addr:    ln.Addr().String(),
+		hostKey: string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey())),
+		userKey: pem.EncodeToMemory(block),
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		s.dropConnections()
+	})
+
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, nc)
+			s.dials++
+			s.mu.Unlock()
+			go s.serveConn(nc, config)
+		}
+	}()
+	return s
+}
+
+// dropConnections closes every client connection, as a server restart would
+func (s *sftpServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, nc := range s.conns {
+		nc.Close()
+	}
+	s.conns = nil
+}
+
+func (s *sftpServer) serveConn(nc net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		return
+	}
+	go func() {
+		for req := range reqs {
+			if req.Type == "keepalive@openssh.com" {
+				s.mu.Lock()
+				s.keepalives++
+				s.mu.Unlock()
+			}
+			if req.WantReply {
+				req.Reply(false, nil) // what OpenSSH answers to keepalives
+			}
+		}
+	}()
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						s.serveSFTP(ch)
+						ch.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// local maps a client path onto the served directory
+func (s *sftpServer) local(p string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(filepath.Clean("/"+p)))
+}
+
+func sftpStatusFor(err error) uint32 {
+	switch {
+	case err == nil:
+		return sftpOK
+	case err == io.EOF:
+		return sftpEOF
+	case errors.Is(err, fs.ErrNotExist):
+		return sftpNoSuchFile
+	case errors.Is(err, fs.ErrPermission):
+		return sftpPermissionDenied
+	default:
+		return sftpFailure
+	}
+}
+
+func sftpAttrsFor(p sftpBuf, fi os.FileInfo) sftpBuf {
+	mode := uint32(fi.Mode().Perm())
+	if fi.IsDir() {
+		mode |= fuse.S_IFDIR
+	} else {
+		mode |= fuse.S_IFREG
+	}
+	mtime := uint32(fi.ModTime().Unix())
+	return p.u32(sftpAttrSize | sftpAttrPermissions | sftpAttrACModTime).
+		u64(uint64(fi.Size())).u32(mode).u32(mtime).u32(mtime)
+}
+
+func (s *sftpServer) serveSFTP(rw io.ReadWriter) {
+	handles := make(map[string]*os.File)
+	defer func() {
+		for _, f := range handles {
+			f.Close()
+		}
+	}()
+	next := 0
+
+	for {
+		typ, data, err := readSFTPPacket(rw)
+		if err != nil {
+			return
+		}
+		if typ == sftpInit {
+			ext := sftpBuf(nil).u32(sftpVersion).str(sftpPosixRename).str("1")
+			writeSFTPPacket(rw, sftpVersionP, ext)
+			continue
+		}
+
+		p := &sftpParser{b: data}
+		id := p.u32()
+		reply := sftpBuf(nil).u32(id)
+		status := func(err error) {
+			s.mu.Lock()
+			lose := s.lose == typ
+			if lose {
+				s.lose = 0
+			}
+			s.mu.Unlock()
+			if lose {
+				s.dropConnections()
+				return
+			}
+			msg := ""
+			if err != nil {
+				msg = err.Error()
+			}
+			writeSFTPPacket(rw, sftpStatus, reply.u32(sftpStatusFor(err)).str(msg).str(""))
+		}
+		newHandle := func(f *os.File) {
+			next++
+			h := strconv.Itoa(next)
+			handles[h] = f
+			writeSFTPPacket(rw, sftpHandle, reply.str(h))
+		}
+
+		switch typ {
+		case sftpRealpath:
+			name := filepath.ToSlash(filepath.Clean("/" + p.str()))
+			writeSFTPPacket(rw, sftpName, reply.u32(1).str(name).str(name).u32(0))
+		case sftpStat, sftpLstat:
+			fi, err := os.Stat(s.local(p.str()))
+			if err != nil {
+				status(err)
+				continue
+			}
+			writeSFTPPacket(rw, sftpAttrs, sftpAttrsFor(reply, fi))
+		case sftpOpen:
+			name := p.str()
+			pflags := p.u32()
+			attrs := p.attrs()
+			flags := os.O_RDONLY
+			if pflags&sftpFlagWrite != 0 {
+				flags = os.O_RDWR
+			}
+			if pflags&sftpFlagCreat != 0 {
+				flags |= os.O_CREATE
+			}
+			if pflags&sftpFlagTrunc != 0 {
+				flags |= os.O_TRUNC
+			}
+			f, err := os.OpenFile(s.local(name), flags, os.FileMode(attrs.Mode&0777))
+			if err != nil {
+				status(err)
+				continue
+			}
+			newHandle(f)
+		case sftpOpendir:
+			f, err := os.Open(s.local(p.str()))
+			if err == nil {
+				if fi, _ := f.Stat(); !fi.IsDir() {
+					f.Close()
+					err = errors.New("not a directory")
+				}
+			}
+			if err != nil {
+				status(err)
+				continue
+			}
+			newHandle(f)
+		case sftpClose:
+			h := p.str()
+			if f, ok := handles[h]; ok {
+				f.Close()
+				delete(handles, h)
+			}
+			status(nil)
+		case sftpRead:
+			f := handles[p.str()]
+			ofst := p.u64()
+			buf := make([]byte, p.u32())
+			n, err := f.ReadAt(buf, int64(ofst))
+			if n == 0 {
+				status(err)
+				continue
+			}
+			writeSFTPPacket(rw, sftpData, reply.bytes(buf[:n]))
+		case sftpWrite:
+			f := handles[p.str()]
+			ofst := p.u64()
+			_, err := f.WriteAt([]byte(p.str()), int64(ofst))
+			status(err)
+		case sftpReaddir:
+			f := handles[p.str()]
+			ents, err := f.ReadDir(2) // small batches exercise repeated READDIR
+			if len(ents) == 0 {
+				status(err)
+				continue
+			}
+			reply = reply.u32(uint32(len(ents)))
+			for _, e := range ents {
+				fi, _ := e.Info()
+				reply = sftpAttrsFor(reply.str(e.Name()).str(e.Name()), fi)
+			}
+			writeSFTPPacket(rw, sftpName, reply)
+		case sftpSetstat:
+			name := p.str()
+			attrs := p.attrs()
+			status(os.Truncate(s.local(name), attrs.Size))
+		case sftpMkdir:
+			status(os.Mkdir(s.local(p.str()), 0755))
+		case sftpRmdir:
+			name := s.local(p.str())
+			fi, err := os.Stat(name)
+			if err == nil && !fi.IsDir() {
+				err = errors.New("not a directory")
+			} else if err == nil {
+				err = os.Remove(name)
+			}
+			status(err)
+		case sftpRemove:
+			name := s.local(p.str())
+			fi, err := os.Stat(name)
+			if err == nil && fi.IsDir() {
+				err = errors.New("is a directory")
+			} else if err == nil {
+				err = os.Remove(name)
+			}
+			status(err)
+		case sftpExtended:
+			if p.str() != sftpPosixRename {
+				writeSFTPPacket(rw, sftpStatus, reply.u32(sftpOpUnsupported).str("").str(""))
+				continue
+			}
+			from := s.local(p.str())
+			status(os.Rename(from, s.local(p.str())))
+		default:
+			writeSFTPPacket(rw, sftpStatus, reply.u32(sftpOpUnsupported).str("").str(""))
+		}
+	}
+}
+
+func newTestSFTP(t *testing.T, s *sftpServer, root string) *SFTPBackend {
+	t.Helper()
+	b, err := NewSFTPBackend(SFTPOptions{Addr: s.addr, User: "build", Key: s.userKey, HostKey: s.hostKey, Root: root})
+	if err != nil {
+		t.Fatalf("NewSFTPBackend: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// TestSFTPBackendFiles tests reading, writing and listing files
+func TestSFTPBackendFiles(t *testing.T) {
+	s := newSFTPServer(t)
+	os.MkdirAll(filepath.Join(s.dir, "home", "sub"), 0755)
+	b := newTestSFTP(t, s, "/home")
+
+	assertSuccess(t, b.Probe(), "Probe")
+	assertSuccess(t, b.Create("/big.bin", 0644), "Create")
+	data := make([]byte, 100<<10) // several pipelined chunks
+	rand.Read(data)
+	n, errc := b.Write("/big.bin", data, 0)
+	assertSuccess(t, errc, "Write")
+	if n != len(data) {
+		t.Fatalf("Write returned %d, expected %d", n, len(data))
+	}
+	if got, _ := os.ReadFile(filepath.Join(s.dir, "home", "big.bin")); !bytes.Equal(got, data) {
+		t.Fatalf("remote file differs after Write")
+	}
+
+	buff := make([]byte, 70<<10)
+	n, errc = b.Read("/big.bin", buff, 40<<10)
+	assertSuccess(t, errc, "Read")
+	if n != 60<<10 || !bytes.Equal(buff[:n], data[40<<10:]) {
+		t.Errorf("Read near end returned %d bytes, expected %d", n, 60<<10)
+	}
+
+	assertSuccess(t, b.Truncate("/big.bin", 10), "Truncate")
+	st, errc := b.Stat("/big.bin")
+	assertSuccess(t, errc, "Stat")
+	assertStatSize(t, st, 10, "/big.bin")
+
+	for _, name := range []string{"/a", "/b", "/c"} {
+		b.Create(name, 0644)
+	}
+	ents, errc := b.Readdir("/")
+	assertSuccess(t, errc, "Readdir")
+	if len(ents) != 5 {
+		t.Errorf("Readdir returned %d entries, expected 5", len(ents))
+	}
+	_, errc = b.Readdir("/a")
+	assertError(t, errc, -fuse.ENOTDIR, "Readdir on a file")
+	_, errc = b.Stat("/missing")
+	assertError(t, errc, -fuse.ENOENT, "Stat missing")
+}
+
+// TestSFTPBackendDirectories tests directory operations and rename
+func TestSFTPBackendDirectories(t *testing.T) {
+	s := newSFTPServer(t)
+	b := newTestSFTP(t, s, "")
+
+	assertSuccess(t, b.Mkdir("/d", 0755), "Mkdir")
+	assertError(t, b.Mkdir("/d", 0755), -fuse.EEXIST, "Mkdir existing")
+	assertSuccess(t, b.Create("/d/f", 0644), "Create")
+	assertError(t, b.Rmdir("/d"), -fuse.ENOTEMPTY, "Rmdir non-empty")
+	assertError(t, b.Unlink("/d"), -fuse.EISDIR, "Unlink directory")
+	assertError(t, b.Rmdir("/d/f"), -fuse.ENOTDIR, "Rmdir file")
+	assertError(t, b.Rmdir("/"), -fuse.EBUSY, "Rmdir root")
+
+	assertSuccess(t, b.Create("/g", 0644), "Create /g")
+	assertSuccess(t, b.Rename("/g", "/d/f"), "Rename over file")
+	assertError(t, b.Rename("/d/f", "/d"), -fuse.EISDIR, "Rename file onto directory")
+	assertError(t, b.Rename("/d", "/d/x"), -fuse.EINVAL, "Rename into itself")
+	assertSuccess(t, b.Rename("/d", "/e"), "Rename directory")
+	if _, errc := b.Stat("/e/f"); errc != 0 {
+		t.Errorf("Stat /e/f after Rename returned %d", errc)
+	}
+
+	assertSuccess(t, b.Unlink("/e/f"), "Unlink")
+	assertSuccess(t, b.Rmdir("/e"), "Rmdir")
+	assertError(t, b.Unlink("/e/f"), -fuse.ENOENT, "Unlink missing")
+}
+
+// TestSFTPBackendReconnect checks the connection is reused and re-dialed
+// after the server drops it
+func TestSFTPBackendReconnect(t *testing.T) {
+	s := newSFTPServer(t)
+	os.WriteFile(filepath.Join(s.dir, "f"), []byte("still here"), 0644)
+	b := newTestSFTP(t, s, "/")
+
+	for i := 0; i < 3; i++ {
+		if _, errc := b.Stat("/f"); errc != 0 {
+			t.Fatalf("Stat returned %d", errc)
+		}
+	}
+	s.dropConnections()
+	buff := make([]byte, 32)
+	n, errc := b.Read("/f", buff, 0)
+	assertSuccess(t, errc, "Read after disconnect")
+	if string(buff[:n]) != "still here" {
+		t.Errorf("Read = %q", buff[:n])
+	}
+	s.mu.Lock()
+	dials := s.dials
+	s.mu.Unlock()
+	if dials != 2 {
+		t.Errorf("server saw %d connections, expected 2", dials)
+	}
+}
+
+// TestSFTPBackendLostReply checks changes whose reply is lost with the
+// connection are not run twice once they took effect
+func TestSFTPBackendLostReply(t *testing.T) {
+	s := newSFTPServer(t)
+	os.WriteFile(filepath.Join(s.dir, "f"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(s.dir, "g"), []byte("x"), 0644)
+	os.Mkdir(filepath.Join(s.dir, "empty"), 0755)
+	b := newTestSFTP(t, s, "/")
+
+	for _, c := range []struct {
+		typ  byte
+		name string
+		call func() int
+	}{
+		{sftpMkdir, "Mkdir", func() int { return b.Mkdir("/d", 0755) }},
+		{sftpRemove, "Unlink", func() int { return b.Unlink("/f") }},
+		{sftpRmdir, "Rmdir", func() int { return b.Rmdir("/empty") }},
+		{sftpExtended, "Rename", func() int { return b.Rename("/g", "/h") }},
+	} {
+		s.mu.Lock()
+		s.lose = c.typ
+		s.mu.Unlock()
+		assertSuccess(t, c.call(), c.name+" with the reply lost")
+	}
+
+	ents, _ := os.ReadDir(s.dir)
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name())
+	}
+	if strings.Join(names, ",") != "d,h" {
+		t.Errorf("remote directory = %v, expected d,h", names)
+	}
+	s.mu.Lock()
+	dials := s.dials
+	s.mu.Unlock()
+	if dials != 5 {
+		t.Errorf("server saw %d connections, expected 5", dials)
+	}
+}
+
+// TestSFTPBackendKeepAlive checks idle connections are pinged
+func TestSFTPBackendKeepAlive(t *testing.T) {
+	s := newSFTPServer(t)
+	b, err := NewSFTPBackend(SFTPOptions{Addr: s.addr, Key: s.userKey, HostKey: s.hostKey, KeepAlive: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	assertSuccess(t, b.Probe(), "Probe")
+	time.Sleep(100 * time.Millisecond)
+	s.mu.Lock()
+	pings := s.keepalives
+	s.mu.Unlock()
+	if pings < 2 {
+		t.Errorf("server saw %d keepalives, expected at least 2", pings)
+	}
+}
+
+// TestLinkSFTP tests linking a remote directory into MemFS
+func TestLinkSFTP(t *testing.T) {
+	s := newSFTPServer(t)
+	fs := newTestFS()
+
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	os.WriteFile(keyFile, s.userKey, 0600)
+	opts := SFTPOptions{Addr: s.addr, User: "build", KeyFile: keyFile, HostKey: s.hostKey}
+	errCode := fs.LinkSFTP("/box", opts)
+	assertSuccess(t, errCode, "LinkSFTP")
+
+	errCode, fh := fs.Create("/box/hello.txt", 0, 0644)
+	assertSuccess(t, errCode, "Create")
+	fs.Write("/box/hello.txt", []byte("hello sftp"), 0, fh)
+	if got, _ := os.ReadFile(filepath.Join(s.dir, "hello.txt")); string(got) != "hello sftp" {
+		t.Errorf("remote file = %q, expected %q", got, "hello sftp")
+	}
+
+	// A different host key is refused
+	other := newSFTPServer(t)
+	bad := opts
+	bad.HostKey = other.hostKey
+	errCode = fs.LinkSFTP("/spoofed", bad)
+	assertError(t, errCode, -fuse.EACCES, "LinkSFTP with wrong host key")
+	errCode = fs.LinkSFTP("/invalid", SFTPOptions{Addr: s.addr})
+	assertError(t, errCode, -fuse.EINVAL, "LinkSFTP without key")
+}
@@ -0,0 +1,395 @@
+package gobox
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+	"golang.org/x/time/rate"
+)
+
+// ThrottleOptions sets token-bucket limits; zero means unlimited. Buckets
+// hold one second's worth of tokens and start full, so short bursts pass at
+// full speed.
+type ThrottleOptions struct {
+	BytesPerSec int64   `json:"bytesPerSec"`
+	OpsPerSec   float64 `json:"opsPerSec"`
+}
+
+// ThrottleStatus reports a throttle's limits and what went through it
+type ThrottleStatus struct {
+	ThrottleOptions
+	Bytes          int64   `json:"bytes"`          // bytes let through
+	Ops            int64   `json:"ops"`            // operations let through
+	WaitedMs       int64   `json:"waitedMs"`       // total time callers were held back
+	AvailableBytes float64 `json:"availableBytes"` // tokens left in the byte bucket
+	AvailableOps   float64 `json:"availableOps"`   // tokens left in the operation bucket
+}
+
+// throttle is a pair of token buckets for bytes and operations. A nil
+// throttle lets everything through.
+type throttle struct {
+	mu     sync.Mutex
+	bytes  *rate.Limiter
+	ops    *rate.Limiter
+	opts   ThrottleOptions
+	st     ThrottleStatus
+	waited time.Duration
+	last   time.Time // when it was created or last let something through
+}
+
+// newThrottle creates a throttle with the given limits
+func newThrottle(opts ThrottleOptions) *throttle {
+	t := &throttle{last: time.Now()}
+	t.set(opts)
+	return t
+}
+
+// newBucket creates a full token bucket for a per-second rate, or an
+// unlimited one for zero
+func newBucket(perSec float64) *rate.Limiter {
+	if perSec <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(perSec), max(int(math.Ceil(perSec)), 1))
+}
+
+// set changes the limits, starting with full buckets. Callers already
+// waiting finish on the old ones.
+func (t *throttle) set(opts ThrottleOptions) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.opts = opts
+	t.bytes = newBucket(float64(opts.BytesPerSec))
+	t.ops = newBucket(opts.OpsPerSec)
+}
+
+// buckets returns the current byte and operation buckets
+func (t *throttle) buckets() (*rate.Limiter, *rate.Limiter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bytes, t.ops
+}
+
+// wait takes n tokens from l, in bucket-sized steps, and adds the time
+// spent to the waiting total
+func (t *throttle) wait(ctx context.Context, l *rate.Limiter, n int) error {
+	start := time.Now()
+	defer func() {
+		t.mu.Lock()
+		t.waited += time.Since(start)
+		t.mu.Unlock()
+	}()
+	for n > 0 {
+		step := n
+		if b := l.Burst(); l.Limit() != rate.Inf && step > b {
+			step = b
+		}
+		if err := l.WaitN(ctx, step); err != nil {
+			return err
+		}
+		n -= step
+	}
+	return nil
+}
+
+// op waits until one more operation may start
+func (t *throttle) op(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	_, ops := t.buckets()
+	if err := t.wait(ctx, ops, 1); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.st.Ops++
+	t.last = time.Now()
+	t.mu.Unlock()
+	return nil
+}
+
+// take waits until n more bytes may pass
+func (t *throttle) take(ctx context.Context, n int) error {
+	if t == nil || n <= 0 {
+		return nil
+	}
+	bytes, _ := t.buckets()
+	if err := t.wait(ctx, bytes, n); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.st.Bytes += int64(n)
+	t.last = time.Now()
+	t.mu.Unlock()
+	return nil
+}
+
+// idle returns how long since the throttle last let something through
+func (t *throttle) idle(now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return now.Sub(t.last)
+}
+
+// status returns the limits, counters and current bucket levels
+func (t *throttle) status() ThrottleStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.st
+	s.ThrottleOptions = t.opts
+	s.WaitedMs = t.waited.Milliseconds()
+	if t.bytes.Limit() != rate.Inf {
+		s.AvailableBytes = t.bytes.Tokens()
+	}
+	if t.ops.Limit() != rate.Inf {
+		s.AvailableOps = t.ops.Tokens()
+	}
+	return s
+}
+
+// throttledReader passes reads through a throttle's byte bucket
+type throttledReader struct {
+	ctx context.Context
+	t   *throttle
+	r   io.Reader
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if werr := r.t.take(r.ctx, n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// throttleChunk is how much of a response is sent per wait for tokens
+const throttleChunk = 32 << 10
+
+// writeThrottled sends data to w at the pace the throttle allows
+func writeThrottled(ctx context.Context, w io.Writer, t *throttle, data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), throttleChunk)
+		if err := t.take(ctx, n); err != nil {
+			return err
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// ============ Backend wrapper ============
+
+// ThrottleBackend limits the bandwidth and operation rate of a Backend.
+// Every call takes an operation token; reads and writes also take one
+// token per byte. Callers block until tokens are available.
+type ThrottleBackend struct {
+	inner Backend
+	t     *throttle
+}
+
+// NewThrottleBackend wraps inner with the given limits
+func NewThrottleBackend(inner Backend, opts ThrottleOptions) *ThrottleBackend {
+	return &ThrottleBackend{inner: inner, t: newThrottle(opts)}
+}
+
+// Unwrap returns the backend being throttled
+func (b *ThrottleBackend) Unwrap() Backend {
+	return b.inner
+}
+
+// SetLimits changes the limits while the backend is in use
+func (b *ThrottleBackend) SetLimits(opts ThrottleOptions) {
+	b.t.set(opts)
+}
+
+// Status returns the limits and usage counters
+func (b *ThrottleBackend) Status() ThrottleStatus {
+	return b.t.status()
+}
+
+// op takes an operation token for a metadata call
+func (b *ThrottleBackend) op() {
+	b.t.op(context.Background())
+}
+
+// Stat returns file attributes
+func (b *ThrottleBackend) Stat(path string) (*fuse.Stat_t, int) {
+	b.op()
+	return b.inner.Stat(path)
+}
+
+// Readdir lists directory contents
+func (b *ThrottleBackend) Readdir(path string) ([]DirEnt, int) {
+	b.op()
+	return b.inner.Readdir(path)
+}
+
+// Read reads file content, charging the bytes actually read
+func (b *ThrottleBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	b.op()
+	n, errc := b.inner.Read(path, buff, ofst)
+	b.t.take(context.Background(), n)
+	return n, errc
+}
+
+// Write writes file content, charging the bytes before they are written
+func (b *ThrottleBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	b.op()
+	b.t.take(context.Background(), len(buff))
+	return b.inner.Write(path, buff, ofst)
+}
+
+// Truncate changes file size
+func (b *ThrottleBackend) Truncate(path string, size int64) int {
+	b.op()
+	return b.inner.Truncate(path, size)
+}
+
+// Mkdir creates a directory
+func (b *ThrottleBackend) Mkdir(path string, mode uint32) int {
+	b.op()
+	return b.inner.Mkdir(path, mode)
+}
+
+// Create creates a new file
+func (b *ThrottleBackend) Create(path string, mode uint32) int {
+	b.op()
+	return b.inner.Create(path, mode)
+}
+
+// Unlink removes a file
+func (b *ThrottleBackend) Unlink(path string) int {
+	b.op()
+	return b.inner.Unlink(path)
+}
+
+// Rmdir removes a directory
+func (b *ThrottleBackend) Rmdir(path string) int {
+	b.op()
+	return b.inner.Rmdir(path)
+}
+
+// Rename moves or renames a file/directory
+func (b *ThrottleBackend) Rename(oldpath, newpath string) int {
+	b.op()
+	return b.inner.Rename(oldpath, newpath)
+}
+
+// Flush commits writes staged by the inner backend
+func (b *ThrottleBackend) Flush(path string) int {
+	return flushBackend(b.inner, path)
+}
+
+// Sync commits everything the inner backend stages, unthrottled so that
+// shutting down isn't held up
+func (b *ThrottleBackend) Sync() int {
+	return syncBackend(b.inner)
+}
+
+// Watch reports outside changes to the inner backend
+func (b *ThrottleBackend) Watch(notify func(BackendChange)) error {
+	return watchBackend(b.inner, notify)
+}
+
+// Unwatch stops reporting outside changes
+func (b *ThrottleBackend) Unwatch() {
+	unwatchBackend(b.inner)
+}
+
+// Invalidate passes an outside change on to the inner backend
+func (b *ThrottleBackend) Invalidate(path string) {
+	invalidateBackend(b.inner, path)
+}
+
+// ============ REST clients ============
+
+// clientIdle is how long a client on the default limits goes without
+// requests before its throttle is dropped. Its buckets have long refilled
+// by then, so a new one behaves the same.
+const clientIdle = 5 * time.Minute
+
+// clientThrottles holds the limits applied to REST clients, identified by
+// their address. Clients without limits of their own get the default.
+type clientThrottles struct {
+	mu     sync.Mutex
+	def    ThrottleOptions
+	limits map[string]ThrottleOptions
+	live   map[string]*throttle
+	swept  time.Time // when idle throttles were last dropped
+}
+
+func newClientThrottles() *clientThrottles {
+	return &clientThrottles{limits: make(map[string]ThrottleOptions), live: make(map[string]*throttle)}
+}
+
+// set changes the limits of one client, or the default if client is ""
+func (c *clientThrottles) set(client string, opts ThrottleOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client == "" {
+		c.def = opts
+		for id, t := range c.live {
+			if _, own := c.limits[id]; !own {
+				t.set(opts)
+			}
+		}
+		return
+	}
+	c.limits[client] = opts
+	if t, ok := c.live[client]; ok {
+		t.set(opts)
+	}
+}
+
+// get returns the throttle for client, or nil if it is not limited
+func (c *clientThrottles) get(client string) *throttle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Every address that calls gets a throttle under a default limit, so
+	// drop those gone quiet to keep the map from growing without bound
+	if now := time.Now(); now.Sub(c.swept) >= clientIdle {
+		c.swept = now
+		for id, t := range c.live {
+			if _, own := c.limits[id]; !own && t.idle(now) >= clientIdle {
+				delete(c.live, id)
+			}
+		}
+	}
+
+	if t, ok := c.live[client]; ok {
+		return t
+	}
+	opts, own := c.limits[client]
+	if !own {
+		opts = c.def
+	}
+	if opts == (ThrottleOptions{}) {
+		return nil
+	}
+	t := newThrottle(opts)
+	c.live[client] = t
+	return t
+}
+
+// status returns the default limits and the state of every limited client
+func (c *clientThrottles) status() (ThrottleOptions, map[string]ThrottleStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make(map[string]ThrottleStatus, len(c.live))
+	for id, t := range c.live {
+		out[id] = t.status()
+	}
+	return c.def, out
+}
@@ -0,0 +1,258 @@
+package gobox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func newThrottleFile(t *testing.T, size int) *MemBackend {
+	t.Helper()
+	mb := NewMemBackend()
+	mb.Create("/f", 0644)
+	mb.Write("/f", bytes.Repeat([]byte("z"), size), 0)
+	return mb
+}
+
+// TestThrottleBackendBytes tests the bandwidth limit
+func TestThrottleBackendBytes(t *testing.T) {
+	b := NewThrottleBackend(newThrottleFile(t, 50000), ThrottleOptions{BytesPerSec: 100000})
+
+	// The first second's worth passes at once, the rest at the limit
+	buff := make([]byte, 50000)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if n, errc := b.Read("/f", buff, 0); errc != 0 || n != 50000 {
+			t.Fatalf("Read = (%d, %d)", n, errc)
+		}
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("150000 bytes at 100000/s with a full bucket took %v, expected about 0.5s", d)
+	}
+
+	st := b.Status()
+	if st.Bytes != 150000 || st.Ops != 3 || st.WaitedMs < 400 || st.BytesPerSec != 100000 {
+		t.Errorf("Status = %+v", st)
+	}
+
+	// Lifting the limit takes effect at once
+	b.SetLimits(ThrottleOptions{})
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		b.Read("/f", buff, 0)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("unlimited reads took %v", d)
+	}
+}
+
+// TestThrottleBackendOps tests the operation rate limit
+func TestThrottleBackendOps(t *testing.T) {
+	b := NewThrottleBackend(NewMemBackend(), ThrottleOptions{OpsPerSec: 20})
+
+	start := time.Now()
+	for i := 0; i < 25; i++ {
+		b.Stat("/")
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("25 calls at 20/s with a full bucket took %v, expected about 0.25s", d)
+	}
+	if st := b.Status(); st.Ops != 25 || st.AvailableOps > 1 {
+		t.Errorf("Status = %+v", st)
+	}
+}
+
+// TestThrottleMount tests throttling a MemFS mount
+func TestThrottleMount(t *testing.T) {
+	fs := newTestFS()
+	fs.LinkBackend("/slow", newThrottleFile(t, 1000))
+
+	errCode := fs.ThrottleMount("/slow", ThrottleOptions{BytesPerSec: 1000})
+	assertSuccess(t, errCode, "ThrottleMount")
+	fs.Read("/slow/f", make([]byte, 1000), 0, 0) // empty the bucket
+
+	// A read waiting for tokens holds up no one else
+	done := make(chan int)
+	go func() {
+		done <- fs.Read("/slow/f", make([]byte, 300), 0, 0)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	assertSuccess(t, fs.Mkdir("/other", 0755), "Mkdir while a read is throttled")
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Mkdir took %v behind a throttled read", d)
+	}
+	if n := <-done; n != 300 {
+		t.Errorf("throttled Read = %d", n)
+	}
+
+	status := fs.ThrottleStatus()
+	if st, ok := status["/slow"]; !ok || st.Bytes != 1300 {
+		t.Errorf("ThrottleStatus = %+v", status)
+	}
+	assertSuccess(t, fs.ThrottleMount("/slow", ThrottleOptions{OpsPerSec: 100}), "ThrottleMount again")
+	if st := fs.ThrottleStatus()["/slow"]; st.BytesPerSec != 0 || st.OpsPerSec != 100 {
+		t.Errorf("limits after update = %+v", st)
+	}
+
+	assertError(t, fs.ThrottleMount("/other", ThrottleOptions{BytesPerSec: 1}), -fuse.EINVAL, "ThrottleMount on in-memory directory")
+	assertError(t, fs.ThrottleMount("/slow", ThrottleOptions{BytesPerSec: -1}), -fuse.EINVAL, "ThrottleMount with negative limit")
+}
+
+// TestThrottleMountOps tests metadata calls waiting on a mount's operation
+// limit holding up no one else
+func TestThrottleMountOps(t *testing.T) {
+	fs := newTestFS()
+	fs.LinkBackend("/slow", NewMemBackend())
+	fs.LinkBackend("/fast", NewMemBackend())
+	assertSuccess(t, fs.ThrottleMount("/slow", ThrottleOptions{OpsPerSec: 4}), "ThrottleMount")
+	for i := 0; i < 4; i++ {
+		fs.Getattr("/slow", &fuse.Stat_t{}, 0) // empty the bucket
+	}
+
+	calls := map[string]func() int{
+		"Getattr": func() int { return fs.Getattr("/slow", &fuse.Stat_t{}, 0) },
+		"Mkdir":   func() int { return fs.Mkdir("/slow/d", 0755) },
+		"Create":  func() int { errc, _ := fs.Create("/slow/f", 0, 0644); return errc },
+		"Readdir": func() int { return fs.Readdir("/slow", func(string, *fuse.Stat_t, int64) bool { return true }, 0, 0) },
+	}
+	done := make(chan int, len(calls))
+	for _, call := range calls {
+		go func() { done <- call() }()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	assertSuccess(t, fs.Getattr("/", &fuse.Stat_t{}, 0), "Getattr on /")
+	assertSuccess(t, fs.Mkdir("/other", 0755), "Mkdir in memory")
+	assertSuccess(t, fs.Mkdir("/fast/d", 0755), "Mkdir on another mount")
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("other calls took %v behind a throttled mount", d)
+	}
+	for range calls {
+		assertSuccess(t, <-done, "throttled call")
+	}
+}
+
+// TestThrottleMountWrapped tests a throttle being found and changed once
+// other wrappers are put in front of it
+func TestThrottleMountWrapped(t *testing.T) {
+	fs := newTestFS()
+	fs.LinkBackend("/slow", NewMirrorBackend(NewMemBackend(), NewMemBackend()))
+	assertSuccess(t, fs.ThrottleMount("/slow", ThrottleOptions{BytesPerSec: 1000}), "ThrottleMount")
+	_, errCode := fs.FaultInject("/slow", FaultRule{Op: "stat", Errno: fuse.EIO})
+	assertSuccess(t, errCode, "FaultInject")
+	assertSuccess(t, fs.CacheMount("/slow", CacheOptions{}), "CacheMount")
+
+	assertSuccess(t, fs.ThrottleMount("/slow", ThrottleOptions{OpsPerSec: 50}), "ThrottleMount again")
+	if st, ok := fs.ThrottleStatus()["/slow"]; !ok || st.BytesPerSec != 0 || st.OpsPerSec != 50 {
+		t.Errorf("ThrottleStatus = %+v", fs.ThrottleStatus())
+	}
+	throttles := 0
+	for b := fs.nodes["/slow"].backend; b != nil; {
+		if _, ok := b.(*ThrottleBackend); ok {
+			throttles++
+		}
+		u, ok := b.(Unwrapper)
+		if !ok {
+			break
+		}
+		b = u.Unwrap()
+	}
+	if throttles != 1 {
+		t.Errorf("%d throttles on the mount", throttles)
+	}
+
+	_, errCode = fs.MirrorStatus("/slow")
+	assertSuccess(t, errCode, "MirrorStatus behind a throttle")
+}
+
+// TestThrottleRESTClient tests per-client limits on the file I/O endpoints
+func TestThrottleRESTClient(t *testing.T) {
+	fs := newTestFS()
+	errCode, fh := fs.Create("/big", os.O_RDWR, 0644)
+	assertSuccess(t, errCode, "Create")
+	fs.Write("/big", bytes.Repeat([]byte("q"), 150000), 0, fh)
+	s := NewAPIServer(fs)
+
+	// httptest requests come from 192.0.2.1
+	s.throttles.set("", ThrottleOptions{BytesPerSec: 100000})
+	s.throttles.set("198.51.100.7", ThrottleOptions{})
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	s.handleFileRead(w, httptest.NewRequest(http.MethodGet, "/api/files/read?path=/big", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 150000 {
+		t.Fatalf("read = %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("throttled read took %v, expected about 0.5s", d)
+	}
+
+	// A client with its own zero limits is not throttled
+	r := httptest.NewRequest(http.MethodGet, "/api/files/read?path=/big", nil)
+	r.RemoteAddr = "198.51.100.7:5000"
+	start = time.Now()
+	s.handleFileRead(httptest.NewRecorder(), r)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("unthrottled client took %v", d)
+	}
+
+	w = httptest.NewRecorder()
+	s.handleThrottleStatus(w, httptest.NewRequest(http.MethodGet, "/api/throttle/status", nil))
+	var resp struct {
+		Data struct {
+			Clients map[string]ThrottleStatus `json:"clients"`
+		} `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if st, ok := resp.Data.Clients["192.0.2.1"]; !ok || st.Bytes != 150000 || st.Ops != 1 {
+		t.Errorf("client status = %+v", resp.Data.Clients)
+	}
+	if _, ok := resp.Data.Clients["198.51.100.7"]; ok {
+		t.Errorf("unthrottled client is listed")
+	}
+}
+
+// TestClientThrottlesIdle tests throttles of clients on the default limits
+// being dropped once idle, while those with their own limits stay
+func TestClientThrottlesIdle(t *testing.T) {
+	c := newClientThrottles()
+	c.set("", ThrottleOptions{OpsPerSec: 100})
+	c.set("192.0.2.1", ThrottleOptions{OpsPerSec: 10})
+	for i := 0; i < 100; i++ {
+		c.get(fmt.Sprintf("198.51.100.%d", i))
+	}
+	own := c.get("192.0.2.1")
+	if len(c.live) != 101 {
+		t.Fatalf("live = %d, expected 101", len(c.live))
+	}
+
+	// Nothing is dropped before the next sweep is due
+	for _, th := range c.live {
+		th.last = th.last.Add(-2 * clientIdle)
+	}
+	active := c.get("198.51.100.0")
+	active.op(context.Background())
+	c.get("203.0.113.1")
+	if len(c.live) != 102 {
+		t.Fatalf("live before the sweep = %d, expected 102", len(c.live))
+	}
+
+	c.swept = c.swept.Add(-clientIdle)
+	c.get("203.0.113.2")
+	if len(c.live) != 4 {
+		t.Errorf("live after the sweep = %d, expected 4", len(c.live))
+	}
+	if c.live["192.0.2.1"] != own || c.live["198.51.100.0"] != active {
+		t.Errorf("own or active client dropped: %v", c.live)
+	}
+}
@@ -0,0 +1,382 @@
+package gobox
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// minTierSweep bounds how often the idle sweeper runs.
+const minTierSweep = time.Second
+
+// TierOptions configures when in-memory file contents move to disk.
+type TierOptions struct {
+	SpillDir     string        // parent of the spill directory; required
+	MaxFileBytes int64         // files larger than this live on disk; 0 for no limit
+	IdleAfter    time.Duration // files untouched this long are spilled; 0 to never
+	MemoryBudget int64         // total bytes of contents kept in memory; 0 for no limit
+}
+
+// TierFile describes where one file's contents live.
+type TierFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Tier   string `json:"tier"` // "memory" or "disk"
+	Pinned bool   `json:"pinned"`
+	IdleMs int64  `json:"idleMs"`
+}
+
+// TierStatus reports memory use and the placement of each file.
+type TierStatus struct {
+	MemoryBudget int64      `json:"memoryBudget"`
+	MemoryBytes  int64      `json:"memoryBytes"`
+	SpilledBytes int64      `json:"spilledBytes"`
+	Files        []TierFile `json:"files"`
+}
+
+// tierInfo is the tiering state of one in-memory file node.
+type tierInfo struct {
+	spill   string    // file holding the contents while they are on disk
+	pinned  bool      // kept in memory whatever the policy says
+	used    time.Time // last read or write
+	counted int64     // bytes of data included in tierManager.mem
+}
+
+// tierManager moves the contents of MemFS files between memory and a spill
+// directory. All methods are called with fs.lock held and do nothing on a
+// nil manager, so MemFS calls them unconditionally.
+type tierManager struct {
+	fs   *MemFS
+	opts TierOptions
+	dir  string // private directory under opts.SpillDir
+	next int    // names the next spill file
+	mem  int64  // bytes of file contents held in memory
+	stop chan struct{}
+}
+
+// EnableTiering starts moving large, idle or excess file contents to disk.
+func (fs *MemFS) EnableTiering(opts TierOptions) int {
+	if opts.SpillDir == "" || opts.MaxFileBytes < 0 || opts.IdleAfter < 0 || opts.MemoryBudget < 0 {
+		return -fuse.EINVAL
+	}
+	if err := os.MkdirAll(opts.SpillDir, 0700); err != nil {
+		return -fuse.EIO
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.tier != nil {
+		return -fuse.EEXIST
+	}
+	dir, err := os.MkdirTemp(opts.SpillDir, "memfs-")
+	if err != nil {
+		return -fuse.EIO
+	}
+	t := &tierManager{fs: fs, opts: opts, dir: dir, stop: make(chan struct{})}
+	now := time.Now()
+	for _, n := range fs.nodes {
+		if n.isMemFile() {
+			n.tier.used = now
+			t.account(n, nil)
+		}
+	}
+	fs.tier = t
+	if opts.IdleAfter > 0 {
+		go t.sweeper()
+	}
+	return 0
+}
+
+// DisableTiering stops tiering, loading every spilled file back into memory
+// and removing the spill directory.
+func (fs *MemFS) DisableTiering() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	t := fs.tier
+	if t == nil {
+		return -fuse.EINVAL
+	}
+	for _, n := range fs.nodes {
+		if n.tier.spill != "" {
+			if errc := t.load(n); errc != 0 {
+				return errc
+			}
+		}
+		n.tier = tierInfo{}
+	}
+	close(t.stop)
+	os.RemoveAll(t.dir)
+	fs.tier = nil
+	return 0
+}
+
+// discard stops the sweeper and deletes the spill directory without loading
+// anything back, for shutting down.
+func (t *tierManager) discard() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	os.RemoveAll(t.dir)
+}
+
+// TierStatus lists the files at or below path and where their contents live.
+func (fs *MemFS) TierStatus(path string) (TierStatus, int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	t := fs.tier
+	if t == nil {
+		return TierStatus{}, -fuse.EINVAL
+	}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	now := time.Now()
+	s := TierStatus{MemoryBudget: t.opts.MemoryBudget, MemoryBytes: t.mem, Files: []TierFile{}}
+	for p, n := range fs.nodes {
+		if !n.isMemFile() {
+			continue
+		}
+		f := TierFile{
+			Path:   p,
+			Size:   n.stat.Size,
+			Tier:   "memory",
+			Pinned: n.tier.pinned,
+			IdleMs: now.Sub(n.tier.used).Milliseconds(),
+		}
+		if n.tier.spill != "" {
+			f.Tier = "disk"
+			s.SpilledBytes += n.stat.Size
+		}
+		if path == "/" || p == path || strings.HasPrefix(p, prefix) {
+			s.Files = append(s.Files, f)
+		}
+	}
+	sort.Slice(s.Files, func(i, j int) bool { return s.Files[i].Path < s.Files[j].Path })
+	return s, 0
+}
+
+// TierPin keeps a file in memory regardless of size, idleness and budget,
+// loading it back first if it was spilled. Unpinning hands it back to the
+// policy.
+func (fs *MemFS) TierPin(path string, pinned bool) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	t := fs.tier
+	if t == nil {
+		return -fuse.EINVAL
+	}
+	n, ok := fs.nodes[path]
+	if !ok {
+		if b, _ := fs.resolveBackend(path); b != nil {
+			// Linked backends keep their own data
+			return -fuse.EINVAL
+		}
+		return -fuse.ENOENT
+	}
+	if !n.isMemFile() {
+		if n.stat.Mode&fuse.S_IFDIR != 0 {
+			return -fuse.EISDIR
+		}
+		return -fuse.EINVAL
+	}
+
+	n.tier.pinned = pinned
+	if pinned && n.tier.spill != "" {
+		if errc := t.load(n); errc != 0 {
+			return errc
+		}
+	}
+	t.account(n, n)
+	return 0
+}
+
+// isMemFile reports whether the node is a regular file held by MemFS itself.
+func (n *node) isMemFile() bool {
+	return n.backend == nil && n.stat.Mode&fuse.S_IFDIR == 0
+}
+
+// sweeper spills idle files until tiering is disabled.
+func (t *tierManager) sweeper() {
+	ticker := time.NewTicker(max(t.opts.IdleAfter/2, minTierSweep))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-ticker.C:
+			t.fs.lock.Lock()
+			t.sweep(now)
+			t.fs.lock.Unlock()
+		}
+	}
+}
+
+// sweep spills every unpinned file that has been idle since IdleAfter
+// before now.
+func (t *tierManager) sweep(now time.Time) {
+	if t == nil || t.opts.IdleAfter == 0 {
+		return
+	}
+	for _, n := range t.fs.nodes {
+		if n.isMemFile() && n.tier.spill == "" && !n.tier.pinned && len(n.data) > 0 &&
+			now.Sub(n.tier.used) >= t.opts.IdleAfter {
+			t.spill(n)
+		}
+	}
+}
+
+// touch records an access to n, loading its contents back into memory if
+// they were spilled for being idle or over budget.
+func (t *tierManager) touch(n *node) int {
+	if t == nil {
+		return 0
+	}
+	n.tier.used = time.Now()
+	if n.tier.spill == "" || t.tooBig(n) {
+		return 0
+	}
+	if errc := t.load(n); errc != 0 {
+		return errc
+	}
+	t.account(n, n)
+	return 0
+}
+
+// tooBig reports whether n must stay on disk because of its size.
+func (t *tierManager) tooBig(n *node) bool {
+	if n.tier.pinned {
+		return false
+	}
+	return (t.opts.MaxFileBytes > 0 && n.stat.Size > t.opts.MaxFileBytes) ||
+		(t.opts.MemoryBudget > 0 && n.stat.Size > t.opts.MemoryBudget)
+}
+
+// account brings the memory total up to date after n's contents changed,
+// spills n if it has outgrown memory, then spills the least recently used
+// files other than keep until the budget is met. Contents that cannot be
+// written to disk simply stay in memory.
+func (t *tierManager) account(n *node, keep *node) {
+	if t == nil {
+		return
+	}
+	t.mem += int64(len(n.data)) - n.tier.counted
+	n.tier.counted = int64(len(n.data))
+	if n.tier.spill == "" && t.tooBig(n) {
+		t.spill(n)
+	}
+	if t.opts.MemoryBudget == 0 || t.mem <= t.opts.MemoryBudget {
+		return
+	}
+
+	var lru []*node
+	for _, m := range t.fs.nodes {
+		if m != keep && m.isMemFile() && m.tier.spill == "" && !m.tier.pinned && len(m.data) > 0 {
+			lru = append(lru, m)
+		}
+	}
+	sort.Slice(lru, func(i, j int) bool { return lru[i].tier.used.Before(lru[j].tier.used) })
+	for _, m := range lru {
+		if t.mem <= t.opts.MemoryBudget {
+			break
+		}
+		t.spill(m)
+	}
+}
+
+// spill writes n's contents to a new spill file and frees them.
+func (t *tierManager) spill(n *node) int {
+	t.next++
+	name := filepath.Join(t.dir, strconv.Itoa(t.next))
+	if err := os.WriteFile(name, n.data, 0600); err != nil {
+		os.Remove(name)
+		return -fuse.EIO
+	}
+	n.tier.spill = name
+	n.data = nil
+	t.mem -= n.tier.counted
+	n.tier.counted = 0
+	return 0
+}
+
+// load reads n's spill file back into memory and removes it.
+func (t *tierManager) load(n *node) int {
+	data, err := os.ReadFile(n.tier.spill)
+	if err != nil {
+		return -fuse.EIO
+	}
+	os.Remove(n.tier.spill)
+	n.tier.spill = ""
+	n.data = data
+	t.mem += int64(len(data))
+	n.tier.counted = int64(len(data))
+	return 0
+}
+
+// drop forgets n, which is being deleted or replaced.
+func (t *tierManager) drop(n *node) {
+	if t == nil {
+		return
+	}
+	if n.tier.spill != "" {
+		os.Remove(n.tier.spill)
+	}
+	t.mem -= n.tier.counted
+	n.tier = tierInfo{}
+}
+
+// readAt reads spilled contents.
+func (t *tierManager) readAt(n *node, buff []byte, ofst int64) int {
+	f, err := os.Open(n.tier.spill)
+	if err != nil {
+		return -fuse.EIO
+	}
+	defer f.Close()
+
+	if ofst >= n.stat.Size {
+		return 0
+	}
+	if end := ofst + int64(len(buff)); end > n.stat.Size {
+		buff = buff[:n.stat.Size-ofst]
+	}
+	k, err := f.ReadAt(buff, ofst)
+	if err != nil && k < len(buff) {
+		return -fuse.EIO
+	}
+	return k
+}
+
+// writeAt writes to spilled contents.
+func (t *tierManager) writeAt(n *node, buff []byte, ofst int64) int {
+	f, err := os.OpenFile(n.tier.spill, os.O_WRONLY, 0)
+	if err != nil {
+		return -fuse.EIO
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(buff, ofst); err != nil {
+		return -fuse.EIO
+	}
+	if end := ofst + int64(len(buff)); end > n.stat.Size {
+		n.stat.Size = end
+	}
+	n.stat.Mtim = fuse.Now()
+	return len(buff)
+}
+
+// truncate resizes spilled contents.
+func (t *tierManager) truncate(n *node, size int64) int {
+	if err := os.Truncate(n.tier.spill, size); err != nil {
+		return -fuse.EIO
+	}
+	n.stat.Size = size
+	n.stat.Mtim = fuse.Now()
+	return 0
+}
@@ -0,0 +1,174 @@
+package gobox
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// writeFile creates path in fs holding data
+func writeFile(t *testing.T, fs *MemFS, path string, data []byte) {
+	t.Helper()
+	errCode, fh := fs.Create(path, os.O_RDWR, 0644)
+	assertSuccess(t, errCode, "Create "+path)
+	if n := fs.Write(path, data, 0, fh); n != len(data) {
+		t.Fatalf("Write %s = %d, expected %d", path, n, len(data))
+	}
+}
+
+// tierOf returns "memory" or "disk" for path
+func tierOf(t *testing.T, fs *MemFS, path string) string {
+	t.Helper()
+	status, errCode := fs.TierStatus(path)
+	assertSuccess(t, errCode, "TierStatus "+path)
+	if len(status.Files) != 1 {
+		t.Fatalf("TierStatus %s listed %d files", path, len(status.Files))
+	}
+	return status.Files[0].Tier
+}
+
+func readFile(t *testing.T, fs *MemFS, path string, size int) []byte {
+	t.Helper()
+	buff := make([]byte, size+10)
+	n := fs.Read(path, buff, 0, 0)
+	if n < 0 {
+		t.Fatalf("Read %s failed with %d", path, n)
+	}
+	return buff[:n]
+}
+
+// TestTierSizeThreshold tests that large files move to disk and keep working
+func TestTierSizeThreshold(t *testing.T) {
+	fs := newTestFS()
+	assertSuccess(t, fs.EnableTiering(TierOptions{SpillDir: t.TempDir(), MaxFileBytes: 100}), "EnableTiering")
+	defer fs.DisableTiering()
+
+	writeFile(t, fs, "/small", []byte("tiny"))
+	if got := tierOf(t, fs, "/small"); got != "memory" {
+		t.Errorf("small file tier = %s", got)
+	}
+
+	big := bytes.Repeat([]byte("x"), 150)
+	writeFile(t, fs, "/big", big[:80])
+	fs.Write("/big", big[80:], 80, 0)
+	if got := tierOf(t, fs, "/big"); got != "disk" {
+		t.Fatalf("big file tier = %s, expected disk", got)
+	}
+	if got := readFile(t, fs, "/big", 150); !bytes.Equal(got, big) {
+		t.Errorf("Read spilled file = %q", got)
+	}
+
+	// Writes and truncates go straight to the spill file
+	fs.Write("/big", []byte("HEAD"), 0, 0)
+	fs.Write("/big", []byte("TAIL"), 150, 0)
+	var stat fuse.Stat_t
+	fs.Getattr("/big", &stat, 0)
+	assertStatSize(t, &stat, 154, "/big")
+	if got := readFile(t, fs, "/big", 154); string(got[:4]) != "HEAD" || string(got[150:]) != "TAIL" {
+		t.Errorf("Read after writes = %q", got)
+	}
+	assertSuccess(t, fs.Truncate("/big", 50, 0), "Truncate")
+	if got := readFile(t, fs, "/big", 50); len(got) != 50 || string(got[:4]) != "HEAD" {
+		t.Errorf("Read after truncate = %q", got)
+	}
+	// Now small enough to come back on the next access
+	readFile(t, fs, "/big", 50)
+	if got := tierOf(t, fs, "/big"); got != "memory" {
+		t.Errorf("shrunk file tier = %s, expected memory", got)
+	}
+
+	status, _ := fs.TierStatus("/")
+	if status.MemoryBytes != 54 {
+		t.Errorf("MemoryBytes = %d, expected 54", status.MemoryBytes)
+	}
+}
+
+// TestTierBudget tests that the least recently used files are spilled to
+// stay within the memory budget
+func TestTierBudget(t *testing.T) {
+	fs := newTestFS()
+	assertSuccess(t, fs.EnableTiering(TierOptions{SpillDir: t.TempDir(), MemoryBudget: 100}), "EnableTiering")
+	defer fs.DisableTiering()
+
+	for _, name := range []string{"/a", "/b", "/c"} {
+		writeFile(t, fs, name, bytes.Repeat([]byte(name[1:]), 40))
+		time.Sleep(time.Millisecond)
+	}
+	if tierOf(t, fs, "/a") != "disk" || tierOf(t, fs, "/b") != "memory" || tierOf(t, fs, "/c") != "memory" {
+		t.Fatalf("after three writes: %+v", allTiers(fs.TierStatus("/")))
+	}
+
+	// Reading /a brings it back and pushes out /b, now the least recent
+	if got := readFile(t, fs, "/a", 40); !bytes.Equal(got, bytes.Repeat([]byte("a"), 40)) {
+		t.Errorf("Read /a = %q", got)
+	}
+	if tierOf(t, fs, "/a") != "memory" || tierOf(t, fs, "/b") != "disk" {
+		t.Errorf("after reading /a: %+v", allTiers(fs.TierStatus("/")))
+	}
+
+	// Pinned files are never chosen
+	assertSuccess(t, fs.TierPin("/b", true), "TierPin")
+	if tierOf(t, fs, "/b") != "memory" {
+		t.Errorf("pinned file is on disk")
+	}
+	status, _ := fs.TierStatus("/")
+	if status.MemoryBytes > 100 {
+		t.Errorf("MemoryBytes = %d over the budget", status.MemoryBytes)
+	}
+}
+
+// TestTierIdle tests idle spilling, pinning and cleanup
+func TestTierIdle(t *testing.T) {
+	fs := newTestFS()
+	spillDir := t.TempDir()
+	assertSuccess(t, fs.EnableTiering(TierOptions{SpillDir: spillDir, IdleAfter: time.Hour}), "EnableTiering")
+
+	fs.Mkdir("/docs", 0755)
+	writeFile(t, fs, "/docs/old", []byte("cold"))
+	writeFile(t, fs, "/docs/kept", []byte("warm"))
+	assertSuccess(t, fs.TierPin("/docs/kept", true), "TierPin")
+
+	fs.lock.Lock()
+	fs.tier.sweep(time.Now().Add(2 * time.Hour))
+	fs.lock.Unlock()
+	if tierOf(t, fs, "/docs/old") != "disk" || tierOf(t, fs, "/docs/kept") != "memory" {
+		t.Errorf("after sweep: %+v", allTiers(fs.TierStatus("/docs")))
+	}
+	if got := readFile(t, fs, "/docs/old", 4); string(got) != "cold" {
+		t.Errorf("Read idle file = %q", got)
+	}
+	if tierOf(t, fs, "/docs/old") != "memory" {
+		t.Errorf("idle file was not reloaded on access")
+	}
+
+	assertError(t, fs.TierPin("/docs", true), -fuse.EISDIR, "TierPin directory")
+	assertError(t, fs.TierPin("/missing", true), -fuse.ENOENT, "TierPin missing")
+	assertError(t, fs.EnableTiering(TierOptions{SpillDir: spillDir}), -fuse.EEXIST, "EnableTiering twice")
+
+	// Deleting a spilled file removes its spill file
+	fs.lock.Lock()
+	fs.tier.sweep(time.Now().Add(2 * time.Hour))
+	dir := fs.tier.dir
+	fs.lock.Unlock()
+	assertSuccess(t, fs.Unlink("/docs/old"), "Unlink")
+	if ents, _ := os.ReadDir(dir); len(ents) != 0 {
+		t.Errorf("spill directory holds %d files after unlink", len(ents))
+	}
+
+	assertSuccess(t, fs.DisableTiering(), "DisableTiering")
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("spill directory left behind: %v", err)
+	}
+	if got := readFile(t, fs, "/docs/kept", 4); string(got) != "warm" {
+		t.Errorf("Read after DisableTiering = %q", got)
+	}
+	_, errCode := fs.TierStatus("/")
+	assertError(t, errCode, -fuse.EINVAL, "TierStatus without tiering")
+}
+
+func allTiers(status TierStatus, _ int) TierStatus {
+	return status
+}
@@ -0,0 +1,215 @@
+package gobox
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+var (
+	errWatchUnsupported = errors.New("backend cannot watch for changes")
+	errWatchActive      = errors.New("backend is already being watched")
+)
+
+// BackendChange is a change another program made to a backend's storage
+type BackendChange struct {
+	Type    EventType
+	Path    string // backend-relative path
+	OldPath string // backend-relative path before a rename
+}
+
+// Watcher is implemented by backends that can report changes made to their
+// storage by other programs
+type Watcher interface {
+	Watch(notify func(BackendChange)) error
+	Unwatch()
+}
+
+// watchBackend starts reporting outside changes if the backend supports it
+func watchBackend(b Backend, notify func(BackendChange)) error {
+	if w, ok := b.(Watcher); ok {
+		return w.Watch(notify)
+	}
+	return errWatchUnsupported
+}
+
+// unwatchBackend stops reporting outside changes
+func unwatchBackend(b Backend) {
+	if w, ok := b.(Watcher); ok {
+		w.Unwatch()
+	}
+}
+
+// Invalidator is implemented by backends that keep copies of what they
+// read and must forget them when the storage changes underneath
+type Invalidator interface {
+	Invalidate(path string)
+}
+
+// invalidateBackend drops anything cached at or below path
+func invalidateBackend(b Backend, path string) {
+	if inv, ok := b.(Invalidator); ok {
+		inv.Invalidate(path)
+	}
+}
+
+// ============ LocalBackend ============
+
+// localEcho is how long after LocalBackend changes a path itself that
+// reports about the path are ignored, so changes made through MemFS are not
+// reported again as outside changes
+const localEcho = 500 * time.Millisecond
+
+// localWatch is the watching state of a LocalBackend
+type localWatch struct {
+	mu   sync.Mutex
+	own  map[string]time.Time // paths recently changed through the backend
+	stop func()
+}
+
+// touched records that the backend itself is changing path
+func (w *localWatch) touched(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	w.own[path] = now
+	for p, at := range w.own {
+		if now.Sub(at) > localEcho {
+			delete(w.own, p)
+		}
+	}
+}
+
+// echo reports whether a change to path was made through the backend
+func (w *localWatch) echo(path string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	at, ok := w.own[path]
+	return ok && time.Since(at) <= localEcho
+}
+
+// touched tells a running watch that the backend itself is about to
+// change paths. It is called before the change, since inotify may report
+// it before the call making it returns.
+func (b *LocalBackend) touched(paths ...string) {
+	if w := b.watch.Load(); w != nil {
+		for _, p := range paths {
+			w.touched(p)
+		}
+	}
+}
+
+// Watch starts reporting changes other programs make below the root. It is
+// only supported on Linux, where it uses inotify.
+func (b *LocalBackend) Watch(notify func(BackendChange)) error {
+	w := &localWatch{own: make(map[string]time.Time)}
+	if !b.watch.CompareAndSwap(nil, w) {
+		return errWatchActive
+	}
+
+	// Reports wait on w.mu in echo, and Unwatch waits on it for stop
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	stop, err := startLocalWatch(b.root, func(c BackendChange) {
+		if w.echo(c.Path) || (c.OldPath != "" && w.echo(c.OldPath)) {
+			return
+		}
+		notify(c)
+	})
+	if err != nil {
+		b.watch.Store(nil)
+		return err
+	}
+	w.stop = stop
+	return nil
+}
+
+// Unwatch stops reporting changes
+func (b *LocalBackend) Unwatch() {
+	if w := b.watch.Swap(nil); w != nil {
+		w.mu.Lock()
+		stop := w.stop
+		w.mu.Unlock()
+		if stop != nil {
+			stop()
+		}
+	}
+}
+
+// ============ MemFS ============
+
+// notifyActions maps a change to the fuse.NOTIFY_* actions telling the
+// kernel about it
+func notifyActions(t EventType) uint32 {
+	switch t {
+	case EventCreate:
+		return fuse.NOTIFY_CREATE
+	case EventMkdir:
+		return fuse.NOTIFY_MKDIR
+	case EventUnlink:
+		return fuse.NOTIFY_UNLINK
+	case EventRmdir:
+		return fuse.NOTIFY_RMDIR
+	case EventChmod:
+		return fuse.NOTIFY_CHMOD
+	case EventWrite, EventTruncate:
+		return fuse.NOTIFY_TRUNCATE | fuse.NOTIFY_UTIME
+	}
+	return 0
+}
+
+// SetNotifier sets the function used to tell the kernel about outside
+// changes, normally the host's Notify. Only WinFsp acts on these; on other
+// platforms cgofuse ignores them and the kernel relies on attribute
+// timeouts.
+func (fs *MemFS) SetNotifier(notify func(path string, action uint32) bool) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.notify = notify
+}
+
+// external passes on an outside change to a watched mount: caches in front
+// of the backend forget the paths, subscribers get an event and the kernel
+// is told
+func (fs *MemFS) external(mountPath string, c BackendChange) {
+	fs.lock.Lock()
+	if n, ok := fs.nodes[mountPath]; ok && n.backend != nil {
+		invalidateBackend(n.backend, c.Path)
+		if c.OldPath != "" {
+			invalidateBackend(n.backend, c.OldPath)
+		}
+	}
+	notify := fs.notify
+	fs.lock.Unlock()
+
+	ev := Event{Type: c.Type, Path: mountedPath(mountPath, c.Path), External: true}
+	if c.OldPath != "" {
+		ev.OldPath = mountedPath(mountPath, c.OldPath)
+	}
+	fs.events.Publish(ev)
+
+	if notify == nil {
+		return
+	}
+	if ev.Type == EventRename {
+		notify(ev.OldPath, fuse.NOTIFY_UNLINK)
+		notify(ev.Path, fuse.NOTIFY_CREATE)
+	} else if actions := notifyActions(ev.Type); actions != 0 {
+		notify(ev.Path, actions)
+	}
+}
+
+// mountedPath turns a backend-relative path into a MemFS path
+func mountedPath(mountPath, relPath string) string {
+	if relPath == "/" {
+		return mountPath
+	}
+	if mountPath == "/" {
+		return relPath
+	}
+	return mountPath + relPath
+}
@@ -0,0 +1,211 @@
+//go:build linux
+
+package gobox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask is what each watched directory reports
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_ATTRIB |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// inotifyWatch watches every directory below a root. inotify is not
+// recursive, so directories appearing later get watches of their own.
+type inotifyWatch struct {
+	fd     int
+	f      *os.File // fd for reading through the runtime poller
+	root   string
+	report func(BackendChange)
+	paths  map[int]string // watch descriptor -> backend path
+}
+
+// startLocalWatch watches root and calls report for every change below it
+// until the returned stop function is called
+func startLocalWatch(root string, report func(BackendChange)) (func(), error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatch{
+		fd:     fd,
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		root:   root,
+		report: report,
+		paths:  make(map[int]string),
+	}
+	if err := w.addTree("/"); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	go w.run()
+	return func() { w.f.Close() }, nil
+}
+
+// abs converts a backend path to a host path
+func (w *inotifyWatch) abs(path string) string {
+	return filepath.Join(w.root, filepath.FromSlash(strings.TrimPrefix(path, "/")))
+}
+
+// addTree watches path and every directory below it
+func (w *inotifyWatch) addTree(path string) error {
+	return filepath.WalkDir(w.abs(path), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == w.abs(path) {
+				return err
+			}
+			return nil // vanished while walking
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, p, inotifyMask)
+		if err != nil {
+			return nil
+		}
+		if rel, _ := filepath.Rel(w.root, p); rel == "." {
+			w.paths[wd] = "/"
+		} else {
+			w.paths[wd] = "/" + filepath.ToSlash(rel)
+		}
+		return nil
+	})
+}
+
+// removeTree stops watching path and every directory below it
+func (w *inotifyWatch) removeTree(path string) {
+	for wd, p := range w.paths {
+		if pathUnder(p, path) {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.paths, wd)
+		}
+	}
+}
+
+// moveTree updates the paths of watched directories after a rename
+func (w *inotifyWatch) moveTree(from, to string) {
+	for wd, p := range w.paths {
+		if pathUnder(p, from) {
+			w.paths[wd] = to + strings.TrimPrefix(p, from)
+		}
+	}
+}
+
+// run reads events until the watch is stopped
+func (w *inotifyWatch) run() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+		for _, c := range w.decode(buf[:n]) {
+			w.report(c)
+		}
+	}
+}
+
+// decode turns a batch of inotify events into changes. A move within the
+// tree arrives as a MOVED_FROM and MOVED_TO pair sharing a cookie; a move
+// whose other half is outside the tree is a delete or create. Repeated
+// writes to the same file in a batch are reported once.
+func (w *inotifyWatch) decode(buf []byte) []BackendChange {
+	type move struct {
+		path string
+		dir  bool
+	}
+	var out []BackendChange
+	moves := make(map[uint32]move)
+	var cookies []uint32
+	emit := func(c BackendChange) {
+		if c.Type == EventWrite && len(out) > 0 && out[len(out)-1] == c {
+			return
+		}
+		out = append(out, c)
+	}
+
+	for len(buf) >= unix.SizeofInotifyEvent {
+		wd := int(int32(binary.NativeEndian.Uint32(buf[0:])))
+		mask := binary.NativeEndian.Uint32(buf[4:])
+		cookie := binary.NativeEndian.Uint32(buf[8:])
+		nameLen := int(binary.NativeEndian.Uint32(buf[12:]))
+		end := min(unix.SizeofInotifyEvent+nameLen, len(buf))
+		name := string(bytes.TrimRight(buf[unix.SizeofInotifyEvent:end], "\x00"))
+		buf = buf[end:]
+
+		if mask&unix.IN_Q_OVERFLOW != 0 {
+			emit(BackendChange{Type: EventRescan, Path: "/"})
+			continue
+		}
+		if mask&unix.IN_IGNORED != 0 {
+			delete(w.paths, wd)
+			continue
+		}
+		dir, ok := w.paths[wd]
+		if !ok || name == "" {
+			continue
+		}
+		p := joinPath(dir, name)
+		isDir := mask&unix.IN_ISDIR != 0
+
+		switch {
+		case mask&unix.IN_CREATE != 0:
+			if isDir {
+				// Entries made in it before the watch is in place are
+				// not reported; readers of the mkdir list it instead
+				w.addTree(p)
+				emit(BackendChange{Type: EventMkdir, Path: p})
+			} else {
+				emit(BackendChange{Type: EventCreate, Path: p})
+			}
+		case mask&unix.IN_MODIFY != 0:
+			emit(BackendChange{Type: EventWrite, Path: p})
+		case mask&unix.IN_ATTRIB != 0:
+			emit(BackendChange{Type: EventChmod, Path: p})
+		case mask&unix.IN_DELETE != 0:
+			if isDir {
+				emit(BackendChange{Type: EventRmdir, Path: p})
+			} else {
+				emit(BackendChange{Type: EventUnlink, Path: p})
+			}
+		case mask&unix.IN_MOVED_FROM != 0:
+			moves[cookie] = move{p, isDir}
+			cookies = append(cookies, cookie)
+		case mask&unix.IN_MOVED_TO != 0:
+			if from, ok := moves[cookie]; ok {
+				delete(moves, cookie)
+				if isDir {
+					w.moveTree(from.path, p)
+				}
+				emit(BackendChange{Type: EventRename, Path: p, OldPath: from.path})
+			} else if isDir {
+				w.addTree(p)
+				emit(BackendChange{Type: EventMkdir, Path: p})
+			} else {
+				emit(BackendChange{Type: EventCreate, Path: p})
+			}
+		}
+	}
+
+	// Moved out of the tree
+	for _, cookie := range cookies {
+		from, ok := moves[cookie]
+		if !ok {
+			continue
+		}
+		if from.dir {
+			w.removeTree(from.path)
+			emit(BackendChange{Type: EventRmdir, Path: from.path})
+		} else {
+			emit(BackendChange{Type: EventUnlink, Path: from.path})
+		}
+	}
+	return out
+}
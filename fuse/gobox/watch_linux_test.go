@@ -0,0 +1,157 @@
+//go:build linux
+
+package gobox
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// waitChange waits for the next reported change
+func waitChange(t *testing.T, ch <-chan BackendChange) BackendChange {
+	t.Helper()
+	select {
+	case c := <-ch:
+		return c
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no change reported")
+	}
+	return BackendChange{}
+}
+
+// TestLocalBackendWatch tests the changes inotify reports
+func TestLocalBackendWatch(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "old"), 0755)
+	b := NewLocalBackend(dir)
+
+	ch := make(chan BackendChange, 100)
+	if err := b.Watch(func(c BackendChange) { ch <- c }); err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	defer b.Unwatch()
+	if err := b.Watch(func(BackendChange) {}); err != errWatchActive {
+		t.Errorf("second Watch = %v", err)
+	}
+
+	expect := func(want BackendChange) {
+		t.Helper()
+		if got := waitChange(t, ch); got != want {
+			t.Errorf("change = %+v, expected %+v", got, want)
+		}
+	}
+
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644)
+	expect(BackendChange{Type: EventCreate, Path: "/a.txt"})
+	expect(BackendChange{Type: EventWrite, Path: "/a.txt"})
+
+	// Directories that existed or appear later are watched too
+	os.Mkdir(filepath.Join(dir, "new"), 0755)
+	expect(BackendChange{Type: EventMkdir, Path: "/new"})
+	time.Sleep(20 * time.Millisecond)
+	os.Rename(filepath.Join(dir, "a.txt"), filepath.Join(dir, "new", "b.txt"))
+	expect(BackendChange{Type: EventRename, Path: "/new/b.txt", OldPath: "/a.txt"})
+
+	// A renamed directory keeps reporting under its new name
+	os.Rename(filepath.Join(dir, "old"), filepath.Join(dir, "moved"))
+	expect(BackendChange{Type: EventRename, Path: "/moved", OldPath: "/old"})
+	os.Mkdir(filepath.Join(dir, "moved", "x"), 0755)
+	expect(BackendChange{Type: EventMkdir, Path: "/moved/x"})
+
+	os.Chmod(filepath.Join(dir, "new", "b.txt"), 0600)
+	expect(BackendChange{Type: EventChmod, Path: "/new/b.txt"})
+	os.Remove(filepath.Join(dir, "new", "b.txt"))
+	expect(BackendChange{Type: EventUnlink, Path: "/new/b.txt"})
+
+	// Moving out of the tree is a removal
+	os.Rename(filepath.Join(dir, "moved"), filepath.Join(t.TempDir(), "gone"))
+	expect(BackendChange{Type: EventRmdir, Path: "/moved"})
+
+	// Changes made through the backend itself are not reported
+	b.Create("/own.txt", 0644)
+	b.Write("/own.txt", []byte("x"), 0)
+	select {
+	case c := <-ch:
+		t.Errorf("own change reported: %+v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	b.Unwatch()
+	os.WriteFile(filepath.Join(dir, "after.txt"), nil, 0644)
+	select {
+	case c := <-ch:
+		t.Errorf("change reported after Unwatch: %+v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestWatchMount tests outside changes reaching MemFS subscribers, caches
+// and the notifier
+func TestWatchMount(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "f.txt"), []byte("v1"), 0644)
+
+	fs := newTestFS()
+	var mu sync.Mutex
+	notified := make(map[string]uint32)
+	fs.SetNotifier(func(path string, action uint32) bool {
+		mu.Lock()
+		notified[path] |= action
+		mu.Unlock()
+		return true
+	})
+
+	assertSuccess(t, fs.LinkLocal("/host", dir), "LinkLocal")
+	assertSuccess(t, fs.CacheMount("/host", CacheOptions{MetaTTL: time.Hour}), "CacheMount")
+	assertSuccess(t, fs.WatchMount("/host"), "WatchMount")
+	defer fs.UnwatchMount("/host")
+	assertError(t, fs.WatchMount("/host"), -fuse.EEXIST, "WatchMount twice")
+
+	if got := string(readFile(t, fs, "/host/f.txt", 2)); got != "v1" {
+		t.Fatalf("first read = %q", got)
+	}
+	sub := fs.Events().Subscribe("/host")
+	defer sub.Close()
+
+	// Changes through MemFS are published once, not again as outside ones
+	errCode, fh := fs.Create("/host/own.txt", os.O_RDWR, 0644)
+	assertSuccess(t, errCode, "Create")
+	fs.Write("/host/own.txt", []byte("mine"), 0, fh)
+	if ev := nextEvent(t, sub); ev.Type != EventCreate || ev.External {
+		t.Errorf("own create = %+v", ev)
+	}
+	if ev := nextEvent(t, sub); ev.Type != EventWrite || ev.External {
+		t.Errorf("own write = %+v", ev)
+	}
+
+	// An outside rewrite is published and the cached copy is dropped
+	os.WriteFile(filepath.Join(dir, "f.txt"), []byte("version 2"), 0644)
+	ev := nextEvent(t, sub)
+	if ev.Type != EventWrite || ev.Path != "/host/f.txt" || !ev.External {
+		t.Errorf("outside write = %+v", ev)
+	}
+	if got := string(readFile(t, fs, "/host/f.txt", 9)); got != "version 2" {
+		t.Errorf("read after outside write = %q", got)
+	}
+	// The notifier is called right after the event is published
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		actions := notified["/host/f.txt"]
+		mu.Unlock()
+		if actions&fuse.NOTIFY_TRUNCATE != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("notifier was not called for /host/f.txt")
+		}
+	}
+
+	fs.LinkBackend("/mem", NewMemBackend())
+	assertError(t, fs.WatchMount("/mem"), -fuse.ENOTSUP, "WatchMount on memory backend")
+	assertError(t, fs.WatchMount("/"), -fuse.EINVAL, "WatchMount on in-memory directory")
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package gobox
+
+// startLocalWatch is only implemented on Linux
+func startLocalWatch(root string, report func(BackendChange)) (func(), error) {
+	return nil, errWatchUnsupported
+}
@@ -0,0 +1,624 @@
+package gobox
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+var errWebDAVConfig = errors.New("an http or https URL is required")
+
+// davPropfindBody asks only for the properties Stat needs
+const davPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/></D:prop></D:propfind>`
+
+// WebDAVOptions selects a collection on a WebDAV server
+type WebDAVOptions struct {
+	URL      string // e.g. https://files.example.com/dav/team
+	Username string // optional basic auth
+	Password string
+	Client   *http.Client
+}
+
+// davStage holds a file being written until it is flushed
+type davStage struct {
+	f     *os.File
+	size  int64
+	dirty bool
+}
+
+// WebDAVBackend implements Backend on top of a WebDAV share. Stat and
+// Readdir are PROPFIND requests, reads are ranged GETs and directories are
+// collections. WebDAV can only replace whole files, so writes are staged in
+// a local temporary file and PUT when the file is flushed.
+type WebDAVBackend struct {
+	base     *url.URL
+	username string
+	password string
+	client   *http.Client
+
+	mu     sync.Mutex
+	stages map[string]*davStage
+}
+
+// NewWebDAVBackend creates a backend rooted at a WebDAV collection
+func NewWebDAVBackend(opts WebDAVOptions) (*WebDAVBackend, error) {
+	base, err := url.Parse(strings.TrimSuffix(opts.URL, "/"))
+	if err != nil || base.Host == "" || base.Scheme != "http" && base.Scheme != "https" {
+		return nil, errWebDAVConfig
+	}
+	base.RawPath = ""
+
+	b := &WebDAVBackend{
+		base:     base,
+		username: opts.Username,
+		password: opts.Password,
+		client:   opts.Client,
+		stages:   make(map[string]*davStage),
+	}
+	if b.client == nil {
+		b.client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	return b, nil
+}
+
+// ============ Requests ============
+
+// davErrno maps an HTTP status to an error code
+func davErrno(status int) int {
+	switch status {
+	case http.StatusNotFound, http.StatusConflict: // 409 means a missing parent
+		return -fuse.ENOENT
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return -fuse.EACCES
+	case http.StatusInsufficientStorage:
+		return -fuse.ENOSPC
+	default:
+		return -fuse.EIO
+	}
+}
+
+// url returns the absolute URL of a mount-relative path
+func (b *WebDAVBackend) url(path string) string {
+	u := *b.base
+	if path != "/" {
+		u.Path += path
+	}
+	return u.String()
+}
+
+// do sends a request for path with the configured credentials
+func (b *WebDAVBackend) do(method, path string, header http.Header, body io.Reader, size int64) (*http.Response, int) {
+	req, err := http.NewRequest(method, b.url(path), body)
+	if err != nil {
+		return nil, -fuse.EIO
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if b.username != "" {
+		req.SetBasicAuth(b.username, b.password)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, -fuse.EIO
+	}
+	return resp, 0
+}
+
+// call sends a request and returns its status, discarding the body
+func (b *WebDAVBackend) call(method, path string, header http.Header) (int, int) {
+	resp, errc := b.do(method, path, header, nil, 0)
+	if errc != 0 {
+		return 0, errc
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, 0
+}
+
+// davMultistatus and davPropstat mirror the parts of a PROPFIND response
+// we use
+type davMultistatus struct {
+	Responses []struct {
+		Href      string        `xml:"DAV: href"`
+		Propstats []davPropstat `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+type davPropstat struct {
+	Status string `xml:"DAV: status"`
+	Prop   struct {
+		ResourceType struct {
+			Collection *struct{} `xml:"DAV: collection"`
+		} `xml:"DAV: resourcetype"`
+		ContentLength string `xml:"DAV: getcontentlength"`
+		LastModified  string `xml:"DAV: getlastmodified"`
+	} `xml:"DAV: prop"`
+}
+
+// davEntry is one resource from a PROPFIND response
+type davEntry struct {
+	path string
+	stat fuse.Stat_t
+}
+
+// propfind returns the resource at path and, with depth 1, its children.
+// The resource itself is always first.
+func (b *WebDAVBackend) propfind(path string, depth int) ([]davEntry, int) {
+	header := http.Header{
+		"Depth":        {strconv.Itoa(depth)},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+	resp, errc := b.do("PROPFIND", path, header, strings.NewReader(davPropfindBody), int64(len(davPropfindBody)))
+	if errc != 0 {
+		return nil, errc
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, davErrno(resp.StatusCode)
+	}
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, -fuse.EIO
+	}
+	var self *davEntry
+	var out []davEntry
+	for _, r := range ms.Responses {
+		p, ok := b.hrefPath(r.Href)
+		if !ok {
+			continue
+		}
+		e := davEntry{path: p}
+		e.stat, ok = davStat(r.Propstats)
+		if !ok {
+			continue
+		}
+		if p == path {
+			self = &e
+		} else if parentPath(p) == path {
+			out = append(out, e)
+		}
+	}
+	if self == nil {
+		return nil, -fuse.ENOENT
+	}
+	return append([]davEntry{*self}, out...), 0
+}
+
+// hrefPath converts an href from a PROPFIND response to a mount-relative
+// path. Servers may send absolute URLs or absolute paths.
+func (b *WebDAVBackend) hrefPath(href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", false
+	}
+	p := strings.TrimSuffix(u.Path, "/")
+	if p != b.base.Path && !strings.HasPrefix(p, b.base.Path+"/") {
+		return "", false
+	}
+	p = strings.TrimPrefix(p, b.base.Path)
+	if p == "" {
+		p = "/"
+	}
+	return p, true
+}
+
+// davStat builds attributes from the successful propstat of a response
+func davStat(propstats []davPropstat) (fuse.Stat_t, bool) {
+	for _, ps := range propstats {
+		if !strings.Contains(ps.Status, " 200 ") {
+			continue
+		}
+		mtime, err := http.ParseTime(ps.Prop.LastModified)
+		if err != nil {
+			mtime = time.Now()
+		}
+		ts := fuse.NewTimespec(mtime)
+		st := fuse.Stat_t{Atim: ts, Mtim: ts, Ctim: ts}
+		if ps.Prop.ResourceType.Collection != nil {
+			st.Mode = fuse.S_IFDIR | 0755
+			st.Nlink = 2
+		} else {
+			st.Mode = fuse.S_IFREG | 0644
+			st.Nlink = 1
+			st.Size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+		}
+		return st, true
+	}
+	return fuse.Stat_t{}, false
+}
+
+// Probe checks the share is reachable and is a collection
+func (b *WebDAVBackend) Probe() int {
+	st, errc := b.Stat("/")
+	if errc != 0 {
+		return errc
+	}
+	if st.Mode&fuse.S_IFDIR == 0 {
+		return -fuse.ENOTDIR
+	}
+	return 0
+}
+
+// ============ Staging ============
+
+// stage returns the local copy of a file being written, downloading the
+// current contents first. Callers hold b.mu.
+func (b *WebDAVBackend) stage(path string) (*davStage, int) {
+	if s, ok := b.stages[path]; ok {
+		return s, 0
+	}
+	resp, errc := b.do(http.MethodGet, path, nil, nil, 0)
+	if errc != 0 {
+		return nil, errc
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, davErrno(resp.StatusCode)
+	}
+
+	f, err := os.CreateTemp("", "gobox-webdav-*")
+	if err != nil {
+		return nil, -fuse.EIO
+	}
+	s := &davStage{f: f}
+	if s.size, err = io.Copy(f, resp.Body); err != nil {
+		b.discard(s)
+		return nil, -fuse.EIO
+	}
+	b.stages[path] = s
+	return s, 0
+}
+
+// discard removes a stage's temporary file
+func (b *WebDAVBackend) discard(s *davStage) {
+	name := s.f.Name()
+	s.f.Close()
+	os.Remove(name)
+}
+
+// drop discards the stage of path, if any; callers hold b.mu
+func (b *WebDAVBackend) drop(path string) {
+	if s, ok := b.stages[path]; ok {
+		delete(b.stages, path)
+		b.discard(s)
+	}
+}
+
+// put replaces the contents of a file
+func (b *WebDAVBackend) put(path string, body io.Reader, size int64) int {
+	if body == nil {
+		body = http.NoBody
+	}
+	resp, errc := b.do(http.MethodPut, path, nil, body, size)
+	if errc != 0 {
+		return errc
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return 0
+	case http.StatusMethodNotAllowed:
+		return -fuse.EISDIR
+	default:
+		return davErrno(resp.StatusCode)
+	}
+}
+
+// Flush uploads a staged file if it was modified
+func (b *WebDAVBackend) Flush(path string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flush(path)
+}
+
+// Sync uploads every staged file that was modified, keeping those that
+// fail staged and returning the first error
+func (b *WebDAVBackend) Sync() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	errc := 0
+	for path := range b.stages {
+		if e := b.flush(path); e != 0 && errc == 0 {
+			errc = e
+		}
+	}
+	return errc
+}
+
+// flush uploads and drops the stage of path; callers hold b.mu
+func (b *WebDAVBackend) flush(path string) int {
+	s, ok := b.stages[path]
+	if !ok {
+		return 0
+	}
+	if s.dirty {
+		if errc := b.put(path, io.NewSectionReader(s.f, 0, s.size), s.size); errc != 0 {
+			return errc
+		}
+	}
+	b.drop(path)
+	return 0
+}
+
+// flushTree uploads and drops the stages of path and everything below it,
+// returning the first error; callers hold b.mu
+func (b *WebDAVBackend) flushTree(path string) int {
+	errc := b.flush(path)
+	for p := range b.stages {
+		if strings.HasPrefix(p, path+"/") {
+			if e := b.flush(p); e != 0 && errc == 0 {
+				errc = e
+			}
+		}
+	}
+	return errc
+}
+
+// ============ Backend ============
+
+// Stat returns resource attributes from a depth 0 PROPFIND
+func (b *WebDAVBackend) Stat(path string) (*fuse.Stat_t, int) {
+	ents, errc := b.propfind(path, 0)
+	if errc != 0 {
+		return nil, errc
+	}
+	st := ents[0].stat
+
+	b.mu.Lock()
+	if s, ok := b.stages[path]; ok {
+		st.Size = s.size
+	}
+	b.mu.Unlock()
+	return &st, 0
+}
+
+// Readdir lists a collection with a depth 1 PROPFIND
+func (b *WebDAVBackend) Readdir(path string) ([]DirEnt, int) {
+	ents, errc := b.propfind(path, 1)
+	if errc != 0 {
+		return nil, errc
+	}
+	if ents[0].stat.Mode&fuse.S_IFDIR == 0 {
+		return nil, -fuse.ENOTDIR
+	}
+
+	out := make([]DirEnt, 0, len(ents)-1)
+	b.mu.Lock()
+	for _, e := range ents[1:] {
+		if s, ok := b.stages[e.path]; ok {
+			e.stat.Size = s.size
+		}
+		_, name := split(e.path)
+		out = append(out, DirEnt{Name: name, Stat: e.stat})
+	}
+	b.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, 0
+}
+
+// Read fetches the requested range with a ranged GET
+func (b *WebDAVBackend) Read(path string, buff []byte, ofst int64) (int, int) {
+	b.mu.Lock()
+	if s, ok := b.stages[path]; ok {
+		defer b.mu.Unlock()
+		n, err := s.f.ReadAt(buff, ofst)
+		if err != nil && err != io.EOF {
+			return 0, -fuse.EIO
+		}
+		return n, 0
+	}
+	b.mu.Unlock()
+
+	if len(buff) == 0 {
+		return 0, 0
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", ofst, ofst+int64(len(buff))-1)}}
+	resp, errc := b.do(http.MethodGet, path, header, nil, 0)
+	if errc != 0 {
+		return 0, errc
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// Range ignored by the server; skip to the offset
+		if _, err := io.CopyN(io.Discard, resp.Body, ofst); err != nil {
+			return 0, 0
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, 0 // at or past end of file
+	default:
+		return 0, davErrno(resp.StatusCode)
+	}
+
+	n, err := io.ReadFull(resp.Body, buff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return n, -fuse.EIO
+	}
+	return n, 0
+}
+
+// Write stages data locally until the file is flushed
+func (b *WebDAVBackend) Write(path string, buff []byte, ofst int64) (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, errc := b.stage(path)
+	if errc != 0 {
+		return 0, errc
+	}
+	n, err := s.f.WriteAt(buff, ofst)
+	if err != nil {
+		return 0, -fuse.EIO
+	}
+	s.dirty = true
+	if end := ofst + int64(n); end > s.size {
+		s.size = end
+	}
+	return n, 0
+}
+
+// Truncate resizes a file. Files not being written are uploaded right away,
+// since a truncate by path is not followed by a close.
+func (b *WebDAVBackend) Truncate(path string, size int64) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, staged := b.stages[path]
+	s, errc := b.stage(path)
+	if errc != 0 {
+		return errc
+	}
+	if err := s.f.Truncate(size); err != nil {
+		return -fuse.EIO
+	}
+	s.size = size
+	s.dirty = true
+	if !staged {
+		return b.flush(path)
+	}
+	return 0
+}
+
+// Mkdir creates a collection with MKCOL
+func (b *WebDAVBackend) Mkdir(path string, mode uint32) int {
+	status, errc := b.call("MKCOL", path, nil)
+	if errc != 0 {
+		return errc
+	}
+	switch status {
+	case http.StatusCreated, http.StatusOK:
+		return 0
+	case http.StatusMethodNotAllowed: // the resource already exists
+		return -fuse.EEXIST
+	default:
+		return davErrno(status)
+	}
+}
+
+// Create PUTs an empty file so it is visible immediately
+func (b *WebDAVBackend) Create(path string, mode uint32) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.drop(path)
+	return b.put(path, nil, 0)
+}
+
+// remove deletes a resource with DELETE
+func (b *WebDAVBackend) remove(path string) int {
+	status, errc := b.call(http.MethodDelete, path, nil)
+	if errc != 0 {
+		return errc
+	}
+	if status != http.StatusNoContent && status != http.StatusOK {
+		return davErrno(status)
+	}
+	return 0
+}
+
+// Unlink deletes a file
+func (b *WebDAVBackend) Unlink(path string) int {
+	b.mu.Lock()
+	b.drop(path)
+	b.mu.Unlock()
+
+	st, errc := b.Stat(path)
+	if errc != 0 {
+		return errc
+	}
+	if st.Mode&fuse.S_IFDIR != 0 {
+		return -fuse.EISDIR
+	}
+	return b.remove(path)
+}
+
+// Rmdir removes an empty collection. DELETE on a collection is recursive,
+// so emptiness is checked first.
+func (b *WebDAVBackend) Rmdir(path string) int {
+	if path == "/" {
+		return -fuse.EBUSY
+	}
+	ents, errc := b.Readdir(path)
+	if errc != 0 {
+		return errc
+	}
+	if len(ents) > 0 {
+		return -fuse.ENOTEMPTY
+	}
+	return b.remove(path)
+}
+
+// Rename moves a file or collection with MOVE, replacing the target the
+// way rename(2) would. Files staged below oldpath are uploaded first so
+// they move too.
+func (b *WebDAVBackend) Rename(oldpath, newpath string) int {
+	b.mu.Lock()
+	errc := b.flushTree(oldpath)
+	b.drop(newpath)
+	b.mu.Unlock()
+	if errc != 0 {
+		return errc
+	}
+	if oldpath == newpath {
+		return 0
+	}
+	if strings.HasPrefix(newpath, oldpath+"/") {
+		return -fuse.EINVAL
+	}
+
+	st, errc := b.Stat(oldpath)
+	if errc != 0 {
+		return errc
+	}
+	if target, errc := b.Stat(newpath); errc == 0 {
+		if target.Mode&fuse.S_IFDIR != 0 {
+			if st.Mode&fuse.S_IFDIR == 0 {
+				return -fuse.EISDIR
+			}
+			if ents, errc := b.Readdir(newpath); errc != 0 {
+				return errc
+			} else if len(ents) > 0 {
+				return -fuse.ENOTEMPTY
+			}
+		} else if st.Mode&fuse.S_IFDIR != 0 {
+			return -fuse.ENOTDIR
+		}
+	}
+
+	header := http.Header{"Destination": {b.url(newpath)}, "Overwrite": {"T"}}
+	if st.Mode&fuse.S_IFDIR != 0 {
+		header.Set("Depth", "infinity")
+	}
+	status, errc := b.call("MOVE", oldpath, header)
+	if errc != 0 {
+		return errc
+	}
+	if status != http.StatusCreated && status != http.StatusNoContent {
+		return davErrno(status)
+	}
+	return 0
+}
@@ -0,0 +1,236 @@
+package gobox
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	testDAVUser     = "alice"
+	testDAVPassword = "s3cret"
+)
+
+// davServer is a golang.org/x/net/webdav share under /dav behind basic
+// auth. It counts the ranged GETs and PUTs it receives.
+type davServer struct {
+	fs webdav.FileSystem
+
+	mu         sync.Mutex
+	rangedGets int
+	puts       int
+}
+
+func newDAVServer(t *testing.T) (*davServer, *httptest.Server) {
+	d := &davServer{fs: webdav.NewMemFS()}
+	h := &webdav.Handler{Prefix: "/dav", FileSystem: d.fs, LockSystem: webdav.NewMemLS()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != testDAVUser || pass != testDAVPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		d.mu.Lock()
+		if r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+			d.rangedGets++
+		}
+		if r.Method == http.MethodPut {
+			d.puts++
+		}
+		d.mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return d, srv
+}
+
+// put stores a file directly on the server side
+func (d *davServer) put(t *testing.T, name string, data []byte) {
+	t.Helper()
+	f, err := d.fs.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(%s): %v", name, err)
+	}
+	f.Write(data)
+	f.Close()
+}
+
+// get reads a file directly on the server side
+func (d *davServer) get(t *testing.T, name string) []byte {
+	t.Helper()
+	f, err := d.fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile(%s): %v", name, err)
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	return data
+}
+
+func newTestWebDAV(t *testing.T, srv *httptest.Server) *WebDAVBackend {
+	t.Helper()
+	b, err := NewWebDAVBackend(WebDAVOptions{URL: srv.URL + "/dav", Username: testDAVUser, Password: testDAVPassword})
+	if err != nil {
+		t.Fatalf("NewWebDAVBackend: %v", err)
+	}
+	return b
+}
+
+// TestWebDAVBackendListing tests PROPFIND-based Stat and Readdir
+func TestWebDAVBackendListing(t *testing.T) {
+	d, srv := newDAVServer(t)
+	d.fs.Mkdir(context.Background(), "/docs", 0755)
+	d.put(t, "/docs/a b.txt", []byte("hello"))
+	d.put(t, "/top.txt", []byte("x"))
+	b := newTestWebDAV(t, srv)
+
+	assertSuccess(t, b.Probe(), "Probe")
+	ents, errc := b.Readdir("/")
+	assertSuccess(t, errc, "Readdir /")
+	if len(ents) != 2 || ents[0].Name != "docs" || ents[1].Name != "top.txt" {
+		t.Fatalf("Readdir / = %v, expected [docs top.txt]", ents)
+	}
+	if ents[0].Stat.Mode&fuse.S_IFDIR == 0 {
+		t.Errorf("docs is not a directory")
+	}
+
+	ents, errc = b.Readdir("/docs")
+	assertSuccess(t, errc, "Readdir /docs")
+	if len(ents) != 1 || ents[0].Name != "a b.txt" || ents[0].Stat.Size != 5 {
+		t.Errorf("Readdir /docs = %v, expected [a b.txt] of 5 bytes", ents)
+	}
+
+	st, errc := b.Stat("/docs/a b.txt")
+	assertSuccess(t, errc, "Stat")
+	assertStatSize(t, st, 5, "/docs/a b.txt")
+
+	_, errc = b.Stat("/missing")
+	assertError(t, errc, -fuse.ENOENT, "Stat missing")
+	_, errc = b.Readdir("/top.txt")
+	assertError(t, errc, -fuse.ENOTDIR, "Readdir on a file")
+}
+
+// TestWebDAVBackendRangedRead checks reads fetch only the requested range
+func TestWebDAVBackendRangedRead(t *testing.T) {
+	d, srv := newDAVServer(t)
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	d.put(t, "/big", data)
+	b := newTestWebDAV(t, srv)
+
+	buff := make([]byte, 100)
+	n, errc := b.Read("/big", buff, 5000)
+	assertSuccess(t, errc, "Read")
+	if !bytes.Equal(buff[:n], data[5000:5100]) {
+		t.Errorf("Read returned wrong data")
+	}
+	n, errc = b.Read("/big", buff, int64(len(data)))
+	if errc != 0 || n != 0 {
+		t.Errorf("Read at end = (%d, %d), expected (0, 0)", n, errc)
+	}
+	if d.rangedGets != 2 {
+		t.Errorf("ranged GETs = %d, expected 2", d.rangedGets)
+	}
+}
+
+// TestWebDAVBackendWriteOnFlush checks writes are staged and PUT on flush
+func TestWebDAVBackendWriteOnFlush(t *testing.T) {
+	d, srv := newDAVServer(t)
+	d.put(t, "/f.txt", []byte("hello world"))
+	b := newTestWebDAV(t, srv)
+
+	b.Write("/f.txt", []byte("HELLO"), 0)
+	b.Write("/f.txt", []byte("!"), 11)
+	if d.puts != 0 {
+		t.Fatalf("PUT before flush")
+	}
+	st, _ := b.Stat("/f.txt")
+	assertStatSize(t, st, 12, "/f.txt")
+	buff := make([]byte, 32)
+	n, _ := b.Read("/f.txt", buff, 0)
+	if string(buff[:n]) != "HELLO world!" {
+		t.Errorf("staged Read = %q", buff[:n])
+	}
+
+	assertSuccess(t, b.Flush("/f.txt"), "Flush")
+	if got := d.get(t, "/f.txt"); string(got) != "HELLO world!" {
+		t.Errorf("server has %q after flush", got)
+	}
+
+	// Truncating a file that is not open is uploaded immediately
+	assertSuccess(t, b.Truncate("/f.txt", 5), "Truncate")
+	if got := d.get(t, "/f.txt"); string(got) != "HELLO" {
+		t.Errorf("server has %q after truncate", got)
+	}
+}
+
+// TestWebDAVBackendDirectories tests MKCOL, MOVE and DELETE
+func TestWebDAVBackendDirectories(t *testing.T) {
+	d, srv := newDAVServer(t)
+	b := newTestWebDAV(t, srv)
+
+	assertSuccess(t, b.Mkdir("/a", 0755), "Mkdir")
+	assertError(t, b.Mkdir("/a", 0755), -fuse.EEXIST, "Mkdir existing")
+	assertError(t, b.Mkdir("/x/y", 0755), -fuse.ENOENT, "Mkdir without parent")
+	assertSuccess(t, b.Create("/a/f", 0644), "Create")
+
+	assertError(t, b.Rmdir("/a"), -fuse.ENOTEMPTY, "Rmdir non-empty")
+	assertError(t, b.Unlink("/a"), -fuse.EISDIR, "Unlink directory")
+	assertSuccess(t, b.Mkdir("/b", 0755), "Mkdir /b")
+	assertSuccess(t, b.Rename("/a", "/b"), "Rename onto empty directory")
+	if _, errc := b.Stat("/b/f"); errc != 0 {
+		t.Errorf("Stat /b/f after Rename returned %d", errc)
+	}
+	assertSuccess(t, b.Create("/g", 0644), "Create /g")
+	assertError(t, b.Rename("/g", "/b"), -fuse.EISDIR, "Rename file onto directory")
+	assertError(t, b.Rename("/b", "/b/sub"), -fuse.EINVAL, "Rename into itself")
+
+	assertSuccess(t, b.Rename("/b/f", "/g"), "Rename file over file")
+	assertSuccess(t, b.Rmdir("/b"), "Rmdir")
+	assertSuccess(t, b.Unlink("/g"), "Unlink")
+	ents, _ := b.Readdir("/")
+	if len(ents) != 0 {
+		t.Errorf("Readdir / = %v, expected empty", ents)
+	}
+
+	// Files still staged below a renamed directory move with it
+	assertSuccess(t, b.Mkdir("/c", 0755), "Mkdir /c")
+	assertSuccess(t, b.Mkdir("/c/sub", 0755), "Mkdir /c/sub")
+	assertSuccess(t, b.Create("/c/sub/f", 0644), "Create /c/sub/f")
+	b.Write("/c/sub/f", []byte("staged"), 0)
+	assertSuccess(t, b.Rename("/c", "/d"), "Rename directory with staged files")
+	if got := d.get(t, "/d/sub/f"); string(got) != "staged" || len(b.stages) != 0 {
+		t.Errorf("/d/sub/f = %q, stages %v", got, b.stages)
+	}
+}
+
+// TestLinkWebDAV tests linking a share into MemFS
+func TestLinkWebDAV(t *testing.T) {
+	d, srv := newDAVServer(t)
+	fs := newTestFS()
+
+	opts := WebDAVOptions{URL: srv.URL + "/dav", Username: testDAVUser, Password: testDAVPassword}
+	errCode := fs.LinkWebDAV("/share", opts)
+	assertSuccess(t, errCode, "LinkWebDAV")
+
+	errCode, fh := fs.Create("/share/hello.txt", 0, 0644)
+	assertSuccess(t, errCode, "Create")
+	fs.Write("/share/hello.txt", []byte("hello dav"), 0, fh)
+	assertSuccess(t, fs.Flush("/share/hello.txt", fh), "Flush")
+	if got := d.get(t, "/hello.txt"); string(got) != "hello dav" {
+		t.Errorf("server has %q after close, expected %q", got, "hello dav")
+	}
+
+	bad := opts
+	bad.Password = "wrong"
+	errCode = fs.LinkWebDAV("/denied", bad)
+	assertError(t, errCode, -fuse.EACCES, "LinkWebDAV with wrong password")
+	errCode = fs.LinkWebDAV("/invalid", WebDAVOptions{URL: "ftp://example.com"})
+	assertError(t, errCode, -fuse.EINVAL, "LinkWebDAV with bad URL")
+}
@@ -1,42 +1,45 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 
-	"github.com/winfsp/cgofuse/fuse"
+	"example/pIFPS/fuse/gobox"
 )
 
 func main() {
-	fs := NewMemFS()
-	host := fuse.NewFileSystemHost(fs)
-
-	// Create API server
-	api := NewAPIServer(fs)
-	api.RegisterRoutes()
-
-	// Graceful shutdown on Ctrl+C
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-
-	go func() {
-		<-sigCh
-		host.Unmount()
+	cfg, err := gobox.LoadConfig(os.Args[1:])
+	switch {
+	case errors.Is(err, flag.ErrHelp):
 		os.Exit(0)
-	}()
-
-	// Start HTTP API server in a goroutine
-	go func() {
-		fmt.Println("Starting API server on http://localhost:8080")
-		if err := http.ListenAndServe(":8080", nil); err != nil {
-			log.Fatal(err)
-		}
-	}()
-
-	// Mount with command-line args (e.g., X:) - this blocks
-	host.Mount("", os.Args[1:])
+	case errors.Is(err, gobox.ErrBadFlags):
+		os.Exit(2) // already reported by the flag package
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "fuse: invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	slog.SetLogLoggerLevel(cfg.Level())
+
+	srv, err := gobox.NewServer(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fuse: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Ctrl+C and SIGTERM stop gracefully; SIGHUP rereads the config file
+	// and flags
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	reload := func() (*gobox.Config, error) {
+		return gobox.LoadConfig(os.Args[1:])
+	}
+	if err := srv.Run(sigCh, reload); err != nil {
+		slog.Error("fuse stopped", "err", err)
+		os.Exit(1)
+	}
 }